@@ -1,15 +1,30 @@
 package cli
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"log/slog"
+	"math/rand"
+	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
 	"strconv"
+	"strings"
+	"syscall"
 
+	"github.com/numbermax/blockchain/internal/config"
 	"github.com/numbermax/blockchain/internal/services/blockchain"
+	"github.com/numbermax/blockchain/internal/services/network"
+	"github.com/numbermax/blockchain/internal/services/pool"
+	"github.com/numbermax/blockchain/internal/services/rpc"
 	"github.com/numbermax/blockchain/internal/services/wallet"
 )
 
@@ -20,11 +35,48 @@ type CommandLine struct {
 func (cli *CommandLine) printUsage() {
 	fmt.Println("Usage:")
 	fmt.Println(" getbalance -address ADDRESS - get balance for the address")
-	fmt.Println(" createblockchain -address ADDRESS - created a blockchain")
-	fmt.Println(" printchain - Prints the blocks in the chain")
-	fmt.Println(" send -from FROM -to TO -amount AMOUNT - send amount to the address")
+	fmt.Println(" createblockchain -address ADDRESS [-txindex] [-addrindex] [-filterindex] - created a blockchain")
+	fmt.Println(" printchain [-from HEIGHT] [-to HEIGHT] - Prints the blocks in the chain")
+	fmt.Println(" getblock -height HEIGHT | -hash HASH - Prints a single block")
+	fmt.Println(" getblockcount - Prints the height of the best chain")
+	fmt.Println(" gettransaction -id TXID - Prints a transaction with its block and confirmations")
+	fmt.Println(" reindex [-txindex] [-addrindex] [-filterindex] - Rebuilds the chain state and indexes from the stored blocks, enabling the indexes given")
+	fmt.Println(" disableindex [-txindex] [-addrindex] [-filterindex] - Turns the indexes given off and deletes their data, as pruning needs for the transaction and address indexes")
+	fmt.Println(" verifychain [-level 0-4] [-depth N] - Audits the last N blocks (0 for all): linkage and PoW, merkle, signatures, UTXO replay, UTXO set")
+	fmt.Println(" exportchain -file FILE [-from HEIGHT] [-to HEIGHT] - Writes main chain blocks to a bootstrap file")
+	fmt.Println(" importchain -file FILE - Validates and adds the blocks of a bootstrap file, starting a new chain if there is none")
+	fmt.Println(" dumptxoutset -file FILE - Writes the UTXO set at the tip to a snapshot file")
+	fmt.Println(" loadtxoutset -file FILE -blockhash HASH - Starts a new chain from a UTXO snapshot taken at block HASH")
+	fmt.Println(" prune -depth N | -size MB | -off - Deletes old block bodies, keeping the last N blocks or about MB of them as the chain grows")
+	fmt.Println(" startrpc [-addr HOST:PORT] - Serves the chain to light clients until interrupted")
+	fmt.Println(" syncheaders [-rpc URL] - Light client: downloads and checks the block headers of a full node")
+	fmt.Println(" getmerkleproof -txid TXID [-rpc URL] [-file FILE] - Prints the Merkle proof of a transaction, from the local chain or a full node")
+	fmt.Println(" verifymerkleproof -file FILE [-rpc URL] - Checks a Merkle proof against the synced headers, or asks a full node")
+	fmt.Println(" startnode [-listen HOST:PORT] [-rpcaddr HOST:PORT] [-connect ADDRS] [-addnode ADDRS] [-encryption off|prefer|require] [-allowkeys KEYS] [-config FILE] [-pooladdress ADDRESS [-stratum HOST:PORT] [-sharebits N]] - Runs a node that finds and keeps peers, serving RPC, until interrupted; the config sets its mempool policy and block limits, a pool address runs a mining pool paying to it")
+	fmt.Println(" getnodekey - Prints the public key the node proves to encrypted peers, creating it if needed")
+	fmt.Println(" addnode -node HOST:PORT [-rpc URL] - Makes the running node keep a connection to the address")
+	fmt.Println(" getpeerinfo [-rpc URL] - Lists the peers of the running node")
+	fmt.Println(" getaddrmaninfo [-rpc URL] - Summarizes the peer addresses the running node knows")
+	fmt.Println(" setban -subnet IP|CIDR [-bantime SECONDS] [-remove] [-rpc URL] - Bans a subnet from the running node, or lifts its ban")
+	fmt.Println(" listbanned [-rpc URL] - Lists the subnets the running node bans")
+	fmt.Println(" clearbanned [-rpc URL] - Lifts every ban of the running node")
+	fmt.Println(" getsyncinfo [-rpc URL] - Shows how far the running node is with downloading the chain")
+	fmt.Println(" scanwallet [-rpc URL] - Light wallet: syncs headers and finds the wallet's payments through compact block filters")
+	fmt.Println(" listtransactions [-address ADDRESS] [-limit N] [-offset N] - Lists the history of an address or of the whole wallet")
+	fmt.Println(" getmempoolinfo [-rpc URL] - Summarizes the transactions waiting in the mempool of the running node")
+	fmt.Println(" getcompactstats [-rpc URL] - Shows how well the running node rebuilds compact blocks from its mempool")
+	fmt.Println(" send -from FROM -to TO -amount AMOUNT [-rpc URL [-fee N | -conftarget N] [-replaceable]] - send amount to the address, mining it locally or through the mempool of a running node")
+	fmt.Println(" getblocktemplate [-longpollid ID] [-rpc URL] - Prints the block the running node would mine next, with its transactions picked by package fee rate; with a long poll ID, once that template is outdated")
+	fmt.Println(" submitblock -block HEX [-rpc URL] - Hands a solved serialized block to the running node and reports why it was rejected, if it was")
+	fmt.Println(" mine -address ADDRESS [-blocks N] [-rpc URL] - Mines N blocks paying to the address on block templates of the running node")
+	fmt.Println(" poolmine -worker ADDRESS[.NAME] [-pool HOST:PORT] [-shares N] - Mines N shares for the mining pool of a running node")
+	fmt.Println(" getpoolinfo [-rpc URL] - Shows the shares of the mining pool of the running node and the blocks it found, with their payouts")
+	fmt.Println(" testmempoolaccept -rawtx HEX [-rpc URL] - Reports whether the mempool of the running node would take a serialized transaction, and why not")
+	fmt.Println(" estimatefee -blocks N [-rpc URL] - Estimates the fee rate, per 1000 bytes, that confirms a transaction within N blocks")
+	fmt.Println(" bumpfee -txid TXID [-fee N] [-rpc URL] - Replaces a replaceable wallet transaction in the mempool of the running node by one paying a higher fee out of its change")
 	fmt.Println(" createwallet - Creates a new wallet")
 	fmt.Println(" listaddresses - Lists all addresses in the wallet")
+	fmt.Println("NETWORK=main|regtest picks the network and its consensus engine, main by default; run each network from its own directory")
 }
 
 func (cli *CommandLine) ValidateArguments() {
@@ -33,74 +85,1032 @@ func (cli *CommandLine) ValidateArguments() {
 	}
 }
 
-func (cli *CommandLine) printChain() {
+// selectNetwork switches to the network named by NETWORK, if set.
+func (cli *CommandLine) selectNetwork() {
+	name := os.Getenv("NETWORK")
+	if name == "" {
+		return
+	}
+	if err := blockchain.SelectNetwork(name); err != nil {
+		cli.Logger.Error("Invalid network", slog.String("error", err.Error()))
+		cli.gracefullExit()
+	}
+}
+
+func (cli *CommandLine) printChain(from, to int) {
+	chain := blockchain.ContinueBlockChain(*cli.Logger, "")
+	defer chain.Store.Close()
+
+	best := chain.GetBestHeight()
+	if to < 0 || to > best {
+		to = best
+	}
+	if pruned := chain.PruneHeight(); from <= pruned {
+		cli.Logger.Error("Blocks are pruned up to this height, use a higher -from",
+			slog.Int("pruned_height", pruned))
+		return
+	}
+
+	for height := to; height >= from; height-- {
+		block, err := chain.GetBlockByHeight(height)
+		if err != nil {
+			cli.Logger.Error("Block not found", slog.String("error", err.Error()))
+			return
+		}
+		cli.printBlock(block, height)
+	}
+}
+
+func (cli *CommandLine) printBlock(block *blockchain.Block, height int) {
+	cli.Logger.Info("Block",
+		slog.String("hash", fmt.Sprintf("%x", block.Hash)),
+		slog.Int("height", height),
+		slog.String("prev", fmt.Sprintf("%x", block.PrevHash)))
+	err := blockchain.CheckProofOfWork(block)
+	cli.Logger.Info("Seal", slog.String("valid", strconv.FormatBool(err == nil)))
+	for _, tx := range block.Transactions {
+		fmt.Println(tx)
+	}
+	fmt.Println()
+}
+
+func (cli *CommandLine) getBlock(height int, hash string) {
 	chain := blockchain.ContinueBlockChain(*cli.Logger, "")
-	defer chain.Database.Close()
-	iter := chain.Iterator()
+	defer chain.Store.Close()
+
+	var block *blockchain.Block
+	var err error
+
+	if hash != "" {
+		var raw []byte
+		raw, err = hex.DecodeString(hash)
+		if err != nil {
+			cli.Logger.Error("Hash is not valid hex", slog.String("hash", hash))
+			return
+		}
+		block, err = chain.GetBlock(raw)
+		if err == nil {
+			height, err = chain.GetBlockHeight(raw)
+		}
+	} else {
+		block, err = chain.GetBlockByHeight(height)
+	}
+
+	if err != nil {
+		cli.Logger.Error("Block not found", slog.String("error", err.Error()))
+		return
+	}
+
+	cli.printBlock(block, height)
+}
+
+func (cli *CommandLine) getBlockCount() {
+	chain := blockchain.ContinueBlockChain(*cli.Logger, "")
+	defer chain.Store.Close()
+
+	cli.Logger.Info("Block count", slog.Int("height", chain.GetBestHeight()))
+}
+
+func (cli *CommandLine) getBalance(address string) {
+	if !wallet.ValidateAddress(address) {
+		log.Panic("The address is not valid")
+	}
+
+	chain := blockchain.ContinueBlockChain(*cli.Logger, address)
+	defer chain.Store.Close()
+
+	balance := 0
+	UTXOs := chain.FindUTXO(addressPubKeyHash(address))
+
+	for _, out := range UTXOs {
+		balance += out.Value
+	}
+
+	cli.Logger.Info("Balance: counted", slog.String("Balance: ", fmt.Sprintf("%d", balance)), slog.String("address: ", address))
+}
+
+func (cli *CommandLine) send(from, to string, amount int) {
+
+	if !wallet.ValidateAddress(from) {
+		log.Panic("The from address is not valid")
+	}
+
+	if !wallet.ValidateAddress(to) {
+		log.Panic("The 'to' address is not valid")
+	}
+
+	chain := blockchain.ContinueBlockChain(*cli.Logger, from)
+	defer chain.Store.Close()
+
+	tx := blockchain.NewTransaction(from, to, amount, chain)
+
+	chain.AddBlock([]*blockchain.Transaction{tx})
+	cli.Logger.Info("Success")
+}
+
+// sendToNode pays from the outputs the running node lists for from and
+// submits the payment to its mempool. With a confirmation target the fee is
+// what the node estimates for it.
+func (cli *CommandLine) sendToNode(from, to string, amount, fee, confTarget int, replaceable bool, url string) {
+	if !wallet.ValidateAddress(from) {
+		log.Panic("The from address is not valid")
+	}
+
+	if !wallet.ValidateAddress(to) {
+		log.Panic("The 'to' address is not valid")
+	}
+
+	wallets, err := wallet.CreateWallets()
+	blockchain.ErrHandle(err)
+	w := wallets.GetWallet(from)
+
+	client := rpc.NewClient(url)
+	utxos, err := client.ListUnspent(from)
+	if err != nil {
+		cli.Logger.Error("No spendable outputs", slog.String("error", err.Error()))
+		return
+	}
+	tx, err := blockchain.NewTransactionFromUTXOs(&w, to, amount, fee, replaceable, utxos)
+	if err != nil {
+		cli.Logger.Error("Transaction not created", slog.String("error", err.Error()))
+		return
+	}
+	if confTarget > 0 {
+		estimate, err := client.EstimateFee(confTarget)
+		if err != nil {
+			cli.Logger.Error("No fee estimate", slog.String("error", err.Error()))
+			return
+		}
+		// the size sets the fee, and the fee may take more inputs
+		for estimate.Fee(len(tx.Serialize())) > fee {
+			fee = estimate.Fee(len(tx.Serialize()))
+			tx, err = blockchain.NewTransactionFromUTXOs(&w, to, amount, fee, replaceable, utxos)
+			if err != nil {
+				cli.Logger.Error("Transaction not created", slog.String("error", err.Error()))
+				return
+			}
+		}
+		cli.Logger.Info("Fee estimated",
+			slog.Float64("fee_rate", estimate.FeeRate),
+			slog.Int("fee", fee))
+	}
+
+	txID, err := client.SendRawTransaction(tx)
+	if err != nil {
+		cli.Logger.Error("Transaction rejected", slog.String("error", err.Error()))
+		return
+	}
+	cli.Logger.Info("Transaction sent", slog.String("txid", fmt.Sprintf("%x", txID)))
+}
+
+// bumpFee replaces the wallet transaction id in the mempool of the running
+// node by the same payment with a higher fee, taken from its change.
+// Without a fee it pays one more than all the replacement evicts, and more
+// than the replaced transaction for every byte.
+func (cli *CommandLine) bumpFee(id string, fee int, url string) {
+	txID, err := hex.DecodeString(id)
+	if err != nil {
+		cli.Logger.Error("Transaction id is not valid hex", slog.String("id", id))
+		return
+	}
+
+	client := rpc.NewClient(url)
+	entry, err := client.GetMempoolEntry(txID)
+	if err != nil {
+		cli.Logger.Error("No mempool entry", slog.String("error", err.Error()))
+		return
+	}
+	tx, err := blockchain.DeserializeTransaction(entry.Tx)
+	blockchain.ErrHandle(err)
+	if !entry.Replaceable {
+		cli.Logger.Error("Transaction does not signal replaceability", slog.String("txid", id))
+		return
+	}
 
-	for {
-		block := iter.Next()
-		cli.Logger.Info("Block", slog.String("hash", fmt.Sprintf("%x", block.Hash)))
-		pow := blockchain.NewProof(block)
-		cli.Logger.Info("Proof of Work", slog.String("valid", strconv.FormatBool(pow.Validate())))
-		for _, tx := range block.Transactions {
-			fmt.Println(tx)
+	wallets, err := wallet.CreateWallets()
+	blockchain.ErrHandle(err)
+	from := string(wallet.PublicKeyHashToAddress(wallet.PublicKeyHash(tx.Inputs[0].PublicKey)))
+	w, ok := wallets.Wallets[from]
+	if !ok {
+		cli.Logger.Error("Transaction is not from this wallet", slog.String("txid", id))
+		return
+	}
+
+	// NewTransactionFromUTXOs puts the change after the payment, and only
+	// when there is any: a payment to the wallet itself is no change
+	pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
+	change := len(tx.Outputs) - 1
+	if len(tx.Outputs) != 2 || !tx.Outputs[change].IsLockedWithKey(pubKeyHash) {
+		cli.Logger.Error("Transaction has no change to raise the fee from", slog.String("txid", id))
+		return
+	}
+
+	replacement := func(fee int) (*blockchain.Transaction, error) {
+		increase := fee - entry.Fee
+		if increase <= 0 {
+			return nil, fmt.Errorf("fee %d is not higher than the %d paid", fee, entry.Fee)
+		}
+		if tx.Outputs[change].Value < increase {
+			return nil, fmt.Errorf("change of %d does not cover a fee increase of %d", tx.Outputs[change].Value, increase)
+		}
+
+		next := &blockchain.Transaction{Outputs: append([]blockchain.TxOutput{}, tx.Outputs...)}
+		next.Outputs[change].Value -= increase
+		if next.Outputs[change].Value == 0 {
+			next.Outputs = next.Outputs[:change]
+		}
+		for _, in := range tx.Inputs {
+			in.Signature = nil
+			next.Inputs = append(next.Inputs, in)
 		}
-		fmt.Println()
+		next.ID = next.Hash()
+		if err := blockchain.SignTransaction(next, w.PrivateKey, entry.Spent); err != nil {
+			return nil, err
+		}
+
+		return next, nil
+	}
 
-		if len(block.PrevHash) == 0 {
+	estimate := fee == 0
+	if estimate {
+		fee = entry.DescendantFees + 1
+	}
+	bumped, err := replacement(fee)
+	// the replacement pays more than all it evicts, and at a higher rate
+	// than the replaced for the size it has signed, which the fee itself
+	// may change
+	for estimate && err == nil {
+		need := entry.Fee*len(bumped.Serialize())/entry.Size + 1
+		if need <= fee {
 			break
 		}
+		fee = need
+		bumped, err = replacement(fee)
+	}
+	if err != nil {
+		cli.Logger.Error("Replacement not created", slog.String("error", err.Error()))
+		return
+	}
+
+	newID, err := client.SendRawTransaction(bumped)
+	if err != nil {
+		cli.Logger.Error("Replacement rejected", slog.String("error", err.Error()))
+		return
+	}
+	cli.Logger.Info("Fee bumped",
+		slog.String("replaced", id),
+		slog.String("txid", fmt.Sprintf("%x", newID)),
+		slog.Int("fee", fee))
+}
+
+func (cli *CommandLine) createBlockchain(address string, indexes []string) {
+	if !wallet.ValidateAddress(address) {
+		log.Panic("The address is not valid")
+	}
+
+	chain := blockchain.InitBlockChain(*cli.Logger, address)
+	defer chain.Store.Close()
+
+	for _, name := range indexes {
+		blockchain.ErrHandle(chain.EnableIndex(name))
+	}
+	cli.Logger.Info("Finished")
+}
+
+func (cli *CommandLine) getTransaction(id string) {
+	txID, err := hex.DecodeString(id)
+	if err != nil {
+		cli.Logger.Error("Transaction id is not valid hex", slog.String("id", id))
+		return
+	}
+
+	chain := blockchain.ContinueBlockChain(*cli.Logger, "")
+	defer chain.Store.Close()
+
+	tx, block, height, err := chain.GetTransaction(txID)
+	if err != nil {
+		cli.Logger.Error("Transaction not found", slog.String("error", err.Error()))
+		return
+	}
+
+	cli.Logger.Info("Transaction",
+		slog.String("block", fmt.Sprintf("%x", block.Hash)),
+		slog.Int("height", height),
+		slog.Int("confirmations", chain.GetBestHeight()-height+1))
+	fmt.Println(tx)
+}
+
+func (cli *CommandLine) reindex(indexes []string) {
+	chain := blockchain.ContinueBlockChain(*cli.Logger, "")
+	defer chain.Store.Close()
+
+	blockchain.ErrHandle(chain.Reindex())
+	for _, name := range indexes {
+		blockchain.ErrHandle(chain.EnableIndex(name))
+	}
+	cli.Logger.Info("Finished")
+}
+
+func (cli *CommandLine) disableIndexes(indexes []string) {
+	chain := blockchain.ContinueBlockChain(*cli.Logger, "")
+	defer chain.Store.Close()
+
+	for _, name := range indexes {
+		blockchain.ErrHandle(chain.DisableIndex(name))
+	}
+	cli.Logger.Info("Finished")
+}
+
+func (cli *CommandLine) listTransactions(address string, limit, offset int) {
+	var pubKeyHashes [][]byte
+
+	if address != "" {
+		if !wallet.ValidateAddress(address) {
+			log.Panic("The address is not valid")
+		}
+		pubKeyHashes = append(pubKeyHashes, addressPubKeyHash(address))
+	} else {
+		wallets, err := wallet.CreateWallets()
+		if err != nil {
+			cli.Logger.Error("Error loading wallets", slog.String("error", err.Error()))
+			cli.gracefullExit()
+		}
+		for _, addr := range wallets.GetAllAddresses() {
+			pubKeyHashes = append(pubKeyHashes, addressPubKeyHash(addr))
+		}
+	}
+
+	chain := blockchain.ContinueBlockChain(*cli.Logger, "")
+	defer chain.Store.Close()
+
+	history, err := chain.GetAddressHistory(pubKeyHashes)
+	if err != nil {
+		cli.Logger.Error("Cannot list transactions", slog.String("error", err.Error()))
+		return
+	}
+
+	best := chain.GetBestHeight()
+	if offset > len(history) {
+		offset = len(history)
+	}
+	history = history[offset:]
+	if limit < len(history) {
+		history = history[:limit]
+	}
+
+	for _, entry := range history {
+		direction := "self"
+		amount := entry.Net()
+		switch {
+		case amount > 0:
+			direction = "receive"
+		case amount < 0:
+			direction = "send"
+			amount = -amount
+		}
+
+		var counterparties []string
+		if entry.Coinbase {
+			counterparties = append(counterparties, "coinbase")
+		}
+		for _, c := range entry.Counterparties {
+			counterparties = append(counterparties, string(wallet.PublicKeyHashToAddress(c)))
+		}
+
+		cli.Logger.Info("Transaction",
+			slog.String("id", fmt.Sprintf("%x", entry.TxID)),
+			slog.String("direction", direction),
+			slog.Int("amount", amount),
+			slog.String("counterparty", strings.Join(counterparties, ",")),
+			slog.Int("confirmations", best-entry.Height+1))
+	}
+}
+
+func (cli *CommandLine) verifyChain(level, depth int) {
+	chain := blockchain.ContinueBlockChain(*cli.Logger, "")
+	defer chain.Store.Close()
+
+	report := chain.VerifyChain(level, depth)
+	out, err := json.MarshalIndent(report, "", "  ")
+	blockchain.ErrHandle(err)
+	fmt.Println(string(out))
+
+	if !report.OK {
+		cli.Logger.Error("Chain verification failed", slog.String("check", report.Failure.Check))
+	}
+}
+
+func (cli *CommandLine) exportChain(file string, from, to int) {
+	chain := blockchain.ContinueBlockChain(*cli.Logger, "")
+	defer chain.Store.Close()
+
+	f, err := os.Create(file)
+	blockchain.ErrHandle(err)
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	written, err := chain.ExportChain(w, from, to)
+	blockchain.ErrHandle(err)
+	blockchain.ErrHandle(w.Flush())
+
+	cli.Logger.Info("Exported chain", slog.String("file", file), slog.Int("blocks", written))
+}
+
+func (cli *CommandLine) importChain(file string) {
+	f, err := os.Open(file)
+	blockchain.ErrHandle(err)
+	defer f.Close()
+
+	reader, err := blockchain.NewBootstrapReader(bufio.NewReader(f))
+	blockchain.ErrHandle(err)
+
+	var chain *blockchain.BlockChain
+	if blockchain.DbExists() {
+		chain = blockchain.ContinueBlockChain(*cli.Logger, "")
+	} else {
+		if reader.Header.From != 0 {
+			cli.Logger.Error("Bootstrap file does not start at the genesis block, cannot start a new chain from it")
+			return
+		}
+		genesis, _, err := reader.Next()
+		blockchain.ErrHandle(err)
+		if !bytes.Equal(genesis.Hash, reader.Header.Genesis[:]) {
+			cli.Logger.Error("Bootstrap file does not start with the genesis block its header names",
+				slog.String("genesis", fmt.Sprintf("%x", reader.Header.Genesis)),
+				slog.String("first", fmt.Sprintf("%x", genesis.Hash)))
+			return
+		}
+		chain = blockchain.InitBlockChainFromGenesis(*cli.Logger, genesis)
+	}
+	defer chain.Store.Close()
+
+	// blocks below a loaded snapshot are validated while they come in
+	var validated chan error
+	stop := make(chan struct{})
+	if state := chain.Snapshot(); state != nil && !state.Validated {
+		validated = make(chan error)
+		go func() {
+			validated <- chain.ValidateSnapshot(stop)
+		}()
+	}
+
+	report, err := chain.ImportChain(reader)
+	if err != nil {
+		cli.Logger.Error("Import stopped", slog.String("error", err.Error()))
+	}
+
+	if validated != nil {
+		close(stop)
+		if err := <-validated; err != nil {
+			cli.Logger.Error("Snapshot validation stopped", slog.String("error", err.Error()))
+		} else if state := chain.Snapshot(); !state.Validated {
+			cli.Logger.Info("Snapshot history is still incomplete")
+		}
+	}
+
+	cli.Logger.Info("Imported chain",
+		slog.Int("imported", report.Imported),
+		slog.Int("known", report.Known),
+		slog.Int("height", report.Height))
+}
+
+func (cli *CommandLine) dumpTxOutSet(file string) {
+	chain := blockchain.ContinueBlockChain(*cli.Logger, "")
+	defer chain.Store.Close()
+
+	f, err := os.Create(file)
+	blockchain.ErrHandle(err)
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	header, err := chain.DumpUTXOSet(w)
+	blockchain.ErrHandle(err)
+	blockchain.ErrHandle(w.Flush())
+
+	cli.Logger.Info("Dumped UTXO set",
+		slog.String("file", file),
+		slog.String("blockhash", hex.EncodeToString(header.BaseHash[:])),
+		slog.Uint64("height", header.BaseHeight),
+		slog.Uint64("coins", header.Coins),
+		slog.String("utxo_hash", hex.EncodeToString(header.UTXOHash[:])))
+}
+
+func (cli *CommandLine) loadTxOutSet(file, blockHash string) {
+	hash, err := hex.DecodeString(blockHash)
+	if err != nil {
+		cli.Logger.Error("Block hash is not valid hex", slog.String("hash", blockHash))
+		return
+	}
+
+	f, err := os.Open(file)
+	blockchain.ErrHandle(err)
+	defer f.Close()
+
+	chain := blockchain.LoadSnapshot(*cli.Logger, hash, bufio.NewReader(f))
+	defer chain.Store.Close()
+
+	cli.Logger.Info("Import the blocks up to the snapshot with importchain, or download them with startnode, to validate it")
+}
+
+func (cli *CommandLine) prune(depth, sizeMB int, off bool) {
+	chain := blockchain.ContinueBlockChain(*cli.Logger, "")
+	defer chain.Store.Close()
+
+	if off {
+		depth, sizeMB = 0, 0
+	}
+	if err := chain.SetPruning(depth, int64(sizeMB)<<20); err != nil {
+		cli.Logger.Error("Pruning not changed", slog.String("error", err.Error()))
+		return
+	}
+
+	state, err := chain.PruneState()
+	blockchain.ErrHandle(err)
+	cli.Logger.Info("Pruning",
+		slog.Bool("enabled", state.Enabled()),
+		slog.Int("depth", state.Depth),
+		slog.Int64("target_size", state.TargetSize),
+		slog.Int("pruned_height", state.PrunedHeight))
+}
+
+func (cli *CommandLine) startRPC(addr string) {
+	chain := blockchain.ContinueBlockChain(*cli.Logger, "")
+	defer chain.Store.Close()
+
+	cli.serveRPC(addr, rpc.NewServer(*cli.Logger, chain))
+}
+
+// serveRPC serves server at addr until the process is interrupted.
+func (cli *CommandLine) serveRPC(addr string, handler http.Handler) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	server := &http.Server{Addr: addr, Handler: handler}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+
+	cli.Logger.Info("Serving RPC", slog.String("addr", addr))
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		cli.Logger.Error("RPC server failed", slog.String("error", err.Error()))
+		return
+	}
+	cli.Logger.Info("RPC server stopped")
+}
+
+func (cli *CommandLine) startNode(cfg network.Config, rpcAddr string, poolCfg *pool.Config) {
+	chain := blockchain.ContinueBlockChain(*cli.Logger, "")
+	defer chain.Store.Close()
+
+	node, err := network.NewNode(*cli.Logger, chain, cfg)
+	if err != nil {
+		cli.Logger.Error("Node not started", slog.String("error", err.Error()))
+		return
+	}
+	if err := node.Start(); err != nil {
+		cli.Logger.Error("Node not started", slog.String("error", err.Error()))
+		return
+	}
+	defer node.Stop()
+
+	// blocks below a loaded snapshot are validated as peers send them
+	if state := chain.Snapshot(); state != nil && !state.Validated {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			if err := chain.ValidateSnapshot(stop); err != nil {
+				cli.Logger.Error("Snapshot validation stopped", slog.String("error", err.Error()))
+			}
+		}()
+	}
+
+	server := rpc.NewServer(*cli.Logger, chain)
+	server.AttachNode(node)
+	if poolCfg != nil {
+		p, err := pool.NewServer(*cli.Logger, node, *poolCfg)
+		if err == nil {
+			err = p.Start()
+		}
+		if err != nil {
+			cli.Logger.Error("Mining pool not started", slog.String("error", err.Error()))
+			return
+		}
+		defer p.Stop()
+		server.AttachPool(p)
+	}
+	cli.serveRPC(rpcAddr, server)
+}
+
+func (cli *CommandLine) addNode(addr, url string) {
+	if err := rpc.NewClient(url).AddNode(addr); err != nil {
+		cli.Logger.Error("Node not added", slog.String("error", err.Error()))
+		return
+	}
+	cli.Logger.Info("Node added", slog.String("addr", addr))
+}
+
+func (cli *CommandLine) getPeerInfo(url string) {
+	peers, err := rpc.NewClient(url).GetPeerInfo()
+	if err != nil {
+		cli.Logger.Error("No peer info", slog.String("error", err.Error()))
+		return
+	}
+
+	out, err := json.MarshalIndent(peers, "", "  ")
+	blockchain.ErrHandle(err)
+	fmt.Println(string(out))
+}
+
+func (cli *CommandLine) getAddrManInfo(url string) {
+	info, err := rpc.NewClient(url).GetAddrManInfo()
+	if err != nil {
+		cli.Logger.Error("No address manager info", slog.String("error", err.Error()))
+		return
+	}
+
+	out, err := json.MarshalIndent(info, "", "  ")
+	blockchain.ErrHandle(err)
+	fmt.Println(string(out))
+}
+
+func (cli *CommandLine) setBan(subnet string, banTime int64, remove bool, url string) {
+	if err := rpc.NewClient(url).SetBan(subnet, remove, banTime); err != nil {
+		cli.Logger.Error("Ban not changed", slog.String("error", err.Error()))
+		return
+	}
+	if remove {
+		cli.Logger.Info("Ban lifted", slog.String("subnet", subnet))
+		return
+	}
+	cli.Logger.Info("Subnet banned", slog.String("subnet", subnet))
+}
+
+func (cli *CommandLine) listBanned(url string) {
+	bans, err := rpc.NewClient(url).ListBanned()
+	if err != nil {
+		cli.Logger.Error("No ban list", slog.String("error", err.Error()))
+		return
+	}
+
+	out, err := json.MarshalIndent(bans, "", "  ")
+	blockchain.ErrHandle(err)
+	fmt.Println(string(out))
+}
+
+func (cli *CommandLine) clearBanned(url string) {
+	if err := rpc.NewClient(url).ClearBanned(); err != nil {
+		cli.Logger.Error("Bans not cleared", slog.String("error", err.Error()))
+		return
+	}
+	cli.Logger.Info("All bans lifted")
+}
+
+func (cli *CommandLine) getSyncInfo(url string) {
+	info, err := rpc.NewClient(url).GetSyncInfo()
+	if err != nil {
+		cli.Logger.Error("No sync info", slog.String("error", err.Error()))
+		return
+	}
+
+	out, err := json.MarshalIndent(info, "", "  ")
+	blockchain.ErrHandle(err)
+	fmt.Println(string(out))
+}
+
+func (cli *CommandLine) getMempoolInfo(url string) {
+	info, err := rpc.NewClient(url).GetMempoolInfo()
+	if err != nil {
+		cli.Logger.Error("No mempool info", slog.String("error", err.Error()))
+		return
+	}
+
+	out, err := json.MarshalIndent(info, "", "  ")
+	blockchain.ErrHandle(err)
+	fmt.Println(string(out))
+}
+
+func (cli *CommandLine) getBlockTemplate(longPollID, url string) {
+	template, err := rpc.NewClient(url).GetBlockTemplate(longPollID)
+	if err != nil {
+		cli.Logger.Error("No block template", slog.String("error", err.Error()))
+		return
+	}
+
+	out, err := json.MarshalIndent(template, "", "  ")
+	blockchain.ErrHandle(err)
+	fmt.Println(string(out))
+}
+
+// poolMine mines shares for a pool as a worker outside the node would.
+func (cli *CommandLine) poolMine(worker, addr string, shares int) {
+	miner, err := pool.DialMiner(*cli.Logger, addr, worker)
+	if err != nil {
+		cli.Logger.Error("Not connected to the pool", slog.String("error", err.Error()))
+		return
+	}
+	defer miner.Close()
+
+	err = miner.Mine(shares)
+	cli.Logger.Info("Pool mining done",
+		slog.Int("accepted", miner.Accepted),
+		slog.Int("rejected", miner.Rejected),
+		slog.Int("blocks", miner.Blocks))
+	if err != nil {
+		cli.Logger.Error("Pool mining stopped", slog.String("error", err.Error()))
+	}
+}
+
+func (cli *CommandLine) getPoolInfo(url string) {
+	info, err := rpc.NewClient(url).GetPoolInfo()
+	if err != nil {
+		cli.Logger.Error("No pool info", slog.String("error", err.Error()))
+		return
+	}
+
+	out, err := json.MarshalIndent(info, "", "  ")
+	blockchain.ErrHandle(err)
+	fmt.Println(string(out))
+}
+
+func (cli *CommandLine) submitBlock(rawBlock, url string) {
+	data, err := hex.DecodeString(rawBlock)
+	if err != nil {
+		cli.Logger.Error("Block is not valid hex")
+		return
+	}
+	block, err := blockchain.DeserializeBlock(data)
+	if err != nil {
+		cli.Logger.Error("Block not decoded", slog.String("error", err.Error()))
+		return
+	}
+
+	res, err := rpc.NewClient(url).SubmitBlock(block)
+	if err != nil {
+		cli.Logger.Error("Block not submitted", slog.String("error", err.Error()))
+		return
+	}
+
+	out, err := json.MarshalIndent(res, "", "  ")
+	blockchain.ErrHandle(err)
+	fmt.Println(string(out))
+}
+
+// mine works as a miner apart from the node: it solves the block templates
+// of the node and submits the blocks, starting over on a new template when
+// the one it works on is outdated.
+func (cli *CommandLine) mine(address string, blocks int, url string) {
+	if !wallet.ValidateAddress(address) {
+		cli.Logger.Error("Address is not valid")
+		return
+	}
+
+	client := rpc.NewClient(url)
+	for mined := 0; mined < blocks; {
+		template, err := client.GetBlockTemplate("")
+		if err != nil {
+			cli.Logger.Error("No block template", slog.String("error", err.Error()))
+			return
+		}
+		// the coinbase data tells apart blocks paying to the same address
+		coinbase := blockchain.NewCoinbaseTx(address,
+			fmt.Sprintf("Height %d, %x", template.Height, rand.Uint64()), template.CoinbaseValue)
+		block, err := template.Block(coinbase)
+		if err != nil {
+			cli.Logger.Error("Block template not decoded", slog.String("error", err.Error()))
+			return
+		}
+
+		outdated := make(chan struct{})
+		go func() {
+			defer close(outdated)
+			for {
+				next, err := client.GetBlockTemplate(template.LongPollID)
+				if err != nil || next.LongPollID != template.LongPollID {
+					return
+				}
+			}
+		}()
+		if !blockchain.Engine().Seal(block, outdated) {
+			cli.Logger.Info("Block template outdated, starting over")
+			continue
+		}
+
+		res, err := client.SubmitBlock(block)
+		if err != nil {
+			cli.Logger.Error("Block not submitted", slog.String("error", err.Error()))
+			return
+		}
+		if !res.Accepted {
+			cli.Logger.Error("Block rejected",
+				slog.String("reason", string(res.RejectReason)),
+				slog.String("error", res.Error))
+			return
+		}
+		mined++
+		cli.Logger.Info("Mined block",
+			slog.String("hash", fmt.Sprintf("%x", block.Hash)),
+			slog.Int("height", template.Height),
+			slog.Int("transactions", len(block.Transactions)),
+			slog.Int("coinbase_value", template.CoinbaseValue))
+	}
+}
+
+func (cli *CommandLine) testMempoolAccept(rawTx, url string) {
+	data, err := hex.DecodeString(rawTx)
+	if err != nil {
+		cli.Logger.Error("Transaction is not valid hex")
+		return
+	}
+	tx, err := blockchain.DeserializeTransaction(data)
+	if err != nil {
+		cli.Logger.Error("Transaction not decoded", slog.String("error", err.Error()))
+		return
+	}
+
+	res, err := rpc.NewClient(url).TestMempoolAccept(tx)
+	if err != nil {
+		cli.Logger.Error("Transaction not tested", slog.String("error", err.Error()))
+		return
+	}
+
+	out, err := json.MarshalIndent(res, "", "  ")
+	blockchain.ErrHandle(err)
+	fmt.Println(string(out))
+}
+
+func (cli *CommandLine) estimateFee(blocks int, url string) {
+	estimate, err := rpc.NewClient(url).EstimateFee(blocks)
+	if err != nil {
+		cli.Logger.Error("No fee estimate", slog.String("error", err.Error()))
+		return
+	}
+
+	out, err := json.MarshalIndent(estimate, "", "  ")
+	blockchain.ErrHandle(err)
+	fmt.Println(string(out))
+}
+
+func (cli *CommandLine) getCompactStats(url string) {
+	stats, err := rpc.NewClient(url).GetCompactStats()
+	if err != nil {
+		cli.Logger.Error("No compact block stats", slog.String("error", err.Error()))
+		return
+	}
+
+	out, err := json.MarshalIndent(stats, "", "  ")
+	blockchain.ErrHandle(err)
+	fmt.Println(string(out))
+}
+
+func (cli *CommandLine) getNodeKey() {
+	key, err := network.LoadNodeKey(network.DefaultDataDir)
+	if err != nil {
+		cli.Logger.Error("No node key", slog.String("error", err.Error()))
+		return
+	}
+	cli.Logger.Info("Node key", slog.String("key", hex.EncodeToString(key.PublicKey().Bytes())))
+}
+
+// splitAddrs turns a comma separated flag into addresses.
+func splitAddrs(list string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(list, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return addrs
+}
+
+func (cli *CommandLine) syncHeaders(url string) {
+	headers := blockchain.OpenHeaderChain(*cli.Logger)
+	defer headers.Store.Close()
+
+	synced, err := rpc.SyncHeaders(rpc.NewClient(url), headers)
+	if err != nil {
+		cli.Logger.Error("Header sync failed", slog.String("error", err.Error()))
+	}
+	cli.Logger.Info("Headers synced",
+		slog.Int("new", synced),
+		slog.Int("height", headers.GetBestHeight()),
+		slog.String("tip", fmt.Sprintf("%x", headers.LastHash)))
+}
+
+func (cli *CommandLine) getMerkleProof(txID, url, file string) {
+	id, err := hex.DecodeString(txID)
+	if err != nil {
+		cli.Logger.Error("Transaction ID is not valid hex", slog.String("txid", txID))
+		return
+	}
+
+	var proof *blockchain.MerkleProof
+	if url != "" {
+		proof, err = rpc.NewClient(url).GetMerkleProof(id)
+	} else {
+		chain := blockchain.ContinueBlockChain(*cli.Logger, "")
+		defer chain.Store.Close()
+
+		var block *blockchain.Block
+		if _, block, _, err = chain.GetTransaction(id); err == nil {
+			proof, err = blockchain.NewMerkleProof(block, id)
+		}
+	}
+	if err != nil {
+		cli.Logger.Error("No Merkle proof", slog.String("error", err.Error()))
+		return
+	}
+
+	out, err := json.MarshalIndent(proof, "", "  ")
+	blockchain.ErrHandle(err)
+	if file == "" {
+		fmt.Println(string(out))
+		return
 	}
+	blockchain.ErrHandle(os.WriteFile(file, out, 0644))
+	cli.Logger.Info("Merkle proof written", slog.String("file", file))
 }
 
-func (cli *CommandLine) getBalance(address string) {
-	if !wallet.ValidateAddress(address) {
-		log.Panic("The address is not valid")
-	}
+func (cli *CommandLine) verifyMerkleProof(file, url string) {
+	data, err := os.ReadFile(file)
+	blockchain.ErrHandle(err)
 
-	chain := blockchain.ContinueBlockChain(*cli.Logger, address)
-	defer chain.Database.Close()
+	var proof blockchain.MerkleProof
+	if err := json.Unmarshal(data, &proof); err != nil {
+		cli.Logger.Error("Malformed Merkle proof", slog.String("error", err.Error()))
+		return
+	}
 
-	balance := 0
-	pubKeyHash := wallet.Base58Decode([]byte(address))
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	UTXOs := chain.FindUTXO(pubKeyHash)
+	var confirmations int
+	if url != "" {
+		confirmations, err = rpc.NewClient(url).VerifyMerkleProof(&proof)
+	} else {
+		headers := blockchain.OpenHeaderChain(*cli.Logger)
+		defer headers.Store.Close()
 
-	for _, out := range UTXOs {
-		balance += out.Value
+		confirmations, err = blockchain.CheckMerkleProof(headers, &proof)
+	}
+	if err != nil {
+		cli.Logger.Error("Merkle proof rejected", slog.String("error", err.Error()))
+		return
 	}
 
-	cli.Logger.Info("Balance: counted", slog.String("Balance: ", fmt.Sprintf("%d", balance)), slog.String("address: ", address))
+	cli.Logger.Info("Merkle proof valid",
+		slog.String("txid", fmt.Sprintf("%x", proof.TxID)),
+		slog.String("block", fmt.Sprintf("%x", proof.BlockHash)),
+		slog.Int("confirmations", confirmations))
 }
 
-func (cli *CommandLine) send(from, to string, amount int) {
-
-	if !wallet.ValidateAddress(from) {
-		log.Panic("The from address is not valid")
+func (cli *CommandLine) scanWallet(url string) {
+	wallets, err := wallet.CreateWallets()
+	if err != nil {
+		cli.Logger.Error("Error loading wallets", slog.String("error", err.Error()))
+		return
 	}
-
-	if !wallet.ValidateAddress(to) {
-		log.Panic("The 'to' address is not valid")
+	var pubKeyHashes [][]byte
+	for _, address := range wallets.GetAllAddresses() {
+		pubKeyHashes = append(pubKeyHashes, addressPubKeyHash(address))
+	}
+	if len(pubKeyHashes) == 0 {
+		cli.Logger.Info("No addresses found")
+		return
 	}
 
-	chain := blockchain.ContinueBlockChain(*cli.Logger, from)
-	defer chain.Database.Close()
+	headers := blockchain.OpenHeaderChain(*cli.Logger)
+	defer headers.Store.Close()
 
-	tx := blockchain.NewTransaction(from, to, amount, chain)
+	client := rpc.NewClient(url)
+	if _, err := rpc.SyncHeaders(client, headers); err != nil {
+		cli.Logger.Error("Header sync failed", slog.String("error", err.Error()))
+		return
+	}
 
-	chain.AddBlock([]*blockchain.Transaction{tx})
-	cli.Logger.Info("Success")
-}
+	watch := blockchain.NewFilterWatch(pubKeyHashes)
+	matches, err := rpc.ScanFilters(client, headers, watch)
+	if err != nil {
+		cli.Logger.Error("Filter scan failed", slog.String("error", err.Error()))
+		return
+	}
 
-func (cli *CommandLine) createBlockchain(address string) {
-	if !wallet.ValidateAddress(address) {
-		log.Panic("The address is not valid")
+	for _, match := range matches {
+		for _, tx := range match.Transactions {
+			cli.Logger.Info("Wallet transaction",
+				slog.String("txid", fmt.Sprintf("%x", tx.ID)),
+				slog.Int("height", match.Height),
+				slog.String("block", fmt.Sprintf("%x", match.BlockHash)))
+		}
 	}
+	cli.Logger.Info("Scan finished",
+		slog.Int("height", headers.GetBestHeight()),
+		slog.Int("blocks_downloaded", len(matches)),
+		slog.Int("balance", watch.Balance()))
+}
 
-	chain := blockchain.InitBlockChain(*cli.Logger, address)
-	chain.Database.Close()
-	cli.Logger.Info("Finished")
+func addressPubKeyHash(address string) []byte {
+	pubKeyHash := wallet.Base58Decode([]byte(address))
+
+	return pubKeyHash[1 : len(pubKeyHash)-4]
 }
 
 func (cli *CommandLine) createWallet() {
@@ -133,6 +1143,23 @@ func (cli *CommandLine) listAddresses() {
 	}
 }
 
+// indexFlags turns the -txindex/-addrindex/-filterindex flags into index
+// names.
+func indexFlags(txIndex, addrIndex, filterIndex bool) []string {
+	var indexes []string
+	if txIndex {
+		indexes = append(indexes, "tx")
+	}
+	if addrIndex {
+		indexes = append(indexes, "addr")
+	}
+	if filterIndex {
+		indexes = append(indexes, "filter")
+	}
+
+	return indexes
+}
+
 func (cli *CommandLine) gracefullExit() {
 	cli.printUsage()
 	runtime.Goexit()
@@ -140,6 +1167,7 @@ func (cli *CommandLine) gracefullExit() {
 
 func (cli *CommandLine) Run() {
 	cli.ValidateArguments()
+	cli.selectNetwork()
 
 	getbalanceCmd := flag.NewFlagSet("getbalance", flag.ExitOnError)
 	createblockchainCmd := flag.NewFlagSet("createblockchain", flag.ExitOnError)
@@ -147,12 +1175,130 @@ func (cli *CommandLine) Run() {
 	printChainCmd := flag.NewFlagSet("print", flag.ExitOnError)
 	createWalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
 	listAddressesCmd := flag.NewFlagSet("listaddresses", flag.ExitOnError)
+	getBlockCmd := flag.NewFlagSet("getblock", flag.ExitOnError)
+	getBlockCountCmd := flag.NewFlagSet("getblockcount", flag.ExitOnError)
+	getTransactionCmd := flag.NewFlagSet("gettransaction", flag.ExitOnError)
+	reindexCmd := flag.NewFlagSet("reindex", flag.ExitOnError)
+	disableIndexCmd := flag.NewFlagSet("disableindex", flag.ExitOnError)
+	listTransactionsCmd := flag.NewFlagSet("listtransactions", flag.ExitOnError)
+	verifyChainCmd := flag.NewFlagSet("verifychain", flag.ExitOnError)
+	exportChainCmd := flag.NewFlagSet("exportchain", flag.ExitOnError)
+	importChainCmd := flag.NewFlagSet("importchain", flag.ExitOnError)
+	dumpTxOutSetCmd := flag.NewFlagSet("dumptxoutset", flag.ExitOnError)
+	loadTxOutSetCmd := flag.NewFlagSet("loadtxoutset", flag.ExitOnError)
+	pruneCmd := flag.NewFlagSet("prune", flag.ExitOnError)
+	startRPCCmd := flag.NewFlagSet("startrpc", flag.ExitOnError)
+	syncHeadersCmd := flag.NewFlagSet("syncheaders", flag.ExitOnError)
+	getMerkleProofCmd := flag.NewFlagSet("getmerkleproof", flag.ExitOnError)
+	verifyMerkleProofCmd := flag.NewFlagSet("verifymerkleproof", flag.ExitOnError)
+	scanWalletCmd := flag.NewFlagSet("scanwallet", flag.ExitOnError)
+	startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
+	getNodeKeyCmd := flag.NewFlagSet("getnodekey", flag.ExitOnError)
+	addNodeCmd := flag.NewFlagSet("addnode", flag.ExitOnError)
+	getPeerInfoCmd := flag.NewFlagSet("getpeerinfo", flag.ExitOnError)
+	getAddrManInfoCmd := flag.NewFlagSet("getaddrmaninfo", flag.ExitOnError)
+	setBanCmd := flag.NewFlagSet("setban", flag.ExitOnError)
+	listBannedCmd := flag.NewFlagSet("listbanned", flag.ExitOnError)
+	clearBannedCmd := flag.NewFlagSet("clearbanned", flag.ExitOnError)
+	getSyncInfoCmd := flag.NewFlagSet("getsyncinfo", flag.ExitOnError)
+	getMempoolInfoCmd := flag.NewFlagSet("getmempoolinfo", flag.ExitOnError)
+	getCompactStatsCmd := flag.NewFlagSet("getcompactstats", flag.ExitOnError)
+	bumpFeeCmd := flag.NewFlagSet("bumpfee", flag.ExitOnError)
+	estimateFeeCmd := flag.NewFlagSet("estimatefee", flag.ExitOnError)
+	testMempoolAcceptCmd := flag.NewFlagSet("testmempoolaccept", flag.ExitOnError)
+	getBlockTemplateCmd := flag.NewFlagSet("getblocktemplate", flag.ExitOnError)
+	submitBlockCmd := flag.NewFlagSet("submitblock", flag.ExitOnError)
+	mineCmd := flag.NewFlagSet("mine", flag.ExitOnError)
+	poolMineCmd := flag.NewFlagSet("poolmine", flag.ExitOnError)
+	getPoolInfoCmd := flag.NewFlagSet("getpoolinfo", flag.ExitOnError)
 
 	getBalanceAddress := getbalanceCmd.String("address", "", "Address to get balance for")
 	createBlockChainAddress := createblockchainCmd.String("address", "", "Address to create blockchain for")
+	createBlockChainTxIndex := createblockchainCmd.Bool("txindex", false, "Maintain the transaction index")
+	createBlockChainAddrIndex := createblockchainCmd.Bool("addrindex", false, "Maintain the address index")
+	createBlockChainFilterIndex := createblockchainCmd.Bool("filterindex", false, "Maintain compact block filters for light wallets")
 	sendFrom := sendCmd.String("from", "", "Address to send from")
 	sendTo := sendCmd.String("to", "", "Address to send to")
 	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
+	sendRPC := sendCmd.String("rpc", "", "URL of a running node to send through instead of mining locally")
+	sendFee := sendCmd.Int("fee", 0, "Fee to leave to the miner, with -rpc")
+	sendConfTarget := sendCmd.Int("conftarget", 0, "Pay the fee estimated to confirm within this many blocks, with -rpc")
+	sendReplaceable := sendCmd.Bool("replaceable", false, "Let the transaction be replaced by one paying a higher fee, with -rpc")
+	printChainFrom := printChainCmd.Int("from", 0, "Lowest height to print")
+	printChainTo := printChainCmd.Int("to", -1, "Highest height to print, defaults to the tip")
+	getBlockHeight := getBlockCmd.Int("height", -1, "Height of the block")
+	getBlockHash := getBlockCmd.String("hash", "", "Hash of the block")
+	getTransactionID := getTransactionCmd.String("id", "", "ID of the transaction")
+	reindexTxIndex := reindexCmd.Bool("txindex", false, "Enable and build the transaction index")
+	reindexAddrIndex := reindexCmd.Bool("addrindex", false, "Enable and build the address index")
+	reindexFilterIndex := reindexCmd.Bool("filterindex", false, "Enable and build the compact block filters")
+	disableTxIndex := disableIndexCmd.Bool("txindex", false, "Disable the transaction index")
+	disableAddrIndex := disableIndexCmd.Bool("addrindex", false, "Disable the address index")
+	disableFilterIndex := disableIndexCmd.Bool("filterindex", false, "Disable the compact block filters")
+	listTransactionsAddress := listTransactionsCmd.String("address", "", "Address to list, defaults to every wallet address")
+	listTransactionsLimit := listTransactionsCmd.Int("limit", 10, "Maximum number of transactions to list")
+	listTransactionsOffset := listTransactionsCmd.Int("offset", 0, "Number of newest transactions to skip")
+	verifyChainLevel := verifyChainCmd.Int("level", blockchain.VerifyUTXOSet, "How thorough the audit is, 0 to 4")
+	verifyChainDepth := verifyChainCmd.Int("depth", 0, "Number of blocks to audit from the tip, 0 for all")
+	exportChainFile := exportChainCmd.String("file", "", "Bootstrap file to write")
+	exportChainFrom := exportChainCmd.Int("from", 0, "Lowest height to export")
+	exportChainTo := exportChainCmd.Int("to", -1, "Highest height to export, defaults to the tip")
+	importChainFile := importChainCmd.String("file", "", "Bootstrap file to read")
+	dumpTxOutSetFile := dumpTxOutSetCmd.String("file", "", "Snapshot file to write")
+	loadTxOutSetFile := loadTxOutSetCmd.String("file", "", "Snapshot file to read")
+	loadTxOutSetBlockHash := loadTxOutSetCmd.String("blockhash", "", "Hash of the block the snapshot must be taken at")
+	pruneDepth := pruneCmd.Int("depth", 0, fmt.Sprintf("Number of recent blocks to keep, at least %d", blockchain.MinPruneDepth))
+	pruneSize := pruneCmd.Int("size", 0, "Megabytes of recent blocks to keep")
+	pruneOff := pruneCmd.Bool("off", false, "Stop pruning, blocks already pruned stay pruned")
+	startRPCAddr := startRPCCmd.String("addr", rpc.DefaultAddr, "Address to listen on")
+	syncHeadersRPC := syncHeadersCmd.String("rpc", "http://"+rpc.DefaultAddr, "URL of the full node")
+	getMerkleProofTxID := getMerkleProofCmd.String("txid", "", "ID of the transaction")
+	getMerkleProofRPC := getMerkleProofCmd.String("rpc", "", "URL of a full node to ask instead of the local chain")
+	getMerkleProofFile := getMerkleProofCmd.String("file", "", "File to write the proof to instead of printing it")
+	verifyMerkleProofFile := verifyMerkleProofCmd.String("file", "", "File holding the proof")
+	verifyMerkleProofRPC := verifyMerkleProofCmd.String("rpc", "", "URL of a full node to ask instead of the synced headers")
+	scanWalletRPC := scanWalletCmd.String("rpc", "http://"+rpc.DefaultAddr, "URL of the full node")
+	startNodeListen := startNodeCmd.String("listen", network.DefaultListenAddr, "Address to accept peers on, also announced to them")
+	startNodeRPCAddr := startNodeCmd.String("rpcaddr", rpc.DefaultAddr, "Address to serve RPC on")
+	startNodeConnect := startNodeCmd.String("connect", "", "Comma separated peers to connect to, and no others")
+	startNodeAddNode := startNodeCmd.String("addnode", "", "Comma separated peers to keep connected besides those found")
+	startNodeEncryption := startNodeCmd.String("encryption", string(network.EncryptionPrefer), "Encrypt peer connections: off, prefer (plaintext with peers that cannot) or require")
+	startNodeAllowKeys := startNodeCmd.String("allowkeys", "", "Comma separated public keys of the only peers allowed, needs -encryption require")
+	startNodeConfig := startNodeCmd.String("config", os.Getenv("CONFIG_PATH"), "Config file setting the mempool policy and block limits")
+	startNodePoolAddress := startNodeCmd.String("pooladdress", "", "Address the mining pool pays blocks to, no pool runs without it")
+	startNodeStratum := startNodeCmd.String("stratum", pool.DefaultListenAddr, "Address to accept pool workers on")
+	startNodeShareBits := startNodeCmd.Int("sharebits", 0, "Difficulty of pool shares in leading zero bits, a sixteenth of that of blocks when 0")
+	addNodeAddr := addNodeCmd.String("node", "", "Address of the peer")
+	addNodeRPC := addNodeCmd.String("rpc", "http://"+rpc.DefaultAddr, "URL of the running node")
+	getPeerInfoRPC := getPeerInfoCmd.String("rpc", "http://"+rpc.DefaultAddr, "URL of the running node")
+	getAddrManInfoRPC := getAddrManInfoCmd.String("rpc", "http://"+rpc.DefaultAddr, "URL of the running node")
+	setBanSubnet := setBanCmd.String("subnet", "", "Address or CIDR subnet to ban")
+	setBanTime := setBanCmd.Int64("bantime", 0, "Seconds to ban for, 0 for the default of a day")
+	setBanRemove := setBanCmd.Bool("remove", false, "Lift the ban instead")
+	setBanRPC := setBanCmd.String("rpc", "http://"+rpc.DefaultAddr, "URL of the running node")
+	listBannedRPC := listBannedCmd.String("rpc", "http://"+rpc.DefaultAddr, "URL of the running node")
+	clearBannedRPC := clearBannedCmd.String("rpc", "http://"+rpc.DefaultAddr, "URL of the running node")
+	getSyncInfoRPC := getSyncInfoCmd.String("rpc", "http://"+rpc.DefaultAddr, "URL of the running node")
+	getMempoolInfoRPC := getMempoolInfoCmd.String("rpc", "http://"+rpc.DefaultAddr, "URL of the running node")
+	getCompactStatsRPC := getCompactStatsCmd.String("rpc", "http://"+rpc.DefaultAddr, "URL of the running node")
+	bumpFeeTxID := bumpFeeCmd.String("txid", "", "ID of the transaction to replace")
+	bumpFeeFee := bumpFeeCmd.Int("fee", 0, "Fee of the replacement, defaults to one more than the transactions it evicts pay")
+	bumpFeeRPC := bumpFeeCmd.String("rpc", "http://"+rpc.DefaultAddr, "URL of the running node")
+	estimateFeeBlocks := estimateFeeCmd.Int("blocks", 0, "Blocks to confirm within")
+	estimateFeeRPC := estimateFeeCmd.String("rpc", "http://"+rpc.DefaultAddr, "URL of the running node")
+	testMempoolAcceptRawTx := testMempoolAcceptCmd.String("rawtx", "", "Serialized transaction in hex")
+	testMempoolAcceptRPC := testMempoolAcceptCmd.String("rpc", "http://"+rpc.DefaultAddr, "URL of the running node")
+	getBlockTemplateLongPollID := getBlockTemplateCmd.String("longpollid", "", "Long poll ID of the template to wait on")
+	getBlockTemplateRPC := getBlockTemplateCmd.String("rpc", "http://"+rpc.DefaultAddr, "URL of the running node")
+	submitBlockBlock := submitBlockCmd.String("block", "", "Serialized block in hex")
+	submitBlockRPC := submitBlockCmd.String("rpc", "http://"+rpc.DefaultAddr, "URL of the running node")
+	mineAddress := mineCmd.String("address", "", "Address the coinbase pays to")
+	mineBlocks := mineCmd.Int("blocks", 1, "Blocks to mine")
+	mineRPC := mineCmd.String("rpc", "http://"+rpc.DefaultAddr, "URL of the running node")
+	poolMineWorker := poolMineCmd.String("worker", "", "Worker name, the payout address optionally followed by a dot and a name")
+	poolMinePool := poolMineCmd.String("pool", pool.DefaultListenAddr, "Address of the mining pool")
+	poolMineShares := poolMineCmd.Int("shares", 10, "Shares to mine")
+	getPoolInfoRPC := getPoolInfoCmd.String("rpc", "http://"+rpc.DefaultAddr, "URL of the running node")
 
 	switch os.Args[1] {
 	case "getbalance":
@@ -179,6 +1325,150 @@ func (cli *CommandLine) Run() {
 		err := listAddressesCmd.Parse(os.Args[2:])
 		blockchain.ErrHandle(err)
 
+	case "getblock":
+		err := getBlockCmd.Parse(os.Args[2:])
+		blockchain.ErrHandle(err)
+
+	case "getblockcount":
+		err := getBlockCountCmd.Parse(os.Args[2:])
+		blockchain.ErrHandle(err)
+
+	case "gettransaction":
+		err := getTransactionCmd.Parse(os.Args[2:])
+		blockchain.ErrHandle(err)
+
+	case "reindex":
+		err := reindexCmd.Parse(os.Args[2:])
+		blockchain.ErrHandle(err)
+
+	case "listtransactions":
+		err := listTransactionsCmd.Parse(os.Args[2:])
+		blockchain.ErrHandle(err)
+
+	case "verifychain":
+		err := verifyChainCmd.Parse(os.Args[2:])
+		blockchain.ErrHandle(err)
+
+	case "exportchain":
+		err := exportChainCmd.Parse(os.Args[2:])
+		blockchain.ErrHandle(err)
+
+	case "importchain":
+		err := importChainCmd.Parse(os.Args[2:])
+		blockchain.ErrHandle(err)
+
+	case "dumptxoutset":
+		err := dumpTxOutSetCmd.Parse(os.Args[2:])
+		blockchain.ErrHandle(err)
+
+	case "loadtxoutset":
+		err := loadTxOutSetCmd.Parse(os.Args[2:])
+		blockchain.ErrHandle(err)
+
+	case "disableindex":
+		err := disableIndexCmd.Parse(os.Args[2:])
+		blockchain.ErrHandle(err)
+
+	case "prune":
+		err := pruneCmd.Parse(os.Args[2:])
+		blockchain.ErrHandle(err)
+
+	case "startrpc":
+		err := startRPCCmd.Parse(os.Args[2:])
+		blockchain.ErrHandle(err)
+
+	case "syncheaders":
+		err := syncHeadersCmd.Parse(os.Args[2:])
+		blockchain.ErrHandle(err)
+
+	case "getmerkleproof":
+		err := getMerkleProofCmd.Parse(os.Args[2:])
+		blockchain.ErrHandle(err)
+
+	case "verifymerkleproof":
+		err := verifyMerkleProofCmd.Parse(os.Args[2:])
+		blockchain.ErrHandle(err)
+
+	case "scanwallet":
+		err := scanWalletCmd.Parse(os.Args[2:])
+		blockchain.ErrHandle(err)
+
+	case "startnode":
+		err := startNodeCmd.Parse(os.Args[2:])
+		blockchain.ErrHandle(err)
+
+	case "getnodekey":
+		err := getNodeKeyCmd.Parse(os.Args[2:])
+		blockchain.ErrHandle(err)
+
+	case "addnode":
+		err := addNodeCmd.Parse(os.Args[2:])
+		blockchain.ErrHandle(err)
+
+	case "getpeerinfo":
+		err := getPeerInfoCmd.Parse(os.Args[2:])
+		blockchain.ErrHandle(err)
+
+	case "getaddrmaninfo":
+		err := getAddrManInfoCmd.Parse(os.Args[2:])
+		blockchain.ErrHandle(err)
+
+	case "setban":
+		err := setBanCmd.Parse(os.Args[2:])
+		blockchain.ErrHandle(err)
+
+	case "listbanned":
+		err := listBannedCmd.Parse(os.Args[2:])
+		blockchain.ErrHandle(err)
+
+	case "clearbanned":
+		err := clearBannedCmd.Parse(os.Args[2:])
+		blockchain.ErrHandle(err)
+
+	case "getsyncinfo":
+		err := getSyncInfoCmd.Parse(os.Args[2:])
+		blockchain.ErrHandle(err)
+
+	case "getmempoolinfo":
+		err := getMempoolInfoCmd.Parse(os.Args[2:])
+		blockchain.ErrHandle(err)
+
+	case "getcompactstats":
+		err := getCompactStatsCmd.Parse(os.Args[2:])
+		blockchain.ErrHandle(err)
+
+	case "bumpfee":
+		err := bumpFeeCmd.Parse(os.Args[2:])
+		blockchain.ErrHandle(err)
+
+	case "estimatefee":
+		err := estimateFeeCmd.Parse(os.Args[2:])
+		blockchain.ErrHandle(err)
+
+	case "testmempoolaccept":
+		err := testMempoolAcceptCmd.Parse(os.Args[2:])
+		blockchain.ErrHandle(err)
+
+	case "getblocktemplate":
+		err := getBlockTemplateCmd.Parse(os.Args[2:])
+		blockchain.ErrHandle(err)
+
+	case "submitblock":
+		err := submitBlockCmd.Parse(os.Args[2:])
+		blockchain.ErrHandle(err)
+
+	case "mine":
+		err := mineCmd.Parse(os.Args[2:])
+		blockchain.ErrHandle(err)
+
+	case "poolmine":
+		err := poolMineCmd.Parse(os.Args[2:])
+		blockchain.ErrHandle(err)
+
+	case "getpoolinfo":
+		err := getPoolInfoCmd.Parse(os.Args[2:])
+		blockchain.ErrHandle(err)
+
 	default:
 		cli.gracefullExit()
 	}
@@ -195,7 +1485,7 @@ func (cli *CommandLine) Run() {
 			cli.Logger.Error("Address is required for createblockchain command")
 			cli.gracefullExit()
 		}
-		cli.createBlockchain(*createBlockChainAddress)
+		cli.createBlockchain(*createBlockChainAddress, indexFlags(*createBlockChainTxIndex, *createBlockChainAddrIndex, *createBlockChainFilterIndex))
 	}
 
 	if sendCmd.Parsed() {
@@ -203,7 +1493,19 @@ func (cli *CommandLine) Run() {
 			cli.Logger.Error("From, To and Amount are required for send command")
 			cli.gracefullExit()
 		}
-		cli.send(*sendFrom, *sendTo, *sendAmount)
+		if *sendRPC == "" && (*sendFee != 0 || *sendConfTarget != 0 || *sendReplaceable) {
+			cli.Logger.Error("Fee, conftarget and replaceable need -rpc, a locally mined payment pays no fee")
+			cli.gracefullExit()
+		}
+		if *sendFee < 0 || *sendConfTarget < 0 || (*sendFee > 0 && *sendConfTarget > 0) {
+			cli.Logger.Error("Fee and conftarget can not be negative nor both given")
+			cli.gracefullExit()
+		}
+		if *sendRPC != "" {
+			cli.sendToNode(*sendFrom, *sendTo, *sendAmount, *sendFee, *sendConfTarget, *sendReplaceable, *sendRPC)
+		} else {
+			cli.send(*sendFrom, *sendTo, *sendAmount)
+		}
 	}
 
 	if createWalletCmd.Parsed() {
@@ -216,6 +1518,287 @@ func (cli *CommandLine) Run() {
 
 	// Print chain
 	if printChainCmd.Parsed() {
-		cli.printChain()
+		if *printChainFrom < 0 || (*printChainTo >= 0 && *printChainTo < *printChainFrom) {
+			cli.Logger.Error("Invalid height range for printchain command")
+			cli.gracefullExit()
+		}
+		cli.printChain(*printChainFrom, *printChainTo)
+	}
+
+	if getBlockCmd.Parsed() {
+		if (*getBlockHeight < 0) == (*getBlockHash == "") {
+			cli.Logger.Error("Exactly one of height or hash is required for getblock command")
+			cli.gracefullExit()
+		}
+		cli.getBlock(*getBlockHeight, *getBlockHash)
+	}
+
+	if getBlockCountCmd.Parsed() {
+		cli.getBlockCount()
+	}
+
+	if getTransactionCmd.Parsed() {
+		if *getTransactionID == "" {
+			cli.Logger.Error("ID is required for gettransaction command")
+			cli.gracefullExit()
+		}
+		cli.getTransaction(*getTransactionID)
+	}
+
+	if reindexCmd.Parsed() {
+		cli.reindex(indexFlags(*reindexTxIndex, *reindexAddrIndex, *reindexFilterIndex))
+	}
+
+	if disableIndexCmd.Parsed() {
+		indexes := indexFlags(*disableTxIndex, *disableAddrIndex, *disableFilterIndex)
+		if len(indexes) == 0 {
+			cli.Logger.Error("At least one index is required for disableindex command")
+			cli.gracefullExit()
+		}
+		cli.disableIndexes(indexes)
+	}
+
+	if listTransactionsCmd.Parsed() {
+		if *listTransactionsLimit <= 0 || *listTransactionsOffset < 0 {
+			cli.Logger.Error("Limit must be positive and offset not negative for listtransactions command")
+			cli.gracefullExit()
+		}
+		cli.listTransactions(*listTransactionsAddress, *listTransactionsLimit, *listTransactionsOffset)
+	}
+
+	if verifyChainCmd.Parsed() {
+		if *verifyChainLevel < 0 || *verifyChainLevel > blockchain.VerifyUTXOSet || *verifyChainDepth < 0 {
+			cli.Logger.Error("Level must be 0 to 4 and depth not negative for verifychain command")
+			cli.gracefullExit()
+		}
+		cli.verifyChain(*verifyChainLevel, *verifyChainDepth)
+	}
+
+	if exportChainCmd.Parsed() {
+		if *exportChainFile == "" || *exportChainFrom < 0 || (*exportChainTo >= 0 && *exportChainTo < *exportChainFrom) {
+			cli.Logger.Error("File and a valid height range are required for exportchain command")
+			cli.gracefullExit()
+		}
+		cli.exportChain(*exportChainFile, *exportChainFrom, *exportChainTo)
+	}
+
+	if importChainCmd.Parsed() {
+		if *importChainFile == "" {
+			cli.Logger.Error("File is required for importchain command")
+			cli.gracefullExit()
+		}
+		cli.importChain(*importChainFile)
+	}
+
+	if dumpTxOutSetCmd.Parsed() {
+		if *dumpTxOutSetFile == "" {
+			cli.Logger.Error("File is required for dumptxoutset command")
+			cli.gracefullExit()
+		}
+		cli.dumpTxOutSet(*dumpTxOutSetFile)
+	}
+
+	if loadTxOutSetCmd.Parsed() {
+		if *loadTxOutSetFile == "" || *loadTxOutSetBlockHash == "" {
+			cli.Logger.Error("File and block hash are required for loadtxoutset command")
+			cli.gracefullExit()
+		}
+		cli.loadTxOutSet(*loadTxOutSetFile, *loadTxOutSetBlockHash)
+	}
+
+	if pruneCmd.Parsed() {
+		set := 0
+		for _, given := range []bool{*pruneDepth > 0, *pruneSize > 0, *pruneOff} {
+			if given {
+				set++
+			}
+		}
+		if set != 1 || *pruneDepth < 0 || *pruneSize < 0 {
+			cli.Logger.Error("Exactly one of depth, size or off is required for prune command")
+			cli.gracefullExit()
+		}
+		cli.prune(*pruneDepth, *pruneSize, *pruneOff)
+	}
+
+	if startRPCCmd.Parsed() {
+		cli.startRPC(*startRPCAddr)
+	}
+
+	if syncHeadersCmd.Parsed() {
+		if *syncHeadersRPC == "" {
+			cli.Logger.Error("RPC URL is required for syncheaders command")
+			cli.gracefullExit()
+		}
+		cli.syncHeaders(*syncHeadersRPC)
+	}
+
+	if getMerkleProofCmd.Parsed() {
+		if *getMerkleProofTxID == "" {
+			cli.Logger.Error("Transaction ID is required for getmerkleproof command")
+			cli.gracefullExit()
+		}
+		cli.getMerkleProof(*getMerkleProofTxID, *getMerkleProofRPC, *getMerkleProofFile)
+	}
+
+	if verifyMerkleProofCmd.Parsed() {
+		if *verifyMerkleProofFile == "" {
+			cli.Logger.Error("File is required for verifymerkleproof command")
+			cli.gracefullExit()
+		}
+		cli.verifyMerkleProof(*verifyMerkleProofFile, *verifyMerkleProofRPC)
+	}
+
+	if scanWalletCmd.Parsed() {
+		if *scanWalletRPC == "" {
+			cli.Logger.Error("RPC URL is required for scanwallet command")
+			cli.gracefullExit()
+		}
+		cli.scanWallet(*scanWalletRPC)
+	}
+
+	if startNodeCmd.Parsed() {
+		encryption, err := network.ParseEncryptionPolicy(*startNodeEncryption)
+		if err != nil {
+			cli.Logger.Error(err.Error())
+			cli.gracefullExit()
+		}
+		var allowKeys [][]byte
+		for _, s := range splitAddrs(*startNodeAllowKeys) {
+			key, err := network.ParsePeerKey(s)
+			if err != nil {
+				cli.Logger.Error(err.Error())
+				cli.gracefullExit()
+			}
+			allowKeys = append(allowKeys, key)
+		}
+		cfg := network.Config{
+			ListenAddr:  *startNodeListen,
+			Connect:     splitAddrs(*startNodeConnect),
+			AddNodes:    splitAddrs(*startNodeAddNode),
+			Encryption:  encryption,
+			AllowedKeys: allowKeys,
+		}
+		if *startNodeConfig != "" {
+			conf, err := config.Load(*startNodeConfig)
+			if err != nil {
+				cli.Logger.Error(err.Error())
+				cli.gracefullExit()
+			}
+			cfg.Policy = conf.Policy.Mempool()
+			cfg.BlockLimits = conf.Mining.Limits()
+		}
+		var poolCfg *pool.Config
+		if *startNodePoolAddress != "" {
+			poolCfg = &pool.Config{
+				ListenAddr: *startNodeStratum,
+				Address:    *startNodePoolAddress,
+				ShareBits:  *startNodeShareBits,
+			}
+		}
+		cli.startNode(cfg, *startNodeRPCAddr, poolCfg)
+	}
+
+	if getNodeKeyCmd.Parsed() {
+		cli.getNodeKey()
+	}
+
+	if addNodeCmd.Parsed() {
+		if *addNodeAddr == "" {
+			cli.Logger.Error("Node address is required for addnode command")
+			cli.gracefullExit()
+		}
+		cli.addNode(*addNodeAddr, *addNodeRPC)
+	}
+
+	if getPeerInfoCmd.Parsed() {
+		cli.getPeerInfo(*getPeerInfoRPC)
+	}
+
+	if getAddrManInfoCmd.Parsed() {
+		cli.getAddrManInfo(*getAddrManInfoRPC)
+	}
+
+	if setBanCmd.Parsed() {
+		if *setBanSubnet == "" {
+			cli.Logger.Error("Subnet is required for setban command")
+			cli.gracefullExit()
+		}
+		cli.setBan(*setBanSubnet, *setBanTime, *setBanRemove, *setBanRPC)
+	}
+
+	if listBannedCmd.Parsed() {
+		cli.listBanned(*listBannedRPC)
+	}
+
+	if clearBannedCmd.Parsed() {
+		cli.clearBanned(*clearBannedRPC)
+	}
+
+	if getSyncInfoCmd.Parsed() {
+		cli.getSyncInfo(*getSyncInfoRPC)
+	}
+
+	if getMempoolInfoCmd.Parsed() {
+		cli.getMempoolInfo(*getMempoolInfoRPC)
+	}
+
+	if getCompactStatsCmd.Parsed() {
+		cli.getCompactStats(*getCompactStatsRPC)
+	}
+
+	if bumpFeeCmd.Parsed() {
+		if *bumpFeeTxID == "" {
+			cli.Logger.Error("Transaction ID is required for bumpfee command")
+			cli.gracefullExit()
+		}
+		cli.bumpFee(*bumpFeeTxID, *bumpFeeFee, *bumpFeeRPC)
+	}
+
+	if estimateFeeCmd.Parsed() {
+		if *estimateFeeBlocks <= 0 {
+			cli.Logger.Error("Blocks are required for estimatefee command")
+			cli.gracefullExit()
+		}
+		cli.estimateFee(*estimateFeeBlocks, *estimateFeeRPC)
+	}
+
+	if testMempoolAcceptCmd.Parsed() {
+		if *testMempoolAcceptRawTx == "" {
+			cli.Logger.Error("Raw transaction is required for testmempoolaccept command")
+			cli.gracefullExit()
+		}
+		cli.testMempoolAccept(*testMempoolAcceptRawTx, *testMempoolAcceptRPC)
+	}
+
+	if getBlockTemplateCmd.Parsed() {
+		cli.getBlockTemplate(*getBlockTemplateLongPollID, *getBlockTemplateRPC)
+	}
+
+	if submitBlockCmd.Parsed() {
+		if *submitBlockBlock == "" {
+			cli.Logger.Error("Block is required for submitblock command")
+			cli.gracefullExit()
+		}
+		cli.submitBlock(*submitBlockBlock, *submitBlockRPC)
+	}
+
+	if mineCmd.Parsed() {
+		if *mineAddress == "" || *mineBlocks <= 0 {
+			cli.Logger.Error("Address and blocks are required for mine command")
+			cli.gracefullExit()
+		}
+		cli.mine(*mineAddress, *mineBlocks, *mineRPC)
+	}
+
+	if poolMineCmd.Parsed() {
+		if *poolMineWorker == "" || *poolMineShares <= 0 {
+			cli.Logger.Error("Worker and shares are required for poolmine command")
+			cli.gracefullExit()
+		}
+		cli.poolMine(*poolMineWorker, *poolMinePool, *poolMineShares)
+	}
+
+	if getPoolInfoCmd.Parsed() {
+		cli.getPoolInfo(*getPoolInfoRPC)
 	}
 }
@@ -2,12 +2,73 @@ package config
 
 import (
 	"flag"
-	"github.com/ilyakaznacheev/cleanenv"
+	"fmt"
 	"os"
+
+	"github.com/ilyakaznacheev/cleanenv"
+	"github.com/numbermax/blockchain/internal/services/mempool"
+	"github.com/numbermax/blockchain/internal/services/mining"
 )
 
 type Config struct {
-	Env string `json:"env"`
+	Env    string `json:"env"`
+	Policy Policy `yaml:"policy"`
+	Mining Mining `yaml:"mining"`
+}
+
+// Policy overrides the mempool policy of a node. Settings left out keep
+// the defaults of mempool.DefaultPolicy.
+type Policy struct {
+	MinRelayFeeRate   *int  `yaml:"min_relay_fee_rate"`
+	DustThreshold     *int  `yaml:"dust_threshold"`
+	MaxTxSize         *int  `yaml:"max_tx_size"`
+	MaxInputs         *int  `yaml:"max_inputs"`
+	MaxOutputs        *int  `yaml:"max_outputs"`
+	AcceptNonstandard *bool `yaml:"accept_nonstandard"`
+	MaxAncestors      *int  `yaml:"max_ancestors"`
+	MaxDescendants    *int  `yaml:"max_descendants"`
+}
+
+// Mempool returns the default policy with the settings of p applied.
+func (p *Policy) Mempool() mempool.Policy {
+	policy := mempool.DefaultPolicy()
+	set := func(dst *int, src *int) {
+		if src != nil {
+			*dst = *src
+		}
+	}
+	set(&policy.MinRelayFeeRate, p.MinRelayFeeRate)
+	set(&policy.DustThreshold, p.DustThreshold)
+	set(&policy.MaxTxSize, p.MaxTxSize)
+	set(&policy.MaxInputs, p.MaxInputs)
+	set(&policy.MaxOutputs, p.MaxOutputs)
+	set(&policy.MaxAncestors, p.MaxAncestors)
+	set(&policy.MaxDescendants, p.MaxDescendants)
+	if p.AcceptNonstandard != nil {
+		policy.AcceptNonstandard = *p.AcceptNonstandard
+	}
+
+	return policy
+}
+
+// Mining overrides the limits of the block templates of a node. Settings
+// left out keep the defaults of mining.DefaultLimits.
+type Mining struct {
+	MaxBlockSize   *int `yaml:"max_block_size"`
+	MaxBlockWeight *int `yaml:"max_block_weight"`
+}
+
+// Limits returns the default limits with the settings of m applied.
+func (m *Mining) Limits() mining.Limits {
+	limits := mining.DefaultLimits()
+	if m.MaxBlockSize != nil {
+		limits.MaxBlockSize = *m.MaxBlockSize
+	}
+	if m.MaxBlockWeight != nil {
+		limits.MaxBlockWeight = *m.MaxBlockWeight
+	}
+
+	return limits
 }
 
 func MustLoad() *Config {
@@ -16,17 +77,27 @@ func MustLoad() *Config {
 		panic("config path is empty")
 	}
 
+	config, err := Load(configPath)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	return config
+}
+
+// Load reads the config file at configPath.
+func Load(configPath string) (*Config, error) {
 	if _, err := os.Stat(configPath); os.IsNotExist(err) {
-		panic("config file does not exist: " + configPath)
+		return nil, fmt.Errorf("config file does not exist: %s", configPath)
 	}
 
 	var config Config
 
 	if err := cleanenv.ReadConfig(configPath, &config); err != nil {
-		panic("failed to read config file: " + err.Error())
+		return nil, fmt.Errorf("failed to read config file: %w", err)
 	}
 
-	return &config
+	return &config, nil
 }
 
 func fetchConfig() string {
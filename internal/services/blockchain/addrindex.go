@@ -0,0 +1,188 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"sort"
+
+	"github.com/numbermax/blockchain/internal/services/wallet"
+)
+
+const addrIndexName = "addr"
+
+// AddressTx is a main chain transaction as seen from one address, or from a
+// set of addresses once merged by GetAddressHistory.
+type AddressTx struct {
+	TxID           []byte
+	Height         int
+	Coinbase       bool
+	Received       int
+	Spent          int
+	Counterparties [][]byte
+}
+
+// Net is the change in balance the transaction caused.
+func (a *AddressTx) Net() int {
+	return a.Received - a.Spent
+}
+
+func (a *AddressTx) Serialize() []byte {
+	var res bytes.Buffer
+	err := gob.NewEncoder(&res).Encode(a)
+	ErrHandle(err)
+
+	return res.Bytes()
+}
+
+func DeserializeAddressTx(data []byte) *AddressTx {
+	var entry AddressTx
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&entry)
+	ErrHandle(err)
+
+	return &entry
+}
+
+// addrIndex records, for every public key hash, the transactions that paid
+// into it or spent from it. Keys are the hash followed by the height and the
+// transaction ID so one address iterates in chain order. Hashes are not
+// length prefixed, so the keys of one hash may start with another.
+type addrIndex struct{}
+
+func (*addrIndex) Name() string {
+	return addrIndexName
+}
+
+func (*addrIndex) ConnectBlock(_ *BlockChain, batch *Batch, block *Block, height int, undo *BlockUndo) error {
+	prev := spentOutputs(block, undo)
+
+	for _, tx := range block.Transactions {
+		entries := make(map[string]*AddressTx)
+		entry := func(pubKeyHash []byte) *AddressTx {
+			e, ok := entries[string(pubKeyHash)]
+			if !ok {
+				e = &AddressTx{TxID: tx.ID, Height: height, Coinbase: tx.IsCoinbase()}
+				entries[string(pubKeyHash)] = e
+			}
+			return e
+		}
+
+		if !tx.IsCoinbase() {
+			for _, in := range tx.Inputs {
+				out, ok := prev[outpointKey(in.ID, in.Out)]
+				if !ok {
+					return errors.New("missing previous output for " + outpointKey(in.ID, in.Out))
+				}
+				entry(wallet.PublicKeyHash(in.PublicKey)).Spent += out.Value
+			}
+		}
+		for _, out := range tx.Outputs {
+			entry(out.PublicKeyHash).Received += out.Value
+		}
+
+		touched := make([]string, 0, len(entries))
+		for pubKeyHash := range entries {
+			touched = append(touched, pubKeyHash)
+		}
+		sort.Strings(touched)
+
+		for _, pubKeyHash := range touched {
+			e := entries[pubKeyHash]
+			for _, other := range touched {
+				if other != pubKeyHash {
+					e.Counterparties = append(e.Counterparties, []byte(other))
+				}
+			}
+			batch.PutIndex(addrIndexName, addrKey([]byte(pubKeyHash), height, tx.ID), e.Serialize())
+		}
+	}
+
+	return nil
+}
+
+func (*addrIndex) DisconnectBlock(_ *BlockChain, batch *Batch, block *Block, height int) error {
+	for _, tx := range block.Transactions {
+		if !tx.IsCoinbase() {
+			for _, in := range tx.Inputs {
+				batch.DeleteIndex(addrIndexName, addrKey(wallet.PublicKeyHash(in.PublicKey), height, tx.ID))
+			}
+		}
+		for _, out := range tx.Outputs {
+			batch.DeleteIndex(addrIndexName, addrKey(out.PublicKeyHash, height, tx.ID))
+		}
+	}
+
+	return nil
+}
+
+// GetAddressHistory returns every main chain transaction touching one of
+// pubKeyHashes, newest first. Transfers between the given hashes net out,
+// so passing all addresses of a wallet yields the wallet's own history.
+func (chain *BlockChain) GetAddressHistory(pubKeyHashes [][]byte) ([]*AddressTx, error) {
+	if !chain.HasIndex(addrIndexName) {
+		return nil, errors.New("address index is not enabled, run reindex -addrindex")
+	}
+
+	own := make(map[string]bool)
+	for _, pubKeyHash := range pubKeyHashes {
+		own[string(pubKeyHash)] = true
+	}
+
+	merged := make(map[string]*AddressTx)
+	for _, pubKeyHash := range pubKeyHashes {
+		err := chain.Store.ForEachIndex(addrIndexName, pubKeyHash, func(key, value []byte) error {
+			e := DeserializeAddressTx(value)
+			if !bytes.Equal(key, addrKey(pubKeyHash, e.Height, e.TxID)) {
+				// a longer hash starting with pubKeyHash
+				return nil
+			}
+			id := hex.EncodeToString(e.TxID)
+
+			m, ok := merged[id]
+			if !ok {
+				m = &AddressTx{TxID: e.TxID, Height: e.Height, Coinbase: e.Coinbase}
+				merged[id] = m
+			}
+			m.Received += e.Received
+			m.Spent += e.Spent
+
+		Counterparties:
+			for _, c := range e.Counterparties {
+				if own[string(c)] {
+					continue
+				}
+				for _, known := range m.Counterparties {
+					if bytes.Equal(known, c) {
+						continue Counterparties
+					}
+				}
+				m.Counterparties = append(m.Counterparties, c)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	history := make([]*AddressTx, 0, len(merged))
+	for _, entry := range merged {
+		history = append(history, entry)
+	}
+	sort.Slice(history, func(i, j int) bool {
+		if history[i].Height != history[j].Height {
+			return history[i].Height > history[j].Height
+		}
+		return bytes.Compare(history[i].TxID, history[j].TxID) < 0
+	})
+
+	return history, nil
+}
+
+func addrKey(pubKeyHash []byte, height int, txID []byte) []byte {
+	key := append(bytes.Clone(pubKeyHash), heightKey(height)...)
+
+	return append(key, txID...)
+}
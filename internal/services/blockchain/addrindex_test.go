@@ -0,0 +1,44 @@
+package blockchain
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/numbermax/blockchain/internal/services/wallet"
+)
+
+// An output locked to a hash that starts with another is not in the
+// history of the shorter one.
+func TestAddressHistoryKeepsToItsHash(t *testing.T) {
+	chain := newTestChain(t, 0)
+	defer chain.Store.Close()
+	if err := chain.EnableIndex(addrIndexName); err != nil {
+		t.Fatal(err)
+	}
+
+	w := wallet.MakeWallet()
+	victim := wallet.PublicKeyHash(w.PublicKey)
+	paid := CoinbaseTx(string(wallet.PublicKeyHashToAddress(victim)), "paid")
+	chain.AddBlock([]*Transaction{paid})
+
+	longer := CoinbaseTx(testAddr, "longer")
+	longer.Outputs[0].PublicKeyHash = append(bytes.Clone(victim), 0x01)
+	longer.ID = longer.Hash()
+	chain.AddBlock([]*Transaction{longer})
+
+	history, err := chain.GetAddressHistory([][]byte{victim})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || !bytes.Equal(history[0].TxID, paid.ID) || history[0].Received != Subsidy {
+		t.Errorf("history of %x holds %d transactions, want only %x", victim, len(history), paid.ID)
+	}
+
+	history, err = chain.GetAddressHistory([][]byte{longer.Outputs[0].PublicKeyHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || !bytes.Equal(history[0].TxID, longer.ID) {
+		t.Errorf("history of the longer hash holds %d transactions, want only %x", len(history), longer.ID)
+	}
+}
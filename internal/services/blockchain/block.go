@@ -6,20 +6,22 @@ import (
 	"encoding/gob"
 )
 
+// BlockVersion is the version of newly mined blocks. Version 1 blocks commit
+// to their transactions with a Merkle root and to the version itself in the
+// proof of work; blocks without a version hash the joined transaction IDs.
+const BlockVersion = 1
+
 type Block struct {
 	Hash         []byte
 	Transactions []*Transaction
 	PrevHash     []byte
 	Nonce        int
+	Version      int
 }
 
 func CreateBlock(txs []*Transaction, prevHash []byte) *Block {
-	block := &Block{[]byte{}, (txs), prevHash, 0}
-	pow := NewProof(block)
-
-	nonce, hash := pow.Run()
-	block.Hash = hash
-	block.Nonce = nonce
+	block := &Block{[]byte{}, (txs), prevHash, 0, BlockVersion}
+	Engine().Seal(block, nil)
 
 	return block
 }
@@ -35,6 +37,9 @@ func (b *Block) HashTransactions() []byte {
 	for _, tx := range b.Transactions {
 		txHashes = append(txHashes, tx.ID)
 	}
+	if b.Version >= 1 {
+		return MerkleRoot(txHashes)
+	}
 	txHash = sha256.Sum256(bytes.Join(txHashes, []byte{}))
 
 	return txHash[:]
@@ -63,3 +68,39 @@ func ErrHandle(err error) {
 		panic("error occurred: " + err.Error())
 	}
 }
+
+// BlockHeader is what remains of a block once its body is pruned: enough to
+// link it into the chain and check its seal.
+type BlockHeader struct {
+	Hash     []byte
+	PrevHash []byte
+	TxHash   []byte
+	Nonce    int
+	Version  int
+}
+
+func (b *Block) Header() *BlockHeader {
+	return &BlockHeader{
+		Hash:     b.Hash,
+		PrevHash: b.PrevHash,
+		TxHash:   b.HashTransactions(),
+		Nonce:    b.Nonce,
+		Version:  b.Version,
+	}
+}
+
+func (h *BlockHeader) Serialize() []byte {
+	var res bytes.Buffer
+	err := gob.NewEncoder(&res).Encode(h)
+	ErrHandle(err)
+
+	return res.Bytes()
+}
+
+func DeserializeHeader(data []byte) *BlockHeader {
+	var header BlockHeader
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&header)
+	ErrHandle(err)
+
+	return &header
+}
@@ -1,16 +1,15 @@
 package blockchain
 
 import (
-	"bytes"
 	"crypto/ecdsa"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"runtime"
-
-	"github.com/dgraph-io/badger"
+	"sync"
 )
 
 const (
@@ -23,194 +22,196 @@ const (
 type BlockChain struct {
 	logger   slog.Logger
 	LastHash []byte
-	Database *badger.DB
+	Store    ChainStore
+	indexers []Indexer
+
+	// snapshot is set for a chain started from a UTXO snapshot. It is
+	// shared with the background validation, hence the mutex.
+	snapshotMu sync.Mutex
+	snapshot   *SnapshotState
+	// historyAdded wakes the background validation when a block below the
+	// snapshot base is stored.
+	historyAdded chan struct{}
 }
 
 type BlockChainIterator struct {
 	CurrentHash []byte
-	Database    *badger.DB
+	Store       ChainStore
 }
 
 func (chain *BlockChain) AddBlock(transactions []*Transaction) {
-	var lastHash []byte
-	err := chain.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(lastHashKey))
-		ErrHandle(err)
-		err = item.Value(func(val []byte) error {
-			lastHash = val
-			return nil
-		})
-		ErrHandle(err)
-		return nil
-	})
-	new := CreateBlock(transactions, lastHash)
-	ErrHandle(err)
-	slog.Info("Adding new block", slog.String("hash", fmt.Sprintf("%x", new.Hash)))
-	err = chain.Database.Update(func(txn *badger.Txn) error {
-		err := txn.Set(new.Hash, new.Serialize())
-		ErrHandle(err)
-		chain.LastHash = new.Hash
-		return nil
-	})
-	ErrHandle(err)
-
-	err = chain.Database.Update(func(txn *badger.Txn) error {
-		err := txn.Set([]byte(lastHashKey), new.Hash)
-		ErrHandle(err)
-		return err
-	})
-	ErrHandle(err)
-}
-
-func (chain *BlockChain) FindUnspentTransactions(pubHash []byte) []Transaction {
-	var unspentTxs []Transaction
-
-	spentTxOs := make(map[string][]int)
-
-	iter := chain.Iterator()
-
-	for {
-		block := iter.Next()
-
-		for _, tx := range block.Transactions {
-			txID := hex.EncodeToString(tx.ID)
-
-		Outputs:
-			for outIdx, out := range tx.Outputs {
-				if spentTxOs[txID] != nil {
-					for _, spentOut := range spentTxOs[txID] {
-						if spentOut == outIdx {
-							continue Outputs
-						}
-					}
-				}
-				if out.IsLockedWithKey(pubHash) {
-					unspentTxs = append(unspentTxs, *tx)
-				}
-			}
-			if tx.IsCoinbase() == false {
-				for _, in := range tx.Inputs {
-					if in.UsesKey(pubHash) {
-						inTxId := hex.EncodeToString(in.ID)
-						spentTxOs[inTxId] = append(spentTxOs[inTxId], in.Out)
-					}
-				}
-			}
-		}
-
-		if len(block.PrevHash) == 0 {
-			break
-		}
-	}
+	new := CreateBlock(transactions, chain.LastHash)
+	chain.logger.Info("Adding new block", slog.String("hash", fmt.Sprintf("%x", new.Hash)))
 
-	return unspentTxs
+	ErrHandle(chain.connectTip(new))
 }
 
 func (chain *BlockChain) FindUTXO(pubHash []byte) []TxOutput {
 	var UTXOs []TxOutput
-	unspentTransactions := chain.FindUnspentTransactions(pubHash)
 
-	for _, tx := range unspentTransactions {
-		for _, out := range tx.Outputs {
-			if out.IsLockedWithKey(pubHash) {
-				UTXOs = append(UTXOs, out)
-			}
+	err := chain.Store.ForEachUTXO(func(_ []byte, _ int, out TxOutput) error {
+		if out.IsLockedWithKey(pubHash) {
+			UTXOs = append(UTXOs, out)
 		}
-	}
+		return nil
+	})
+	ErrHandle(err)
 
 	return UTXOs
 }
 
 func (chain *BlockChain) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int) {
 	unspentOuts := make(map[string][]int)
-	unspentTxs := chain.FindUnspentTransactions(pubKeyHash)
 	accumulated := 0
 
-Work:
-	for _, tx := range unspentTxs {
-		txID := hex.EncodeToString(tx.ID)
-
-		for outIdx, out := range tx.Outputs {
-			if out.IsLockedWithKey(pubKeyHash) && accumulated < amount {
-				accumulated += out.Value
-				unspentOuts[txID] = append(unspentOuts[txID], outIdx)
-
-				if accumulated >= amount {
-					break Work
-				}
-			}
+	err := chain.Store.ForEachUTXO(func(txID []byte, outIdx int, out TxOutput) error {
+		if accumulated >= amount {
+			return errStopIteration
+		}
+		if out.IsLockedWithKey(pubKeyHash) {
+			id := hex.EncodeToString(txID)
+			accumulated += out.Value
+			unspentOuts[id] = append(unspentOuts[id], outIdx)
 		}
+		return nil
+	})
+	if !errors.Is(err, errStopIteration) {
+		ErrHandle(err)
 	}
 
 	return accumulated, unspentOuts
 }
 
 func InitBlockChain(logger slog.Logger, address string) *BlockChain {
+	if DbExists() {
+		logger.Info("Database already exists")
+		runtime.Goexit()
+	}
+
+	store, err := NewBadgerStore(dbPath)
+	ErrHandle(err)
+
+	return InitBlockChainWithStore(logger, store, address)
+}
+
+// InitBlockChainWithStore mines the genesis block for address into an empty store.
+func InitBlockChainWithStore(logger slog.Logger, store ChainStore, address string) *BlockChain {
 	op := "services.blockchain.blockchain.InitBlockChain"
-	var lastHash []byte
 	logger.With(slog.String("operation", op))
 
+	cbtx := CoinbaseTx(address, genesisData)
+	fmt.Println("No existing blockchain found, creating genesis block...")
+	genesis := Genesis(cbtx)
+	fmt.Println("Genesis block created with hash:", genesis.Hash)
+
+	chain := &BlockChain{
+		logger: logger,
+		Store:  store,
+	}
+	// the store is empty, this only stamps the chain state version
+	ErrHandle(chain.wipeChainState())
+	ErrHandle(chain.connectTip(genesis))
+
+	return chain
+}
+
+// InitBlockChainFromGenesis starts a chain from a genesis block made
+// elsewhere, validating it first.
+func InitBlockChainFromGenesis(logger slog.Logger, genesis *Block) *BlockChain {
 	if DbExists() {
 		logger.Info("Database already exists")
 		runtime.Goexit()
 	}
 
-	opts := badger.DefaultOptions(dbPath)
-
-	db, err := badger.Open(opts)
+	store, err := NewBadgerStore(dbPath)
 	ErrHandle(err)
 
-	err = db.Update(func(txn *badger.Txn) error {
-		cbtx := CoinbaseTx(address, genesisData)
-		fmt.Println("No existing blockchain found, creating genesis block...")
-		genesis := Genesis(cbtx)
-		fmt.Println("Genesis block created with hash:", genesis.Hash)
-		err = txn.Set(genesis.Hash, genesis.Serialize())
+	chain, err := InitBlockChainFromGenesisWithStore(logger, store, genesis)
+	if err != nil {
+		store.Close()
 		ErrHandle(err)
-		lastHash = genesis.Hash
-		err = txn.Set([]byte(lastHashKey), genesis.Hash)
+	}
 
-		return err
-	})
+	return chain
+}
 
+// InitBlockChainFromGenesisWithStore starts a chain from genesis in an empty
+// store.
+func InitBlockChainFromGenesisWithStore(logger slog.Logger, store ChainStore, genesis *Block) (*BlockChain, error) {
+	if len(genesis.PrevHash) != 0 {
+		return nil, fmt.Errorf("block %x is not a genesis block", genesis.Hash)
+	}
+	if err := CheckProofOfWork(genesis); err != nil {
+		return nil, err
+	}
+	if err := CheckTransactions(genesis); err != nil {
+		return nil, err
+	}
+
+	chain := &BlockChain{
+		logger: logger,
+		Store:  store,
+	}
+	// the store is empty, so this checks the genesis spends nothing
+	if err := chain.CheckBlockInputs(genesis); err != nil {
+		return nil, err
+	}
+	if err := chain.wipeChainState(); err != nil {
+		return nil, err
+	}
+	if err := chain.connectTip(genesis); err != nil {
+		return nil, err
+	}
+
+	return chain, nil
+}
+
+// LoadSnapshot starts a new chain from the UTXO snapshot in r, which must be
+// taken at the block blockHash.
+func LoadSnapshot(logger slog.Logger, blockHash []byte, r io.Reader) *BlockChain {
+	if DbExists() {
+		logger.Info("Database already exists")
+		runtime.Goexit()
+	}
+
+	store, err := NewBadgerStore(dbPath)
 	ErrHandle(err)
 
-	return &BlockChain{
-		LastHash: lastHash,
-		Database: db,
+	chain, err := LoadSnapshotWithStore(logger, store, blockHash, r)
+	if err != nil {
+		// a half loaded set is of no use, start over next time
+		store.Close()
+		os.RemoveAll(dbPath)
+		ErrHandle(err)
 	}
+
+	return chain
 }
 
 func ContinueBlockChain(logger slog.Logger, address string) *BlockChain {
-	op := "services.blockchain.blockchain.InitBlockChain"
-	var lastHash []byte
-	logger.With(slog.String("operation", op))
-
 	if !DbExists() {
 		fmt.Println("No existing blockchain, create one")
 		runtime.Goexit()
 	}
 
-	opts := badger.DefaultOptions(dbPath)
-	db, err := badger.Open(opts)
+	store, err := NewBadgerStore(dbPath)
 	ErrHandle(err)
 
-	err = db.Update(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(lastHashKey))
-		ErrHandle(err)
-		err = item.Value(func(val []byte) error {
-			lastHash = val
-			return nil
-		})
+	return ContinueBlockChainWithStore(logger, store)
+}
 
-		return err
-	})
+// ContinueBlockChainWithStore opens the chain already held by store.
+func ContinueBlockChainWithStore(logger slog.Logger, store ChainStore) *BlockChain {
+	op := "services.blockchain.blockchain.ContinueBlockChain"
+	logger.With(slog.String("operation", op))
 
-	return &BlockChain{
-		logger:   logger,
-		LastHash: lastHash,
-		Database: db,
+	chain := &BlockChain{
+		logger: logger,
+		Store:  store,
 	}
+	ErrHandle(chain.checkConsistency())
+
+	return chain
 }
 
 func DbExists() bool {
@@ -224,26 +225,12 @@ func DbExists() bool {
 func (chain *BlockChain) Iterator() *BlockChainIterator {
 	return &BlockChainIterator{
 		CurrentHash: chain.LastHash,
-		Database:    chain.Database,
+		Store:       chain.Store,
 	}
 }
 
 func (iter *BlockChainIterator) Next() *Block {
-	var block *Block
-
-	err := iter.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(iter.CurrentHash)
-		ErrHandle(err)
-
-		err = item.Value(func(val []byte) error {
-			block = Deserialize(val)
-
-			return nil
-		})
-
-		return err
-	})
-
+	block, err := iter.Store.GetBlock(iter.CurrentHash)
 	ErrHandle(err)
 
 	iter.CurrentHash = block.PrevHash
@@ -252,44 +239,33 @@ func (iter *BlockChainIterator) Next() *Block {
 }
 
 func (bc *BlockChain) FindTransaction(Id []byte) (Transaction, error) {
-	iter := bc.Iterator()
-
-	for {
-		block := iter.Next()
-
-		for _, tx := range block.Transactions {
-			if bytes.Compare(tx.ID, Id) == 0 {
-				return *tx, nil
-			}
-		}
-
-		if len(block.PrevHash) == 0 {
-			break
-		}
+	tx, _, _, err := bc.GetTransaction(Id)
+	if err != nil {
+		return Transaction{}, err
 	}
-	return Transaction{}, errors.New("Transaction does not exist")
+
+	return *tx, nil
 }
 
 func (bc *BlockChain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) {
-	prevTXs := make(map[string]Transaction)
-
-	for _, in := range tx.Inputs {
-		prevTX, err := bc.FindTransaction(in.ID)
-		ErrHandle(err)
-		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
-	}
-
-	tx.Sign(privKey, prevTXs)
+	tx.Sign(privKey, bc.prevOutputs(tx))
 }
 
 func (bc *BlockChain) VerifyTransaction(tx *Transaction, privKey ecdsa.PrivateKey) bool {
+	return tx.Verify(bc.prevOutputs(tx))
+}
+
+// prevOutputs looks up the outputs tx spends in the UTXO set, in the form
+// Sign and Verify expect. The full previous transactions are not needed, so
+// this works for outputs created before a loaded snapshot too.
+func (bc *BlockChain) prevOutputs(tx *Transaction) map[string]Transaction {
 	prevTXs := make(map[string]Transaction)
 
 	for _, in := range tx.Inputs {
-		prevTX, err := bc.FindTransaction(in.ID)
+		out, err := bc.Store.GetUTXO(in.ID, in.Out)
 		ErrHandle(err)
-		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+		addPrevOutput(prevTXs, in, out)
 	}
 
-	return tx.Verify(prevTXs)
+	return prevTXs
 }
@@ -0,0 +1,198 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+const (
+	bootstrapVersion = 1
+	// maxBootstrapBlockSize bounds a single record so a corrupt length does
+	// not allocate without limit.
+	maxBootstrapBlockSize = 32 << 20
+)
+
+// bootstrapMagic starts every bootstrap file.
+var bootstrapMagic = [4]byte{'B', 'C', 'B', 'S'}
+
+// BootstrapHeader starts a bootstrap file, written big-endian after the
+// magic. It is followed by the blocks from height From to To, each as a
+// big-endian uint32 length and the serialized block.
+type BootstrapHeader struct {
+	Version uint32
+	Network uint32
+	Genesis [32]byte
+	From    uint64
+	To      uint64
+}
+
+// ImportReport is the outcome of ImportChain.
+type ImportReport struct {
+	Imported int
+	Known    int
+	Height   int
+}
+
+// BootstrapReader reads the blocks of a bootstrap file in order.
+type BootstrapReader struct {
+	Header BootstrapHeader
+	r      io.Reader
+	// height is the height of the next block
+	height int
+}
+
+// ExportChain writes the main chain blocks from height from to height to to
+// w as a bootstrap file. A negative to means the tip. It returns the number
+// of blocks written.
+func (chain *BlockChain) ExportChain(w io.Writer, from, to int) (int, error) {
+	best := chain.GetBestHeight()
+	if to < 0 || to > best {
+		to = best
+	}
+	if from < 0 || from > to {
+		return 0, fmt.Errorf("invalid height range %d to %d", from, to)
+	}
+
+	genesis, err := chain.genesisHash()
+	if err != nil {
+		return 0, err
+	}
+
+	header := BootstrapHeader{
+		Version: bootstrapVersion,
+		Network: ActiveNetwork().Magic,
+		From:    uint64(from),
+		To:      uint64(to),
+	}
+	copy(header.Genesis[:], genesis)
+
+	if _, err := w.Write(bootstrapMagic[:]); err != nil {
+		return 0, err
+	}
+	if err := binary.Write(w, binary.BigEndian, &header); err != nil {
+		return 0, err
+	}
+
+	written := 0
+	for height := from; height <= to; height++ {
+		block, err := chain.GetBlockByHeight(height)
+		if err != nil {
+			return written, err
+		}
+
+		data := block.Serialize()
+		if err := binary.Write(w, binary.BigEndian, uint32(len(data))); err != nil {
+			return written, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return written, err
+		}
+		written++
+	}
+
+	return written, nil
+}
+
+// NewBootstrapReader reads and checks the header of a bootstrap file.
+func NewBootstrapReader(r io.Reader) (*BootstrapReader, error) {
+	var magic [4]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil || magic != bootstrapMagic {
+		return nil, errors.New("not a bootstrap file")
+	}
+
+	br := &BootstrapReader{r: r}
+	if err := binary.Read(r, binary.BigEndian, &br.Header); err != nil {
+		return nil, fmt.Errorf("bootstrap header: %w", err)
+	}
+	br.height = int(br.Header.From)
+	if br.Header.Version != bootstrapVersion {
+		return nil, fmt.Errorf("unsupported bootstrap version %d", br.Header.Version)
+	}
+	if magic := ActiveNetwork().Magic; br.Header.Network != magic {
+		return nil, fmt.Errorf("bootstrap file is for network %08x, not %08x", br.Header.Network, magic)
+	}
+
+	return br, nil
+}
+
+// Next returns the next block and its height, or io.EOF after the last one.
+func (br *BootstrapReader) Next() (*Block, int, error) {
+	height := br.height
+
+	var size uint32
+	if err := binary.Read(br.r, binary.BigEndian, &size); err != nil {
+		return nil, height, err
+	}
+	if size > maxBootstrapBlockSize {
+		return nil, height, fmt.Errorf("bootstrap block of %d bytes is too large", size)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(br.r, data); err != nil {
+		return nil, height, fmt.Errorf("bootstrap block: %w", io.ErrUnexpectedEOF)
+	}
+	br.height++
+
+	block, err := DeserializeBlock(data)
+
+	return block, height, err
+}
+
+// ImportChain feeds every block of br through ProcessBlock, the same checks a
+// block from a peer goes through. Blocks already stored are skipped.
+func (chain *BlockChain) ImportChain(br *BootstrapReader) (*ImportReport, error) {
+	report := &ImportReport{}
+	defer func() {
+		report.Height = chain.GetBestHeight()
+	}()
+
+	genesis, err := chain.genesisHash()
+	if err != nil {
+		return report, err
+	}
+	if !bytes.Equal(genesis, br.Header.Genesis[:]) {
+		return report, fmt.Errorf("bootstrap file starts from genesis %x, this chain from %x", br.Header.Genesis, genesis)
+	}
+
+	for {
+		block, height, err := br.Next()
+		if errors.Is(err, io.EOF) {
+			return report, nil
+		}
+		if err != nil {
+			return report, fmt.Errorf("block at height %d: %w", height, err)
+		}
+
+		err = chain.ProcessBlock(block)
+		switch {
+		case errors.Is(err, ErrBlockKnown):
+			report.Known++
+		case err != nil:
+			return report, fmt.Errorf("block at height %d: %w", height, err)
+		default:
+			report.Imported++
+		}
+
+		if (report.Imported+report.Known)%reindexLogInterval == 0 {
+			chain.logger.Info("Importing",
+				slog.Int("height", height),
+				slog.Uint64("to", br.Header.To))
+		}
+	}
+}
+
+// DeserializeBlock is Deserialize for data that may be malformed, such as
+// blocks from a file or a peer.
+func DeserializeBlock(data []byte) (*Block, error) {
+	var block Block
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&block); err != nil {
+		return nil, fmt.Errorf("malformed block: %w", err)
+	}
+
+	return &block, nil
+}
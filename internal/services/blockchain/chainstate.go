@@ -0,0 +1,486 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+)
+
+const (
+	chainStateIndex   = "chainstate"
+	undoIndex         = "undo"
+	chainStateVersion = 2
+)
+
+// chainStateIndexes are wiped and rebuilt together with the UTXO set.
+var chainStateIndexes = []string{undoIndex, heightIndex, blockHeightIndex}
+
+// chainStateBestKey holds the block the UTXO set currently reflects. Every
+// connect and disconnect moves it in the same batch as the tip, so the two
+// only disagree after an interrupted repair or on a store written by an
+// older version.
+var chainStateBestKey = []byte("best")
+
+// chainStateVersionKey records the layout of the chain state. A store with a
+// different version has its chain state rebuilt on open.
+var chainStateVersionKey = []byte("version")
+
+// SpentOutput is a previous output consumed by a block.
+type SpentOutput struct {
+	TxID   []byte
+	Out    int
+	Output TxOutput
+}
+
+// BlockUndo holds what is needed to put the UTXO set back as it was before
+// the block was connected.
+type BlockUndo struct {
+	Spent []SpentOutput
+}
+
+func (u *BlockUndo) Serialize() []byte {
+	var res bytes.Buffer
+	err := gob.NewEncoder(&res).Encode(u)
+	ErrHandle(err)
+
+	return res.Bytes()
+}
+
+func DeserializeUndo(data []byte) *BlockUndo {
+	var undo BlockUndo
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&undo)
+	ErrHandle(err)
+
+	return &undo
+}
+
+// spentOutputs returns the previous output of every non-coinbase input of
+// block keyed by outpoint, using undo for outputs from earlier blocks.
+func spentOutputs(block *Block, undo *BlockUndo) map[string]TxOutput {
+	prev := make(map[string]TxOutput)
+
+	for _, s := range undo.Spent {
+		prev[outpointKey(s.TxID, s.Out)] = s.Output
+	}
+	for _, tx := range block.Transactions {
+		for outIdx, out := range tx.Outputs {
+			key := outpointKey(tx.ID, outIdx)
+			if _, ok := prev[key]; !ok {
+				prev[key] = out
+			}
+		}
+	}
+
+	return prev
+}
+
+// connectBlock queues the UTXO changes of block into batch and advances the
+// chain state marker. The caller decides whether the tip moves as well.
+func (chain *BlockChain) connectBlock(batch *Batch, block *Block) error {
+	if chain.snapshotFailed() {
+		return ErrSnapshotInvalid
+	}
+
+	height, err := chain.heightForNewBlock(block)
+	if err != nil {
+		return err
+	}
+
+	created := make(map[string]TxOutput)
+	spent := make(map[string]bool)
+	undo := &BlockUndo{}
+
+	for _, tx := range block.Transactions {
+		if !tx.IsCoinbase() {
+			for _, in := range tx.Inputs {
+				key := outpointKey(in.ID, in.Out)
+				if spent[key] {
+					return fmt.Errorf("block %x spends %s twice", block.Hash, key)
+				}
+				spent[key] = true
+
+				if _, ok := created[key]; !ok {
+					output, err := chain.Store.GetUTXO(in.ID, in.Out)
+					if err != nil {
+						return fmt.Errorf("block %x input %s: %w", block.Hash, key, err)
+					}
+					undo.Spent = append(undo.Spent, SpentOutput{in.ID, in.Out, output})
+				}
+				batch.DeleteUTXO(in.ID, in.Out)
+			}
+		}
+
+		for outIdx, out := range tx.Outputs {
+			created[outpointKey(tx.ID, outIdx)] = out
+			batch.PutUTXO(tx.ID, outIdx, out)
+		}
+	}
+
+	batch.PutIndex(undoIndex, block.Hash, undo.Serialize())
+	batch.PutIndex(heightIndex, heightKey(height), block.Hash)
+	batch.PutIndex(blockHeightIndex, block.Hash, heightKey(height))
+	batch.PutIndex(chainStateIndex, chainStateBestKey, block.Hash)
+	if err := chain.trackPruneSize(batch, block, 1); err != nil {
+		return err
+	}
+
+	for _, idx := range chain.indexers {
+		if err := idx.ConnectBlock(chain, batch, block, height, undo); err != nil {
+			return fmt.Errorf("%s index: %w", idx.Name(), err)
+		}
+		batch.PutIndex(chainStateIndex, indexBestKey(idx.Name()), block.Hash)
+	}
+
+	return nil
+}
+
+// disconnectBlock queues the inverse of connectBlock for block, which must
+// be the block the chain state currently reflects.
+func (chain *BlockChain) disconnectBlock(batch *Batch, block *Block) error {
+	data, err := chain.Store.GetIndex(undoIndex, block.Hash)
+	if err != nil {
+		return fmt.Errorf("undo data for block %x: %w", block.Hash, err)
+	}
+	undo := DeserializeUndo(data)
+
+	height, err := chain.GetBlockHeight(block.Hash)
+	if err != nil {
+		return err
+	}
+
+	for _, tx := range block.Transactions {
+		for outIdx := range tx.Outputs {
+			batch.DeleteUTXO(tx.ID, outIdx)
+		}
+	}
+	for _, s := range undo.Spent {
+		batch.PutUTXO(s.TxID, s.Out, s.Output)
+	}
+
+	batch.DeleteIndex(undoIndex, block.Hash)
+	batch.DeleteIndex(heightIndex, heightKey(height))
+	batch.PutIndex(chainStateIndex, chainStateBestKey, block.PrevHash)
+	if err := chain.trackPruneSize(batch, block, -1); err != nil {
+		return err
+	}
+
+	for _, idx := range chain.indexers {
+		if err := idx.DisconnectBlock(chain, batch, block, height); err != nil {
+			return fmt.Errorf("%s index: %w", idx.Name(), err)
+		}
+		batch.PutIndex(chainStateIndex, indexBestKey(idx.Name()), block.PrevHash)
+	}
+
+	return nil
+}
+
+// connectTip stores block on top of the current tip and applies it to the
+// chain state in a single write.
+func (chain *BlockChain) connectTip(block *Block) error {
+	batch := NewBatch()
+	batch.PutBlock(block)
+	if err := chain.connectBlock(batch, block); err != nil {
+		return err
+	}
+	batch.SetTip(block.Hash)
+
+	if err := chain.Store.Write(batch); err != nil {
+		return err
+	}
+	chain.LastHash = block.Hash
+
+	// the block is in, a failed prune is retried with the next one
+	if err := chain.prune(); err != nil {
+		chain.logger.Error("Pruning failed", slog.String("error", err.Error()))
+	}
+
+	return nil
+}
+
+// DisconnectTip rolls the chain back by one block. The block itself stays
+// in the store.
+func (chain *BlockChain) DisconnectTip() *Block {
+	block, err := chain.Store.GetBlock(chain.LastHash)
+	ErrHandle(err)
+
+	if len(block.PrevHash) == 0 {
+		ErrHandle(errors.New("cannot disconnect the genesis block"))
+	}
+
+	batch := NewBatch()
+	ErrHandle(chain.disconnectBlock(batch, block))
+	batch.SetTip(block.PrevHash)
+	ErrHandle(chain.Store.Write(batch))
+
+	chain.LastHash = block.PrevHash
+
+	return block
+}
+
+// checkConsistency runs when a chain is opened. It makes sure the tip points
+// at a stored block and that the chain state reflects exactly that block,
+// repairing whatever an interrupted write or an older version left behind.
+func (chain *BlockChain) checkConsistency() error {
+	tip, err := chain.Store.GetTip()
+	if err == nil {
+		var ok bool
+		ok, err = chain.Store.HasBlock(tip)
+		if err == nil && !ok {
+			err = ErrNotFound
+		}
+	}
+	if err != nil {
+		chain.logger.Warn("Tip is unusable, searching stored blocks", slog.String("error", err.Error()))
+		tip, err = chain.findBestStoredBlock()
+		if err != nil {
+			return err
+		}
+		batch := NewBatch()
+		batch.SetTip(tip)
+		if err := chain.Store.Write(batch); err != nil {
+			return err
+		}
+	}
+	chain.LastHash = tip
+
+	if state, err := chain.loadReindexState(); err != nil {
+		return err
+	} else if state != nil {
+		// the chain state is half built, only Reindex may move it further
+		chain.logger.Warn("A reindex was interrupted, run reindex to finish it",
+			slog.Int("target_height", state.TargetHeight))
+		return chain.loadIndexesNoCatchUp()
+	}
+
+	if err := chain.loadSnapshot(); err != nil {
+		return err
+	}
+
+	version, err := chain.Store.GetIndex(chainStateIndex, chainStateVersionKey)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if string(version) != strconv.Itoa(chainStateVersion) {
+		chain.logger.Warn("Chain state layout is outdated, rebuilding",
+			slog.String("version", string(version)))
+		if err := chain.wipeChainState(); err != nil {
+			return err
+		}
+	}
+
+	best, err := chain.Store.GetIndex(chainStateIndex, chainStateBestKey)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	if err != nil || !bytes.Equal(best, tip) {
+		chain.logger.Warn("Chain state does not match tip, repairing",
+			slog.String("tip", fmt.Sprintf("%x", tip)),
+			slog.String("state", fmt.Sprintf("%x", best)))
+
+		if err := chain.moveChainState(best, tip); err != nil {
+			return err
+		}
+	}
+
+	return chain.loadIndexes()
+}
+
+// moveChainState applies the blocks between from (empty for nothing
+// applied) and to to the chain state. Each step is its own write so progress
+// survives an interruption.
+func (chain *BlockChain) moveChainState(from, to []byte) error {
+	return chain.walkChain(from, to,
+		func(block *Block) error {
+			batch := NewBatch()
+			if err := chain.disconnectBlock(batch, block); err != nil {
+				return err
+			}
+			return chain.Store.Write(batch)
+		},
+		func(block *Block) error {
+			batch := NewBatch()
+			if err := chain.connectBlock(batch, block); err != nil {
+				return err
+			}
+			return chain.Store.Write(batch)
+		})
+}
+
+// walkChain calls disconnect for every block from block from down to the
+// common ancestor with block to, then connect for every block from that
+// ancestor up to to. An empty from means nothing is applied yet.
+func (chain *BlockChain) walkChain(from, to []byte, disconnect, connect func(block *Block) error) error {
+	onTarget := make(map[string]bool)
+	var path [][]byte
+
+	floors, err := chain.walkFloors()
+	if err != nil {
+		return err
+	}
+
+	for hash := to; len(hash) > 0; {
+		onTarget[string(hash)] = true
+		path = append(path, hash)
+		if floors[string(hash)] {
+			break
+		}
+		block, err := chain.Store.GetBlock(hash)
+		if err != nil {
+			return err
+		}
+		hash = block.PrevHash
+	}
+
+	for len(from) > 0 && !onTarget[string(from)] {
+		block, err := chain.Store.GetBlock(from)
+		if err != nil {
+			return err
+		}
+		if err := disconnect(block); err != nil {
+			return err
+		}
+		from = block.PrevHash
+	}
+
+	i := len(path) - 1
+	if len(from) > 0 {
+		for !bytes.Equal(path[i], from) {
+			i--
+		}
+		i--
+	}
+
+	for ; i >= 0; i-- {
+		block, err := chain.Store.GetBlock(path[i])
+		if err != nil {
+			return err
+		}
+		if err := connect(block); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// walkFloors returns the blocks walkChain never walks below: the base of an
+// unvalidated snapshot and the lowest main chain block a pruned node still
+// has in full.
+func (chain *BlockChain) walkFloors() (map[string]bool, error) {
+	floors := make(map[string]bool)
+
+	if state := chain.Snapshot(); state != nil && !state.Validated {
+		floors[string(state.BaseHash)] = true
+	}
+
+	state, err := chain.PruneState()
+	if err != nil {
+		return nil, err
+	}
+	if state.PrunedHeight >= 0 {
+		hash, err := chain.GetBlockHash(state.PrunedHeight + 1)
+		if err != nil {
+			return nil, err
+		}
+		floors[string(hash)] = true
+	}
+
+	return floors, nil
+}
+
+// wipeChainState drops the UTXO set and everything derived alongside it,
+// leaving an empty chain state stamped with the current version. The
+// deletes span several writes; the stamp goes with the last, so a wipe
+// cut short is done again.
+func (chain *BlockChain) wipeChainState() error {
+	batch := NewBatch()
+
+	err := chain.Store.ForEachUTXO(func(txID []byte, out int, _ TxOutput) error {
+		batch.DeleteUTXO(txID, out)
+		var err error
+		batch, err = chain.writeIfFull(batch)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, index := range chainStateIndexes {
+		if batch, err = chain.clearIndex(batch, index); err != nil {
+			return err
+		}
+	}
+
+	batch.DeleteIndex(chainStateIndex, chainStateBestKey)
+	batch.PutIndex(chainStateIndex, chainStateVersionKey, []byte(strconv.Itoa(chainStateVersion)))
+
+	return chain.Store.Write(batch)
+}
+
+// clearIndex adds the deletes of every entry of index to batch and returns
+// the batch to go on with, what did not fit written already.
+func (chain *BlockChain) clearIndex(batch *Batch, index string) (*Batch, error) {
+	err := chain.Store.ForEachIndex(index, nil, func(key, _ []byte) error {
+		batch.DeleteIndex(index, key)
+		var err error
+		batch, err = chain.writeIfFull(batch)
+		return err
+	})
+
+	return batch, err
+}
+
+// writeIfFull writes batch once it holds snapshotBatchSize writes, which
+// one transaction of the store takes whatever their size, and returns the
+// batch to go on with.
+func (chain *BlockChain) writeIfFull(batch *Batch) (*Batch, error) {
+	if batch.Len() < snapshotBatchSize {
+		return batch, nil
+	}
+	if err := chain.Store.Write(batch); err != nil {
+		return nil, err
+	}
+
+	return NewBatch(), nil
+}
+
+// findBestStoredBlock returns the end of the branch of stored blocks with
+// the most work that reaches back to a genesis block, leaving out blocks
+// marked invalid and their descendants.
+func (chain *BlockChain) findBestStoredBlock() ([]byte, error) {
+	invalid, err := chain.invalidBlocks()
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make(map[string]*blockNode)
+	err = chain.Store.ForEachBlock(func(block *Block) error {
+		nodes[string(block.Hash)] = &blockNode{
+			hash:    block.Hash,
+			prev:    string(block.PrevHash),
+			genesis: len(block.PrevHash) == 0,
+			work:    Engine().Weight(block.Header()),
+			valid:   !invalid[string(block.Hash)],
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	best := bestNode(nodes, nil)
+	if best == nil {
+		return nil, errors.New("no complete chain found in store")
+	}
+
+	return best.hash, nil
+}
+
+func outpointKey(txID []byte, out int) string {
+	return fmt.Sprintf("%s:%d", hex.EncodeToString(txID), out)
+}
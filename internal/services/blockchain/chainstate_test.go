@@ -0,0 +1,105 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"testing"
+)
+
+// storeBranch mines n blocks on top of prev into store and returns them.
+func storeBranch(t *testing.T, store ChainStore, prev []byte, n int, tag string) []*Block {
+	t.Helper()
+
+	var blocks []*Block
+	batch := NewBatch()
+	for i := 0; i < n; i++ {
+		block := CreateBlock([]*Transaction{CoinbaseTx(testAddr, fmt.Sprintf("%s %d", tag, i))}, prev)
+		batch.PutBlock(block)
+		blocks = append(blocks, block)
+		prev = block.Hash
+	}
+	if err := store.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	return blocks
+}
+
+func TestFindBestStoredBlockSkipsInvalidBranch(t *testing.T) {
+	store := NewMemoryStore()
+	chain := &BlockChain{logger: *discardLogger(), Store: store}
+
+	genesis := storeBranch(t, store, []byte{}, 1, "genesis")[0]
+	short := storeBranch(t, store, genesis.Hash, 2, "short")
+	long := storeBranch(t, store, genesis.Hash, 4, "long")
+
+	best, err := chain.findBestStoredBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(best, long[3].Hash) {
+		t.Fatalf("best = %x, want the tip of the branch with the most work %x", best, long[3].Hash)
+	}
+
+	// rejecting a block of the long branch rules out every block after it
+	batch := NewBatch()
+	batch.PutIndex(invalidIndex, long[1].Hash, []byte("rejected"))
+	if err := store.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	best, err = chain.findBestStoredBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(best, short[1].Hash) {
+		t.Errorf("best = %x, want the tip of the valid branch %x", best, short[1].Hash)
+	}
+}
+
+func TestFindBestStoredBlockNeedsGenesis(t *testing.T) {
+	store := NewMemoryStore()
+	chain := &BlockChain{logger: *discardLogger(), Store: store}
+
+	// a branch whose parent was never stored does not reach a genesis
+	storeBranch(t, store, testHash(7), 2, "detached")
+
+	if best, err := chain.findBestStoredBlock(); err == nil {
+		t.Errorf("found %x without a genesis block", best)
+	}
+}
+
+func TestWipeChainStateAboveTxnLimit(t *testing.T) {
+	store := fillBadger(t, overTxnLimit, func(batch *Batch, key []byte) {
+		batch.PutUTXO(key, 0, TxOutput{Value: 1})
+	})
+	batch := NewBatch()
+	batch.PutIndex(chainStateIndex, chainStateBestKey, testHash(1))
+	batch.PutIndex(chainStateIndex, chainStateVersionKey, []byte("1"))
+	if err := store.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	chain := &BlockChain{logger: *discardLogger(), Store: store}
+	if err := chain.wipeChainState(); err != nil {
+		t.Fatal(err)
+	}
+
+	left := 0
+	err := store.ForEachUTXO(func([]byte, int, TxOutput) error {
+		left++
+		return nil
+	})
+	if err != nil || left != 0 {
+		t.Errorf("%d outputs left after the wipe, %v", left, err)
+	}
+	if _, err := store.GetIndex(chainStateIndex, chainStateBestKey); !errors.Is(err, ErrNotFound) {
+		t.Errorf("best chain state marker after the wipe: %v, want ErrNotFound", err)
+	}
+	version, err := store.GetIndex(chainStateIndex, chainStateVersionKey)
+	if err != nil || string(version) != strconv.Itoa(chainStateVersion) {
+		t.Errorf("chain state version = %q, %v, want %d", version, err, chainStateVersion)
+	}
+}
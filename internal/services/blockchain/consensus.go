@@ -0,0 +1,112 @@
+package blockchain
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+)
+
+// ConsensusEngine decides what seals a block and which branch the chain
+// follows. The chain, the UTXO set, wallets and networking leave both to
+// the engine of the network they run on.
+type ConsensusEngine interface {
+	// Seal completes block, setting its nonce and hash, and reports whether
+	// it did before quit was closed; quit may be nil.
+	Seal(block *Block, quit <-chan struct{}) bool
+	// VerifySeal checks that a header hashes to its block hash and is
+	// sealed as the engine asks.
+	VerifySeal(header *BlockHeader) error
+	// CalcNextTarget returns the target of the block on top of parent.
+	CalcNextTarget(parent *BlockHeader) *big.Int
+	// Weight is what a block adds to its branch: the chain follows the
+	// branch weighing the most.
+	Weight(header *BlockHeader) *big.Int
+}
+
+// NetworkParams tell networks apart: by the magic starting their messages,
+// snapshots and bootstrap files, and by the consensus engine their blocks
+// follow.
+type NetworkParams struct {
+	Name   string
+	Magic  uint32
+	Engine ConsensusEngine
+}
+
+var (
+	// MainNetParams are the network the chain has always run on.
+	MainNetParams = &NetworkParams{
+		Name:   "main",
+		Magic:  0x4e4d4243,
+		Engine: NewProofOfWork(Difficulty),
+	}
+	// RegTestParams are a private network to try things out on, whose
+	// blocks take a couple of hashes to seal.
+	RegTestParams = &NetworkParams{
+		Name:   "regtest",
+		Magic:  0x4e4d5254,
+		Engine: NewProofOfWork(1),
+	}
+)
+
+var networks = []*NetworkParams{MainNetParams, RegTestParams}
+
+// activeNetwork is the network the process runs on.
+var activeNetwork = MainNetParams
+
+// SelectNetwork makes the network called name the one the process runs
+// on. It must be called before any chain is opened.
+func SelectNetwork(name string) error {
+	for _, params := range networks {
+		if params.Name == name {
+			activeNetwork = params
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown network %q", name)
+}
+
+// ActiveNetwork returns the parameters of the network the process runs on.
+func ActiveNetwork() *NetworkParams {
+	return activeNetwork
+}
+
+// Engine returns the consensus engine of the network the process runs on.
+func Engine() ConsensusEngine {
+	return activeNetwork.Engine
+}
+
+// outweighsBest reports whether the branch ending at the stored block tip,
+// at height, weighs more than the best chain of headers, both counted from
+// where they split.
+func outweighsBest(headers HeaderSource, tip []byte, height int) (bool, error) {
+	engine := Engine()
+	branch, best := new(big.Int), new(big.Int)
+
+	hash := tip
+	for ; height >= 0; height-- {
+		if onBest, err := headers.GetBlockHash(height); err == nil && bytes.Equal(onBest, hash) {
+			break
+		}
+		header, err := headers.GetBlockHeader(hash)
+		if err != nil {
+			return false, err
+		}
+		branch.Add(branch, engine.Weight(header))
+		hash = header.PrevHash
+	}
+
+	for h := height + 1; h <= headers.GetBestHeight(); h++ {
+		hash, err := headers.GetBlockHash(h)
+		if err != nil {
+			return false, err
+		}
+		header, err := headers.GetBlockHeader(hash)
+		if err != nil {
+			return false, err
+		}
+		best.Add(best, engine.Weight(header))
+	}
+
+	return branch.Cmp(best) > 0, nil
+}
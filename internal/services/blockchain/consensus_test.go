@@ -0,0 +1,152 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"testing"
+)
+
+// testEngine seals a block by hashing its header, with no work to do. The
+// nonce of a block is its weight, a block left at nonce 0 is not sealed.
+type testEngine struct{}
+
+var errUnsealed = errors.New("block is not sealed")
+
+func (testEngine) hash(header *BlockHeader) []byte {
+	return NewProofOfWork(0).Hash(header)
+}
+
+func (e testEngine) Seal(block *Block, _ <-chan struct{}) bool {
+	if block.Nonce == 0 {
+		block.Nonce = 1
+	}
+	block.Hash = e.hash(block.Header())
+
+	return true
+}
+
+func (e testEngine) VerifySeal(header *BlockHeader) error {
+	if !bytes.Equal(e.hash(header), header.Hash) {
+		return rejectf(RejectBadHash, "block hash %x does not match its header", header.Hash)
+	}
+	if header.Nonce <= 0 {
+		return rejectf(RejectHighHash, "block %x: %w", header.Hash, errUnsealed)
+	}
+
+	return nil
+}
+
+func (testEngine) CalcNextTarget(*BlockHeader) *big.Int {
+	return big.NewInt(0)
+}
+
+func (testEngine) Weight(header *BlockHeader) *big.Int {
+	return big.NewInt(int64(header.Nonce))
+}
+
+// useTestEngine runs the rest of the test on a network following
+// testEngine.
+func useTestEngine(t *testing.T) {
+	t.Helper()
+
+	active := activeNetwork
+	activeNetwork = &NetworkParams{Name: "test", Magic: 0x4e4d5445, Engine: testEngine{}}
+	t.Cleanup(func() { activeNetwork = active })
+}
+
+// weighing returns a block on prev weighing weight.
+func weighing(prev []byte, weight int, data string) *Block {
+	block := &Block{
+		Transactions: []*Transaction{CoinbaseTx(testAddr, data)},
+		PrevHash:     prev,
+		Nonce:        weight,
+		Version:      BlockVersion,
+	}
+	Engine().Seal(block, nil)
+
+	return block
+}
+
+func TestForkChoiceFollowsWeight(t *testing.T) {
+	useTestEngine(t)
+	chain := newTestChain(t, 3)
+	defer chain.Store.Close()
+	genesis, err := chain.GetBlockHash(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := chain.LastHash
+
+	tests := []struct {
+		name   string
+		block  *Block
+		tip    func(block *Block) []byte
+		reject RejectCode
+	}{
+		{
+			// three blocks weighing 1 against two
+			name:  "lighter short branch",
+			block: weighing(genesis, 2, "light"),
+			tip:   func(*Block) []byte { return long },
+		},
+		{
+			name:  "heavier short branch",
+			block: weighing(genesis, 4, "heavy"),
+			tip:   func(block *Block) []byte { return block.Hash },
+		},
+		{
+			name: "bad hash",
+			block: func() *Block {
+				block := weighing(chain.LastHash, 1, "bad hash")
+				block.Nonce = 100
+				return block
+			}(),
+			reject: RejectBadHash,
+		},
+		{
+			name: "unsealed",
+			block: func() *Block {
+				block := &Block{Transactions: []*Transaction{CoinbaseTx(testAddr, "unsealed")}, PrevHash: long, Version: BlockVersion}
+				block.Hash = testEngine{}.hash(block.Header())
+				return block
+			}(),
+			reject: RejectHighHash,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := chain.LastHash
+			err := chain.ProcessBlock(tt.block)
+			if tt.reject != "" {
+				if code := RejectCodeOf(err); code != tt.reject {
+					t.Errorf("block rejected with %q (%v), want %q", code, err, tt.reject)
+				}
+				if !bytes.Equal(chain.LastHash, before) {
+					t.Error("tip moved onto a rejected block")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := tt.tip(tt.block); !bytes.Equal(chain.LastHash, want) {
+				t.Errorf("tip %x, want %x", chain.LastHash, want)
+			}
+		})
+	}
+
+	// with the tip lost the heaviest stored branch is found again, not the
+	// longest
+	best, err := chain.findBestStoredBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(best, chain.LastHash) {
+		t.Errorf("best stored block %x, want the heavy tip %x", best, chain.LastHash)
+	}
+	if height := chain.GetBestHeight(); height != 1 {
+		t.Errorf("best height %d, want 1", height)
+	}
+}
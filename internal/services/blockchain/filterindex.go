@@ -0,0 +1,212 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+const (
+	filterIndexName = "filter"
+	// filterHeaderIndex keeps, in a light client's header store, the filter
+	// header of every block whose filter was checked.
+	filterHeaderIndex = "filterheader"
+)
+
+// BlockFilter is the compact filter of a block with its filter header,
+// which commits to the filter and to the filter header of the previous
+// block.
+type BlockFilter struct {
+	BlockHash []byte `json:"block_hash"`
+	Filter    []byte `json:"filter"`
+	Header    []byte `json:"header"`
+}
+
+// filterIndex stores a Golomb-coded set per main chain block over the public
+// key hashes it pays and the outpoints it spends, so a light wallet can tell
+// which blocks concern it without naming its addresses. Values are the
+// filter header followed by the filter.
+type filterIndex struct{}
+
+func (*filterIndex) Name() string {
+	return filterIndexName
+}
+
+func (*filterIndex) ConnectBlock(chain *BlockChain, batch *Batch, block *Block, _ int, _ *BlockUndo) error {
+	prev := make([]byte, sha256.Size)
+	if len(block.PrevHash) != 0 {
+		data, err := chain.Store.GetIndex(filterIndexName, block.PrevHash)
+		if err != nil {
+			return fmt.Errorf("filter of block %x: %w", block.PrevHash, err)
+		}
+		prev = data[:sha256.Size]
+	}
+
+	filter := NewBlockFilter(block)
+	header := FilterHeader(filter, prev)
+	batch.PutIndex(filterIndexName, block.Hash, append(header, filter...))
+
+	return nil
+}
+
+func (*filterIndex) DisconnectBlock(_ *BlockChain, batch *Batch, block *Block, _ int) error {
+	batch.DeleteIndex(filterIndexName, block.Hash)
+
+	return nil
+}
+
+// NewBlockFilter builds the compact filter of block, keyed by its hash.
+func NewBlockFilter(block *Block) []byte {
+	var items [][]byte
+	for _, tx := range block.Transactions {
+		if !tx.IsCoinbase() {
+			for _, in := range tx.Inputs {
+				items = append(items, outpointBytes(in.ID, in.Out))
+			}
+		}
+		for _, out := range tx.Outputs {
+			if len(out.PublicKeyHash) != 0 {
+				items = append(items, out.PublicKeyHash)
+			}
+		}
+	}
+
+	return BuildGCS(block.Hash, items)
+}
+
+// FilterHeader chains filter onto the filter header of the previous block,
+// all zeros for the genesis block.
+func FilterHeader(filter, prevHeader []byte) []byte {
+	filterHash := sha256.Sum256(filter)
+	header := sha256.Sum256(append(filterHash[:], prevHeader...))
+
+	return header[:]
+}
+
+// GetBlockFilter returns the filter of a main chain block.
+func (chain *BlockChain) GetBlockFilter(hash []byte) (*BlockFilter, error) {
+	if !chain.HasIndex(filterIndexName) {
+		return nil, errors.New("the filter index is not enabled")
+	}
+
+	data, err := chain.Store.GetIndex(filterIndexName, hash)
+	if err != nil {
+		return nil, fmt.Errorf("filter of block %x: %w", hash, err)
+	}
+
+	return &BlockFilter{
+		BlockHash: hash,
+		Header:    data[:sha256.Size],
+		Filter:    data[sha256.Size:],
+	}, nil
+}
+
+// AddFilter checks a block filter against the filter header chain of the
+// light client and records its header. The filter of the previous block must
+// have been added first, and a filter seen before must not have changed.
+func (headers *HeaderChain) AddFilter(filter *BlockFilter) error {
+	header, err := headers.GetBlockHeader(filter.BlockHash)
+	if err != nil {
+		return err
+	}
+
+	prev := make([]byte, sha256.Size)
+	if len(header.PrevHash) != 0 {
+		prev, err = headers.Store.GetIndex(filterHeaderIndex, header.PrevHash)
+		if err != nil {
+			return fmt.Errorf("filter header of block %x: %w", header.PrevHash, err)
+		}
+	}
+
+	computed := FilterHeader(filter.Filter, prev)
+	if !bytes.Equal(computed, filter.Header) {
+		return fmt.Errorf("filter of block %x does not match its filter header", filter.BlockHash)
+	}
+
+	known, err := headers.Store.GetIndex(filterHeaderIndex, filter.BlockHash)
+	if err == nil && !bytes.Equal(known, computed) {
+		return fmt.Errorf("filter of block %x differs from the one checked before", filter.BlockHash)
+	}
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	batch := NewBatch()
+	batch.PutIndex(filterHeaderIndex, filter.BlockHash, computed)
+
+	return headers.Store.Write(batch)
+}
+
+// FilterWatch is what a wallet looks for in block filters: its public key
+// hashes and the outputs it owns, which grow as payments to it are found so
+// that spending them is found as well.
+type FilterWatch struct {
+	pubKeyHashes map[string]bool
+	// outpoints maps the outpoint bytes of every owned output to its value
+	outpoints map[string]int
+}
+
+func NewFilterWatch(pubKeyHashes [][]byte) *FilterWatch {
+	w := &FilterWatch{
+		pubKeyHashes: make(map[string]bool),
+		outpoints:    make(map[string]int),
+	}
+	for _, pubKeyHash := range pubKeyHashes {
+		w.pubKeyHashes[string(pubKeyHash)] = true
+	}
+
+	return w
+}
+
+// Match reports whether the filter of a block may concern the watch.
+func (w *FilterWatch) Match(filter *BlockFilter) (bool, error) {
+	items := make([][]byte, 0, len(w.pubKeyHashes)+len(w.outpoints))
+	for pubKeyHash := range w.pubKeyHashes {
+		items = append(items, []byte(pubKeyHash))
+	}
+	for outpoint := range w.outpoints {
+		items = append(items, []byte(outpoint))
+	}
+
+	return MatchGCS(filter.Filter, filter.BlockHash, items)
+}
+
+// AddBlock returns the transactions of block that pay or spend from the
+// watch and updates the outputs it owns.
+func (w *FilterWatch) AddBlock(block *Block) []*Transaction {
+	var relevant []*Transaction
+	for _, tx := range block.Transactions {
+		found := false
+		if !tx.IsCoinbase() {
+			for _, in := range tx.Inputs {
+				key := string(outpointBytes(in.ID, in.Out))
+				if _, ok := w.outpoints[key]; ok {
+					delete(w.outpoints, key)
+					found = true
+				}
+			}
+		}
+		for outIdx, out := range tx.Outputs {
+			if w.pubKeyHashes[string(out.PublicKeyHash)] {
+				w.outpoints[string(outpointBytes(tx.ID, outIdx))] = out.Value
+				found = true
+			}
+		}
+		if found {
+			relevant = append(relevant, tx)
+		}
+	}
+
+	return relevant
+}
+
+// Balance is the value of the outputs the watch owns.
+func (w *FilterWatch) Balance() int {
+	balance := 0
+	for _, value := range w.outpoints {
+		balance += value
+	}
+
+	return balance
+}
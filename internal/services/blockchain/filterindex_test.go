@@ -0,0 +1,150 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/numbermax/blockchain/internal/services/wallet"
+)
+
+// newFilterChain returns a chain with the filter index on whose blocks
+// past the genesis each pay a new public key hash, returned in height order.
+func newFilterChain(t *testing.T, blocks int) (*BlockChain, [][]byte) {
+	t.Helper()
+
+	chain := newTestChain(t, 0)
+	t.Cleanup(func() { chain.Store.Close() })
+	if err := chain.EnableIndex(filterIndexName); err != nil {
+		t.Fatal(err)
+	}
+
+	var pkhs [][]byte
+	for i := 0; i < blocks; i++ {
+		pkhs = append(pkhs, payNewKey(chain, fmt.Sprintf("block %d", i)))
+	}
+
+	return chain, pkhs
+}
+
+// payNewKey adds a block paying a new public key hash to chain and returns
+// the hash.
+func payNewKey(chain *BlockChain, data string) []byte {
+	w := wallet.MakeWallet()
+	pkh := wallet.PublicKeyHash(w.PublicKey)
+	chain.AddBlock([]*Transaction{CoinbaseTx(string(wallet.PublicKeyHashToAddress(pkh)), data)})
+
+	return pkh
+}
+
+func blockFilter(t *testing.T, chain *BlockChain, height int) *BlockFilter {
+	t.Helper()
+
+	hash, err := chain.GetBlockHash(height)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter, err := chain.GetBlockFilter(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return filter
+}
+
+// mainHeaders returns the headers of the main chain of chain.
+func mainHeaders(t *testing.T, chain *BlockChain) []*BlockHeader {
+	t.Helper()
+
+	var list []*BlockHeader
+	for height := 0; height <= chain.GetBestHeight(); height++ {
+		block, err := chain.GetBlockByHeight(height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		list = append(list, block.Header())
+	}
+
+	return list
+}
+
+// lightHeaders returns the header chain of a light client that downloaded
+// the headers of chain.
+func lightHeaders(t *testing.T, chain *BlockChain) *HeaderChain {
+	t.Helper()
+
+	headers, err := OpenHeaderChainWithStore(*discardLogger(), NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := headers.AddHeaders(mainHeaders(t, chain)); err != nil {
+		t.Fatal(err)
+	}
+
+	return headers
+}
+
+func TestBlockFilters(t *testing.T) {
+	chain, pkhs := newFilterChain(t, 3)
+	headers := lightHeaders(t, chain)
+	stranger := NewFilterWatch(randomItems(1))
+
+	prev := make([]byte, sha256.Size)
+	for height := 0; height <= chain.GetBestHeight(); height++ {
+		filter := blockFilter(t, chain, height)
+		if !bytes.Equal(filter.Header, FilterHeader(filter.Filter, prev)) {
+			t.Errorf("filter header of block %d does not chain onto the one before", height)
+		}
+		prev = filter.Header
+
+		if height > 0 {
+			if ok, err := NewFilterWatch(pkhs[height-1 : height]).Match(filter); err != nil || !ok {
+				t.Errorf("filter of block %d does not match the key it pays: %v, %v", height, ok, err)
+			}
+		}
+		if ok, err := stranger.Match(filter); err != nil || ok {
+			t.Errorf("filter of block %d matches a stranger: %v, %v", height, ok, err)
+		}
+		if err := headers.AddFilter(filter); err != nil {
+			t.Errorf("light client refused the filter of block %d: %v", height, err)
+		}
+	}
+
+	tampered := blockFilter(t, chain, 2)
+	tampered.Filter = BuildGCS(tampered.BlockHash, randomItems(1))
+	if err := headers.AddFilter(tampered); err == nil {
+		t.Error("light client took a filter that does not match its header")
+	}
+	if err := lightHeaders(t, chain).AddFilter(blockFilter(t, chain, 2)); err == nil {
+		t.Error("light client took a filter before that of the previous block")
+	}
+}
+
+func TestFilterHeadersAcrossReorg(t *testing.T) {
+	chain, _ := newFilterChain(t, 2)
+	parent := blockFilter(t, chain, 1)
+	old := blockFilter(t, chain, 2)
+
+	chain.DisconnectTip()
+	if _, err := chain.GetBlockFilter(old.BlockHash); !errors.Is(err, ErrNotFound) {
+		t.Errorf("filter of the disconnected block: %v, want %v", err, ErrNotFound)
+	}
+
+	payNewKey(chain, "replacement")
+	replacement := blockFilter(t, chain, 2)
+	if !bytes.Equal(replacement.Header, FilterHeader(replacement.Filter, parent.Header)) {
+		t.Error("filter header of the new tip does not chain onto its parent")
+	}
+	if bytes.Equal(replacement.Header, old.Header) {
+		t.Error("filter header of the new tip is that of the block it replaced")
+	}
+
+	headers := lightHeaders(t, chain)
+	for height := 0; height <= 2; height++ {
+		if err := headers.AddFilter(blockFilter(t, chain, height)); err != nil {
+			t.Errorf("light client refused the filter of block %d: %v", height, err)
+		}
+	}
+}
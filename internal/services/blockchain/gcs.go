@@ -0,0 +1,159 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+	"sort"
+)
+
+const (
+	// gcsP is the number of low bits of every delta written as is by the
+	// Golomb-Rice coding.
+	gcsP = 19
+	// gcsM sets the false positive rate of a filter to about 1 in gcsM.
+	gcsM = 784931
+)
+
+// BuildGCS builds a Golomb-coded set over items. Every item is hashed with
+// key into the range [0, N*gcsM), the values are sorted and the differences
+// between neighbours are Golomb-Rice coded after the item count N.
+func BuildGCS(key []byte, items [][]byte) []byte {
+	unique := make(map[string][]byte)
+	for _, item := range items {
+		unique[string(item)] = item
+	}
+
+	n := uint64(len(unique))
+	values := make([]uint64, 0, n)
+	for _, item := range unique {
+		values = append(values, gcsHash(key, item, n*gcsM))
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+	w := &bitWriter{}
+	w.bytes = binary.AppendUvarint(nil, n)
+	var last uint64
+	for _, value := range values {
+		delta := value - last
+		last = value
+
+		for q := delta >> gcsP; q > 0; q-- {
+			w.writeBit(1)
+		}
+		w.writeBit(0)
+		w.writeBits(delta, gcsP)
+	}
+
+	return w.bytes
+}
+
+// MatchGCS reports whether any of items may be in the set built by BuildGCS
+// with key. False positives happen at about 1 in gcsM, false negatives never.
+func MatchGCS(filter, key []byte, items [][]byte) (bool, error) {
+	n, read := binary.Uvarint(filter)
+	if read <= 0 {
+		return false, errors.New("malformed filter")
+	}
+	if n == 0 || len(items) == 0 {
+		return false, nil
+	}
+
+	targets := make([]uint64, 0, len(items))
+	for _, item := range items {
+		targets = append(targets, gcsHash(key, item, n*gcsM))
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i] < targets[j] })
+
+	r := &bitReader{bytes: filter[read:]}
+	var value uint64
+	for i := uint64(0); i < n; i++ {
+		var q uint64
+		for {
+			bit, err := r.readBit()
+			if err != nil {
+				return false, errors.New("malformed filter")
+			}
+			if bit == 0 {
+				break
+			}
+			q++
+		}
+		rem, err := r.readBits(gcsP)
+		if err != nil {
+			return false, errors.New("malformed filter")
+		}
+		value += q<<gcsP | rem
+
+		for len(targets) > 0 && targets[0] < value {
+			targets = targets[1:]
+		}
+		if len(targets) == 0 {
+			return false, nil
+		}
+		if targets[0] == value {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// gcsHash maps item into [0, limit) with a hash keyed by key.
+func gcsHash(key, item []byte, limit uint64) uint64 {
+	sum := sha256.Sum256(append(bytes.Clone(key), item...))
+	hi, _ := bits.Mul64(binary.BigEndian.Uint64(sum[:8]), limit)
+
+	return hi
+}
+
+type bitWriter struct {
+	bytes []byte
+	used  uint8
+}
+
+func (w *bitWriter) writeBit(bit uint64) {
+	if w.used == 0 {
+		w.bytes = append(w.bytes, 0)
+		w.used = 8
+	}
+	w.used--
+	w.bytes[len(w.bytes)-1] |= byte(bit&1) << w.used
+}
+
+func (w *bitWriter) writeBits(value uint64, count int) {
+	for i := count - 1; i >= 0; i-- {
+		w.writeBit(value >> i)
+	}
+}
+
+type bitReader struct {
+	bytes []byte
+	pos   int
+}
+
+func (r *bitReader) readBit() (uint64, error) {
+	if r.pos >= len(r.bytes)*8 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	bit := r.bytes[r.pos/8] >> (7 - r.pos%8) & 1
+	r.pos++
+
+	return uint64(bit), nil
+}
+
+func (r *bitReader) readBits(count int) (uint64, error) {
+	var value uint64
+	for i := 0; i < count; i++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		value = value<<1 | bit
+	}
+
+	return value, nil
+}
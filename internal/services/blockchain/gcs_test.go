@@ -0,0 +1,100 @@
+package blockchain
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"testing"
+)
+
+// randomItems returns n random items of the size of a public key hash.
+func randomItems(n int) [][]byte {
+	items := make([][]byte, n)
+	for i := range items {
+		items[i] = make([]byte, 20)
+		rand.Read(items[i])
+	}
+
+	return items
+}
+
+func TestGCSRoundTrip(t *testing.T) {
+	key := testHash(1)
+	items := randomItems(1000)
+	filter := BuildGCS(key, append(items, items[:10]...))
+
+	for i, item := range items {
+		if ok, err := MatchGCS(filter, key, [][]byte{item}); err != nil || !ok {
+			t.Fatalf("item %d not matched: %v, %v", i, ok, err)
+		}
+	}
+	if ok, err := MatchGCS(filter, key, items); err != nil || !ok {
+		t.Errorf("all items not matched: %v, %v", ok, err)
+	}
+
+	others := randomItems(10000)
+	matched := 0
+	for _, item := range others {
+		ok, err := MatchGCS(filter, key, [][]byte{item})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			matched++
+		}
+	}
+	// about 1 in gcsM matches falsely
+	if matched > 2 {
+		t.Errorf("%d of %d other items matched", matched, len(others))
+	}
+	if ok, err := MatchGCS(filter, testHash(2), items[:1]); err != nil || ok {
+		t.Errorf("item matched under another key: %v, %v", ok, err)
+	}
+}
+
+func TestGCSEmpty(t *testing.T) {
+	key := testHash(1)
+
+	tests := []struct {
+		name   string
+		filter []byte
+		items  [][]byte
+	}{
+		{"empty set", BuildGCS(key, nil), randomItems(3)},
+		{"no items", BuildGCS(key, randomItems(3)), nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if ok, err := MatchGCS(tt.filter, key, tt.items); err != nil || ok {
+				t.Errorf("MatchGCS = %v, %v, want no match", ok, err)
+			}
+		})
+	}
+}
+
+func TestGCSMalformed(t *testing.T) {
+	key := testHash(1)
+	filter := BuildGCS(key, randomItems(100))
+	deltas := filter[len(binary.AppendUvarint(nil, 100)):]
+
+	tests := []struct {
+		name   string
+		filter []byte
+	}{
+		{"empty", nil},
+		{"count only", binary.AppendUvarint(nil, 100)},
+		{"truncated", filter[:len(filter)/2]},
+		{"count too high", append(binary.AppendUvarint(nil, 1000), deltas...)},
+	}
+
+	// items spread over the whole range, the last past every value, so the
+	// match reads to the end of the filter
+	items := randomItems(1000)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if ok, err := MatchGCS(tt.filter, key, items); err == nil {
+				t.Errorf("malformed filter read, match %v", ok)
+			}
+		})
+	}
+}
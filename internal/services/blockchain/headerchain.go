@@ -0,0 +1,248 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+const (
+	headerChainPath = "./tmp/headers"
+
+	// MaxHeadersPerRequest bounds the headers HeadersAfter returns at once.
+	MaxHeadersPerRequest = 2000
+)
+
+// HeaderChain is the chain as a light client sees it: headers only, checked
+// for proof of work and linkage, with the best one as the tip. Transactions
+// are confirmed against it with Merkle proofs from a full node.
+type HeaderChain struct {
+	logger   slog.Logger
+	LastHash []byte
+	Store    ChainStore
+}
+
+// OpenHeaderChain opens the header chain of the light client, creating an
+// empty one the first time.
+func OpenHeaderChain(logger slog.Logger) *HeaderChain {
+	store, err := NewBadgerStore(headerChainPath)
+	ErrHandle(err)
+
+	headers, err := OpenHeaderChainWithStore(logger, store)
+	if err != nil {
+		store.Close()
+		ErrHandle(err)
+	}
+
+	return headers
+}
+
+// OpenHeaderChainWithStore opens the header chain held by store.
+func OpenHeaderChainWithStore(logger slog.Logger, store ChainStore) (*HeaderChain, error) {
+	headers := &HeaderChain{
+		logger: logger,
+		Store:  store,
+	}
+
+	tip, err := store.GetTip()
+	if err == nil {
+		headers.LastHash = tip
+	} else if !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+
+	return headers, nil
+}
+
+// AddHeaders checks and stores headers, which must each follow a stored
+// header or one before it in the list, and moves the tip to the heaviest
+// branch. A genesis header is only taken by an empty chain. It returns the
+// number of headers that were new.
+func (headers *HeaderChain) AddHeaders(list []*BlockHeader) (int, error) {
+	added := 0
+	for _, header := range list {
+		if _, err := headers.Store.GetIndex(headerIndex, header.Hash); err == nil {
+			continue
+		} else if !errors.Is(err, ErrNotFound) {
+			return added, err
+		}
+
+		if err := CheckHeader(header); err != nil {
+			return added, err
+		}
+
+		height := 0
+		if len(header.PrevHash) == 0 {
+			if headers.LastHash != nil {
+				return added, rejectf(RejectOtherGenesis, "header %x is a genesis block of another chain", header.Hash)
+			}
+		} else {
+			prev, err := headers.GetBlockHeight(header.PrevHash)
+			if errors.Is(err, ErrNotFound) {
+				return added, fmt.Errorf("header %x: %w", header.Hash, ErrOrphanBlock)
+			}
+			if err != nil {
+				return added, err
+			}
+			height = prev + 1
+		}
+
+		batch := NewBatch()
+		batch.PutIndex(headerIndex, header.Hash, header.Serialize())
+		batch.PutIndex(blockHeightIndex, header.Hash, heightKey(height))
+		if err := headers.Store.Write(batch); err != nil {
+			return added, err
+		}
+		added++
+
+		heavier, err := outweighsBest(headers, header.Hash, height)
+		if err != nil {
+			return added, err
+		}
+		if heavier {
+			if err := headers.setTip(header, height); err != nil {
+				return added, err
+			}
+		}
+	}
+
+	return added, nil
+}
+
+// Locator lists main chain hashes from the tip back to the genesis, densely
+// near the tip and then at doubling steps, so a full node can find where
+// its chain and this one split.
+func (headers *HeaderChain) Locator() [][]byte {
+	return blockLocator(headers.GetBestHeight(), headers.GetBlockHash)
+}
+
+// GetBlockHeader returns a stored header.
+func (headers *HeaderChain) GetBlockHeader(hash []byte) (*BlockHeader, error) {
+	data, err := headers.Store.GetIndex(headerIndex, hash)
+	if err != nil {
+		return nil, fmt.Errorf("header of block %x: %w", hash, err)
+	}
+
+	return DeserializeHeader(data), nil
+}
+
+// GetBlockHeight returns the height of a stored header.
+func (headers *HeaderChain) GetBlockHeight(hash []byte) (int, error) {
+	data, err := headers.Store.GetIndex(blockHeightIndex, hash)
+	if err != nil {
+		return 0, fmt.Errorf("height of block %x: %w", hash, err)
+	}
+
+	return int(binary.BigEndian.Uint64(data)), nil
+}
+
+// GetBlockHash returns the hash of the main chain header at height.
+func (headers *HeaderChain) GetBlockHash(height int) ([]byte, error) {
+	if height < 0 {
+		return nil, fmt.Errorf("block at height %d: %w", height, ErrNotFound)
+	}
+
+	hash, err := headers.Store.GetIndex(heightIndex, heightKey(height))
+	if err != nil {
+		return nil, fmt.Errorf("block at height %d: %w", height, err)
+	}
+
+	return hash, nil
+}
+
+// GetBestHeight returns the height of the tip, -1 before the first sync.
+func (headers *HeaderChain) GetBestHeight() int {
+	if headers.LastHash == nil {
+		return -1
+	}
+
+	height, err := headers.GetBlockHeight(headers.LastHash)
+	ErrHandle(err)
+
+	return height
+}
+
+// setTip makes header, which is above the tip, the new tip, pointing the
+// height index at its branch back to where it meets the old main chain.
+func (headers *HeaderChain) setTip(header *BlockHeader, height int) error {
+	batch := NewBatch()
+	hash := header.Hash
+	for ; height >= 0; height-- {
+		current, err := headers.GetBlockHash(height)
+		if err == nil && bytes.Equal(current, hash) {
+			break
+		}
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		batch.PutIndex(heightIndex, heightKey(height), hash)
+
+		branch, err := headers.GetBlockHeader(hash)
+		if err != nil {
+			return err
+		}
+		hash = branch.PrevHash
+	}
+	batch.SetTip(header.Hash)
+
+	if err := headers.Store.Write(batch); err != nil {
+		return err
+	}
+	headers.LastHash = header.Hash
+
+	return nil
+}
+
+// HeadersAfter returns up to max main chain headers following the first
+// locator hash on the main chain, from the genesis when none is.
+func (chain *BlockChain) HeadersAfter(locator [][]byte, max int) ([]*BlockHeader, error) {
+	start := 0
+	for _, hash := range locator {
+		height, err := chain.GetBlockHeight(hash)
+		if err != nil {
+			continue
+		}
+		if main, err := chain.GetBlockHash(height); err == nil && bytes.Equal(main, hash) {
+			start = height + 1
+			break
+		}
+	}
+
+	var list []*BlockHeader
+	for height := start; height <= chain.GetBestHeight() && len(list) < max; height++ {
+		hash, err := chain.GetBlockHash(height)
+		if err != nil {
+			return nil, err
+		}
+		header, err := chain.GetBlockHeader(hash)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, header)
+	}
+
+	return list, nil
+}
+
+// blockLocator builds a locator for a chain whose tip is at best.
+func blockLocator(best int, hashAt func(height int) ([]byte, error)) [][]byte {
+	var locator [][]byte
+	step := 1
+	for height := best; height >= 0; height -= step {
+		hash, err := hashAt(height)
+		if err != nil {
+			break
+		}
+		locator = append(locator, hash)
+		if len(locator) >= 10 {
+			step *= 2
+		}
+		if height > 0 && height-step < 0 {
+			height = step
+		}
+	}
+
+	return locator
+}
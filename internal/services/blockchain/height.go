@@ -0,0 +1,91 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	// heightIndex maps the height of every main chain block to its hash.
+	heightIndex = "height"
+	// blockHeightIndex maps a block hash to its height. Entries are kept
+	// when a block is disconnected, so it also answers for side branches.
+	blockHeightIndex = "blockheight"
+)
+
+// GetBestHeight returns the height of the tip; the genesis block is height 0.
+func (chain *BlockChain) GetBestHeight() int {
+	height, err := chain.GetBlockHeight(chain.LastHash)
+	ErrHandle(err)
+
+	return height
+}
+
+// GetBlockHeight returns the height of a block the chain state has seen.
+func (chain *BlockChain) GetBlockHeight(hash []byte) (int, error) {
+	data, err := chain.Store.GetIndex(blockHeightIndex, hash)
+	if err != nil {
+		return 0, fmt.Errorf("height of block %x: %w", hash, err)
+	}
+
+	return int(binary.BigEndian.Uint64(data)), nil
+}
+
+// GetBlockHash returns the hash of the main chain block at height.
+func (chain *BlockChain) GetBlockHash(height int) ([]byte, error) {
+	if height < 0 {
+		return nil, fmt.Errorf("block at height %d: %w", height, ErrNotFound)
+	}
+
+	hash, err := chain.Store.GetIndex(heightIndex, heightKey(height))
+	if err != nil {
+		return nil, fmt.Errorf("block at height %d: %w", height, err)
+	}
+
+	return hash, nil
+}
+
+// GetBlock returns a stored block by hash.
+func (chain *BlockChain) GetBlock(hash []byte) (*Block, error) {
+	block, err := chain.Store.GetBlock(hash)
+	if errors.Is(err, ErrNotFound) {
+		if _, herr := chain.Store.GetIndex(headerIndex, hash); herr == nil {
+			err = ErrPruned
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("block %x: %w", hash, err)
+	}
+
+	return block, nil
+}
+
+// GetBlockByHeight returns the main chain block at height.
+func (chain *BlockChain) GetBlockByHeight(height int) (*Block, error) {
+	hash, err := chain.GetBlockHash(height)
+	if err != nil {
+		return nil, err
+	}
+
+	return chain.GetBlock(hash)
+}
+
+// heightForNewBlock returns the height block will have once connected.
+func (chain *BlockChain) heightForNewBlock(block *Block) (int, error) {
+	if len(block.PrevHash) == 0 {
+		return 0, nil
+	}
+
+	height, err := chain.GetBlockHeight(block.PrevHash)
+	if err != nil {
+		return 0, err
+	}
+
+	return height + 1, nil
+}
+
+// heightKey encodes height big-endian so the index iterates in chain order.
+func heightKey(height int) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(height))
+}
@@ -0,0 +1,67 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestGetBlockByHeight(t *testing.T) {
+	chain := newTestChain(t, 5)
+	defer chain.Store.Close()
+
+	if best := chain.GetBestHeight(); best != 5 {
+		t.Fatalf("best height %d, want 5", best)
+	}
+	var prev []byte
+	for height := 0; height <= 5; height++ {
+		block, err := chain.GetBlockByHeight(height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash, err := chain.GetBlockHash(height)
+		if err != nil || !bytes.Equal(block.Hash, hash) || !bytes.Equal(block.PrevHash, prev) {
+			t.Errorf("block %d is %x on %x, want %x on %x", height, block.Hash, block.PrevHash, hash, prev)
+		}
+		if got, err := chain.GetBlockHeight(block.Hash); err != nil || got != height {
+			t.Errorf("height of block %d = %d, %v", height, got, err)
+		}
+		prev = block.Hash
+	}
+	for _, height := range []int{-1, 6} {
+		if _, err := chain.GetBlockByHeight(height); !errors.Is(err, ErrNotFound) {
+			t.Errorf("block at %d: %v, want %v", height, err, ErrNotFound)
+		}
+	}
+
+	// a disconnected block leaves the main chain but keeps its height
+	tip := chain.DisconnectTip()
+	if _, err := chain.GetBlockByHeight(5); !errors.Is(err, ErrNotFound) {
+		t.Errorf("disconnected block still at height 5: %v", err)
+	}
+	if height, err := chain.GetBlockHeight(tip.Hash); err != nil || height != 5 {
+		t.Errorf("height of the disconnected block = %d, %v, want 5", height, err)
+	}
+}
+
+func TestGetBlockByHeightPruned(t *testing.T) {
+	chain := newTestChain(t, MinPruneDepth+5)
+	defer chain.Store.Close()
+	if err := chain.SetPruning(MinPruneDepth, 0); err != nil {
+		t.Fatal(err)
+	}
+	pruned := chain.PruneHeight()
+	if pruned < 1 {
+		t.Fatalf("pruned up to %d, want past the genesis", pruned)
+	}
+
+	if _, err := chain.GetBlockByHeight(pruned); !errors.Is(err, ErrPruned) {
+		t.Errorf("pruned block %d: %v, want %v", pruned, err, ErrPruned)
+	}
+	if _, err := chain.GetBlockHash(pruned); err != nil {
+		t.Errorf("hash of pruned block %d: %v", pruned, err)
+	}
+	if _, err := chain.GetBlockByHeight(pruned + 1); err != nil {
+		t.Errorf("block %d past the pruned ones: %v", pruned+1, err)
+	}
+}
@@ -0,0 +1,59 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"testing"
+)
+
+// testAddr is a valid address the test chains pay their coinbases to.
+const testAddr = "1EnGBkhk3qkj9u6dyXNrBcBUgd2xnzZGaG"
+
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// overTxnLimit is more writes than one Badger transaction takes.
+const overTxnLimit = 150000
+
+// fillBadger opens a Badger store and writes n entries put makes into it,
+// over as many batches as it takes.
+func fillBadger(t *testing.T, n int, put func(batch *Batch, key []byte)) ChainStore {
+	t.Helper()
+
+	store := storeBackends["badger"](t)
+	t.Cleanup(func() { store.Close() })
+
+	batch := NewBatch()
+	for i := 0; i < n; i++ {
+		put(batch, binary.BigEndian.AppendUint64(make([]byte, 24), uint64(i)))
+		if batch.Len() >= snapshotBatchSize {
+			if err := store.Write(batch); err != nil {
+				t.Fatal(err)
+			}
+			batch = NewBatch()
+		}
+	}
+	if err := store.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	return store
+}
+
+// countIndex returns how many entries index holds.
+func countIndex(t *testing.T, store ChainStore, index string) int {
+	t.Helper()
+
+	n := 0
+	err := store.ForEachIndex(index, nil, func(_, _ []byte) error {
+		n++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return n
+}
@@ -0,0 +1,206 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+)
+
+// Indexer maintains an optional index over the main chain. Once enabled it
+// is updated in the same batch as every connect and disconnect; its progress
+// is tracked separately so it can be built for a chain that already exists.
+// ConnectBlock gets the undo data of the block so it can see the outputs
+// the block spends.
+type Indexer interface {
+	Name() string
+	ConnectBlock(chain *BlockChain, batch *Batch, block *Block, height int, undo *BlockUndo) error
+	DisconnectBlock(chain *BlockChain, batch *Batch, block *Block, height int) error
+}
+
+// availableIndexers lists every optional index by name.
+var availableIndexers = map[string]func() Indexer{
+	txIndexName:     func() Indexer { return &txIndex{} },
+	addrIndexName:   func() Indexer { return &addrIndex{} },
+	filterIndexName: func() Indexer { return &filterIndex{} },
+}
+
+// IndexNames returns the names of all optional indexes.
+func IndexNames() []string {
+	var names []string
+	for name := range availableIndexers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// HasIndex reports whether the named index is enabled and in sync.
+func (chain *BlockChain) HasIndex(name string) bool {
+	for _, idx := range chain.indexers {
+		if idx.Name() == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// EnableIndex turns the named index on and builds it up to the tip.
+func (chain *BlockChain) EnableIndex(name string) error {
+	if chain.HasIndex(name) {
+		return nil
+	}
+
+	newIndexer, ok := availableIndexers[name]
+	if !ok {
+		return fmt.Errorf("unknown index %q", name)
+	}
+	if chain.snapshotPending() {
+		return errors.New("indexes need the full history, validate the UTXO snapshot first")
+	}
+	if chain.PruneHeight() >= 0 {
+		return errors.New("indexes need the full history, which a pruned node no longer has")
+	}
+
+	batch := NewBatch()
+	batch.PutIndex(chainStateIndex, indexBestKey(name), []byte{})
+	if err := chain.Store.Write(batch); err != nil {
+		return err
+	}
+
+	return chain.attachIndex(newIndexer())
+}
+
+// DisableIndex turns the named index off and deletes its data.
+func (chain *BlockChain) DisableIndex(name string) error {
+	if _, ok := availableIndexers[name]; !ok {
+		return fmt.Errorf("unknown index %q", name)
+	}
+
+	if err := chain.wipeIndex(name); err != nil {
+		return err
+	}
+	batch := NewBatch()
+	batch.DeleteIndex(chainStateIndex, indexBestKey(name))
+	if err := chain.Store.Write(batch); err != nil {
+		return err
+	}
+
+	indexers := chain.indexers[:0]
+	for _, idx := range chain.indexers {
+		if idx.Name() != name {
+			indexers = append(indexers, idx)
+		}
+	}
+	chain.indexers = indexers
+
+	return nil
+}
+
+// RebuildIndexes drops the data of every enabled index and builds it again
+// from the main chain.
+func (chain *BlockChain) RebuildIndexes() error {
+	indexers := chain.indexers
+	chain.indexers = nil
+
+	for _, idx := range indexers {
+		if err := chain.wipeIndex(idx.Name()); err != nil {
+			return err
+		}
+		if err := chain.attachIndex(idx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadIndexes attaches every enabled index, catching up those that lag
+// behind the tip.
+func (chain *BlockChain) loadIndexes() error {
+	chain.indexers = nil
+
+	for _, name := range IndexNames() {
+		_, err := chain.Store.GetIndex(chainStateIndex, indexBestKey(name))
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := chain.attachIndex(availableIndexers[name]()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// attachIndex brings idx up to the tip and starts updating it with the chain.
+func (chain *BlockChain) attachIndex(idx Indexer) error {
+	key := indexBestKey(idx.Name())
+
+	best, err := chain.Store.GetIndex(chainStateIndex, key)
+	if err != nil {
+		return err
+	}
+
+	if len(best) == 0 {
+		chain.logger.Info("Building index", slog.String("index", idx.Name()))
+	}
+
+	err = chain.walkChain(best, chain.LastHash,
+		func(block *Block) error {
+			height, err := chain.GetBlockHeight(block.Hash)
+			if err != nil {
+				return err
+			}
+			batch := NewBatch()
+			if err := idx.DisconnectBlock(chain, batch, block, height); err != nil {
+				return err
+			}
+			batch.PutIndex(chainStateIndex, key, block.PrevHash)
+			return chain.Store.Write(batch)
+		},
+		func(block *Block) error {
+			height, err := chain.GetBlockHeight(block.Hash)
+			if err != nil {
+				return err
+			}
+			data, err := chain.Store.GetIndex(undoIndex, block.Hash)
+			if err != nil {
+				return fmt.Errorf("undo data for block %x: %w", block.Hash, err)
+			}
+			batch := NewBatch()
+			if err := idx.ConnectBlock(chain, batch, block, height, DeserializeUndo(data)); err != nil {
+				return err
+			}
+			batch.PutIndex(chainStateIndex, key, block.Hash)
+			return chain.Store.Write(batch)
+		})
+	if err != nil {
+		return fmt.Errorf("%s index: %w", idx.Name(), err)
+	}
+
+	chain.indexers = append(chain.indexers, idx)
+
+	return nil
+}
+
+// wipeIndex deletes the data of the named index and resets its progress,
+// in the last of the writes it takes.
+func (chain *BlockChain) wipeIndex(name string) error {
+	batch, err := chain.clearIndex(NewBatch(), name)
+	if err != nil {
+		return err
+	}
+	batch.PutIndex(chainStateIndex, indexBestKey(name), []byte{})
+
+	return chain.Store.Write(batch)
+}
+
+func indexBestKey(name string) []byte {
+	return []byte("index-" + name)
+}
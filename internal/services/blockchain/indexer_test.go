@@ -0,0 +1,28 @@
+package blockchain
+
+import (
+	"testing"
+)
+
+func TestWipeIndexAboveTxnLimit(t *testing.T) {
+	store := fillBadger(t, overTxnLimit, func(batch *Batch, key []byte) {
+		batch.PutIndex(txIndexName, key, []byte{1})
+	})
+	batch := NewBatch()
+	batch.PutIndex(chainStateIndex, indexBestKey(txIndexName), testHash(1))
+	if err := store.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	chain := &BlockChain{logger: *discardLogger(), Store: store}
+	if err := chain.wipeIndex(txIndexName); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := countIndex(t, store, txIndexName); n != 0 {
+		t.Errorf("%d index entries left after the wipe", n)
+	}
+	if best, err := store.GetIndex(chainStateIndex, indexBestKey(txIndexName)); err != nil || len(best) != 0 {
+		t.Errorf("index progress after the wipe = %x, %v, want it reset", best, err)
+	}
+}
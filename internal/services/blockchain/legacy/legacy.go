@@ -0,0 +1,161 @@
+// Package legacy encodes transactions as they were before inputs carried a
+// sequence number, which is what their IDs hash.
+//
+// The encoding is the one gob gave the transaction types of the blockchain
+// package back then, written out byte for byte so that it does not depend on
+// gob, the name of this package or what else the process encodes.
+package legacy
+
+import (
+	"bytes"
+	"encoding/hex"
+)
+
+type Transaction struct {
+	ID      []byte
+	Inputs  []TxInput
+	Outputs []TxOutput
+}
+
+type TxInput struct {
+	ID        []byte
+	Out       int
+	Signature []byte
+	PublicKey []byte
+}
+
+type TxOutput struct {
+	Value         int
+	PublicKeyHash []byte
+}
+
+// typeDefinitions start every encoding: gob's descriptions of Transaction,
+// TxInput, TxOutput and their slices, named after the blockchain package.
+var typeDefinitions = mustDecodeHex("" +
+	"387f0301010b5472616e73616374696f6e01ff8000010301024944010a000106" +
+	"496e7075747301ff840001074f75747075747301ff8800000023ff8302010114" +
+	"5b5d626c6f636b636861696e2e5478496e70757401ff840001ff82000040ff81" +
+	"030101075478496e70757401ff8200010401024944010a0001034f7574010400" +
+	"01095369676e6174757265010a0001095075626c69634b6579010a00000024ff" +
+	"87020101155b5d626c6f636b636861696e2e54784f757470757401ff880001ff" +
+	"86000032ff850301010854784f757470757401ff86000102010556616c756501" +
+	"0400010d5075626c69634b657948617368010a000000")
+
+// transactionType is the gob type ID typeDefinitions give Transaction.
+const transactionType = 64
+
+func Encode(tx *Transaction) []byte {
+	var value encoder
+	value.int(transactionType)
+
+	fields := value.fields()
+	fields.bytes(0, tx.ID)
+	if len(tx.Inputs) > 0 {
+		fields.field(1)
+		value.uint(uint64(len(tx.Inputs)))
+		for _, in := range tx.Inputs {
+			input := value.fields()
+			input.bytes(0, in.ID)
+			input.int(1, in.Out)
+			input.bytes(2, in.Signature)
+			input.bytes(3, in.PublicKey)
+			input.end()
+		}
+	}
+	if len(tx.Outputs) > 0 {
+		fields.field(2)
+		value.uint(uint64(len(tx.Outputs)))
+		for _, out := range tx.Outputs {
+			output := value.fields()
+			output.int(0, out.Value)
+			output.bytes(1, out.PublicKeyHash)
+			output.end()
+		}
+	}
+	fields.end()
+
+	var message encoder
+	message.Write(typeDefinitions)
+	message.uint(uint64(value.Len()))
+	message.Write(value.Bytes())
+
+	return message.Bytes()
+}
+
+// encoder writes values the way gob does.
+type encoder struct {
+	bytes.Buffer
+}
+
+// uint writes small values as one byte and others as their big-endian
+// bytes, preceded by the negated byte count.
+func (e *encoder) uint(u uint64) {
+	if u < 0x80 {
+		e.WriteByte(byte(u))
+		return
+	}
+
+	var buf [8]byte
+	n := len(buf)
+	for ; u > 0; u >>= 8 {
+		n--
+		buf[n] = byte(u)
+	}
+	e.WriteByte(byte(-(len(buf) - n)))
+	e.Write(buf[n:])
+}
+
+// int folds the sign into the lowest bit, complementing negative values.
+func (e *encoder) int(i int) {
+	var u uint64
+	if i < 0 {
+		u = uint64(^i)<<1 | 1
+	} else {
+		u = uint64(i) << 1
+	}
+	e.uint(u)
+}
+
+func (e *encoder) fields() *structEncoder {
+	return &structEncoder{e: e, last: -1}
+}
+
+// structEncoder writes the fields of a struct that are not zero, each
+// after its distance from the one written before.
+type structEncoder struct {
+	e    *encoder
+	last int
+}
+
+func (s *structEncoder) field(n int) {
+	s.e.uint(uint64(n - s.last))
+	s.last = n
+}
+
+func (s *structEncoder) int(n, value int) {
+	if value != 0 {
+		s.field(n)
+		s.e.int(value)
+	}
+}
+
+func (s *structEncoder) bytes(n int, value []byte) {
+	if len(value) > 0 {
+		s.field(n)
+		s.e.uint(uint64(len(value)))
+		s.e.Write(value)
+	}
+}
+
+func (s *structEncoder) end() {
+	s.e.WriteByte(0)
+}
+
+func mustDecodeHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+
+	return b
+}
@@ -0,0 +1,48 @@
+package legacy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// The encodings gob gave these transactions when it still encoded them.
+func TestEncodeMatchesGob(t *testing.T) {
+	tests := []struct {
+		name string
+		tx   *Transaction
+		want string
+	}{
+		{
+			name: "empty",
+			tx:   &Transaction{},
+			want: "03ff8000",
+		},
+		{
+			name: "fields",
+			tx: &Transaction{
+				ID: []byte{1, 2},
+				Inputs: []TxInput{
+					{ID: []byte{3}, Out: -1},
+					{},
+				},
+				Outputs: []TxOutput{
+					{Value: 300, PublicKeyHash: []byte{9}},
+				},
+			},
+			want: "1aff8001020102010201010301010000010101fe02580101090000",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Encode(tt.tx)
+			if !bytes.HasPrefix(got, typeDefinitions) {
+				t.Fatalf("encoding does not start with the type definitions: %x", got)
+			}
+			if value := hex.EncodeToString(got[len(typeDefinitions):]); value != tt.want {
+				t.Errorf("value = %s, want %s", value, tt.want)
+			}
+		})
+	}
+}
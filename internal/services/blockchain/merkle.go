@@ -0,0 +1,149 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// MerkleProof shows that a transaction is committed to by a block header
+// without the rest of the block. Siblings are the hashes paired with the
+// transaction on the way up the tree, bottom first.
+type MerkleProof struct {
+	BlockHash []byte   `json:"block_hash"`
+	TxID      []byte   `json:"txid"`
+	Index     int      `json:"index"`
+	Siblings  [][]byte `json:"siblings"`
+}
+
+// MerkleRoot returns the root of the Merkle tree over ids. A level with an
+// odd number of nodes pairs its last node with itself.
+func MerkleRoot(ids [][]byte) []byte {
+	if len(ids) == 0 {
+		hash := sha256.Sum256(nil)
+		return hash[:]
+	}
+
+	level := ids
+	for len(level) > 1 {
+		level = merkleParents(level)
+	}
+
+	return bytes.Clone(level[0])
+}
+
+// NewMerkleProof builds the proof for the transaction txID of block.
+func NewMerkleProof(block *Block, txID []byte) (*MerkleProof, error) {
+	if block.Version < 1 {
+		return nil, fmt.Errorf("block %x predates Merkle commitments", block.Hash)
+	}
+
+	var level [][]byte
+	index := -1
+	for i, tx := range block.Transactions {
+		level = append(level, tx.ID)
+		if bytes.Equal(tx.ID, txID) {
+			index = i
+		}
+	}
+	if index < 0 {
+		return nil, fmt.Errorf("transaction %x is not in block %x", txID, block.Hash)
+	}
+
+	return &MerkleProof{BlockHash: block.Hash, TxID: txID, Index: index, Siblings: MerkleBranch(level, index)}, nil
+}
+
+// MerkleBranch returns the hashes paired with ids[index] on the way up the
+// Merkle tree over ids, bottom first. The branch of the first ID does not
+// depend on it, so a miner can change the coinbase and rebuild the root
+// from the branch alone.
+func MerkleBranch(ids [][]byte, index int) [][]byte {
+	var branch [][]byte
+	level := ids
+	for pos := index; len(level) > 1; pos /= 2 {
+		sibling := pos ^ 1
+		if sibling >= len(level) {
+			sibling = pos
+		}
+		branch = append(branch, level[sibling])
+		level = merkleParents(level)
+	}
+
+	return branch
+}
+
+// Root returns the Merkle root the proof leads to.
+func (p *MerkleProof) Root() []byte {
+	hash := p.TxID
+	pos := p.Index
+	for _, sibling := range p.Siblings {
+		if pos%2 == 0 {
+			hash = merkleHash(hash, sibling)
+		} else {
+			hash = merkleHash(sibling, hash)
+		}
+		pos /= 2
+	}
+
+	return hash
+}
+
+// HeaderSource gives the headers a Merkle proof is checked against. It is
+// served by a full BlockChain as well as by a light HeaderChain.
+type HeaderSource interface {
+	GetBlockHeader(hash []byte) (*BlockHeader, error)
+	GetBlockHeight(hash []byte) (int, error)
+	GetBlockHash(height int) ([]byte, error)
+	GetBestHeight() int
+}
+
+// CheckMerkleProof verifies that proof leads to the transaction hash of a
+// main chain header from headers and returns the number of confirmations
+// the transaction has.
+func CheckMerkleProof(headers HeaderSource, proof *MerkleProof) (int, error) {
+	if proof.Index < 0 || proof.Index >= 1<<len(proof.Siblings) {
+		return 0, errors.New("proof index does not fit the proof")
+	}
+
+	header, err := headers.GetBlockHeader(proof.BlockHash)
+	if err != nil {
+		return 0, err
+	}
+	if header.Version < 1 {
+		return 0, fmt.Errorf("block %x predates Merkle commitments", header.Hash)
+	}
+	if !bytes.Equal(proof.Root(), header.TxHash) {
+		return 0, fmt.Errorf("proof does not lead to the Merkle root of block %x", header.Hash)
+	}
+
+	height, err := headers.GetBlockHeight(header.Hash)
+	if err != nil {
+		return 0, err
+	}
+	hash, err := headers.GetBlockHash(height)
+	if err != nil || !bytes.Equal(hash, header.Hash) {
+		return 0, fmt.Errorf("block %x is not on the main chain", header.Hash)
+	}
+
+	return headers.GetBestHeight() - height + 1, nil
+}
+
+func merkleParents(level [][]byte) [][]byte {
+	var parents [][]byte
+	for i := 0; i < len(level); i += 2 {
+		right := level[i]
+		if i+1 < len(level) {
+			right = level[i+1]
+		}
+		parents = append(parents, merkleHash(level[i], right))
+	}
+
+	return parents
+}
+
+func merkleHash(left, right []byte) []byte {
+	hash := sha256.Sum256(append(bytes.Clone(left), right...))
+
+	return hash[:]
+}
@@ -0,0 +1,167 @@
+package blockchain
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/numbermax/blockchain/internal/services/wallet"
+)
+
+// idBlock returns a block committing to transactions with the given IDs.
+func idBlock(ids [][]byte) *Block {
+	block := &Block{Hash: testHash(0xb0), Version: BlockVersion}
+	for _, id := range ids {
+		block.Transactions = append(block.Transactions, &Transaction{ID: id})
+	}
+
+	return block
+}
+
+func TestMerkleProofs(t *testing.T) {
+	a, b, c := testHash(1), testHash(2), testHash(3)
+	if root, want := MerkleRoot([][]byte{a, b, c}), merkleHash(merkleHash(a, b), merkleHash(c, c)); !bytes.Equal(root, want) {
+		t.Errorf("root of three = %x, want the last paired with itself %x", root, want)
+	}
+
+	for n := 1; n <= 9; n++ {
+		t.Run(fmt.Sprintf("%d transactions", n), func(t *testing.T) {
+			var ids [][]byte
+			for i := 0; i < n; i++ {
+				ids = append(ids, testHash(byte(0x10+i)))
+			}
+			root := MerkleRoot(ids)
+
+			for i, id := range ids {
+				proof, err := NewMerkleProof(idBlock(ids), id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if proof.Index != i || !bytes.Equal(proof.Root(), root) {
+					t.Errorf("proof of %d at %d leads to %x, want %x", i, proof.Index, proof.Root(), root)
+				}
+				if len(proof.Siblings) > 0 {
+					proof.Siblings[0] = testHash(0xff)
+					if bytes.Equal(proof.Root(), root) {
+						t.Errorf("proof of %d with a wrong sibling leads to the root", i)
+					}
+				}
+			}
+		})
+	}
+
+	if _, err := NewMerkleProof(idBlock([][]byte{a}), b); err == nil {
+		t.Error("proof built for a transaction not in the block")
+	}
+}
+
+// spendCoinbases returns a transaction of w spending the outputs of
+// coinbases.
+func spendCoinbases(t *testing.T, w *wallet.Wallet, coinbases ...*Transaction) *Transaction {
+	t.Helper()
+
+	tx := &Transaction{}
+	var spent []TxOutput
+	for _, coinbase := range coinbases {
+		tx.Inputs = append(tx.Inputs, TxInput{ID: coinbase.ID, Out: 0, PublicKey: w.PublicKey})
+		tx.Outputs = append(tx.Outputs, coinbase.Outputs[0])
+		spent = append(spent, coinbase.Outputs[0])
+	}
+	tx.ID = tx.Hash()
+	if err := SignTransaction(tx, w.PrivateKey, spent); err != nil {
+		t.Fatal(err)
+	}
+
+	return tx
+}
+
+// addTip adds a block of txs to chain and returns it.
+func addTip(t *testing.T, chain *BlockChain, txs ...*Transaction) *Block {
+	t.Helper()
+
+	chain.AddBlock(txs)
+	block, err := chain.GetBlock(chain.LastHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return block
+}
+
+func TestCheckMerkleProof(t *testing.T) {
+	w := wallet.MakeWallet()
+	addr := string(wallet.PublicKeyHashToAddress(wallet.PublicKeyHash(w.PublicKey)))
+	chain := newTestChain(t, 0)
+	defer chain.Store.Close()
+	var coinbases []*Transaction
+	for i := 0; i < 3; i++ {
+		coinbase := CoinbaseTx(addr, fmt.Sprintf("coin %d", i))
+		chain.AddBlock([]*Transaction{coinbase})
+		coinbases = append(coinbases, coinbase)
+	}
+
+	// an odd and an even number of transactions
+	odd := addTip(t, chain, CoinbaseTx(testAddr, "odd"), spendCoinbases(t, w, coinbases[0]), spendCoinbases(t, w, coinbases[1]))
+	even := addTip(t, chain, CoinbaseTx(testAddr, "even"), spendCoinbases(t, w, coinbases[2]))
+	chain.AddBlock([]*Transaction{CoinbaseTx(testAddr, "on top")})
+	headers := lightHeaders(t, chain)
+
+	for _, tt := range []struct {
+		block         *Block
+		confirmations int
+	}{{odd, 3}, {even, 2}} {
+		for _, tx := range tt.block.Transactions {
+			proof, err := NewMerkleProof(tt.block, tx.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, source := range map[string]HeaderSource{"header chain": headers, "block chain": chain} {
+				if confirmations, err := CheckMerkleProof(source, proof); err != nil || confirmations != tt.confirmations {
+					t.Errorf("proof of %x against the %s = %d, %v, want %d confirmations", tx.ID, name, confirmations, err, tt.confirmations)
+				}
+			}
+		}
+	}
+
+	proof, err := NewMerkleProof(odd, odd.Transactions[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		change func(p *MerkleProof)
+	}{
+		{"wrong index", func(p *MerkleProof) { p.Index = 2 }},
+		{"index past the siblings", func(p *MerkleProof) { p.Index = 4 }},
+		{"other transaction", func(p *MerkleProof) { p.TxID = even.Transactions[1].ID }},
+		{"other block", func(p *MerkleProof) { p.BlockHash = even.Hash }},
+		{"unknown block", func(p *MerkleProof) { p.BlockHash = testHash(0xee) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changed := *proof
+			tt.change(&changed)
+			if _, err := CheckMerkleProof(headers, &changed); err == nil {
+				t.Error("changed proof checked")
+			}
+		})
+	}
+
+	// a block the light client saw leave the main chain
+	tip := addTip(t, chain, CoinbaseTx(testAddr, "replaced"))
+	headers = lightHeaders(t, chain)
+	tipProof, err := NewMerkleProof(tip, tip.Transactions[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.DisconnectTip()
+	for i := 0; i < 2; i++ {
+		chain.AddBlock([]*Transaction{CoinbaseTx(testAddr, fmt.Sprintf("fork %d", i))})
+	}
+	if _, err := headers.AddHeaders(mainHeaders(t, chain)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CheckMerkleProof(headers, tipProof); err == nil {
+		t.Error("proof of a block off the main chain checked")
+	}
+}
@@ -0,0 +1,211 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+var (
+	// ErrBlockKnown is returned by ProcessBlock for a block already stored.
+	ErrBlockKnown = errors.New("block already known")
+	// ErrOrphanBlock is returned by ProcessBlock when the previous block is
+	// not stored.
+	ErrOrphanBlock = errors.New("previous block is unknown")
+)
+
+// ProcessBlock validates a block that did not come from this node, stores it
+// and moves the tip onto its branch when that branch has more work than the
+// main chain. Blocks that break a consensus rule against the chain state are
+// marked invalid together with everything built on them.
+func (chain *BlockChain) ProcessBlock(block *Block) error {
+	if chain.snapshotFailed() {
+		return fmt.Errorf("block %x: %w", block.Hash, ErrSnapshotInvalid)
+	}
+
+	known, err := chain.Store.HasBlock(block.Hash)
+	if err != nil {
+		return err
+	}
+	if _, err := chain.Store.GetIndex(headerIndex, block.Hash); err == nil {
+		known = true
+	}
+	if known {
+		return ErrBlockKnown
+	}
+
+	if err := CheckProofOfWork(block); err != nil {
+		return err
+	}
+	if err := CheckTransactions(block); err != nil {
+		return err
+	}
+
+	if chain.snapshotPending() {
+		if history, err := chain.processHistoryBlock(block); history {
+			return err
+		}
+	}
+	if len(block.PrevHash) == 0 {
+		return rejectf(RejectOtherGenesis, "block %x is a genesis block of another chain", block.Hash)
+	}
+
+	known, err = chain.Store.HasBlock(block.PrevHash)
+	if err != nil {
+		return err
+	}
+	if !known {
+		return fmt.Errorf("block %x: %w", block.Hash, ErrOrphanBlock)
+	}
+
+	if _, err := chain.Store.GetIndex(invalidIndex, block.PrevHash); err == nil {
+		invalid := &invalidBlockError{hash: block.Hash, err: rejectf(RejectInvalidPrevious, "previous block %x is invalid", block.PrevHash)}
+		return chain.markInvalid(invalid)
+	} else if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	height, err := chain.branchHeight(block.PrevHash)
+	if err != nil {
+		return err
+	}
+	height++
+
+	if bytes.Equal(block.PrevHash, chain.LastHash) {
+		if err := chain.CheckBlockInputs(block); err != nil {
+			return chain.markInvalid(&invalidBlockError{hash: block.Hash, err: err})
+		}
+		return chain.connectTip(block)
+	}
+
+	batch := NewBatch()
+	batch.PutBlock(block)
+	batch.PutIndex(blockHeightIndex, block.Hash, heightKey(height))
+	if err := chain.Store.Write(batch); err != nil {
+		return err
+	}
+
+	heavier, err := outweighsBest(chain, block.Hash, height)
+	if err != nil {
+		return err
+	}
+	if !heavier {
+		chain.logger.Info("Stored side branch block",
+			slog.String("hash", fmt.Sprintf("%x", block.Hash)),
+			slog.Int("height", height))
+		return nil
+	}
+
+	return chain.reorganize(block.Hash)
+}
+
+// reorganize moves the main chain onto the branch ending at to, validating
+// every block it connects. When one fails the chain goes back to the old
+// tip and the invalid block is returned.
+func (chain *BlockChain) reorganize(to []byte) error {
+	from := chain.LastHash
+	chain.logger.Info("Reorganizing chain",
+		slog.String("from", fmt.Sprintf("%x", from)),
+		slog.String("to", fmt.Sprintf("%x", to)))
+
+	err := chain.moveChainStateValidated(from, to, nil)
+	var invalid *invalidBlockError
+	if errors.As(err, &invalid) {
+		best, err := chain.Store.GetIndex(chainStateIndex, chainStateBestKey)
+		if err != nil {
+			return err
+		}
+		if err := chain.moveChainState(best, from); err != nil {
+			return err
+		}
+		return chain.markInvalid(invalid)
+	}
+	if err != nil {
+		return err
+	}
+
+	batch := NewBatch()
+	batch.SetTip(to)
+	if err := chain.Store.Write(batch); err != nil {
+		return err
+	}
+	chain.LastHash = to
+
+	if err := chain.prune(); err != nil {
+		chain.logger.Error("Pruning failed", slog.String("error", err.Error()))
+	}
+
+	return nil
+}
+
+// moveChainStateValidated is moveChainState with every block checked
+// against the chain state before it is connected. A block that fails is
+// returned as an *invalidBlockError; connected is called after each block
+// that was applied, it may be nil.
+func (chain *BlockChain) moveChainStateValidated(from, to []byte, connected func(block *Block)) error {
+	return chain.walkChain(from, to,
+		func(block *Block) error {
+			batch := NewBatch()
+			if err := chain.disconnectBlock(batch, block); err != nil {
+				return err
+			}
+			return chain.Store.Write(batch)
+		},
+		func(block *Block) error {
+			if err := chain.CheckBlockInputs(block); err != nil {
+				return &invalidBlockError{hash: block.Hash, err: err}
+			}
+			batch := NewBatch()
+			if err := chain.connectBlock(batch, block); err != nil {
+				return &invalidBlockError{hash: block.Hash, err: err}
+			}
+			if err := chain.Store.Write(batch); err != nil {
+				return err
+			}
+			if connected != nil {
+				connected(block)
+			}
+			return nil
+		})
+}
+
+// markInvalid records the block of invalid so it is never connected again
+// and returns invalid.
+func (chain *BlockChain) markInvalid(invalid *invalidBlockError) error {
+	chain.logger.Warn("Rejected invalid block", slog.String("error", invalid.Error()))
+
+	batch := NewBatch()
+	batch.PutIndex(invalidIndex, invalid.hash, []byte(invalid.err.Error()))
+	if err := chain.Store.Write(batch); err != nil {
+		return err
+	}
+
+	return invalid
+}
+
+// branchHeight returns the height of a stored block, counting back to the
+// nearest block with a known height for side branches that lost theirs in
+// a chain state rebuild.
+func (chain *BlockChain) branchHeight(hash []byte) (int, error) {
+	steps := 0
+	for {
+		height, err := chain.GetBlockHeight(hash)
+		if err == nil {
+			return height + steps, nil
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return 0, err
+		}
+
+		block, err := chain.Store.GetBlock(hash)
+		if err != nil {
+			return 0, err
+		}
+		if len(block.PrevHash) == 0 {
+			return steps, nil
+		}
+		hash = block.PrevHash
+		steps++
+	}
+}
@@ -4,75 +4,114 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
-	"fmt"
 	"log"
 	"math"
 	"math/big"
 )
 
+// Difficulty is the proof of work of the main network, in leading zero bits
+// of the block hash.
 const Difficulty = 12
 
+// checkQuitEvery is how many nonces Seal tries between looks at quit.
+const checkQuitEvery = 1 << 16
+
+// ProofOfWork is the consensus engine that seals a block with a nonce
+// giving its header a hash below a target of Bits leading zero bits. Every
+// block has the same target, so each weighs the same.
 type ProofOfWork struct {
-	Block  *Block
-	Target *big.Int
+	Bits   int
+	target *big.Int
 }
 
-func (pow *ProofOfWork) Run() (int, []byte) {
-	var intHash big.Int
-	var hash [32]byte
-
-	nonce := 0
-	fmt.Printf("Mining a new block with difficulty %d\n", Difficulty)
+func NewProofOfWork(bits int) *ProofOfWork {
+	target := big.NewInt(1)
+	target.Lsh(target, uint(256-bits))
 
-	for nonce < math.MaxInt64 {
-		data := pow.InitData(nonce)
-		hash = sha256.Sum256(data)
+	return &ProofOfWork{
+		Bits:   bits,
+		target: target,
+	}
+}
 
-		fmt.Printf("\r%x", hash[:])
-		intHash.SetBytes(hash[:])
+// Seal tries nonces, from the one block has up, until the hash of its
+// header is below the target and sets the nonce and the hash. It gives up
+// when quit is closed, as when the work is outdated, or the nonces run
+// out, returning false.
+func (pow *ProofOfWork) Seal(block *Block, quit <-chan struct{}) bool {
+	header := block.Header()
+	var hashInt big.Int
+
+	for nonce := block.Nonce; nonce < math.MaxInt64; nonce++ {
+		if nonce%checkQuitEvery == 0 {
+			select {
+			case <-quit:
+				return false
+			default:
+			}
+		}
 
-		if intHash.Cmp(pow.Target) == -1 {
-			break
+		header.Nonce = nonce
+		hash := pow.Hash(header)
+		if hashInt.SetBytes(hash).Cmp(pow.target) < 0 {
+			block.Nonce = nonce
+			block.Hash = hash
+			return true
 		}
-		nonce++
 	}
 
-	fmt.Printf("\n\nBlock mined! Nonce: %d\n", nonce)
-
-	return nonce, hash[:]
+	return false
 }
 
-func NewProof(d *Block) *ProofOfWork {
-	target := big.NewInt(1)
-	target.Lsh(target, uint(256-Difficulty))
+// VerifySeal checks that a header hashes to its block hash and that the
+// hash meets the target, which is all a header can be checked for alone.
+func (pow *ProofOfWork) VerifySeal(header *BlockHeader) error {
+	hash := pow.Hash(header)
 
-	return &ProofOfWork{
-		Block:  d,
-		Target: target,
+	if !bytes.Equal(hash, header.Hash) {
+		return rejectf(RejectBadHash, "block hash %x does not match header hash %x", header.Hash, hash)
 	}
+	if new(big.Int).SetBytes(hash).Cmp(pow.target) >= 0 {
+		return rejectf(RejectHighHash, "block hash %x does not meet the target", header.Hash)
+	}
+
+	return nil
 }
 
-func (pow *ProofOfWork) InitData(nonce int) []byte {
-	data := bytes.Join(
-		[][]byte{
-			pow.Block.PrevHash,
-			pow.Block.HashTransactions(),
-			ToHex(int64(nonce)),
-			ToHex(int64(Difficulty)),
-		},
-		[]byte{},
-	)
-	return data
+// CalcNextTarget returns the target, which does not change.
+func (pow *ProofOfWork) CalcNextTarget(*BlockHeader) *big.Int {
+	return new(big.Int).Set(pow.target)
+}
+
+// Weight is the expected number of hashes needed to meet the target.
+func (pow *ProofOfWork) Weight(*BlockHeader) *big.Int {
+	maxHash := new(big.Int).Lsh(big.NewInt(1), 256)
+	denominator := new(big.Int).Add(pow.target, big.NewInt(1))
+
+	return maxHash.Div(maxHash, denominator)
 }
 
-func (pow *ProofOfWork) Validate() bool {
-	var intHash big.Int
+// Hash returns the proof of work hash of header.
+func (pow *ProofOfWork) Hash(header *BlockHeader) []byte {
+	hash := sha256.Sum256(pow.HeaderData(header))
 
-	data := pow.InitData(pow.Block.Nonce)
-	hash := sha256.Sum256(data)
-	intHash.SetBytes(hash[:])
+	return hash[:]
+}
+
+// HeaderData is what the proof of work hashes. Blocks from before versions
+// existed leave the version out.
+func (pow *ProofOfWork) HeaderData(header *BlockHeader) []byte {
+	parts := [][]byte{
+		header.PrevHash,
+		header.TxHash,
+		ToHex(int64(header.Nonce)),
+		ToHex(int64(pow.Bits)),
+	}
+	if header.Version >= 1 {
+		parts = append([][]byte{ToHex(int64(header.Version))}, parts...)
+	}
 
-	return intHash.Cmp(pow.Target) == -1
+	return bytes.Join(parts, []byte{})
 }
 
 func ToHex(num int64) []byte {
@@ -0,0 +1,245 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+const (
+	// headerIndex keeps the header of every block whose body was pruned.
+	headerIndex = "header"
+
+	// MinPruneDepth is the number of recent blocks a pruned node always
+	// keeps, with their undo data, so it can still follow a reorg.
+	MinPruneDepth = 100
+
+	pruneBatchSize = 100
+)
+
+// pruneKey holds the PruneState of a node that prunes or has pruned.
+var pruneKey = []byte("prune")
+
+// ErrPruned is returned for blocks whose body was deleted by pruning.
+var ErrPruned = errors.New("block body is pruned")
+
+// bodyIndexes point into block bodies, so they cannot be kept on a node
+// that prunes.
+var bodyIndexes = []string{txIndexName, addrIndexName}
+
+// PruneState is the pruning setting of a node and how far it got. Only one
+// of Depth and TargetSize is set while pruning is on.
+type PruneState struct {
+	// Depth is the number of recent blocks to keep.
+	Depth int
+	// TargetSize is the number of bytes of recent blocks to keep.
+	TargetSize int64
+	// PrunedHeight is the highest main chain height without a body, -1
+	// when nothing is pruned.
+	PrunedHeight int
+	// Size is the number of bytes of the main chain blocks above
+	// PrunedHeight, kept up to date while pruning by size and zero when
+	// not known.
+	Size int64
+}
+
+// Enabled reports whether blocks are still pruned as the chain grows.
+func (s *PruneState) Enabled() bool {
+	return s.Depth > 0 || s.TargetSize > 0
+}
+
+func (s *PruneState) Serialize() []byte {
+	var res bytes.Buffer
+	err := gob.NewEncoder(&res).Encode(s)
+	ErrHandle(err)
+
+	return res.Bytes()
+}
+
+// SetPruning turns pruning on, keeping either the last depth blocks or about
+// targetSize bytes of recent blocks, and prunes right away. Passing zero for
+// both turns pruning off; blocks already pruned stay pruned.
+func (chain *BlockChain) SetPruning(depth int, targetSize int64) error {
+	if depth > 0 && targetSize > 0 {
+		return errors.New("prune by depth or by size, not both")
+	}
+	if depth > 0 && depth < MinPruneDepth {
+		return fmt.Errorf("prune depth must be at least %d blocks", MinPruneDepth)
+	}
+	if depth > 0 || targetSize > 0 {
+		if chain.snapshotPending() {
+			return errors.New("the UTXO snapshot must be validated before pruning")
+		}
+		for _, name := range bodyIndexes {
+			if chain.HasIndex(name) {
+				return fmt.Errorf("the %s index needs the block bodies pruning deletes, disable it first", name)
+			}
+		}
+	}
+
+	state, err := chain.PruneState()
+	if err != nil {
+		return err
+	}
+	state.Depth, state.TargetSize = depth, targetSize
+	// counted again in full, blocks connected while pruning was off or by
+	// depth were not tracked
+	state.Size = 0
+
+	batch := NewBatch()
+	batch.PutIndex(chainStateIndex, pruneKey, state.Serialize())
+	if err := chain.Store.Write(batch); err != nil {
+		return err
+	}
+
+	return chain.prune()
+}
+
+// PruneState returns the pruning setting, which is off with nothing pruned
+// for a node that never pruned.
+func (chain *BlockChain) PruneState() (*PruneState, error) {
+	data, err := chain.Store.GetIndex(chainStateIndex, pruneKey)
+	if errors.Is(err, ErrNotFound) {
+		return &PruneState{PrunedHeight: -1}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state PruneState
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&state); err != nil {
+		return nil, err
+	}
+
+	return &state, nil
+}
+
+// PruneHeight returns the highest main chain height whose block body is
+// pruned, -1 when none is.
+func (chain *BlockChain) PruneHeight() int {
+	state, err := chain.PruneState()
+	ErrHandle(err)
+
+	return state.PrunedHeight
+}
+
+// GetBlockHeader returns the header of a stored block, pruned or not.
+func (chain *BlockChain) GetBlockHeader(hash []byte) (*BlockHeader, error) {
+	block, err := chain.Store.GetBlock(hash)
+	if err == nil {
+		return block.Header(), nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+
+	data, err := chain.Store.GetIndex(headerIndex, hash)
+	if err != nil {
+		return nil, fmt.Errorf("header of block %x: %w", hash, err)
+	}
+
+	return DeserializeHeader(data), nil
+}
+
+// prune deletes the bodies and undo data of main chain blocks that fell out
+// of the retention window, keeping their headers. By size, it prunes the
+// oldest blocks until those left fit in the target.
+func (chain *BlockChain) prune() error {
+	state, err := chain.PruneState()
+	if err != nil || !state.Enabled() || chain.snapshotPending() {
+		return err
+	}
+
+	tip := chain.GetBestHeight()
+	limit := tip - MinPruneDepth
+	if state.Depth > 0 {
+		limit = min(tip-state.Depth, limit)
+	}
+
+	batch := NewBatch()
+	if state.TargetSize > 0 && state.Size == 0 {
+		if state.Size, err = chain.mainChainSize(state.PrunedHeight + 1); err != nil {
+			return err
+		}
+		batch.PutIndex(chainStateIndex, pruneKey, state.Serialize())
+	}
+
+	pruned := 0
+	for height := state.PrunedHeight + 1; height <= limit; height++ {
+		if state.TargetSize > 0 && state.Size <= state.TargetSize {
+			break
+		}
+		hash, err := chain.GetBlockHash(height)
+		if err != nil {
+			return err
+		}
+		block, err := chain.Store.GetBlock(hash)
+		if err != nil {
+			return err
+		}
+
+		batch.PutIndex(headerIndex, hash, block.Header().Serialize())
+		batch.DeleteBlock(hash)
+		batch.DeleteIndex(undoIndex, hash)
+		state.PrunedHeight = height
+		if state.TargetSize > 0 {
+			state.Size -= blockSize(block)
+		}
+		pruned++
+
+		if pruned%pruneBatchSize == 0 {
+			batch.PutIndex(chainStateIndex, pruneKey, state.Serialize())
+			if err := chain.Store.Write(batch); err != nil {
+				return err
+			}
+			batch = NewBatch()
+		}
+	}
+	if pruned%pruneBatchSize != 0 {
+		batch.PutIndex(chainStateIndex, pruneKey, state.Serialize())
+	}
+	if err := chain.Store.Write(batch); err != nil {
+		return err
+	}
+
+	if pruned > 0 {
+		chain.logger.Info("Pruned blocks", slog.Int("pruned_height", state.PrunedHeight))
+	}
+
+	return nil
+}
+
+// trackPruneSize queues the change to the size of the main chain that
+// connecting (sign 1) or disconnecting (sign -1) block makes, when pruning
+// by size keeps count of it.
+func (chain *BlockChain) trackPruneSize(batch *Batch, block *Block, sign int64) error {
+	state, err := chain.PruneState()
+	if err != nil || state.TargetSize == 0 || state.Size == 0 {
+		return err
+	}
+	state.Size += sign * blockSize(block)
+	batch.PutIndex(chainStateIndex, pruneKey, state.Serialize())
+
+	return nil
+}
+
+// mainChainSize returns the number of bytes of the main chain blocks from
+// height from up to the tip.
+func (chain *BlockChain) mainChainSize(from int) (int64, error) {
+	var size int64
+	for height := from; height <= chain.GetBestHeight(); height++ {
+		block, err := chain.GetBlockByHeight(height)
+		if err != nil {
+			return 0, err
+		}
+		size += blockSize(block)
+	}
+
+	return size, nil
+}
+
+func blockSize(block *Block) int64 {
+	return int64(len(block.Serialize()))
+}
@@ -0,0 +1,101 @@
+package blockchain
+
+import (
+	"fmt"
+	"testing"
+)
+
+func checkPruneSize(t *testing.T, chain *BlockChain, target int64) *PruneState {
+	t.Helper()
+
+	state, err := chain.PruneState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := chain.mainChainSize(state.PrunedHeight + 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Size != want {
+		t.Errorf("tracked size = %d, the unpruned blocks take %d", state.Size, want)
+	}
+	if state.Size > target {
+		t.Errorf("kept %d bytes, more than the target %d", state.Size, target)
+	}
+
+	return state
+}
+
+func TestPruneBySizeTracksSize(t *testing.T) {
+	chain := newTestChain(t, MinPruneDepth+50)
+	defer chain.Store.Close()
+
+	sizes := make(map[int]int64)
+	for height := 0; height <= chain.GetBestHeight(); height++ {
+		block, err := chain.GetBlockByHeight(height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[height] = blockSize(block)
+	}
+	target := sizes[chain.GetBestHeight()] * (MinPruneDepth + 20)
+
+	if err := chain.SetPruning(0, target); err != nil {
+		t.Fatal(err)
+	}
+	state := checkPruneSize(t, chain, target)
+	if state.PrunedHeight < 0 {
+		t.Fatal("nothing was pruned")
+	}
+	// pruning stops as soon as what is left fits
+	if state.Size+sizes[state.PrunedHeight] <= target {
+		t.Errorf("pruned up to %d, block %d alone would have fit", state.PrunedHeight, state.PrunedHeight)
+	}
+
+	for i := 0; i < 20; i++ {
+		chain.AddBlock([]*Transaction{CoinbaseTx(testAddr, fmt.Sprintf("more %d", i))})
+	}
+	checkPruneSize(t, chain, target)
+
+	chain.DisconnectTip()
+	checkPruneSize(t, chain, target)
+
+	if report := chain.VerifyChain(VerifyUTXOSet, 0); !report.OK {
+		t.Errorf("pruned chain failed verification: %+v", report.Failure)
+	}
+}
+
+func TestSetPruningRefusesBodyIndexes(t *testing.T) {
+	chain := newTestChain(t, 2)
+	defer chain.Store.Close()
+
+	for _, name := range bodyIndexes {
+		if err := chain.EnableIndex(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := chain.SetPruning(MinPruneDepth, 0); err == nil {
+		t.Fatal("pruning turned on with the transaction and address indexes")
+	}
+	if state, err := chain.PruneState(); err != nil || state.Enabled() {
+		t.Fatalf("prune state = %+v, %v, want pruning off", state, err)
+	}
+
+	for _, name := range bodyIndexes {
+		if err := chain.DisableIndex(name); err != nil {
+			t.Fatal(err)
+		}
+		if chain.HasIndex(name) {
+			t.Errorf("%s index still enabled", name)
+		}
+		err := chain.Store.ForEachIndex(name, nil, func(key, _ []byte) error {
+			return fmt.Errorf("%s index kept key %x", name, key)
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if err := chain.SetPruning(MinPruneDepth, 0); err != nil {
+		t.Fatalf("pruning with the indexes disabled: %v", err)
+	}
+}
@@ -0,0 +1,357 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+)
+
+const (
+	// invalidIndex records blocks that broke a consensus rule, so they and
+	// their descendants are never picked as the tip again.
+	invalidIndex = "invalid"
+
+	reindexLogInterval = 500
+)
+
+// reindexKey holds the ReindexState while a reindex is in progress.
+var reindexKey = []byte("reindex")
+
+// ReindexState is the progress of an interrupted reindex.
+type ReindexState struct {
+	Target       []byte
+	TargetHeight int
+	Wiped        bool
+}
+
+// invalidBlockError is returned when a block fails validation while the
+// chain state is moved onto it.
+type invalidBlockError struct {
+	hash []byte
+	err  error
+}
+
+func (e *invalidBlockError) Error() string {
+	return fmt.Sprintf("block %x is invalid: %v", e.hash, e.err)
+}
+
+func (e *invalidBlockError) Unwrap() error {
+	return e.err
+}
+
+// blockNode is a stored block as seen by the reindex block tree.
+type blockNode struct {
+	hash      []byte
+	prev      string
+	genesis   bool
+	height    int
+	work      *big.Int
+	chainWork *big.Int
+	valid     bool
+}
+
+// Reindex throws away every structure derived from the stored blocks (the
+// UTXO set, undo data, height and optional indexes) and rebuilds it from the
+// blocks alone, moving the tip to the valid branch with the most work. It
+// resumes an earlier run that was interrupted. A chain state from a UTXO
+// snapshot that failed validation is thrown away with the snapshot.
+func (chain *BlockChain) Reindex() error {
+	if chain.snapshotPending() && !chain.snapshotFailed() {
+		return errors.New("the chain state comes from a UTXO snapshot, its history must be validated before a reindex")
+	}
+	if chain.PruneHeight() >= 0 {
+		return errors.New("a pruned node cannot reindex, its old blocks are gone")
+	}
+
+	state, err := chain.loadReindexState()
+	if err != nil {
+		return err
+	}
+
+	if state == nil {
+		target, height, err := chain.pickBestBranch()
+		if err != nil {
+			return err
+		}
+		state = &ReindexState{Target: target, TargetHeight: height}
+		if err := chain.saveReindexState(state); err != nil {
+			return err
+		}
+	} else {
+		chain.logger.Info("Resuming interrupted reindex", slog.Int("target_height", state.TargetHeight))
+	}
+
+	indexers := chain.indexers
+	if !state.Wiped {
+		chain.indexers = nil
+		if err := chain.dropSnapshot(); err != nil {
+			return err
+		}
+		if err := chain.wipeChainState(); err != nil {
+			return err
+		}
+		for _, idx := range indexers {
+			if err := chain.wipeIndex(idx.Name()); err != nil {
+				return err
+			}
+		}
+		state.Wiped = true
+		if err := chain.saveReindexState(state); err != nil {
+			return err
+		}
+	}
+	chain.indexers = indexers
+
+	for {
+		err := chain.reindexTo(state)
+		var invalid *invalidBlockError
+		if !errors.As(err, &invalid) {
+			if err != nil {
+				return err
+			}
+			break
+		}
+
+		if err := chain.markInvalid(invalid); err != invalid {
+			return err
+		}
+
+		target, height, err := chain.pickBestBranch()
+		if err != nil {
+			return err
+		}
+		state.Target, state.TargetHeight = target, height
+		if err := chain.saveReindexState(state); err != nil {
+			return err
+		}
+	}
+
+	batch := NewBatch()
+	batch.SetTip(state.Target)
+	batch.DeleteIndex(chainStateIndex, reindexKey)
+	if err := chain.Store.Write(batch); err != nil {
+		return err
+	}
+	chain.LastHash = state.Target
+
+	chain.logger.Info("Reindex finished",
+		slog.String("tip", fmt.Sprintf("%x", state.Target)),
+		slog.Int("height", state.TargetHeight))
+
+	return nil
+}
+
+// reindexTo moves the chain state onto state.Target, fully validating every
+// block it connects.
+func (chain *BlockChain) reindexTo(state *ReindexState) error {
+	best, err := chain.Store.GetIndex(chainStateIndex, chainStateBestKey)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	connected := 0
+	return chain.moveChainStateValidated(best, state.Target, func(block *Block) {
+		connected++
+		if connected%reindexLogInterval == 0 {
+			height, _ := chain.GetBlockHeight(block.Hash)
+			chain.logger.Info("Reindexing",
+				slog.Int("height", height),
+				slog.Int("target_height", state.TargetHeight))
+		}
+	})
+}
+
+// pickBestBranch scans every stored block and returns the tip of the valid
+// branch with the most work. Blocks that fail the context free checks are
+// marked invalid on the way. Ties keep the current tip.
+func (chain *BlockChain) pickBestBranch() ([]byte, int, error) {
+	invalid, err := chain.invalidBlocks()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	nodes := make(map[string]*blockNode)
+	batch := NewBatch()
+	scanned := 0
+
+	err = chain.Store.ForEachBlock(func(block *Block) error {
+		node := &blockNode{hash: block.Hash, prev: string(block.PrevHash), genesis: len(block.PrevHash) == 0}
+		node.work = Engine().Weight(block.Header())
+		node.valid = !invalid[string(block.Hash)]
+
+		if node.valid {
+			err := CheckProofOfWork(block)
+			if err == nil {
+				err = CheckTransactions(block)
+			}
+			if err != nil {
+				node.valid = false
+				batch.PutIndex(invalidIndex, block.Hash, []byte(err.Error()))
+				chain.logger.Warn("Found invalid block", slog.String("error", err.Error()))
+			}
+		}
+		nodes[string(block.Hash)] = node
+
+		scanned++
+		if scanned%reindexLogInterval == 0 {
+			chain.logger.Info("Scanning stored blocks", slog.Int("blocks", scanned))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := chain.Store.Write(batch); err != nil {
+		return nil, 0, err
+	}
+
+	best := bestNode(nodes, chain.LastHash)
+	if best == nil {
+		return nil, 0, errors.New("no valid chain found in store")
+	}
+
+	chain.logger.Info("Picked best branch",
+		slog.Int("blocks", scanned),
+		slog.String("tip", fmt.Sprintf("%x", best.hash)),
+		slog.Int("height", best.height))
+
+	return best.hash, best.height, nil
+}
+
+// invalidBlocks returns the hashes of the blocks marked invalid.
+func (chain *BlockChain) invalidBlocks() (map[string]bool, error) {
+	invalid := make(map[string]bool)
+	err := chain.Store.ForEachIndex(invalidIndex, nil, func(key, _ []byte) error {
+		invalid[string(key)] = true
+		return nil
+	})
+
+	return invalid, err
+}
+
+// bestNode returns the valid node with the most chain work, nil when there
+// is none. Ties keep tip, then go to the lowest hash so the pick does not
+// depend on map order.
+func bestNode(nodes map[string]*blockNode, tip []byte) *blockNode {
+	var best *blockNode
+	for _, node := range nodes {
+		if !resolveNode(nodes, node) {
+			continue
+		}
+		if best == nil {
+			best = node
+			continue
+		}
+		switch node.chainWork.Cmp(best.chainWork) {
+		case 1:
+			best = node
+		case 0:
+			if bytes.Equal(node.hash, tip) ||
+				(!bytes.Equal(best.hash, tip) && bytes.Compare(node.hash, best.hash) < 0) {
+				best = node
+			}
+		}
+	}
+
+	return best
+}
+
+// resolveNode fills in height and chain work for node and its ancestors and
+// reports whether node is valid. A node is not valid when it or an ancestor
+// failed validation or its branch does not reach a genesis block.
+func resolveNode(nodes map[string]*blockNode, node *blockNode) bool {
+	var path []*blockNode
+	// base is the first ancestor that is already resolved or invalid, it
+	// stays nil when the walk ends at a genesis block
+	var base *blockNode
+
+	for n := node; ; {
+		if n.chainWork != nil || !n.valid {
+			base = n
+			break
+		}
+		path = append(path, n)
+		if n.genesis {
+			break
+		}
+		parent, ok := nodes[n.prev]
+		if !ok {
+			n.valid = false
+			path, base = path[:len(path)-1], n
+			break
+		}
+		n = parent
+	}
+
+	for i := len(path) - 1; i >= 0; i-- {
+		n := path[i]
+		if n.genesis {
+			n.height, n.chainWork = 0, new(big.Int).Set(n.work)
+			continue
+		}
+
+		parent := base
+		if i+1 < len(path) {
+			parent = path[i+1]
+		}
+		if !parent.valid {
+			n.valid = false
+			continue
+		}
+		n.height = parent.height + 1
+		n.chainWork = new(big.Int).Add(parent.chainWork, n.work)
+	}
+
+	return node.valid
+}
+
+// loadIndexesNoCatchUp attaches every enabled index as it is, for a chain
+// state that is still being rebuilt by Reindex.
+func (chain *BlockChain) loadIndexesNoCatchUp() error {
+	chain.indexers = nil
+
+	for _, name := range IndexNames() {
+		_, err := chain.Store.GetIndex(chainStateIndex, indexBestKey(name))
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		chain.indexers = append(chain.indexers, availableIndexers[name]())
+	}
+
+	return nil
+}
+
+func (chain *BlockChain) loadReindexState() (*ReindexState, error) {
+	data, err := chain.Store.GetIndex(chainStateIndex, reindexKey)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state ReindexState
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&state); err != nil {
+		return nil, err
+	}
+
+	return &state, nil
+}
+
+func (chain *BlockChain) saveReindexState(state *ReindexState) error {
+	var res bytes.Buffer
+	if err := gob.NewEncoder(&res).Encode(state); err != nil {
+		return err
+	}
+
+	batch := NewBatch()
+	batch.PutIndex(chainStateIndex, reindexKey, res.Bytes())
+
+	return chain.Store.Write(batch)
+}
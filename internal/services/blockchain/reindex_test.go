@@ -0,0 +1,85 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// assertReindexed checks that the chain ended a reindex on tip at height.
+func assertReindexed(t *testing.T, chain *BlockChain, tip *Block, height int) {
+	t.Helper()
+
+	if !bytes.Equal(chain.LastHash, tip.Hash) {
+		t.Errorf("tip = %x, want %x", chain.LastHash, tip.Hash)
+	}
+	if got, err := chain.GetBlockHeight(tip.Hash); err != nil || got != height {
+		t.Errorf("height of the tip = %d, %v, want %d", got, err, height)
+	}
+	if _, err := chain.Store.GetIndex(chainStateIndex, reindexKey); !errors.Is(err, ErrNotFound) {
+		t.Errorf("reindex state kept after the reindex: %v", err)
+	}
+	if report := chain.VerifyChain(VerifyUTXOSet, 0); !report.OK {
+		t.Errorf("reindexed chain failed verification: %+v", report.Failure)
+	}
+}
+
+func TestReindexResumes(t *testing.T) {
+	chain := newTestChain(t, 2)
+	defer chain.Store.Close()
+	genesis, err := chain.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a fresh pick keeps the tip on a tie, the saved state names the other
+	// branch
+	side := storeBranch(t, chain.Store, genesis.Hash, 2, "side")
+
+	if err := chain.saveReindexState(&ReindexState{Target: side[1].Hash, TargetHeight: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.Reindex(); err != nil {
+		t.Fatal(err)
+	}
+	assertReindexed(t, chain, side[1], 2)
+}
+
+func TestReindexMarksInvalidBranch(t *testing.T) {
+	chain := newTestChain(t, 2)
+	defer chain.Store.Close()
+	tip, err := chain.GetBlock(chain.LastHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis, err := chain.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the branch with the most work creates too much in its second block,
+	// which only shows once the block is connected
+	first := storeBranch(t, chain.Store, genesis.Hash, 1, "heavy")[0]
+	greedy := CreateBlock([]*Transaction{NewCoinbaseTx(testAddr, "greedy", Subsidy+1)}, first.Hash)
+	batch := NewBatch()
+	batch.PutBlock(greedy)
+	if err := chain.Store.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	storeBranch(t, chain.Store, greedy.Hash, 1, "heavy after")
+
+	if err := chain.Reindex(); err != nil {
+		t.Fatal(err)
+	}
+	assertReindexed(t, chain, tip, 2)
+
+	invalid, err := chain.invalidBlocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !invalid[string(greedy.Hash)] {
+		t.Errorf("block %x creating too much not marked invalid", greedy.Hash)
+	}
+	if invalid[string(first.Hash)] {
+		t.Errorf("valid parent %x of the invalid block marked invalid", first.Hash)
+	}
+}
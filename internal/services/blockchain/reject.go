@@ -0,0 +1,58 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+)
+
+// RejectCode names the rule a block or transaction broke.
+type RejectCode string
+
+const (
+	RejectBadHash         RejectCode = "bad-hash"
+	RejectHighHash        RejectCode = "high-hash"
+	RejectNoTransactions  RejectCode = "bad-blk-empty"
+	RejectBadTxID         RejectCode = "bad-txid"
+	RejectDuplicateTx     RejectCode = "bad-txns-duplicate"
+	RejectCoinbasePos     RejectCode = "bad-cb-position"
+	RejectCoinbaseAmount  RejectCode = "bad-cb-amount"
+	RejectNoInputs        RejectCode = "bad-txns-noinputs"
+	RejectNegativeOutput  RejectCode = "bad-txns-vout-negative"
+	RejectMissingInputs   RejectCode = "bad-txns-inputs-missing"
+	RejectDoubleSpend     RejectCode = "bad-txns-double-spend"
+	RejectWrongKey        RejectCode = "bad-txns-wrong-key"
+	RejectBadSignature    RejectCode = "bad-txns-signature"
+	RejectValueCreated    RejectCode = "bad-txns-in-belowout"
+	RejectInvalidPrevious RejectCode = "bad-prevblk"
+	RejectOtherGenesis    RejectCode = "bad-genesis"
+	RejectLooseCoinbase   RejectCode = "coinbase"
+)
+
+// RejectError is a block or transaction that broke the rule Code.
+type RejectError struct {
+	Code RejectCode
+	Err  error
+}
+
+func (e *RejectError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RejectError) Unwrap() error {
+	return e.Err
+}
+
+// RejectCodeOf returns the rule err reports as broken, "" when err is not
+// a rule failure, such as a store error.
+func RejectCodeOf(err error) RejectCode {
+	var reject *RejectError
+	if errors.As(err, &reject) {
+		return reject.Code
+	}
+
+	return ""
+}
+
+func rejectf(code RejectCode, format string, args ...any) error {
+	return &RejectError{Code: code, Err: fmt.Errorf(format, args...)}
+}
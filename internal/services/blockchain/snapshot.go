@@ -0,0 +1,598 @@
+package blockchain
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+const (
+	// snapshotUTXOIndex holds the UTXO set the background validation builds
+	// from the history below a loaded snapshot, keyed like the main set.
+	snapshotUTXOIndex = "snapshotutxo"
+
+	snapshotVersion   = 1
+	snapshotBatchSize = 10000
+	maxPublicKeyHash  = 1 << 10
+)
+
+// ErrSnapshotInvalid is returned for blocks that would extend a chain state
+// taken from a UTXO snapshot that failed validation. Only a reindex from the
+// blocks brings such a chain back.
+var ErrSnapshotInvalid = errors.New("the UTXO snapshot the chain state comes from failed validation, reindex from the blocks")
+
+// snapshotMagic starts every UTXO snapshot file.
+var snapshotMagic = [4]byte{'B', 'C', 'U', 'S'}
+
+var (
+	// snapshotKey holds the SnapshotState of a node started from a snapshot.
+	snapshotKey = []byte("snapshot")
+	// snapshotHistoryKey holds the last history block stored below the
+	// snapshot base.
+	snapshotHistoryKey = []byte("snapshot-history")
+	// snapshotBestKey holds the last history block the background
+	// validation has applied.
+	snapshotBestKey = []byte("snapshot-best")
+)
+
+// SnapshotHeader starts a UTXO snapshot file, written big-endian after the
+// magic. It is followed by the base block as a big-endian uint32 length and
+// the serialized block, then Coins entries. UTXOHash is the SHA-256 of the
+// entries exactly as written.
+type SnapshotHeader struct {
+	Version    uint32
+	Network    uint32
+	Genesis    [32]byte
+	BaseHash   [32]byte
+	BaseHeight uint64
+	Coins      uint64
+	UTXOHash   [32]byte
+}
+
+// SnapshotState describes the snapshot a node was started from.
+type SnapshotState struct {
+	Genesis    []byte
+	BaseHash   []byte
+	BaseHeight int
+	UTXOHash   []byte
+	// Validated is set once the blocks below the base replayed to the same
+	// UTXO set.
+	Validated bool
+	// Failure is set when they did not.
+	Failure string
+}
+
+// DumpUTXOSet writes the UTXO set at the tip to w as a snapshot file.
+func (chain *BlockChain) DumpUTXOSet(w io.Writer) (*SnapshotHeader, error) {
+	genesis, err := chain.genesisHash()
+	if err != nil {
+		return nil, err
+	}
+	base, err := chain.GetBlock(chain.LastHash)
+	if err != nil {
+		return nil, err
+	}
+
+	header := &SnapshotHeader{
+		Version:    snapshotVersion,
+		Network:    ActiveNetwork().Magic,
+		BaseHeight: uint64(chain.GetBestHeight()),
+	}
+	copy(header.Genesis[:], genesis)
+	copy(header.BaseHash[:], base.Hash)
+
+	// the header carries the count and the hash, so the set is read twice
+	hasher := sha256.New()
+	err = chain.Store.ForEachUTXO(func(txID []byte, out int, output TxOutput) error {
+		header.Coins++
+		return writeCoin(hasher, txID, out, output)
+	})
+	if err != nil {
+		return nil, err
+	}
+	copy(header.UTXOHash[:], hasher.Sum(nil))
+
+	if _, err := w.Write(snapshotMagic[:]); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(w, binary.BigEndian, header); err != nil {
+		return nil, err
+	}
+	data := base.Serialize()
+	if err := binary.Write(w, binary.BigEndian, uint32(len(data))); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+
+	err = chain.Store.ForEachUTXO(func(txID []byte, out int, output TxOutput) error {
+		return writeCoin(w, txID, out, output)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return header, nil
+}
+
+// LoadSnapshotWithStore starts a chain in an empty store from the UTXO
+// snapshot in r. The chain state is usable right away at the snapshot base;
+// the blocks below it are validated later by ValidateSnapshot.
+func LoadSnapshotWithStore(logger slog.Logger, store ChainStore, blockHash []byte, r io.Reader) (*BlockChain, error) {
+	var magic [4]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil || magic != snapshotMagic {
+		return nil, errors.New("not a UTXO snapshot file")
+	}
+
+	var header SnapshotHeader
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return nil, fmt.Errorf("snapshot header: %w", err)
+	}
+	if header.Version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", header.Version)
+	}
+	if magic := ActiveNetwork().Magic; header.Network != magic {
+		return nil, fmt.Errorf("snapshot is for network %08x, not %08x", header.Network, magic)
+	}
+	if !bytes.Equal(header.BaseHash[:], blockHash) {
+		return nil, fmt.Errorf("snapshot is taken at block %x, not %x", header.BaseHash, blockHash)
+	}
+
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, fmt.Errorf("snapshot base block: %w", err)
+	}
+	if size > maxBootstrapBlockSize {
+		return nil, fmt.Errorf("snapshot base block of %d bytes is too large", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("snapshot base block: %w", err)
+	}
+	base, err := DeserializeBlock(data)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(base.Hash, blockHash) {
+		return nil, fmt.Errorf("snapshot base block is %x, not %x", base.Hash, blockHash)
+	}
+	if err := CheckProofOfWork(base); err != nil {
+		return nil, err
+	}
+	if err := CheckTransactions(base); err != nil {
+		return nil, err
+	}
+
+	chain := &BlockChain{
+		logger: logger,
+		Store:  store,
+	}
+	if err := chain.wipeChainState(); err != nil {
+		return nil, err
+	}
+
+	hasher := sha256.New()
+	coins := bufio.NewReader(r)
+	batch := NewBatch()
+	for i := uint64(0); i < header.Coins; i++ {
+		txID, out, output, err := readCoin(coins)
+		if err != nil {
+			return nil, fmt.Errorf("snapshot coin %d: %w", i, err)
+		}
+		writeCoin(hasher, txID, out, output)
+		batch.PutUTXO(txID, out, output)
+
+		if batch.Len() >= snapshotBatchSize {
+			if err := store.Write(batch); err != nil {
+				return nil, err
+			}
+			batch = NewBatch()
+			logger.Info("Loading snapshot", slog.Uint64("coins", i+1), slog.Uint64("total", header.Coins))
+		}
+	}
+	if _, err := coins.ReadByte(); !errors.Is(err, io.EOF) {
+		return nil, errors.New("snapshot has data after the last coin")
+	}
+	if !bytes.Equal(hasher.Sum(nil), header.UTXOHash[:]) {
+		return nil, errors.New("snapshot coins do not match the UTXO hash in its header")
+	}
+
+	state := &SnapshotState{
+		Genesis:    header.Genesis[:],
+		BaseHash:   base.Hash,
+		BaseHeight: int(header.BaseHeight),
+		UTXOHash:   header.UTXOHash[:],
+	}
+	batch.PutBlock(base)
+	batch.PutIndex(heightIndex, heightKey(state.BaseHeight), base.Hash)
+	batch.PutIndex(blockHeightIndex, base.Hash, heightKey(state.BaseHeight))
+	batch.PutIndex(chainStateIndex, chainStateBestKey, base.Hash)
+	batch.PutIndex(chainStateIndex, snapshotKey, state.Serialize())
+	batch.SetTip(base.Hash)
+	if err := store.Write(batch); err != nil {
+		return nil, err
+	}
+
+	chain.LastHash = base.Hash
+	chain.setSnapshot(state)
+	chain.historyAdded = make(chan struct{}, 1)
+
+	logger.Info("Loaded UTXO snapshot",
+		slog.String("base", fmt.Sprintf("%x", base.Hash)),
+		slog.Int("height", state.BaseHeight),
+		slog.Uint64("coins", header.Coins))
+
+	return chain, nil
+}
+
+// Snapshot returns the snapshot the chain was started from, or nil.
+func (chain *BlockChain) Snapshot() *SnapshotState {
+	chain.snapshotMu.Lock()
+	defer chain.snapshotMu.Unlock()
+
+	if chain.snapshot == nil {
+		return nil
+	}
+	state := *chain.snapshot
+
+	return &state
+}
+
+// snapshotPending reports whether the chain runs on a snapshot whose history
+// is not validated yet. Nothing below the base can be relied on until then.
+func (chain *BlockChain) snapshotPending() bool {
+	state := chain.Snapshot()
+
+	return state != nil && !state.Validated
+}
+
+// snapshotFailed reports whether the chain runs on a snapshot whose history
+// did not replay to it, so its chain state is known to be wrong.
+func (chain *BlockChain) snapshotFailed() bool {
+	state := chain.Snapshot()
+
+	return state != nil && state.Failure != ""
+}
+
+// dropSnapshot forgets the snapshot the chain was started from, with what
+// its validation left behind, so the chain state can be rebuilt from the
+// blocks alone. The snapshot markers go last, so a drop cut short is done
+// again.
+func (chain *BlockChain) dropSnapshot() error {
+	batch, err := chain.clearIndex(NewBatch(), snapshotUTXOIndex)
+	if err != nil {
+		return err
+	}
+	batch.DeleteIndex(chainStateIndex, snapshotKey)
+	batch.DeleteIndex(chainStateIndex, snapshotBestKey)
+	batch.DeleteIndex(chainStateIndex, snapshotHistoryKey)
+	if err := chain.Store.Write(batch); err != nil {
+		return err
+	}
+	chain.setSnapshot(nil)
+
+	return nil
+}
+
+// ValidateSnapshot replays the blocks below the snapshot base on a separate
+// UTXO set as they become available and compares the result with the
+// snapshot once it reaches the base. When the next block is missing it waits
+// for ProcessBlock to store it, or returns once stop is closed.
+func (chain *BlockChain) ValidateSnapshot(stop <-chan struct{}) error {
+	state := chain.Snapshot()
+	if state == nil || state.Validated || state.Failure != "" {
+		return nil
+	}
+
+	best, err := chain.Store.GetIndex(chainStateIndex, snapshotBestKey)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	next := 0
+	if len(best) > 0 {
+		height, err := chain.GetBlockHeight(best)
+		if err != nil {
+			return err
+		}
+		next = height + 1
+	}
+
+	for ; next <= state.BaseHeight; next++ {
+		hash, err := chain.GetBlockHash(next)
+		for errors.Is(err, ErrNotFound) {
+			select {
+			case <-stop:
+				return nil
+			case <-chain.historyAdded:
+			}
+			hash, err = chain.GetBlockHash(next)
+		}
+		if err != nil {
+			return err
+		}
+
+		block, err := chain.GetBlock(hash)
+		if err != nil {
+			return err
+		}
+		if err := chain.connectHistoryBlock(block); err != nil {
+			return chain.failSnapshot(state, fmt.Sprintf("block %x at height %d: %v", block.Hash, next, err))
+		}
+
+		if next%reindexLogInterval == 0 {
+			chain.logger.Info("Validating snapshot history",
+				slog.Int("height", next),
+				slog.Int("base_height", state.BaseHeight))
+		}
+	}
+
+	replayed, err := hashUTXOSet(func(fn func(txID []byte, out int, output TxOutput) error) error {
+		return chain.Store.ForEachIndex(snapshotUTXOIndex, nil, func(key, value []byte) error {
+			txID, out := splitOutpoint(key)
+			return fn(txID, out, deserializeOutput(value))
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(replayed, state.UTXOHash) {
+		return chain.failSnapshot(state, fmt.Sprintf("history replays to UTXO hash %x, the snapshot has %x", replayed, state.UTXOHash))
+	}
+
+	state.Validated = true
+	batch := NewBatch()
+	err = chain.Store.ForEachIndex(snapshotUTXOIndex, nil, func(key, _ []byte) error {
+		batch.DeleteIndex(snapshotUTXOIndex, key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	batch.DeleteIndex(chainStateIndex, snapshotBestKey)
+	batch.DeleteIndex(chainStateIndex, snapshotHistoryKey)
+	batch.PutIndex(chainStateIndex, snapshotKey, state.Serialize())
+	if err := chain.Store.Write(batch); err != nil {
+		return err
+	}
+	chain.setSnapshot(state)
+
+	chain.logger.Info("Snapshot validated", slog.Int("base_height", state.BaseHeight))
+
+	return nil
+}
+
+// connectHistoryBlock applies a block below the snapshot base to the
+// background UTXO set, writing undo data so the block can be disconnected
+// like any other once the snapshot is validated.
+func (chain *BlockChain) connectHistoryBlock(block *Block) error {
+	getUTXO := func(txID []byte, out int) (TxOutput, error) {
+		data, err := chain.Store.GetIndex(snapshotUTXOIndex, outpointBytes(txID, out))
+		if err != nil {
+			return TxOutput{}, err
+		}
+		return deserializeOutput(data), nil
+	}
+
+	if err := checkBlockInputs(block, getUTXO); err != nil {
+		return err
+	}
+
+	batch := NewBatch()
+	undo := &BlockUndo{}
+	created := make(map[string]bool)
+	for _, tx := range block.Transactions {
+		if !tx.IsCoinbase() {
+			for _, in := range tx.Inputs {
+				if !created[outpointKey(in.ID, in.Out)] {
+					output, err := getUTXO(in.ID, in.Out)
+					if err != nil {
+						return err
+					}
+					undo.Spent = append(undo.Spent, SpentOutput{in.ID, in.Out, output})
+				}
+				batch.DeleteIndex(snapshotUTXOIndex, outpointBytes(in.ID, in.Out))
+			}
+		}
+		for outIdx, out := range tx.Outputs {
+			created[outpointKey(tx.ID, outIdx)] = true
+			batch.PutIndex(snapshotUTXOIndex, outpointBytes(tx.ID, outIdx), serializeOutput(out))
+		}
+	}
+	batch.PutIndex(undoIndex, block.Hash, undo.Serialize())
+	batch.PutIndex(chainStateIndex, snapshotBestKey, block.Hash)
+
+	return chain.Store.Write(batch)
+}
+
+// processHistoryBlock stores a block below the base of a snapshot that is
+// not validated yet. It reports false for blocks that are not history.
+// History is accepted in order only, so the stored blocks form a single
+// chain ending at the base.
+func (chain *BlockChain) processHistoryBlock(block *Block) (bool, error) {
+	state := chain.Snapshot()
+
+	tip, err := chain.Store.GetIndex(chainStateIndex, snapshotHistoryKey)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return true, err
+	}
+
+	height := 0
+	if len(block.PrevHash) > 0 {
+		prevHeight, err := chain.GetBlockHeight(block.PrevHash)
+		if errors.Is(err, ErrNotFound) {
+			return false, nil
+		}
+		if err != nil {
+			return true, err
+		}
+		height = prevHeight + 1
+	}
+	if height >= state.BaseHeight {
+		return false, nil
+	}
+
+	switch {
+	case !bytes.Equal(block.PrevHash, tip):
+		return true, fmt.Errorf("block %x does not extend the snapshot history", block.Hash)
+	case height == 0 && !bytes.Equal(block.Hash, state.Genesis):
+		return true, rejectf(RejectOtherGenesis, "block %x is a genesis block of another chain", block.Hash)
+	}
+	if height == state.BaseHeight-1 {
+		base, err := chain.GetBlock(state.BaseHash)
+		if err != nil {
+			return true, err
+		}
+		if !bytes.Equal(block.Hash, base.PrevHash) {
+			return true, fmt.Errorf("block %x is not the parent of the snapshot base", block.Hash)
+		}
+	}
+
+	batch := NewBatch()
+	batch.PutBlock(block)
+	batch.PutIndex(heightIndex, heightKey(height), block.Hash)
+	batch.PutIndex(blockHeightIndex, block.Hash, heightKey(height))
+	batch.PutIndex(chainStateIndex, snapshotHistoryKey, block.Hash)
+	if err := chain.Store.Write(batch); err != nil {
+		return true, err
+	}
+
+	select {
+	case chain.historyAdded <- struct{}{}:
+	default:
+	}
+
+	return true, nil
+}
+
+// loadSnapshot picks up the snapshot state of a chain opened from the store.
+func (chain *BlockChain) loadSnapshot() error {
+	data, err := chain.Store.GetIndex(chainStateIndex, snapshotKey)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var state SnapshotState
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&state); err != nil {
+		return err
+	}
+	chain.setSnapshot(&state)
+	chain.historyAdded = make(chan struct{}, 1)
+
+	switch {
+	case state.Failure != "":
+		chain.logger.Error("The UTXO snapshot this chain started from failed validation, no blocks are accepted until a reindex",
+			slog.String("error", state.Failure))
+	case !state.Validated:
+		chain.logger.Warn("Running on a UTXO snapshot whose history is not validated yet",
+			slog.Int("base_height", state.BaseHeight))
+	}
+
+	return nil
+}
+
+func (chain *BlockChain) failSnapshot(state *SnapshotState, failure string) error {
+	state.Failure = failure
+
+	batch := NewBatch()
+	batch.PutIndex(chainStateIndex, snapshotKey, state.Serialize())
+	if err := chain.Store.Write(batch); err != nil {
+		return err
+	}
+	chain.setSnapshot(state)
+
+	chain.logger.Error("UTXO snapshot failed validation, no blocks are accepted until a reindex", slog.String("error", failure))
+
+	return errors.New(failure)
+}
+
+func (chain *BlockChain) setSnapshot(state *SnapshotState) {
+	chain.snapshotMu.Lock()
+	defer chain.snapshotMu.Unlock()
+
+	chain.snapshot = state
+}
+
+// genesisHash returns the hash of the genesis block, which a chain started
+// from a snapshot may not have stored yet.
+func (chain *BlockChain) genesisHash() ([]byte, error) {
+	hash, err := chain.GetBlockHash(0)
+	if errors.Is(err, ErrNotFound) {
+		if state := chain.Snapshot(); state != nil {
+			return state.Genesis, nil
+		}
+	}
+
+	return hash, err
+}
+
+func (s *SnapshotState) Serialize() []byte {
+	var res bytes.Buffer
+	err := gob.NewEncoder(&res).Encode(s)
+	ErrHandle(err)
+
+	return res.Bytes()
+}
+
+// hashUTXOSet hashes the coins forEach visits the way a snapshot file
+// commits to them. forEach must visit them in key order.
+func hashUTXOSet(forEach func(fn func(txID []byte, out int, output TxOutput) error) error) ([]byte, error) {
+	hasher := sha256.New()
+	err := forEach(func(txID []byte, out int, output TxOutput) error {
+		return writeCoin(hasher, txID, out, output)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return hasher.Sum(nil), nil
+}
+
+// writeCoin writes one snapshot entry: the 32 byte transaction ID, the
+// output index, the value and the public key hash with its length.
+func writeCoin(w io.Writer, txID []byte, out int, output TxOutput) error {
+	var entry bytes.Buffer
+	var id [32]byte
+	copy(id[:], txID)
+
+	entry.Write(id[:])
+	binary.Write(&entry, binary.BigEndian, uint32(out))
+	binary.Write(&entry, binary.BigEndian, int64(output.Value))
+	binary.Write(&entry, binary.BigEndian, uint16(len(output.PublicKeyHash)))
+	entry.Write(output.PublicKeyHash)
+
+	_, err := w.Write(entry.Bytes())
+
+	return err
+}
+
+func readCoin(r io.Reader) ([]byte, int, TxOutput, error) {
+	var fixed struct {
+		TxID  [32]byte
+		Out   uint32
+		Value int64
+		Len   uint16
+	}
+	if err := binary.Read(r, binary.BigEndian, &fixed); err != nil {
+		return nil, 0, TxOutput{}, err
+	}
+	if fixed.Len > maxPublicKeyHash {
+		return nil, 0, TxOutput{}, fmt.Errorf("public key hash of %d bytes is too long", fixed.Len)
+	}
+
+	pubKeyHash := make([]byte, fixed.Len)
+	if _, err := io.ReadFull(r, pubKeyHash); err != nil {
+		return nil, 0, TxOutput{}, err
+	}
+
+	return fixed.TxID[:], int(fixed.Out), TxOutput{Value: int(fixed.Value), PublicKeyHash: pubKeyHash}, nil
+}
@@ -0,0 +1,130 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// loadSnapshotOf starts a chain from a snapshot of the tip of source and
+// hands it the history below the base.
+func loadSnapshotOf(t *testing.T, source *BlockChain) *BlockChain {
+	t.Helper()
+
+	var file bytes.Buffer
+	if _, err := source.DumpUTXOSet(&file); err != nil {
+		t.Fatal(err)
+	}
+
+	chain, err := LoadSnapshotWithStore(*discardLogger(), NewMemoryStore(), source.LastHash, &file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for height := 0; height < source.GetBestHeight(); height++ {
+		block, err := source.GetBlockByHeight(height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := chain.ProcessBlock(block); err != nil {
+			t.Fatalf("history block %d: %v", height, err)
+		}
+	}
+
+	return chain
+}
+
+func TestFailedSnapshotStopsTheChain(t *testing.T) {
+	source := newTestChain(t, 3)
+	defer source.Store.Close()
+	// the snapshot holds an output no block created
+	batch := NewBatch()
+	batch.PutUTXO(testHash(0xfa), 0, TxOutput{Value: 1000000, PublicKeyHash: []byte("thief")})
+	if err := source.Store.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	chain := loadSnapshotOf(t, source)
+	defer chain.Store.Close()
+
+	if err := chain.ValidateSnapshot(nil); err == nil {
+		t.Fatal("snapshot with an injected output validated")
+	}
+	if state := chain.Snapshot(); state.Validated || state.Failure == "" {
+		t.Fatalf("snapshot state = %+v, want a failure", state)
+	}
+
+	next := CreateBlock([]*Transaction{CoinbaseTx(testAddr, "after the snapshot")}, chain.LastHash)
+	if err := chain.ProcessBlock(next); !errors.Is(err, ErrSnapshotInvalid) {
+		t.Fatalf("ProcessBlock on a failed snapshot: %v, want ErrSnapshotInvalid", err)
+	}
+	if ok, _ := chain.Store.HasBlock(next.Hash); ok {
+		t.Error("block refused on a failed snapshot was stored")
+	}
+
+	// a reindex rebuilds the chain state from the blocks and lifts the ban
+	if err := chain.Reindex(); err != nil {
+		t.Fatal(err)
+	}
+	if chain.Snapshot() != nil {
+		t.Error("snapshot state survived the reindex")
+	}
+	if report := chain.VerifyChain(VerifyUTXOSet, 0); !report.OK {
+		t.Fatalf("reindexed chain failed verification: %+v", report.Failure)
+	}
+	if err := chain.ProcessBlock(next); err != nil {
+		t.Fatalf("ProcessBlock after the reindex: %v", err)
+	}
+	if !bytes.Equal(chain.LastHash, next.Hash) {
+		t.Errorf("tip = %x, want %x", chain.LastHash, next.Hash)
+	}
+}
+
+func TestValidSnapshotKeepsTheChain(t *testing.T) {
+	source := newTestChain(t, 3)
+	defer source.Store.Close()
+
+	chain := loadSnapshotOf(t, source)
+	defer chain.Store.Close()
+
+	if err := chain.ValidateSnapshot(nil); err != nil {
+		t.Fatal(err)
+	}
+	if state := chain.Snapshot(); !state.Validated {
+		t.Fatalf("snapshot state = %+v, want validated", state)
+	}
+	next := CreateBlock([]*Transaction{CoinbaseTx(testAddr, "after the snapshot")}, chain.LastHash)
+	if err := chain.ProcessBlock(next); err != nil {
+		t.Fatalf("ProcessBlock on a validated snapshot: %v", err)
+	}
+}
+
+func TestDropSnapshotAboveTxnLimit(t *testing.T) {
+	store := fillBadger(t, overTxnLimit, func(batch *Batch, key []byte) {
+		batch.PutIndex(snapshotUTXOIndex, key, []byte{1})
+	})
+	markers := [][]byte{snapshotKey, snapshotBestKey, snapshotHistoryKey}
+	batch := NewBatch()
+	for _, key := range markers {
+		batch.PutIndex(chainStateIndex, key, []byte{1})
+	}
+	if err := store.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	chain := &BlockChain{logger: *discardLogger(), Store: store}
+	chain.setSnapshot(&SnapshotState{Failure: "test"})
+	if err := chain.dropSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := countIndex(t, store, snapshotUTXOIndex); n != 0 {
+		t.Errorf("%d snapshot outputs left after the drop", n)
+	}
+	for _, key := range markers {
+		if _, err := store.GetIndex(chainStateIndex, key); !errors.Is(err, ErrNotFound) {
+			t.Errorf("snapshot marker %s after the drop: %v, want ErrNotFound", key, err)
+		}
+	}
+	if chain.Snapshot() != nil {
+		t.Error("the chain still runs on the dropped snapshot")
+	}
+}
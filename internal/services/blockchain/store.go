@@ -0,0 +1,219 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+)
+
+// ErrNotFound is returned by a ChainStore when the requested record is absent.
+var ErrNotFound = errors.New("not found")
+
+// errStopIteration lets a ForEach callback end the walk early.
+var errStopIteration = errors.New("stop iteration")
+
+const (
+	blockPrefix   = "b-"
+	utxoPrefix    = "u-"
+	indexPrefix   = "i-"
+	schemaKey     = "v"
+	schemaVersion = 1
+)
+
+// ChainStore is the persistence layer used by BlockChain. Reads go straight
+// to the backend, every write goes through a Batch so that a block and all
+// state derived from it are committed together or not at all.
+type ChainStore interface {
+	GetBlock(hash []byte) (*Block, error)
+	HasBlock(hash []byte) (bool, error)
+	ForEachBlock(fn func(block *Block) error) error
+	GetTip() ([]byte, error)
+	GetUTXO(txID []byte, out int) (TxOutput, error)
+	ForEachUTXO(fn func(txID []byte, out int, output TxOutput) error) error
+	GetIndex(index string, key []byte) ([]byte, error)
+	ForEachIndex(index string, prefix []byte, fn func(key, value []byte) error) error
+	Write(batch *Batch) error
+	Close() error
+}
+
+type batchOp struct {
+	key    []byte
+	value  []byte
+	delete bool
+}
+
+// Batch collects writes that a ChainStore applies atomically.
+type Batch struct {
+	ops []batchOp
+}
+
+func NewBatch() *Batch {
+	return &Batch{}
+}
+
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+func (b *Batch) PutBlock(block *Block) {
+	b.put(blockKey(block.Hash), block.Serialize())
+}
+
+func (b *Batch) DeleteBlock(hash []byte) {
+	b.del(blockKey(hash))
+}
+
+func (b *Batch) SetTip(hash []byte) {
+	b.put([]byte(lastHashKey), hash)
+}
+
+func (b *Batch) PutUTXO(txID []byte, out int, output TxOutput) {
+	b.put(utxoKey(txID, out), serializeOutput(output))
+}
+
+func (b *Batch) DeleteUTXO(txID []byte, out int) {
+	b.del(utxoKey(txID, out))
+}
+
+func (b *Batch) PutIndex(index string, key, value []byte) {
+	b.put(indexKey(index, key), value)
+}
+
+func (b *Batch) DeleteIndex(index string, key []byte) {
+	b.del(indexKey(index, key))
+}
+
+func (b *Batch) put(key, value []byte) {
+	b.ops = append(b.ops, batchOp{key: key, value: value})
+}
+
+func (b *Batch) del(key []byte) {
+	b.ops = append(b.ops, batchOp{key: key, delete: true})
+}
+
+// kvBackend is the raw key/value layer a ChainStore implementation provides.
+// iterate must visit keys in ascending order.
+type kvBackend interface {
+	get(key []byte) ([]byte, error)
+	iterate(prefix []byte, fn func(key, value []byte) error) error
+	write(ops []batchOp) error
+	close() error
+}
+
+// kvStore maps the chain records onto a kvBackend.
+type kvStore struct {
+	kv kvBackend
+}
+
+func (s *kvStore) GetBlock(hash []byte) (*Block, error) {
+	data, err := s.kv.get(blockKey(hash))
+	if err != nil {
+		return nil, err
+	}
+
+	return Deserialize(data), nil
+}
+
+func (s *kvStore) HasBlock(hash []byte) (bool, error) {
+	_, err := s.kv.get(blockKey(hash))
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func (s *kvStore) ForEachBlock(fn func(block *Block) error) error {
+	return s.kv.iterate([]byte(blockPrefix), func(_, value []byte) error {
+		return fn(Deserialize(value))
+	})
+}
+
+func (s *kvStore) GetTip() ([]byte, error) {
+	return s.kv.get([]byte(lastHashKey))
+}
+
+func (s *kvStore) GetUTXO(txID []byte, out int) (TxOutput, error) {
+	data, err := s.kv.get(utxoKey(txID, out))
+	if err != nil {
+		return TxOutput{}, err
+	}
+
+	return deserializeOutput(data), nil
+}
+
+func (s *kvStore) ForEachUTXO(fn func(txID []byte, out int, output TxOutput) error) error {
+	return s.kv.iterate([]byte(utxoPrefix), func(key, value []byte) error {
+		txID, out := splitOutpoint(key[len(utxoPrefix):])
+
+		return fn(txID, out, deserializeOutput(value))
+	})
+}
+
+func (s *kvStore) GetIndex(index string, key []byte) ([]byte, error) {
+	return s.kv.get(indexKey(index, key))
+}
+
+func (s *kvStore) ForEachIndex(index string, prefix []byte, fn func(key, value []byte) error) error {
+	full := indexKey(index, prefix)
+	strip := len(full) - len(prefix)
+
+	return s.kv.iterate(full, func(key, value []byte) error {
+		return fn(key[strip:], value)
+	})
+}
+
+func (s *kvStore) Write(batch *Batch) error {
+	if batch.Len() == 0 {
+		return nil
+	}
+
+	return s.kv.write(batch.ops)
+}
+
+func (s *kvStore) Close() error {
+	return s.kv.close()
+}
+
+func blockKey(hash []byte) []byte {
+	return append([]byte(blockPrefix), hash...)
+}
+
+func utxoKey(txID []byte, out int) []byte {
+	return append([]byte(utxoPrefix), outpointBytes(txID, out)...)
+}
+
+// outpointBytes lays out an outpoint as the transaction ID followed by the
+// big-endian output index, so outputs sort by transaction.
+func outpointBytes(txID []byte, out int) []byte {
+	return binary.BigEndian.AppendUint32(bytes.Clone(txID), uint32(out))
+}
+
+func splitOutpoint(key []byte) ([]byte, int) {
+	split := len(key) - 4
+
+	return key[:split], int(binary.BigEndian.Uint32(key[split:]))
+}
+
+func indexKey(index string, key []byte) []byte {
+	full := []byte(indexPrefix + index + "-")
+
+	return append(full, key...)
+}
+
+func serializeOutput(out TxOutput) []byte {
+	var res bytes.Buffer
+	err := gob.NewEncoder(&res).Encode(out)
+	ErrHandle(err)
+
+	return res.Bytes()
+}
+
+func deserializeOutput(data []byte) TxOutput {
+	var out TxOutput
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&out)
+	ErrHandle(err)
+
+	return out
+}
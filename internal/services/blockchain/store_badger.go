@@ -0,0 +1,138 @@
+package blockchain
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/dgraph-io/badger"
+)
+
+// legacyBlockKeyLen is the length of the raw block hash keys written before
+// the store had a schema version.
+const legacyBlockKeyLen = 32
+
+type badgerBackend struct {
+	db *badger.DB
+}
+
+// NewBadgerStore opens (or creates) a Badger backed ChainStore at path.
+func NewBadgerStore(path string) (ChainStore, error) {
+	db, err := badger.Open(badger.DefaultOptions(path))
+	if err != nil {
+		return nil, err
+	}
+
+	backend := &badgerBackend{db: db}
+	if err := backend.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &kvStore{kv: backend}, nil
+}
+
+func (b *badgerBackend) get(key []byte) ([]byte, error) {
+	var value []byte
+
+	err := b.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		value, err = item.ValueCopy(nil)
+
+		return err
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, ErrNotFound
+	}
+
+	return value, err
+}
+
+func (b *badgerBackend) iterate(prefix []byte, fn func(key, value []byte) error) error {
+	return b.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if err := fn(item.KeyCopy(nil), value); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (b *badgerBackend) write(ops []batchOp) error {
+	return b.db.Update(func(txn *badger.Txn) error {
+		for _, op := range ops {
+			var err error
+			if op.delete {
+				err = txn.Delete(op.key)
+			} else {
+				err = txn.Set(op.key, op.value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (b *badgerBackend) close() error {
+	return b.db.Close()
+}
+
+// migrate moves blocks stored under their bare hash into the block prefix
+// and stamps the schema version. It is safe to rerun after an interruption.
+func (b *badgerBackend) migrate() error {
+	if _, err := b.get([]byte(schemaKey)); err == nil {
+		return nil
+	} else if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	var legacy [][]byte
+	err := b.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			if key := it.Item().KeyCopy(nil); len(key) == legacyBlockKeyLen {
+				legacy = append(legacy, key)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range legacy {
+		data, err := b.get(key)
+		if err != nil {
+			return err
+		}
+		err = b.write([]batchOp{
+			{key: blockKey(key), value: data},
+			{key: key, delete: true},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return b.write([]batchOp{{key: []byte(schemaKey), value: []byte(strconv.Itoa(schemaVersion))}})
+}
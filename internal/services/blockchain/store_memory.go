@@ -0,0 +1,86 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var errEmptyKey = errors.New("key cannot be empty")
+
+type memoryBackend struct {
+	mu   sync.RWMutex
+	data map[string][]byte
+}
+
+// NewMemoryStore returns a ChainStore that keeps everything in memory. It is
+// meant for unit tests and simulations; nothing survives Close.
+func NewMemoryStore() ChainStore {
+	return &kvStore{kv: &memoryBackend{data: make(map[string][]byte)}}
+}
+
+func (m *memoryBackend) get(key []byte) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	value, ok := m.data[string(key)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return bytes.Clone(value), nil
+}
+
+func (m *memoryBackend) iterate(prefix []byte, fn func(key, value []byte) error) error {
+	m.mu.RLock()
+	var keys []string
+	for key := range m.data {
+		if strings.HasPrefix(key, string(prefix)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i] = bytes.Clone(m.data[key])
+	}
+	m.mu.RUnlock()
+
+	for i, key := range keys {
+		if err := fn([]byte(key), values[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *memoryBackend) write(ops []batchOp) error {
+	// refuse what Badger refuses before applying anything, so a bad batch
+	// leaves the store untouched on both
+	for _, op := range ops {
+		if len(op.key) == 0 {
+			return errEmptyKey
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, op := range ops {
+		if op.delete {
+			delete(m.data, string(op.key))
+			continue
+		}
+		m.data[string(op.key)] = bytes.Clone(op.value)
+	}
+
+	return nil
+}
+
+func (m *memoryBackend) close() error {
+	return nil
+}
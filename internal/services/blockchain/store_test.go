@@ -0,0 +1,281 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+)
+
+// storeBackends opens an empty store of every backend.
+var storeBackends = map[string]func(t *testing.T) ChainStore{
+	"memory": func(t *testing.T) ChainStore {
+		return NewMemoryStore()
+	},
+	"badger": func(t *testing.T) ChainStore {
+		store, err := NewBadgerStore(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	},
+}
+
+func forEachBackend(t *testing.T, fn func(t *testing.T, store ChainStore)) {
+	for name, open := range storeBackends {
+		t.Run(name, func(t *testing.T) {
+			store := open(t)
+			defer store.Close()
+			fn(t, store)
+		})
+	}
+}
+
+func testHash(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func TestStoreBatchWrite(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store ChainStore) {
+		block := &Block{Hash: testHash(1), PrevHash: testHash(0), Nonce: 7, Version: BlockVersion}
+		output := TxOutput{Value: 42, PublicKeyHash: []byte("pkh")}
+
+		batch := NewBatch()
+		batch.PutBlock(block)
+		batch.PutUTXO(testHash(2), 3, output)
+		batch.PutIndex("test", []byte("key"), []byte("value"))
+		batch.SetTip(block.Hash)
+		if err := store.Write(batch); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := store.GetBlock(block.Hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Nonce != block.Nonce || !bytes.Equal(got.PrevHash, block.PrevHash) {
+			t.Errorf("block = %+v, want %+v", got, block)
+		}
+		if ok, err := store.HasBlock(block.Hash); err != nil || !ok {
+			t.Errorf("HasBlock = %v, %v, want true", ok, err)
+		}
+		gotOut, err := store.GetUTXO(testHash(2), 3)
+		if err != nil || gotOut.Value != output.Value || !bytes.Equal(gotOut.PublicKeyHash, output.PublicKeyHash) {
+			t.Errorf("GetUTXO = %+v, %v, want %+v", gotOut, err, output)
+		}
+		if value, err := store.GetIndex("test", []byte("key")); err != nil || string(value) != "value" {
+			t.Errorf("GetIndex = %q, %v, want value", value, err)
+		}
+
+		batch = NewBatch()
+		batch.DeleteBlock(block.Hash)
+		batch.DeleteUTXO(testHash(2), 3)
+		batch.DeleteIndex("test", []byte("key"))
+		if err := store.Write(batch); err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := store.HasBlock(block.Hash); err != nil || ok {
+			t.Errorf("HasBlock after delete = %v, %v, want false", ok, err)
+		}
+		if _, err := store.GetUTXO(testHash(2), 3); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetUTXO after delete: %v, want ErrNotFound", err)
+		}
+		if _, err := store.GetIndex("test", []byte("key")); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetIndex after delete: %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestStoreBatchIsAtomic(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store ChainStore) {
+		batch := NewBatch()
+		batch.PutUTXO(testHash(1), 0, TxOutput{Value: 1})
+		batch.SetTip(testHash(1))
+		// the store refuses an empty key, failing the batch after two
+		// good writes
+		batch.put(nil, []byte("bad"))
+
+		if err := store.Write(batch); err == nil {
+			t.Fatal("batch with an empty key was written")
+		}
+		if _, err := store.GetUTXO(testHash(1), 0); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetUTXO of failed batch: %v, want ErrNotFound", err)
+		}
+		if _, err := store.GetTip(); !errors.Is(err, ErrNotFound) {
+			t.Errorf("GetTip of failed batch: %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestStoreIterationOrder(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store ChainStore) {
+		batch := NewBatch()
+		for _, b := range []byte{3, 1, 2} {
+			batch.PutBlock(&Block{Hash: testHash(b)})
+		}
+		// 256 sorts before 2 as a string, not as a big-endian index
+		for _, out := range []int{256, 2, 0} {
+			batch.PutUTXO(testHash(5), out, TxOutput{Value: out})
+		}
+		batch.PutUTXO(testHash(4), 9, TxOutput{Value: 9})
+		for _, key := range []string{"b2", "a", "b1", "c"} {
+			batch.PutIndex("test", []byte(key), []byte(key))
+		}
+		batch.PutIndex("testing", []byte("b0"), []byte("other index"))
+		if err := store.Write(batch); err != nil {
+			t.Fatal(err)
+		}
+
+		var blocks [][]byte
+		err := store.ForEachBlock(func(block *Block) error {
+			blocks = append(blocks, block.Hash)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := [][]byte{testHash(1), testHash(2), testHash(3)}
+		if len(blocks) != len(want) {
+			t.Fatalf("ForEachBlock visited %d blocks, want %d", len(blocks), len(want))
+		}
+		for i := range want {
+			if !bytes.Equal(blocks[i], want[i]) {
+				t.Errorf("block %d = %x, want %x", i, blocks[i], want[i])
+			}
+		}
+
+		var outpoints []string
+		err = store.ForEachUTXO(func(txID []byte, out int, output TxOutput) error {
+			if output.Value != out {
+				t.Errorf("output %x:%d has value %d", txID, out, output.Value)
+			}
+			outpoints = append(outpoints, strconv.Itoa(int(txID[0]))+":"+strconv.Itoa(out))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertStrings(t, "ForEachUTXO", outpoints, []string{"4:9", "5:0", "5:2", "5:256"})
+
+		var keys []string
+		err = store.ForEachIndex("test", nil, func(key, _ []byte) error {
+			keys = append(keys, string(key))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertStrings(t, "ForEachIndex", keys, []string{"a", "b1", "b2", "c"})
+
+		keys = nil
+		err = store.ForEachIndex("test", []byte("b"), func(key, _ []byte) error {
+			keys = append(keys, string(key))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertStrings(t, "ForEachIndex with prefix", keys, []string{"b1", "b2"})
+
+		visited := 0
+		err = store.ForEachBlock(func(*Block) error {
+			visited++
+			return errStopIteration
+		})
+		if !errors.Is(err, errStopIteration) || visited != 1 {
+			t.Errorf("ForEachBlock stopped after %d blocks with %v, want 1 and errStopIteration", visited, err)
+		}
+	})
+}
+
+func TestStoreTipAndVersion(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, store ChainStore) {
+		if _, err := store.GetTip(); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("GetTip of an empty store: %v, want ErrNotFound", err)
+		}
+
+		chain := InitBlockChainWithStore(*discardLogger(), store, testAddr)
+		tip, err := store.GetTip()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(tip, chain.LastHash) {
+			t.Errorf("tip = %x, want the genesis %x", tip, chain.LastHash)
+		}
+		version, err := store.GetIndex(chainStateIndex, chainStateVersionKey)
+		if err != nil || string(version) != strconv.Itoa(chainStateVersion) {
+			t.Errorf("chain state version = %q, %v, want %d", version, err, chainStateVersion)
+		}
+
+		batch := NewBatch()
+		batch.SetTip(testHash(9))
+		if err := store.Write(batch); err != nil {
+			t.Fatal(err)
+		}
+		if tip, err := store.GetTip(); err != nil || !bytes.Equal(tip, testHash(9)) {
+			t.Errorf("tip = %x, %v, want %x", tip, err, testHash(9))
+		}
+	})
+}
+
+func TestBadgerStoreMigratesLegacyLayout(t *testing.T) {
+	dir := t.TempDir()
+	block := &Block{Hash: testHash(1), PrevHash: testHash(0), Nonce: 5}
+
+	db, err := badger.Open(badger.DefaultOptions(dir).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(txn *badger.Txn) error {
+		if err := txn.Set(block.Hash, block.Serialize()); err != nil {
+			return err
+		}
+		return txn.Set([]byte(lastHashKey), block.Hash)
+	})
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a second open finds the schema version and leaves the store alone
+	for i := 0; i < 2; i++ {
+		store, err := NewBadgerStore(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := store.GetBlock(block.Hash)
+		if err != nil {
+			t.Fatalf("open %d: migrated block: %v", i, err)
+		}
+		if got.Nonce != block.Nonce {
+			t.Errorf("open %d: migrated block nonce = %d, want %d", i, got.Nonce, block.Nonce)
+		}
+		if tip, err := store.GetTip(); err != nil || !bytes.Equal(tip, block.Hash) {
+			t.Errorf("open %d: tip = %x, %v, want %x", i, tip, err, block.Hash)
+		}
+		backend := store.(*kvStore).kv
+		if _, err := backend.get(block.Hash); !errors.Is(err, ErrNotFound) {
+			t.Errorf("open %d: legacy key still present: %v", i, err)
+		}
+		if version, err := backend.get([]byte(schemaKey)); err != nil || string(version) != strconv.Itoa(schemaVersion) {
+			t.Errorf("open %d: schema version = %q, %v, want %d", i, version, err, schemaVersion)
+		}
+		store.Close()
+	}
+}
+
+func assertStrings(t *testing.T, what string, got, want []string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("%s = %v, want %v", what, got, want)
+		return
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("%s = %v, want %v", what, got, want)
+			return
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/gob"
 	"encoding/hex"
 	"fmt"
@@ -13,9 +14,14 @@ import (
 	"math/big"
 	"strings"
 
+	"github.com/numbermax/blockchain/internal/services/blockchain/legacy"
 	"github.com/numbermax/blockchain/internal/services/wallet"
 )
 
+// Subsidy is the amount a coinbase transaction may create on top of the
+// fees of its block.
+const Subsidy = 100
+
 type Transaction struct {
 	ID      []byte
 	Inputs  []TxInput
@@ -35,31 +41,74 @@ func (tx *Transaction) Serialize() []byte {
 }
 
 func (tx *Transaction) Hash() []byte {
-	var hash [32]byte
 	txCopy := *tx
 	txCopy.ID = []byte{}
 
-	hash = sha256.Sum256(txCopy.Serialize())
-
-	return hash[:]
+	return txCopy.hash()
 }
 
 func (tx *Transaction) SetId() {
-	var encoded bytes.Buffer
-	var hash [32]byte
+	tx.ID = tx.hash()
+}
 
-	encode := gob.NewEncoder(&encoded)
-	err := encode.Encode(tx)
-	ErrHandle(err)
+// hash is the SHA-256 of the encoding from before inputs had sequence
+// numbers, so the IDs of older transactions stay what they were. The
+// sequences of a transaction that has any follow that encoding.
+func (tx *Transaction) hash() []byte {
+	old := legacy.Transaction{ID: tx.ID}
+	sequenced := false
+	for _, in := range tx.Inputs {
+		old.Inputs = append(old.Inputs, legacy.TxInput{
+			ID:        in.ID,
+			Out:       in.Out,
+			Signature: in.Signature,
+			PublicKey: in.PublicKey,
+		})
+		sequenced = sequenced || in.Sequence != 0
+	}
+	for _, out := range tx.Outputs {
+		old.Outputs = append(old.Outputs, legacy.TxOutput{Value: out.Value, PublicKeyHash: out.PublicKeyHash})
+	}
+
+	data := legacy.Encode(&old)
+	if sequenced {
+		for _, in := range tx.Inputs {
+			data = binary.BigEndian.AppendUint32(data, in.Sequence)
+		}
+	}
+	hash := sha256.Sum256(data)
+
+	return hash[:]
+}
+
+// ComputeID recomputes the ID the transaction was created with, the hash of
+// the transaction before any of its inputs were signed.
+func (tx *Transaction) ComputeID() []byte {
+	txCopy := *tx
+	txCopy.Inputs = make([]TxInput, len(tx.Inputs))
+	for i, in := range tx.Inputs {
+		txCopy.Inputs[i] = TxInput{in.ID, in.Out, nil, in.PublicKey, in.Sequence}
+	}
 
-	hash = sha256.Sum256(encoded.Bytes())
-	tx.ID = hash[:]
+	return txCopy.Hash()
 }
 
 func (tx *Transaction) IsCoinbase() bool {
 	return len(tx.Inputs) == 1 && len(tx.Inputs[0].ID) == 0 && tx.Inputs[0].Out == -1
 }
 
+// Replaceable reports whether an input of tx signals that a conflicting
+// transaction paying more may replace it in the mempool.
+func (tx *Transaction) Replaceable() bool {
+	for _, in := range tx.Inputs {
+		if in.Sequence >= SequenceReplaceable {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) {
 	if tx.IsCoinbase() {
 		return
@@ -82,7 +131,12 @@ func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transac
 
 		r, s, err := ecdsa.Sign(rand.Reader, &privKey, txCopy.ID)
 		ErrHandle(err)
-		signature := append(r.Bytes(), s.Bytes()...)
+		// Verify splits the signature in halves, so r and s take the same
+		// number of bytes whatever their leading zeros.
+		size := (privKey.Curve.Params().BitSize + 7) / 8
+		signature := make([]byte, 2*size)
+		r.FillBytes(signature[:size])
+		s.FillBytes(signature[size:])
 
 		tx.Inputs[inId].Signature = signature
 
@@ -95,7 +149,7 @@ func (tx *Transaction) TrimmedCopy() Transaction {
 	var outputs []TxOutput
 
 	for _, in := range tx.Inputs {
-		inputs = append(inputs, TxInput{in.ID, in.Out, nil, nil})
+		inputs = append(inputs, TxInput{in.ID, in.Out, nil, nil, in.Sequence})
 	}
 
 	for _, out := range tx.Outputs {
@@ -140,7 +194,7 @@ func (tx *Transaction) Verify(prevTx map[string]Transaction) bool {
 		x.SetBytes(in.PublicKey[:(keyLen / 2)])
 		y.SetBytes(in.PublicKey[(keyLen / 2):])
 
-		rawPublicKey := ecdsa.PublicKey{curve, &x, &y}
+		rawPublicKey := ecdsa.PublicKey{Curve: curve, X: &x, Y: &y}
 		if ecdsa.Verify(&rawPublicKey, txCopy.ID, &r, &s) == false {
 			return false
 		}
@@ -150,12 +204,18 @@ func (tx *Transaction) Verify(prevTx map[string]Transaction) bool {
 }
 
 func CoinbaseTx(to, data string) *Transaction {
+	return NewCoinbaseTx(to, data, Subsidy)
+}
+
+// NewCoinbaseTx returns a coinbase paying value to to, which may be up to
+// the subsidy and the fees of its block. data makes its ID unique.
+func NewCoinbaseTx(to, data string, value int) *Transaction {
 	if data == "" {
 		data = fmt.Sprintf("Coins to %s", to)
 	}
 
-	txin := TxInput{[]byte{}, -1, nil, []byte(data)}
-	txout := NewTxOutput(100, to)
+	txin := TxInput{[]byte{}, -1, nil, []byte(data), 0}
+	txout := NewTxOutput(value, to)
 
 	tx := Transaction{nil, []TxInput{txin}, []TxOutput{*txout}}
 	tx.SetId()
@@ -183,7 +243,7 @@ func NewTransaction(from, to string, amount int, chain *BlockChain) *Transaction
 		ErrHandle(err)
 
 		for _, out := range outs {
-			input := TxInput{txId, out, nil, w.PublicKey}
+			input := TxInput{txId, out, nil, w.PublicKey, 0}
 			inputs = append(inputs, input)
 		}
 	}
@@ -201,6 +261,83 @@ func NewTransaction(from, to string, amount int, chain *BlockChain) *Transaction
 	return &tx
 }
 
+// UTXO is an unspent output together with the outpoint that spends it.
+type UTXO struct {
+	TxID   []byte
+	Out    int
+	Output TxOutput
+}
+
+// NewTransactionFromUTXOs pays amount from the wallet w to to out of utxos,
+// which must be locked to w, leaving fee to the miner and returning the
+// change to w. A replaceable transaction signals that it may be replaced by
+// one paying a higher fee. It needs no chain, so a wallet can build a
+// payment from the outputs a node lists for it.
+func NewTransactionFromUTXOs(w *wallet.Wallet, to string, amount, fee int, replaceable bool, utxos []UTXO) (*Transaction, error) {
+	var inputs []TxInput
+	var outputs []TxOutput
+	var spent []TxOutput
+
+	sequence := uint32(0)
+	if replaceable {
+		sequence = SequenceReplaceable
+	}
+
+	acc := 0
+	for _, utxo := range utxos {
+		if acc >= amount+fee {
+			break
+		}
+		inputs = append(inputs, TxInput{utxo.TxID, utxo.Out, nil, w.PublicKey, sequence})
+		spent = append(spent, utxo.Output)
+		acc += utxo.Output.Value
+	}
+	if acc < amount+fee {
+		return nil, fmt.Errorf("not enough funds: %d available, %d needed", acc, amount+fee)
+	}
+
+	outputs = append(outputs, *NewTxOutput(amount, to))
+	if acc > amount+fee {
+		outputs = append(outputs, *NewTxOutput(acc-amount-fee, string(w.Address())))
+	}
+
+	tx := Transaction{nil, inputs, outputs}
+	tx.ID = tx.Hash()
+	if err := SignTransaction(&tx, w.PrivateKey, spent); err != nil {
+		return nil, err
+	}
+
+	return &tx, nil
+}
+
+// SignTransaction signs every input of tx, spent holding the outputs they
+// spend in the same order. Unlike the method of BlockChain it needs no
+// chain, so a wallet can sign against the outputs a node lists for it.
+func SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey, spent []TxOutput) error {
+	if len(spent) != len(tx.Inputs) {
+		return fmt.Errorf("%d spent outputs given for %d inputs", len(spent), len(tx.Inputs))
+	}
+
+	prevTXs := make(map[string]Transaction)
+	for i, in := range tx.Inputs {
+		addPrevOutput(prevTXs, in, spent[i])
+	}
+	tx.Sign(privKey, prevTXs)
+
+	return nil
+}
+
+// DeserializeTransaction decodes a transaction that may be malformed, such
+// as one from a peer.
+func DeserializeTransaction(data []byte) (*Transaction, error) {
+	var tx Transaction
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&tx); err != nil {
+		return nil, fmt.Errorf("malformed transaction: %w", err)
+	}
+
+	return &tx, nil
+}
+
 func (tx Transaction) String() string {
 	var lines []string
 
@@ -211,6 +348,7 @@ func (tx Transaction) String() string {
 		lines = append(lines, fmt.Sprintf("    Out: %d", in.Out))
 		lines = append(lines, fmt.Sprintf("    Signature: %x", in.Signature))
 		lines = append(lines, fmt.Sprintf("    PublicKey: %x", in.PublicKey))
+		lines = append(lines, fmt.Sprintf("    Sequence: %d", in.Sequence))
 	}
 
 	for i, out := range tx.Outputs {
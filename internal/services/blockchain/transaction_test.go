@@ -0,0 +1,95 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/numbermax/blockchain/internal/services/wallet"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+// Transactions of a chain built before inputs had sequence numbers, whose
+// IDs hash the legacy encoding.
+func TestLegacyTransactionIDs(t *testing.T) {
+	tests := []struct {
+		name string
+		tx   func(t *testing.T) *Transaction
+		id   string
+	}{
+		{
+			name: "coinbase",
+			tx: func(t *testing.T) *Transaction {
+				return &Transaction{
+					Inputs: []TxInput{{
+						ID:        []byte{},
+						Out:       -1,
+						PublicKey: []byte("First Transaction from Genesis"),
+					}},
+					Outputs: []TxOutput{{Value: 100, PublicKeyHash: mustHex(t, "8a7465602113c587999c7db52390f641352a2b46")}},
+				}
+			},
+			id: "c5f196169d095268b638f0e660de8f18327ee4d40f340b0c7821a155ae52e12d",
+		},
+		{
+			name: "signed",
+			tx: func(t *testing.T) *Transaction {
+				return &Transaction{
+					Inputs: []TxInput{{
+						ID:  mustHex(t, "c5f196169d095268b638f0e660de8f18327ee4d40f340b0c7821a155ae52e12d"),
+						Out: 0,
+						Signature: mustHex(t, "1ec64be7ca6a0c7ad0d927ed9bc5a666fa3d99e8828015fad06d96d867c46c8d"+
+							"23e4064ecb8665c273b5519fde6a816f9df217ece32da28f1ca44c00dbe9600a"),
+						PublicKey: mustHex(t, "bf585e7bdc14e01a5e533646c3c93aec147e8c8d612bbac074f45c44d4bb2d50"+
+							"9d7f32ef6f65833690df03ad7b219e1c3a4243853d627b933b4976490ed60037"),
+					}},
+					Outputs: []TxOutput{
+						{Value: 5, PublicKeyHash: mustHex(t, "7bf1637a655e0aa5228abca4519445f8a7a991d8")},
+						{Value: 95, PublicKeyHash: mustHex(t, "8a7465602113c587999c7db52390f641352a2b46")},
+					},
+				}
+			},
+			id: "458e64c988cac1acd1250e45d444f0f19e84884773ce0be86a1a11e622c48fc1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if id := hex.EncodeToString(tt.tx(t).ComputeID()); id != tt.id {
+				t.Errorf("ID = %s, want %s", id, tt.id)
+			}
+		})
+	}
+}
+
+// One r or s in 128 has a leading zero byte; the signatures are split in
+// halves all the same.
+func TestSignaturesVerify(t *testing.T) {
+	w := wallet.MakeWallet()
+	spent := TxOutput{Value: 100, PublicKeyHash: wallet.PublicKeyHash(w.PublicKey)}
+	prev := Transaction{ID: []byte("previous"), Outputs: []TxOutput{spent}}
+	prevTXs := map[string]Transaction{hex.EncodeToString(prev.ID): prev}
+
+	for i := 0; i < 1000; i++ {
+		tx := &Transaction{
+			Inputs:  []TxInput{{ID: prev.ID, PublicKey: w.PublicKey}},
+			Outputs: []TxOutput{{Value: i, PublicKeyHash: spent.PublicKeyHash}},
+		}
+		tx.ID = tx.Hash()
+		if err := SignTransaction(tx, w.PrivateKey, []TxOutput{spent}); err != nil {
+			t.Fatal(err)
+		}
+		if len(tx.Inputs[0].Signature) != 64 || !tx.Verify(prevTXs) {
+			t.Fatalf("signature %x of transaction %d does not verify", tx.Inputs[0].Signature, i)
+		}
+	}
+}
@@ -16,8 +16,15 @@ type TxInput struct {
 	Out       int
 	Signature []byte
 	PublicKey []byte
+	// Sequence is 0 on inputs that signal nothing, as on every input from
+	// before it existed.
+	Sequence uint32
 }
 
+// SequenceReplaceable on an input lets the mempool replace its transaction
+// by a conflicting one that pays more.
+const SequenceReplaceable uint32 = 1
+
 func (in *TxInput) UsesKey(publicKeyHash []byte) bool {
 	lockingHash := wallet.PublicKeyHash(in.PublicKey)
 
@@ -0,0 +1,116 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+)
+
+const txIndexName = "tx"
+
+// TxLocation says where a main chain transaction is stored.
+type TxLocation struct {
+	BlockHash []byte
+	Position  int
+}
+
+func (l *TxLocation) Serialize() []byte {
+	var res bytes.Buffer
+	err := gob.NewEncoder(&res).Encode(l)
+	ErrHandle(err)
+
+	return res.Bytes()
+}
+
+func DeserializeTxLocation(data []byte) *TxLocation {
+	var loc TxLocation
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&loc)
+	ErrHandle(err)
+
+	return &loc
+}
+
+// txIndex maps transaction IDs to the block that holds them.
+type txIndex struct{}
+
+func (*txIndex) Name() string {
+	return txIndexName
+}
+
+func (*txIndex) ConnectBlock(_ *BlockChain, batch *Batch, block *Block, _ int, _ *BlockUndo) error {
+	for pos, tx := range block.Transactions {
+		loc := TxLocation{BlockHash: block.Hash, Position: pos}
+		batch.PutIndex(txIndexName, tx.ID, loc.Serialize())
+	}
+
+	return nil
+}
+
+func (*txIndex) DisconnectBlock(_ *BlockChain, batch *Batch, block *Block, _ int) error {
+	for _, tx := range block.Transactions {
+		batch.DeleteIndex(txIndexName, tx.ID)
+	}
+
+	return nil
+}
+
+// GetTransaction returns a main chain transaction together with its block
+// and the block height. It uses the tx index when enabled and falls back to
+// scanning the chain otherwise.
+func (chain *BlockChain) GetTransaction(id []byte) (*Transaction, *Block, int, error) {
+	var tx *Transaction
+	var block *Block
+
+	if chain.HasIndex(txIndexName) {
+		data, err := chain.Store.GetIndex(txIndexName, id)
+		if errors.Is(err, ErrNotFound) {
+			return nil, nil, 0, errors.New("Transaction does not exist")
+		}
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		loc := DeserializeTxLocation(data)
+
+		block, err = chain.GetBlock(loc.BlockHash)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		if loc.Position >= len(block.Transactions) {
+			return nil, nil, 0, fmt.Errorf("tx index points past the end of block %x", loc.BlockHash)
+		}
+		tx = block.Transactions[loc.Position]
+	} else {
+		hash := chain.LastHash
+	Scan:
+		for {
+			var err error
+			block, err = chain.Store.GetBlock(hash)
+			// a chain started from a snapshot may not have its history yet,
+			// a pruned one no longer has it
+			if errors.Is(err, ErrNotFound) {
+				return nil, nil, 0, errors.New("Transaction does not exist in the stored blocks")
+			}
+			if err != nil {
+				return nil, nil, 0, err
+			}
+			for _, candidate := range block.Transactions {
+				if bytes.Equal(candidate.ID, id) {
+					tx = candidate
+					break Scan
+				}
+			}
+			if len(block.PrevHash) == 0 {
+				return nil, nil, 0, errors.New("Transaction does not exist")
+			}
+			hash = block.PrevHash
+		}
+	}
+
+	height, err := chain.GetBlockHeight(block.Hash)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	return tx, block, height, nil
+}
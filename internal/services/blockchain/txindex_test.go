@@ -0,0 +1,50 @@
+package blockchain
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestGetTransaction(t *testing.T) {
+	for _, indexed := range []bool{true, false} {
+		name := "scan"
+		if indexed {
+			name = "tx index"
+		}
+		t.Run(name, func(t *testing.T) {
+			chain := newTestChain(t, 3)
+			defer chain.Store.Close()
+			if indexed {
+				if err := chain.EnableIndex(txIndexName); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if chain.HasIndex(txIndexName) != indexed {
+				t.Fatalf("tx index enabled: %v, want %v", !indexed, indexed)
+			}
+
+			for height := 0; height <= 3; height++ {
+				want, err := chain.GetBlockByHeight(height)
+				if err != nil {
+					t.Fatal(err)
+				}
+				id := want.Transactions[0].ID
+				tx, block, got, err := chain.GetTransaction(id)
+				if err != nil {
+					t.Fatalf("transaction of block %d: %v", height, err)
+				}
+				if !bytes.Equal(tx.ID, id) || !bytes.Equal(block.Hash, want.Hash) || got != height {
+					t.Errorf("transaction of block %d found as %x in %x at %d", height, tx.ID, block.Hash, got)
+				}
+			}
+
+			if _, _, _, err := chain.GetTransaction(testHash(0xee)); err == nil {
+				t.Error("unknown transaction found")
+			}
+			tip := chain.DisconnectTip()
+			if _, _, _, err := chain.GetTransaction(tip.Transactions[0].ID); err == nil {
+				t.Error("transaction of a disconnected block found")
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// CheckProofOfWork verifies that the block is sealed as the consensus
+// engine asks.
+func CheckProofOfWork(block *Block) error {
+	return CheckHeader(block.Header())
+}
+
+// CheckHeader verifies the seal of a header with the consensus engine,
+// which is all a header can be checked for alone.
+func CheckHeader(header *BlockHeader) error {
+	return Engine().VerifySeal(header)
+}
+
+// CheckTransactions verifies what a block commits to without looking at the
+// chain: every transaction ID matches its contents, so the transaction hash
+// in the header covers them, only the first transaction may be a coinbase,
+// and no output carries a negative value.
+func CheckTransactions(block *Block) error {
+	if len(block.Transactions) == 0 {
+		return rejectf(RejectNoTransactions, "block %x has no transactions", block.Hash)
+	}
+
+	seen := make(map[string]bool)
+	for i, tx := range block.Transactions {
+		if !bytes.Equal(tx.ID, tx.ComputeID()) {
+			return rejectf(RejectBadTxID, "transaction %x does not match its contents", tx.ID)
+		}
+		if seen[hex.EncodeToString(tx.ID)] {
+			return rejectf(RejectDuplicateTx, "transaction %x appears twice", tx.ID)
+		}
+		seen[hex.EncodeToString(tx.ID)] = true
+
+		if tx.IsCoinbase() && i != 0 {
+			return rejectf(RejectCoinbasePos, "coinbase transaction %x at position %d", tx.ID, i)
+		}
+		if !tx.IsCoinbase() && len(tx.Inputs) == 0 {
+			return rejectf(RejectNoInputs, "transaction %x has no inputs", tx.ID)
+		}
+		for outIdx, out := range tx.Outputs {
+			if out.Value < 0 {
+				return rejectf(RejectNegativeOutput, "transaction %x output %d has negative value", tx.ID, outIdx)
+			}
+		}
+	}
+
+	return nil
+}
+
+// CheckSignatures verifies every input signature of tx against the
+// transactions it spends.
+func CheckSignatures(tx *Transaction, prevTXs map[string]Transaction) error {
+	if tx.IsCoinbase() {
+		return nil
+	}
+
+	for _, in := range tx.Inputs {
+		prev, ok := prevTXs[hex.EncodeToString(in.ID)]
+		if !ok || prev.ID == nil {
+			return rejectf(RejectMissingInputs, "transaction %x spends unknown transaction %x", tx.ID, in.ID)
+		}
+		if in.Out < 0 || in.Out >= len(prev.Outputs) {
+			return rejectf(RejectMissingInputs, "transaction %x spends missing output %s", tx.ID, outpointKey(in.ID, in.Out))
+		}
+		// Verify only checks the signature against the key in the input,
+		// the key must also be the one the output is locked to
+		if !in.UsesKey(prev.Outputs[in.Out].PublicKeyHash) {
+			return rejectf(RejectWrongKey, "transaction %x spends %s with the wrong key", tx.ID, outpointKey(in.ID, in.Out))
+		}
+	}
+
+	if !tx.Verify(prevTXs) {
+		return rejectf(RejectBadSignature, "transaction %x has an invalid signature", tx.ID)
+	}
+
+	return nil
+}
+
+// CheckBlockInputs verifies block against the current chain state: every
+// input spends an unspent output, at most once, with the key it is locked
+// to and a valid signature, no transaction creates value and the coinbase
+// claims no more than the subsidy and the fees of the block.
+func (chain *BlockChain) CheckBlockInputs(block *Block) error {
+	return checkBlockInputs(block, chain.Store.GetUTXO)
+}
+
+// checkBlockInputs is CheckBlockInputs against the UTXO set getUTXO reads.
+func checkBlockInputs(block *Block, getUTXO func(txID []byte, out int) (TxOutput, error)) error {
+	created := make(map[string]TxOutput)
+	spent := make(map[string]bool)
+	view := func(txID []byte, out int) (TxOutput, error) {
+		if output, ok := created[outpointKey(txID, out)]; ok {
+			return output, nil
+		}
+		return getUTXO(txID, out)
+	}
+
+	var coinbase *Transaction
+	fees := 0
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() {
+			coinbase = tx
+		} else {
+			in, err := checkTxInputs(tx, spent, view)
+			if err != nil {
+				return err
+			}
+			fees += in - outputsValue(tx)
+		}
+
+		for outIdx, out := range tx.Outputs {
+			created[outpointKey(tx.ID, outIdx)] = out
+		}
+	}
+
+	// the coinbase comes first, so it is checked once the fees are known
+	if coinbase != nil {
+		if value := outputsValue(coinbase); value > Subsidy+fees {
+			return rejectf(RejectCoinbaseAmount, "coinbase %x creates %d, more than the subsidy %d and the fees %d",
+				coinbase.ID, value, Subsidy, fees)
+		}
+	}
+
+	return nil
+}
+
+// CheckTransaction verifies a transaction that is not in a block yet
+// without looking at the chain: it is no coinbase, its ID matches its
+// contents, it has inputs and no output carries a negative value.
+func CheckTransaction(tx *Transaction) error {
+	if tx.IsCoinbase() {
+		return rejectf(RejectLooseCoinbase, "coinbase transaction %x outside a block", tx.ID)
+	}
+	if !bytes.Equal(tx.ID, tx.ComputeID()) {
+		return rejectf(RejectBadTxID, "transaction %x does not match its contents", tx.ID)
+	}
+	if len(tx.Inputs) == 0 {
+		return rejectf(RejectNoInputs, "transaction %x has no inputs", tx.ID)
+	}
+	for outIdx, out := range tx.Outputs {
+		if out.Value < 0 {
+			return rejectf(RejectNegativeOutput, "transaction %x output %d has negative value", tx.ID, outIdx)
+		}
+	}
+
+	return nil
+}
+
+// CheckTransactionInputs verifies tx against the UTXO set getUTXO reads as
+// CheckBlockInputs does for the transactions of a block, and returns the
+// fee, the value its inputs carry beyond its outputs.
+func CheckTransactionInputs(tx *Transaction, getUTXO func(txID []byte, out int) (TxOutput, error)) (int, error) {
+	in, err := checkTxInputs(tx, make(map[string]bool), getUTXO)
+	if err != nil {
+		return 0, err
+	}
+
+	return in - outputsValue(tx), nil
+}
+
+// checkTxInputs verifies the inputs of a transaction that is not a coinbase
+// and returns their value. spent holds the outputs spent before tx and gets
+// those tx spends.
+func checkTxInputs(tx *Transaction, spent map[string]bool, getUTXO func(txID []byte, out int) (TxOutput, error)) (int, error) {
+	prevTXs := make(map[string]Transaction)
+	in := 0
+
+	for _, input := range tx.Inputs {
+		key := outpointKey(input.ID, input.Out)
+		if spent[key] {
+			return 0, rejectf(RejectDoubleSpend, "transaction %x spends %s which is already spent", tx.ID, key)
+		}
+		spent[key] = true
+
+		out, err := getUTXO(input.ID, input.Out)
+		if errors.Is(err, ErrNotFound) {
+			return 0, rejectf(RejectMissingInputs, "transaction %x spends %s: %w", tx.ID, key, err)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("transaction %x spends %s: %w", tx.ID, key, err)
+		}
+		in += out.Value
+		addPrevOutput(prevTXs, input, out)
+	}
+
+	if err := CheckSignatures(tx, prevTXs); err != nil {
+		return 0, err
+	}
+	if out := outputsValue(tx); out > in {
+		return 0, rejectf(RejectValueCreated, "transaction %x spends %d but creates %d", tx.ID, in, out)
+	}
+
+	return in, nil
+}
+
+// addPrevOutput records out as the output input spends in the minimal form
+// of the previous transaction that Transaction.Verify reads.
+func addPrevOutput(prevTXs map[string]Transaction, input TxInput, out TxOutput) {
+	id := hex.EncodeToString(input.ID)
+	prev := prevTXs[id]
+	prev.ID = input.ID
+	for len(prev.Outputs) <= input.Out {
+		prev.Outputs = append(prev.Outputs, TxOutput{})
+	}
+	prev.Outputs[input.Out] = out
+	prevTXs[id] = prev
+}
+
+func outputsValue(tx *Transaction) int {
+	value := 0
+	for _, out := range tx.Outputs {
+		value += out.Value
+	}
+
+	return value
+}
@@ -0,0 +1,343 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+// Verification levels for VerifyChain, each includes the ones below it.
+const (
+	VerifyLinkage = iota
+	VerifyMerkle
+	VerifySignatures
+	VerifyUTXOReplay
+	VerifyUTXOSet
+)
+
+var verifyCheckNames = []string{"linkage", "merkle", "signatures", "utxo-replay", "utxo-set"}
+
+// VerifyFailure describes the first problem VerifyChain ran into.
+type VerifyFailure struct {
+	Height int    `json:"height"`
+	Block  string `json:"block"`
+	Check  string `json:"check"`
+	Error  string `json:"error"`
+}
+
+// VerifyReport is the outcome of VerifyChain.
+type VerifyReport struct {
+	OK           bool           `json:"ok"`
+	Level        int            `json:"level"`
+	StartHeight  int            `json:"start_height"`
+	TipHeight    int            `json:"tip_height"`
+	Blocks       int            `json:"blocks"`
+	Transactions int            `json:"transactions"`
+	Inputs       int            `json:"inputs"`
+	UTXOs        int            `json:"utxos"`
+	Failure      *VerifyFailure `json:"failure,omitempty"`
+}
+
+type chainVerifier struct {
+	chain  *BlockChain
+	level  int
+	report *VerifyReport
+	// utxos is the replayed UTXO set, used from VerifyUTXOReplay up
+	utxos map[string]TxOutput
+}
+
+// VerifyChain audits the last depth blocks of the main chain, or all of it
+// when depth is not positive, up to the given level. It stops at the first
+// failure.
+func (chain *BlockChain) VerifyChain(level, depth int) *VerifyReport {
+	if level > VerifyUTXOSet {
+		level = VerifyUTXOSet
+	}
+
+	tip := chain.GetBestHeight()
+	start := 0
+	if depth > 0 && depth <= tip {
+		start = tip - depth + 1
+	}
+	// blocks up to an unvalidated snapshot base have no undo data yet, pruned
+	// blocks have none left
+	if state := chain.Snapshot(); state != nil && !state.Validated && start <= state.BaseHeight {
+		start = state.BaseHeight + 1
+	}
+	if pruned := chain.PruneHeight(); start <= pruned {
+		start = pruned + 1
+	}
+
+	v := &chainVerifier{
+		chain:  chain,
+		level:  level,
+		report: &VerifyReport{Level: level, StartHeight: start, TipHeight: tip},
+	}
+	v.run()
+	v.report.OK = v.report.Failure == nil
+
+	return v.report
+}
+
+func (v *chainVerifier) fail(height int, hash []byte, level int, err error) {
+	v.report.Failure = &VerifyFailure{
+		Height: height,
+		Block:  hex.EncodeToString(hash),
+		Check:  verifyCheckNames[level],
+		Error:  err.Error(),
+	}
+}
+
+func (v *chainVerifier) run() {
+	start, tip := v.report.StartHeight, v.report.TipHeight
+
+	if hash, err := v.chain.GetBlockHash(tip); err != nil || !bytes.Equal(hash, v.chain.LastHash) {
+		v.fail(tip, v.chain.LastHash, VerifyLinkage, fmt.Errorf("tip is not indexed at height %d", tip))
+		return
+	}
+
+	var stored map[string]TxOutput
+	if v.level >= VerifyUTXOReplay {
+		var err error
+		if stored, err = v.loadUTXOSet(); err != nil {
+			return
+		}
+		// a full audit replays from nothing, so the stored set cannot
+		// vouch for itself
+		if start == 0 {
+			v.utxos = make(map[string]TxOutput)
+		} else if err := v.rollback(stored, start, tip); err != nil {
+			return
+		}
+	}
+
+	var prevHash []byte
+	if start > 0 {
+		hash, err := v.chain.GetBlockHash(start - 1)
+		if err != nil {
+			v.fail(start-1, nil, VerifyLinkage, err)
+			return
+		}
+		prevHash = hash
+	}
+
+	for height := start; height <= tip; height++ {
+		block, err := v.chain.GetBlockByHeight(height)
+		if err != nil {
+			v.fail(height, nil, VerifyLinkage, err)
+			return
+		}
+		if !v.verifyBlock(block, height, prevHash) {
+			return
+		}
+		prevHash = block.Hash
+		v.report.Blocks++
+	}
+
+	if v.level >= VerifyUTXOSet {
+		v.compareUTXOSet(stored)
+	}
+	if v.utxos != nil {
+		v.report.UTXOs = len(v.utxos)
+	}
+}
+
+func (v *chainVerifier) verifyBlock(block *Block, height int, prevHash []byte) bool {
+	if !bytes.Equal(block.PrevHash, prevHash) {
+		v.fail(height, block.Hash, VerifyLinkage, fmt.Errorf("previous hash %x, expected %x", block.PrevHash, prevHash))
+		return false
+	}
+	if err := CheckProofOfWork(block); err != nil {
+		v.fail(height, block.Hash, VerifyLinkage, err)
+		return false
+	}
+
+	if v.level >= VerifyMerkle {
+		if err := CheckTransactions(block); err != nil {
+			v.fail(height, block.Hash, VerifyMerkle, err)
+			return false
+		}
+	}
+
+	var prev map[string]TxOutput
+	if v.level >= VerifySignatures {
+		data, err := v.chain.Store.GetIndex(undoIndex, block.Hash)
+		if err != nil {
+			v.fail(height, block.Hash, VerifySignatures, fmt.Errorf("undo data: %w", err))
+			return false
+		}
+		prev = spentOutputs(block, DeserializeUndo(data))
+	}
+
+	for _, tx := range block.Transactions {
+		v.report.Transactions++
+		if !tx.IsCoinbase() {
+			v.report.Inputs += len(tx.Inputs)
+		}
+
+		if v.level >= VerifySignatures {
+			if err := verifySignatures(tx, prev); err != nil {
+				v.fail(height, block.Hash, VerifySignatures, err)
+				return false
+			}
+		}
+	}
+
+	if v.level >= VerifyUTXOReplay {
+		if err := v.replay(block); err != nil {
+			v.fail(height, block.Hash, VerifyUTXOReplay, err)
+			return false
+		}
+	}
+
+	return true
+}
+
+// verifySignatures checks the signatures of tx against prev, the outputs its
+// block spends.
+func verifySignatures(tx *Transaction, prev map[string]TxOutput) error {
+	if tx.IsCoinbase() {
+		return nil
+	}
+
+	prevTXs := make(map[string]Transaction)
+	for _, in := range tx.Inputs {
+		out, ok := prev[outpointKey(in.ID, in.Out)]
+		if !ok {
+			return fmt.Errorf("transaction %x input %s: %w", tx.ID, outpointKey(in.ID, in.Out), ErrNotFound)
+		}
+		addPrevOutput(prevTXs, in, out)
+	}
+
+	return CheckSignatures(tx, prevTXs)
+}
+
+// replay applies block to the replayed UTXO set, rejecting inputs that are
+// missing or already spent, transactions that create value and a coinbase
+// claiming more than the subsidy and the fees.
+func (v *chainVerifier) replay(block *Block) error {
+	coinbase, fees := 0, 0
+	for _, tx := range block.Transactions {
+		in := 0
+		if !tx.IsCoinbase() {
+			for _, input := range tx.Inputs {
+				key := outpointKey(input.ID, input.Out)
+				out, ok := v.utxos[key]
+				if !ok {
+					return fmt.Errorf("transaction %x spends %s which is missing or already spent", tx.ID, key)
+				}
+				in += out.Value
+				delete(v.utxos, key)
+			}
+		}
+
+		out := 0
+		for outIdx, output := range tx.Outputs {
+			key := outpointKey(tx.ID, outIdx)
+			if _, ok := v.utxos[key]; ok {
+				return fmt.Errorf("transaction %x overwrites unspent output %s", tx.ID, key)
+			}
+			v.utxos[key] = output
+			out += output.Value
+		}
+
+		if tx.IsCoinbase() {
+			coinbase = out
+		} else if out > in {
+			return fmt.Errorf("transaction %x spends %d but creates %d", tx.ID, in, out)
+		} else {
+			fees += in - out
+		}
+	}
+	if coinbase > Subsidy+fees {
+		return fmt.Errorf("coinbase of block %x creates %d, more than the subsidy %d and the fees %d", block.Hash, coinbase, Subsidy, fees)
+	}
+
+	return nil
+}
+
+func (v *chainVerifier) loadUTXOSet() (map[string]TxOutput, error) {
+	stored := make(map[string]TxOutput)
+
+	err := v.chain.Store.ForEachUTXO(func(txID []byte, out int, output TxOutput) error {
+		stored[outpointKey(txID, out)] = output
+		return nil
+	})
+	if err != nil {
+		v.fail(v.report.TipHeight, v.chain.LastHash, VerifyUTXOReplay, err)
+	}
+
+	return stored, err
+}
+
+// rollback derives the UTXO set as it was below height start by undoing the
+// blocks from tip down to start on a copy of the stored set. Outputs no
+// block created survive it, only a replay from the genesis finds those.
+func (v *chainVerifier) rollback(stored map[string]TxOutput, start, tip int) error {
+	v.utxos = make(map[string]TxOutput, len(stored))
+	for key, out := range stored {
+		v.utxos[key] = out
+	}
+
+	for height := tip; height >= start; height-- {
+		block, err := v.chain.GetBlockByHeight(height)
+		if err != nil {
+			v.fail(height, nil, VerifyUTXOReplay, err)
+			return err
+		}
+		data, err := v.chain.Store.GetIndex(undoIndex, block.Hash)
+		if err != nil {
+			err = fmt.Errorf("undo data: %w", err)
+			v.fail(height, block.Hash, VerifyUTXOReplay, err)
+			return err
+		}
+
+		for _, tx := range block.Transactions {
+			for outIdx := range tx.Outputs {
+				delete(v.utxos, outpointKey(tx.ID, outIdx))
+			}
+		}
+		for _, s := range DeserializeUndo(data).Spent {
+			v.utxos[outpointKey(s.TxID, s.Out)] = s.Output
+		}
+	}
+
+	return nil
+}
+
+func (v *chainVerifier) compareUTXOSet(stored map[string]TxOutput) {
+	tip := v.report.TipHeight
+
+	keys := make([]string, 0, len(v.utxos))
+	for key := range v.utxos {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		out := v.utxos[key]
+		got, ok := stored[key]
+		if !ok {
+			v.fail(tip, v.chain.LastHash, VerifyUTXOSet, fmt.Errorf("output %s is missing from the stored set", key))
+			return
+		}
+		if got.Value != out.Value || !bytes.Equal(got.PublicKeyHash, out.PublicKeyHash) {
+			v.fail(tip, v.chain.LastHash, VerifyUTXOSet, fmt.Errorf("output %s differs from the stored set", key))
+			return
+		}
+	}
+
+	keys = keys[:0]
+	for key := range stored {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if _, ok := v.utxos[key]; !ok {
+			v.fail(tip, v.chain.LastHash, VerifyUTXOSet, fmt.Errorf("stored output %s is not produced by the chain", key))
+			return
+		}
+	}
+}
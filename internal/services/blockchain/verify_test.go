@@ -0,0 +1,65 @@
+package blockchain
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func newTestChain(t *testing.T, blocks int) *BlockChain {
+	t.Helper()
+
+	chain := InitBlockChainWithStore(*discardLogger(), NewMemoryStore(), testAddr)
+	for i := 0; i < blocks; i++ {
+		chain.AddBlock([]*Transaction{CoinbaseTx(testAddr, fmt.Sprintf("block %d", i))})
+	}
+
+	return chain
+}
+
+func TestVerifyChainFindsInjectedOutput(t *testing.T) {
+	chain := newTestChain(t, 2)
+	defer chain.Store.Close()
+
+	if report := chain.VerifyChain(VerifyUTXOSet, 0); !report.OK {
+		t.Fatalf("untouched chain failed verification: %+v", report.Failure)
+	}
+
+	fake := testHash(0xfa)
+	batch := NewBatch()
+	batch.PutUTXO(fake, 0, TxOutput{Value: 1000000, PublicKeyHash: []byte("thief")})
+	if err := chain.Store.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	report := chain.VerifyChain(VerifyUTXOSet, 0)
+	if report.OK {
+		t.Fatalf("chain with an injected output passed verification with %d outputs", report.UTXOs)
+	}
+	if report.Failure.Check != "utxo-set" || !strings.Contains(report.Failure.Error, outpointKey(fake, 0)) {
+		t.Errorf("failure = %+v, want the utxo-set check naming the injected output", report.Failure)
+	}
+}
+
+func TestVerifyChainFindsAlteredOutput(t *testing.T) {
+	chain := newTestChain(t, 1)
+	defer chain.Store.Close()
+
+	tip, err := chain.GetBlockByHeight(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinbase := tip.Transactions[0]
+	batch := NewBatch()
+	batch.PutUTXO(coinbase.ID, 0, TxOutput{Value: coinbase.Outputs[0].Value * 100, PublicKeyHash: coinbase.Outputs[0].PublicKeyHash})
+	if err := chain.Store.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, depth := range []int{0, 1} {
+		report := chain.VerifyChain(VerifyUTXOSet, depth)
+		if report.OK || report.Failure.Check != "utxo-set" {
+			t.Errorf("depth %d: report = %+v, want a utxo-set failure", depth, report)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package mempool
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	feeEstimatesFile = "fee_estimates.json"
+
+	// MaxConfTarget is the most blocks a fee can be estimated for.
+	MaxConfTarget = 25
+	// feeBuckets group fee rates by powers of two: the first holds the rates
+	// below 1 per 1000 bytes, bucket i those from 2^(i-1) up to 2^i.
+	feeBuckets = 24
+	// feeDecay weighs every block down the confirmations seen before it,
+	// so estimates follow the fees miners take now.
+	feeDecay = 0.99
+	// successShare is how many transactions of a fee rate must confirm
+	// within the target for the rate to be estimated.
+	successShare = 0.85
+	// minSamples is how many transactions, decayed, an estimate rests on at
+	// least; neighbouring buckets are joined to get there.
+	minSamples = 2
+)
+
+// FeeEstimate is the result of estimatefee: the fee rate, per 1000 bytes,
+// that confirmed transactions within Blocks blocks.
+type FeeEstimate struct {
+	FeeRate float64 `json:"fee_rate"`
+	Blocks  int     `json:"blocks"`
+}
+
+// Fee returns what a transaction of size bytes pays at the estimated rate.
+func (fe *FeeEstimate) Fee(size int) int {
+	return int(math.Ceil(fe.FeeRate * float64(size) / 1000))
+}
+
+// feeBucket counts the transactions of a fee rate that confirmed.
+type feeBucket struct {
+	// Within[i] is those that confirmed within i+1 blocks.
+	Within [MaxConfTarget]float64 `json:"within"`
+	Total  float64                `json:"total"`
+}
+
+// FeeEstimator learns from the transactions the pool held how long each
+// fee rate took to confirm, and keeps what it learnt in the data dir.
+type FeeEstimator struct {
+	path    string
+	mu      sync.Mutex
+	buckets [feeBuckets]feeBucket
+}
+
+// LoadFeeEstimator reads the estimates saved in dataDir, starting without
+// any when there are none.
+func LoadFeeEstimator(dataDir string) (*FeeEstimator, error) {
+	fe := &FeeEstimator{path: filepath.Join(dataDir, feeEstimatesFile)}
+
+	data, err := os.ReadFile(fe.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return fe, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &fe.buckets); err != nil {
+		return nil, fmt.Errorf("%s: %w", fe.path, err)
+	}
+
+	return fe, nil
+}
+
+// Save writes the estimates to the data dir.
+func (fe *FeeEstimator) Save() error {
+	fe.mu.Lock()
+	data, err := json.MarshalIndent(fe.buckets, "", "  ")
+	fe.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := fe.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, fe.path)
+}
+
+// bucketOf returns the bucket of a fee rate.
+func bucketOf(feeRate float64) int {
+	if feeRate < 1 {
+		return 0
+	}
+
+	return min(1+int(math.Log2(feeRate)), feeBuckets-1)
+}
+
+// bucketFeeRate returns the lowest fee rate of bucket i.
+func bucketFeeRate(i int) float64 {
+	if i == 0 {
+		return 0
+	}
+
+	return math.Exp2(float64(i - 1))
+}
+
+// newBlocks decays what was seen before blocks more blocks.
+func (fe *FeeEstimator) newBlocks(blocks int) {
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+
+	decay := math.Pow(feeDecay, float64(blocks))
+	for i := range fe.buckets {
+		b := &fe.buckets[i]
+		for j := range b.Within {
+			b.Within[j] *= decay
+		}
+		b.Total *= decay
+	}
+}
+
+// confirmed counts a transaction paying feeRate that a block confirmed
+// blocks blocks after the pool took it.
+func (fe *FeeEstimator) confirmed(feeRate float64, blocks int) {
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+
+	b := &fe.buckets[bucketOf(feeRate)]
+	for j := max(blocks, 1) - 1; j < MaxConfTarget; j++ {
+		b.Within[j]++
+	}
+	b.Total++
+}
+
+// estimate returns the lowest fee rate at which enough transactions
+// confirmed within target blocks. waiting counts, per bucket, the pool
+// transactions that have been waiting longer than that already.
+func (fe *FeeEstimator) estimate(target int, waiting [feeBuckets]float64) (*FeeEstimate, error) {
+	if target < 1 || target > MaxConfTarget {
+		return nil, fmt.Errorf("blocks must be between 1 and %d", MaxConfTarget)
+	}
+
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+
+	// from the highest rate down, join buckets until they hold enough
+	// samples and stop at the first group that confirms too few
+	best := -1
+	within, total := 0.0, 0.0
+	for i := feeBuckets - 1; i >= 0; i-- {
+		within += fe.buckets[i].Within[target-1]
+		total += fe.buckets[i].Total + waiting[i]
+		if total < minSamples {
+			continue
+		}
+		if within/total < successShare {
+			break
+		}
+		best = i
+		within, total = 0, 0
+	}
+	if best < 0 {
+		return nil, fmt.Errorf("not enough transactions confirmed yet to estimate a fee for %d blocks", target)
+	}
+
+	return &FeeEstimate{FeeRate: bucketFeeRate(best), Blocks: target}, nil
+}
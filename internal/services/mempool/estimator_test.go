@@ -0,0 +1,193 @@
+package mempool
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/numbermax/blockchain/internal/services/blockchain"
+)
+
+func newTestEstimator(t *testing.T) *FeeEstimator {
+	t.Helper()
+
+	fe, err := LoadFeeEstimator(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fe
+}
+
+// confirmedN counts n transactions paying feeRate confirmed within blocks.
+func confirmedN(fe *FeeEstimator, feeRate float64, blocks, n int) {
+	for i := 0; i < n; i++ {
+		fe.confirmed(feeRate, blocks)
+	}
+}
+
+func TestFeeBuckets(t *testing.T) {
+	tests := []struct {
+		feeRate float64
+		bucket  int
+	}{
+		{0, 0},
+		{0.99, 0},
+		{1, 1},
+		{1.99, 1},
+		{2, 2},
+		{3.5, 2},
+		{4, 3},
+		{1000, 10},
+		{math.Exp2(22), 23},
+		{math.Exp2(40), 23},
+	}
+
+	for _, tt := range tests {
+		bucket := bucketOf(tt.feeRate)
+		if bucket != tt.bucket {
+			t.Errorf("bucketOf(%v) = %d, want %d", tt.feeRate, bucket, tt.bucket)
+		}
+		if low := bucketFeeRate(bucket); low > tt.feeRate {
+			t.Errorf("bucket %d of fee rate %v starts at %v", bucket, tt.feeRate, low)
+		}
+	}
+}
+
+func TestFeeDecay(t *testing.T) {
+	fe := newTestEstimator(t)
+	confirmedN(fe, 8, 2, 10)
+	fe.newBlocks(10)
+
+	b := fe.buckets[bucketOf(8)]
+	want := 10 * math.Pow(feeDecay, 10)
+	if math.Abs(b.Total-want) > 1e-9 || math.Abs(b.Within[1]-want) > 1e-9 {
+		t.Errorf("after 10 blocks the bucket counts %v, %v within 2 blocks, want %v", b.Total, b.Within[1], want)
+	}
+	if b.Within[0] != 0 {
+		t.Errorf("bucket counts %v confirmed within a block, want none", b.Within[0])
+	}
+}
+
+func TestFeeEstimate(t *testing.T) {
+	fe := newTestEstimator(t)
+	// all of the rate of 16 confirm in a block, 9 in 10 of the rate of 4
+	// and 8 in 10 of the rate of 2, the others within 3 blocks
+	confirmedN(fe, 16, 1, 10)
+	confirmedN(fe, 4, 1, 9)
+	confirmedN(fe, 4, 3, 1)
+	confirmedN(fe, 2, 1, 8)
+	confirmedN(fe, 2, 3, 2)
+	// a single sample, joined with the bucket below
+	confirmedN(fe, 1000, 1, 1)
+
+	tests := []struct {
+		name    string
+		target  int
+		waiting map[float64]float64
+		want    float64
+	}{
+		{
+			name:   "below the success share",
+			target: 1,
+			want:   4,
+		},
+		{
+			name:   "all confirmed",
+			target: 3,
+			want:   2,
+		},
+		{
+			// 9 of 12 confirmed in a block, counting those waiting
+			name:    "waiting",
+			target:  1,
+			waiting: map[float64]float64{4: 2},
+			want:    16,
+		},
+		{
+			name:    "waiting below the estimate",
+			target:  1,
+			waiting: map[float64]float64{2: 10},
+			want:    4,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var waiting [feeBuckets]float64
+			for feeRate, n := range tt.waiting {
+				waiting[bucketOf(feeRate)] = n
+			}
+			estimate, err := fe.estimate(tt.target, waiting)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if estimate.FeeRate != tt.want || estimate.Blocks != tt.target {
+				t.Errorf("estimate = %+v, want %v within %d blocks", estimate, tt.want, tt.target)
+			}
+		})
+	}
+
+	for _, target := range []int{0, MaxConfTarget + 1} {
+		if _, err := fe.estimate(target, [feeBuckets]float64{}); err == nil {
+			t.Errorf("estimate for %d blocks did not fail", target)
+		}
+	}
+	if _, err := newTestEstimator(t).estimate(1, [feeBuckets]float64{}); err == nil {
+		t.Error("estimate without samples did not fail")
+	}
+}
+
+// The pool counts what it holds past the target against the rates.
+func TestEstimateFeeCountsWaiting(t *testing.T) {
+	tp := newTestPool(t, DefaultPolicy(), 1)
+	tx := tp.spend(t, 0, tp.coins[:1], tp.pay(90))
+	entry := tp.accept(t, tx)
+	// 5 of 5 confirmed in a block, 5 of 6 once the transaction waits
+	confirmedN(tp.fees, entry.FeeRate(), 1, 5)
+
+	estimate, err := tp.EstimateFee(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := bucketFeeRate(bucketOf(entry.FeeRate())); estimate.FeeRate != want {
+		t.Errorf("estimate = %v, want %v", estimate.FeeRate, want)
+	}
+
+	for i := 0; i < 2; i++ {
+		tp.chain.AddBlock([]*blockchain.Transaction{blockchain.CoinbaseTx(tp.addr, fmt.Sprintf("block %d", i))})
+	}
+	if estimate, err := tp.EstimateFee(1); err == nil {
+		t.Errorf("estimate = %v with the transaction waiting 2 blocks, want none", estimate.FeeRate)
+	}
+}
+
+func TestFeeEstimatorSaveLoad(t *testing.T) {
+	dir := t.TempDir()
+	fe, err := LoadFeeEstimator(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	confirmedN(fe, 4, 2, 3)
+	fe.newBlocks(1)
+	if err := fe.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadFeeEstimator(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.buckets != fe.buckets {
+		t.Errorf("loaded buckets %v, want %v", loaded.buckets, fe.buckets)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, feeEstimatesFile), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadFeeEstimator(dir); err == nil {
+		t.Error("malformed estimates loaded")
+	}
+}
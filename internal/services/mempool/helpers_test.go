@@ -0,0 +1,122 @@
+package mempool
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/numbermax/blockchain/internal/services/blockchain"
+	"github.com/numbermax/blockchain/internal/services/wallet"
+)
+
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// testPool is a pool on a chain whose coinbases all pay w.
+type testPool struct {
+	*Mempool
+	chain *blockchain.BlockChain
+	w     *wallet.Wallet
+	pkh   []byte
+	addr  string
+	// coins are the coinbase outputs of the chain, none spent yet.
+	coins []blockchain.UTXO
+}
+
+// newTestPool opens a pool taking what policy allows on a chain of coins
+// blocks.
+func newTestPool(t *testing.T, policy Policy, coins int) *testPool {
+	t.Helper()
+
+	w := wallet.MakeWallet()
+	pkh := wallet.PublicKeyHash(w.PublicKey)
+	addr := string(wallet.PublicKeyHashToAddress(pkh))
+
+	chain := blockchain.InitBlockChainWithStore(*discardLogger(), blockchain.NewMemoryStore(), addr)
+	for i := 1; i < coins; i++ {
+		chain.AddBlock([]*blockchain.Transaction{blockchain.CoinbaseTx(addr, fmt.Sprintf("coin %d", i))})
+	}
+	fees, err := LoadFeeEstimator(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tp := &testPool{
+		Mempool: New(*discardLogger(), chain, fees, policy),
+		chain:   chain,
+		w:       w,
+		pkh:     pkh,
+		addr:    addr,
+	}
+	err = chain.Store.ForEachUTXO(func(txID []byte, out int, output blockchain.TxOutput) error {
+		tp.coins = append(tp.coins, blockchain.UTXO{TxID: txID, Out: out, Output: output})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tp
+}
+
+// pay returns an output of value locked to the test wallet.
+func (tp *testPool) pay(value int) blockchain.TxOutput {
+	return blockchain.TxOutput{Value: value, PublicKeyHash: tp.pkh}
+}
+
+// spend returns a transaction of the test wallet spending utxos to
+// outputs, its inputs carrying sequence.
+func (tp *testPool) spend(t *testing.T, sequence uint32, utxos []blockchain.UTXO, outputs ...blockchain.TxOutput) *blockchain.Transaction {
+	t.Helper()
+
+	tx := &blockchain.Transaction{Outputs: outputs}
+	var spent []blockchain.TxOutput
+	for _, utxo := range utxos {
+		tx.Inputs = append(tx.Inputs, blockchain.TxInput{
+			ID:        utxo.TxID,
+			Out:       utxo.Out,
+			PublicKey: tp.w.PublicKey,
+			Sequence:  sequence,
+		})
+		spent = append(spent, utxo.Output)
+	}
+	tx.ID = tx.Hash()
+	if err := blockchain.SignTransaction(tx, tp.w.PrivateKey, spent); err != nil {
+		t.Fatal(err)
+	}
+
+	return tx
+}
+
+// accept adds tx to the pool, failing the test when it does not get in.
+func (tp *testPool) accept(t *testing.T, tx *blockchain.Transaction) *Entry {
+	t.Helper()
+
+	entry, err := tp.Accept(tx)
+	if err != nil {
+		t.Fatalf("transaction %x refused: %v", tx.ID, err)
+	}
+
+	return entry
+}
+
+// output returns output out of tx as a UTXO to spend.
+func output(tx *blockchain.Transaction, out int) blockchain.UTXO {
+	return blockchain.UTXO{TxID: tx.ID, Out: out, Output: tx.Outputs[out]}
+}
+
+func assertReject(t *testing.T, err error, code blockchain.RejectCode) {
+	t.Helper()
+
+	if code == "" {
+		if err != nil {
+			t.Errorf("refused: %v", err)
+		}
+		return
+	}
+	if got := blockchain.RejectCodeOf(err); got != code {
+		t.Errorf("rejected with %q (%v), want %q", got, err, code)
+	}
+}
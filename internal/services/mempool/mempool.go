@@ -0,0 +1,455 @@
+// Package mempool holds the transactions a node has accepted but no block
+// has confirmed yet.
+package mempool
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/numbermax/blockchain/internal/services/blockchain"
+)
+
+const (
+	// MaxBytes bounds the serialized size of the transactions held.
+	MaxBytes = 32 << 20
+	// MaxReplacements bounds the transactions one replacement evicts, those
+	// spending the replaced ones included.
+	MaxReplacements = 100
+)
+
+// Reasons a transaction is refused that are no consensus rule but the state
+// of the pool.
+const (
+	RejectAlreadyKnown blockchain.RejectCode = "txn-already-known"
+	RejectConflict     blockchain.RejectCode = "txn-mempool-conflict"
+	RejectFull         blockchain.RejectCode = "mempool-full"
+
+	RejectReplaceFee          blockchain.RejectCode = "rbf-insufficient-fee"
+	RejectReplaceFeeRate      blockchain.RejectCode = "rbf-insufficient-feerate"
+	RejectTooManyReplacements blockchain.RejectCode = "rbf-too-many-replacements"
+	RejectSpendsConflicting   blockchain.RejectCode = "rbf-spends-conflicting-tx"
+)
+
+// Entry is a transaction in the pool.
+type Entry struct {
+	Tx   *blockchain.Transaction
+	Fee  int
+	Size int
+	Time time.Time
+	// Height is the chain height when the pool took the transaction.
+	Height int
+}
+
+// FeeRate is the fee per 1000 bytes.
+func (e *Entry) FeeRate() float64 {
+	return float64(e.Fee) * 1000 / float64(e.Size)
+}
+
+// Info summarizes the pool for getmempoolinfo.
+type Info struct {
+	Size  int `json:"size"`
+	Bytes int `json:"bytes"`
+}
+
+// Mempool holds unconfirmed transactions that spend the UTXO set of its
+// chain or each other. It is guarded by the same lock as the chain: every
+// method reads the chain state and expects the caller to hold that lock.
+type Mempool struct {
+	logger slog.Logger
+	chain  *blockchain.BlockChain
+	// tip is the chain tip the pool was last checked against, height its
+	// height.
+	tip    []byte
+	height int
+	fees   *FeeEstimator
+	policy Policy
+	txs    map[string]*Entry
+	order  []*Entry
+	// spends maps every outpoint spent in the pool to its spender.
+	spends map[string]*Entry
+	bytes  int
+	// changes counts the transactions added and removed.
+	changes uint64
+}
+
+// New returns an empty pool on chain that takes what policy allows and
+// teaches fees how long the transactions it holds take to confirm.
+func New(logger slog.Logger, chain *blockchain.BlockChain, fees *FeeEstimator, policy Policy) *Mempool {
+	return &Mempool{
+		logger: logger,
+		chain:  chain,
+		tip:    chain.LastHash,
+		height: chain.GetBestHeight(),
+		fees:   fees,
+		policy: policy,
+		txs:    make(map[string]*Entry),
+		spends: make(map[string]*Entry),
+	}
+}
+
+// Accept adds tx to the pool when it is valid against the chain tip and the
+// transactions already held, and meets the policy of the pool. A
+// transaction spending the same output as pool transactions replaces them
+// when both sides signal replaceability and it pays more: a higher fee than
+// all it evicts, those spending the replaced transactions included, and a
+// higher fee rate than each it conflicts with.
+func (mp *Mempool) Accept(tx *blockchain.Transaction) (*Entry, error) {
+	mp.update()
+
+	entry, evicted, err := mp.check(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(evicted) > 0 {
+		mp.remove(evicted)
+		mp.logger.Info("Replaced pool transactions",
+			slog.String("txid", fmt.Sprintf("%x", tx.ID)),
+			slog.Int("evicted", len(evicted)),
+			slog.Int("fee", entry.Fee))
+	}
+	mp.add(entry)
+
+	return entry, nil
+}
+
+// Test checks tx as Accept does, leaving the pool as it is.
+func (mp *Mempool) Test(tx *blockchain.Transaction) (*Entry, error) {
+	mp.update()
+
+	entry, _, err := mp.check(tx)
+
+	return entry, err
+}
+
+// check returns the entry tx would get in the pool and the transactions it
+// would evict, or the reason it does not get in.
+func (mp *Mempool) check(tx *blockchain.Transaction) (*Entry, []*Entry, error) {
+	if _, ok := mp.txs[hex.EncodeToString(tx.ID)]; ok {
+		return nil, nil, rejectf(RejectAlreadyKnown, "transaction %x is already in the pool", tx.ID)
+	}
+	if err := blockchain.CheckTransaction(tx); err != nil {
+		return nil, nil, err
+	}
+	size := len(tx.Serialize())
+	if err := mp.policy.checkStandard(tx, size); err != nil {
+		return nil, nil, err
+	}
+
+	var conflicts []*Entry
+	for _, in := range tx.Inputs {
+		spender, ok := mp.spends[outpoint(in.ID, in.Out)]
+		if !ok || slices.Contains(conflicts, spender) {
+			continue
+		}
+		if !tx.Replaceable() || !spender.Tx.Replaceable() {
+			return nil, nil, rejectf(RejectConflict, "transaction %x spends %s which %x spends already",
+				tx.ID, outpoint(in.ID, in.Out), spender.Tx.ID)
+		}
+		conflicts = append(conflicts, spender)
+	}
+	evicted, err := mp.evictions(tx, conflicts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fee, err := blockchain.CheckTransactionInputs(tx, mp.getUTXO)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entry := &Entry{Tx: tx, Fee: fee, Size: size, Time: time.Now(), Height: mp.height}
+	if err := mp.policy.checkFee(entry); err != nil {
+		return nil, nil, err
+	}
+	if err := checkReplacement(entry, conflicts, evicted); err != nil {
+		return nil, nil, err
+	}
+	if err := mp.checkChainLimits(tx); err != nil {
+		return nil, nil, err
+	}
+	freed := 0
+	for _, e := range evicted {
+		freed += e.Size
+	}
+	if mp.bytes-freed+entry.Size > MaxBytes {
+		return nil, nil, rejectf(RejectFull, "the pool holds %d bytes, no room for transaction %x", mp.bytes, tx.ID)
+	}
+
+	return entry, evicted, nil
+}
+
+// evictions returns the transactions replacing conflicts removes from the
+// pool: conflicts and every transaction spending their outputs.
+func (mp *Mempool) evictions(tx *blockchain.Transaction, conflicts []*Entry) ([]*Entry, error) {
+	if len(conflicts) == 0 {
+		return nil, nil
+	}
+
+	evicted := append([]*Entry{}, conflicts...)
+	for i := 0; i < len(evicted); i++ {
+		evicted = mp.appendDescendants(evicted, evicted[i])
+		if len(evicted) > MaxReplacements {
+			return nil, rejectf(RejectTooManyReplacements, "transaction %x would evict more than %d transactions",
+				tx.ID, MaxReplacements)
+		}
+	}
+
+	for _, in := range tx.Inputs {
+		for _, e := range evicted {
+			if bytes.Equal(in.ID, e.Tx.ID) {
+				return nil, rejectf(RejectSpendsConflicting, "transaction %x spends %x which it replaces",
+					tx.ID, e.Tx.ID)
+			}
+		}
+	}
+
+	return evicted, nil
+}
+
+// checkReplacement checks that entry pays more than the transactions it
+// evicts.
+func checkReplacement(entry *Entry, conflicts, evicted []*Entry) error {
+	evictedFees := 0
+	for _, e := range evicted {
+		evictedFees += e.Fee
+	}
+	if len(evicted) > 0 && entry.Fee <= evictedFees {
+		return rejectf(RejectReplaceFee, "transaction %x pays a fee of %d, the %d transactions it evicts pay %d",
+			entry.Tx.ID, entry.Fee, len(evicted), evictedFees)
+	}
+	for _, c := range conflicts {
+		// fee/size > c.Fee/c.Size without rounding
+		if entry.Fee*c.Size <= c.Fee*entry.Size {
+			return rejectf(RejectReplaceFeeRate, "transaction %x pays %d for %d bytes, no higher a rate than %d for %d bytes of %x",
+				entry.Tx.ID, entry.Fee, entry.Size, c.Fee, c.Size, c.Tx.ID)
+		}
+	}
+
+	return nil
+}
+
+// Get returns the entry of the transaction id, nil when it is not held.
+func (mp *Mempool) Get(id []byte) *Entry {
+	mp.update()
+
+	return mp.txs[hex.EncodeToString(id)]
+}
+
+// Entries returns the pool in the order the transactions were accepted,
+// which puts every transaction after those it spends.
+func (mp *Mempool) Entries() []*Entry {
+	mp.update()
+
+	return append([]*Entry{}, mp.order...)
+}
+
+// Descendants returns the pool transactions spending the outputs of entry,
+// directly or through others.
+func (mp *Mempool) Descendants(entry *Entry) []*Entry {
+	mp.update()
+
+	descendants := mp.appendDescendants(nil, entry)
+	for i := 0; i < len(descendants); i++ {
+		descendants = mp.appendDescendants(descendants, descendants[i])
+	}
+
+	return descendants
+}
+
+// SpentOutputs returns the outputs the inputs of tx spend, in their order,
+// from the pool or the chain.
+func (mp *Mempool) SpentOutputs(tx *blockchain.Transaction) ([]blockchain.TxOutput, error) {
+	mp.update()
+
+	var spent []blockchain.TxOutput
+	for _, in := range tx.Inputs {
+		out, err := mp.getUTXO(in.ID, in.Out)
+		if err != nil {
+			return nil, err
+		}
+		spent = append(spent, out)
+	}
+
+	return spent, nil
+}
+
+// EstimateFee returns the fee rate to confirm within target blocks. The
+// transactions of the pool that have been waiting longer than that count
+// against their fee rates.
+func (mp *Mempool) EstimateFee(target int) (*FeeEstimate, error) {
+	mp.update()
+
+	var waiting [feeBuckets]float64
+	for _, entry := range mp.order {
+		if mp.height-entry.Height > target {
+			waiting[bucketOf(entry.FeeRate())]++
+		}
+	}
+
+	return mp.fees.estimate(target, waiting)
+}
+
+func (mp *Mempool) Info() *Info {
+	mp.update()
+
+	return &Info{Size: len(mp.txs), Bytes: mp.bytes}
+}
+
+// Changes counts the transactions the pool took and dropped, so those
+// watching it can tell that it changed.
+func (mp *Mempool) Changes() uint64 {
+	mp.update()
+
+	return mp.changes
+}
+
+// Unspent returns the outputs locked to pubKeyHash that neither the chain
+// nor the pool spends, those of pool transactions included.
+func (mp *Mempool) Unspent(pubKeyHash []byte) ([]blockchain.UTXO, error) {
+	mp.update()
+
+	var utxos []blockchain.UTXO
+	err := mp.chain.Store.ForEachUTXO(func(txID []byte, out int, output blockchain.TxOutput) error {
+		if output.IsLockedWithKey(pubKeyHash) && mp.spends[outpoint(txID, out)] == nil {
+			utxos = append(utxos, blockchain.UTXO{TxID: txID, Out: out, Output: output})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range mp.order {
+		for out, output := range entry.Tx.Outputs {
+			if output.IsLockedWithKey(pubKeyHash) && mp.spends[outpoint(entry.Tx.ID, out)] == nil {
+				utxos = append(utxos, blockchain.UTXO{TxID: entry.Tx.ID, Out: out, Output: output})
+			}
+		}
+	}
+
+	return utxos, nil
+}
+
+// update checks the pool again once the chain tip moved: transactions a
+// block confirmed, or that no longer fit the chain state, are dropped
+// together with those spending them.
+func (mp *Mempool) update() {
+	if bytes.Equal(mp.tip, mp.chain.LastHash) {
+		return
+	}
+	confirmed := mp.confirmedSince(mp.height)
+	height := mp.chain.GetBestHeight()
+	if height > mp.height {
+		mp.fees.newBlocks(height - mp.height)
+	}
+	mp.tip = mp.chain.LastHash
+	mp.height = height
+
+	entries := mp.order
+	mp.txs = make(map[string]*Entry)
+	mp.spends = make(map[string]*Entry)
+	mp.order = nil
+	mp.bytes = 0
+
+	dropped := 0
+	for _, entry := range entries {
+		fee, err := blockchain.CheckTransactionInputs(entry.Tx, mp.getUTXO)
+		if err != nil {
+			if at, ok := confirmed[hex.EncodeToString(entry.Tx.ID)]; ok {
+				mp.fees.confirmed(entry.FeeRate(), at-entry.Height)
+			}
+			dropped++
+			continue
+		}
+		entry.Fee = fee
+		mp.add(entry)
+	}
+	if dropped > 0 {
+		mp.logger.Debug("Dropped confirmed or invalid transactions from the pool",
+			slog.Int("dropped", dropped),
+			slog.Int("size", len(mp.txs)))
+	}
+}
+
+// confirmedSince maps the transactions of the main chain blocks above
+// height to the heights of their blocks. Blocks whose bodies were pruned
+// are left out.
+func (mp *Mempool) confirmedSince(height int) map[string]int {
+	confirmed := make(map[string]int)
+	for h := mp.chain.GetBestHeight(); h > height; h-- {
+		block, err := mp.chain.GetBlockByHeight(h)
+		if err != nil {
+			break
+		}
+		for _, tx := range block.Transactions {
+			confirmed[hex.EncodeToString(tx.ID)] = h
+		}
+	}
+
+	return confirmed
+}
+
+func (mp *Mempool) add(entry *Entry) {
+	mp.txs[hex.EncodeToString(entry.Tx.ID)] = entry
+	mp.order = append(mp.order, entry)
+	for _, in := range entry.Tx.Inputs {
+		mp.spends[outpoint(in.ID, in.Out)] = entry
+	}
+	mp.bytes += entry.Size
+	mp.changes++
+}
+
+// appendDescendants appends the spenders of the outputs of entry that list
+// does not hold yet.
+func (mp *Mempool) appendDescendants(list []*Entry, entry *Entry) []*Entry {
+	for out := range entry.Tx.Outputs {
+		spender, ok := mp.spends[outpoint(entry.Tx.ID, out)]
+		if ok && !slices.Contains(list, spender) {
+			list = append(list, spender)
+		}
+	}
+
+	return list
+}
+
+// remove drops entries from the pool.
+func (mp *Mempool) remove(entries []*Entry) {
+	for _, entry := range entries {
+		delete(mp.txs, hex.EncodeToString(entry.Tx.ID))
+		for _, in := range entry.Tx.Inputs {
+			delete(mp.spends, outpoint(in.ID, in.Out))
+		}
+		mp.bytes -= entry.Size
+		mp.changes++
+	}
+	mp.order = slices.DeleteFunc(mp.order, func(e *Entry) bool {
+		return slices.Contains(entries, e)
+	})
+}
+
+// getUTXO reads an output of a pool transaction or, failing that, of the
+// chain's UTXO set.
+func (mp *Mempool) getUTXO(txID []byte, out int) (blockchain.TxOutput, error) {
+	if entry, ok := mp.txs[hex.EncodeToString(txID)]; ok {
+		if out < 0 || out >= len(entry.Tx.Outputs) {
+			return blockchain.TxOutput{}, fmt.Errorf("output %s: %w", outpoint(txID, out), blockchain.ErrNotFound)
+		}
+		return entry.Tx.Outputs[out], nil
+	}
+
+	return mp.chain.Store.GetUTXO(txID, out)
+}
+
+func outpoint(txID []byte, out int) string {
+	return hex.EncodeToString(txID) + ":" + strconv.Itoa(out)
+}
+
+func rejectf(code blockchain.RejectCode, format string, args ...any) error {
+	return &blockchain.RejectError{Code: code, Err: fmt.Errorf(format, args...)}
+}
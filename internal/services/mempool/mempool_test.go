@@ -0,0 +1,133 @@
+package mempool
+
+import (
+	"testing"
+
+	"github.com/numbermax/blockchain/internal/services/blockchain"
+)
+
+const replaceable = blockchain.SequenceReplaceable
+
+func TestReplacementRejections(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy func(p *Policy)
+		// tx accepts what the replacement conflicts with and returns the
+		// replacement.
+		tx   func(t *testing.T, tp *testPool) *blockchain.Transaction
+		want blockchain.RejectCode
+	}{
+		{
+			name: "replaced does not signal",
+			tx: func(t *testing.T, tp *testPool) *blockchain.Transaction {
+				tp.accept(t, tp.spend(t, 0, tp.coins[:1], tp.pay(90)))
+				return tp.spend(t, replaceable, tp.coins[:1], tp.pay(50))
+			},
+			want: RejectConflict,
+		},
+		{
+			name: "replacement does not signal",
+			tx: func(t *testing.T, tp *testPool) *blockchain.Transaction {
+				tp.accept(t, tp.spend(t, replaceable, tp.coins[:1], tp.pay(90)))
+				return tp.spend(t, 0, tp.coins[:1], tp.pay(50))
+			},
+			want: RejectConflict,
+		},
+		{
+			name: "higher fee at a lower rate",
+			tx: func(t *testing.T, tp *testPool) *blockchain.Transaction {
+				tp.accept(t, tp.spend(t, replaceable, tp.coins[:1], tp.pay(90)))
+				// a fee of 11 for twice the bytes of the fee of 10
+				return tp.spend(t, replaceable, tp.coins[:2], tp.pay(189))
+			},
+			want: RejectReplaceFeeRate,
+		},
+		{
+			name: "fee below the evicted descendants",
+			tx: func(t *testing.T, tp *testPool) *blockchain.Transaction {
+				parent := tp.spend(t, replaceable, tp.coins[:1], tp.pay(90))
+				tp.accept(t, parent)
+				tp.accept(t, tp.spend(t, 0, []blockchain.UTXO{output(parent, 0)}, tp.pay(70)))
+				// above the fee of the parent, not of parent and child
+				return tp.spend(t, replaceable, tp.coins[:1], tp.pay(75))
+			},
+			want: RejectReplaceFee,
+		},
+		{
+			name:   "too many replacements",
+			policy: func(p *Policy) { p.MaxDescendants = 2 * MaxReplacements },
+			tx: func(t *testing.T, tp *testPool) *blockchain.Transaction {
+				var outputs []blockchain.TxOutput
+				for i := 0; i < MaxReplacements; i++ {
+					outputs = append(outputs, tp.pay(1))
+				}
+				parent := tp.spend(t, replaceable, tp.coins[:1], outputs...)
+				tp.accept(t, parent)
+				for i := range outputs {
+					tp.accept(t, tp.spend(t, 0, []blockchain.UTXO{output(parent, i)}, tp.pay(1)))
+				}
+				return tp.spend(t, replaceable, tp.coins[:1], tp.pay(1))
+			},
+			want: RejectTooManyReplacements,
+		},
+		{
+			name: "spends what it replaces",
+			tx: func(t *testing.T, tp *testPool) *blockchain.Transaction {
+				replaced := tp.spend(t, replaceable, tp.coins[:1], tp.pay(45), tp.pay(45))
+				tp.accept(t, replaced)
+				return tp.spend(t, replaceable, []blockchain.UTXO{tp.coins[0], output(replaced, 1)}, tp.pay(100))
+			},
+			want: RejectSpendsConflicting,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := DefaultPolicy()
+			if tt.policy != nil {
+				tt.policy(&policy)
+			}
+			tp := newTestPool(t, policy, 2)
+
+			tx := tt.tx(t, tp)
+			held := len(tp.Entries())
+			_, err := tp.Accept(tx)
+			assertReject(t, err, tt.want)
+			if len(tp.Entries()) != held || tp.Get(tx.ID) != nil {
+				t.Errorf("pool holds %d transactions, want the %d before the replacement", len(tp.Entries()), held)
+			}
+		})
+	}
+}
+
+func TestReplacementEvictsDescendants(t *testing.T) {
+	tp := newTestPool(t, DefaultPolicy(), 2)
+	parent := tp.spend(t, replaceable, tp.coins[:1], tp.pay(90))
+	tp.accept(t, parent)
+	child := tp.spend(t, 0, []blockchain.UTXO{output(parent, 0)}, tp.pay(80))
+	tp.accept(t, child)
+	other := tp.spend(t, 0, tp.coins[1:2], tp.pay(100))
+	tp.accept(t, other)
+
+	// a fee of 50 over the 20 of parent and child
+	replacement := tp.spend(t, replaceable, tp.coins[:1], tp.pay(50))
+	entry := tp.accept(t, replacement)
+	if entry.Fee != 50 {
+		t.Errorf("replacement fee = %d, want 50", entry.Fee)
+	}
+
+	for _, tx := range []*blockchain.Transaction{parent, child} {
+		if tp.Get(tx.ID) != nil {
+			t.Errorf("pool still holds %x", tx.ID)
+		}
+	}
+	if got := len(tp.Entries()); got != 2 || tp.Get(other.ID) == nil {
+		t.Errorf("pool holds %d transactions, want the replacement and the unrelated one", got)
+	}
+
+	// the outputs of the replacement stand in for those of the evicted
+	tp.accept(t, tp.spend(t, 0, []blockchain.UTXO{output(replacement, 0)}, tp.pay(50)))
+	if _, err := tp.Accept(tp.spend(t, 0, []blockchain.UTXO{output(parent, 0)}, tp.pay(80))); blockchain.RejectCodeOf(err) != blockchain.RejectMissingInputs {
+		t.Errorf("spending an evicted output: %v, want %q", err, blockchain.RejectMissingInputs)
+	}
+}
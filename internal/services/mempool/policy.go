@@ -0,0 +1,144 @@
+package mempool
+
+import (
+	"encoding/hex"
+	"slices"
+
+	"github.com/numbermax/blockchain/internal/services/blockchain"
+)
+
+// Reasons a transaction is refused for the policy of the node rather than
+// for breaking a consensus rule: a block holding it would still be valid.
+const (
+	RejectMinRelayFee      blockchain.RejectCode = "min-relay-fee-not-met"
+	RejectDust             blockchain.RejectCode = "dust"
+	RejectTxSize           blockchain.RejectCode = "tx-size"
+	RejectTooManyInputs    blockchain.RejectCode = "too-many-inputs"
+	RejectTooManyOutputs   blockchain.RejectCode = "too-many-outputs"
+	RejectNonstandardIn    blockchain.RejectCode = "nonstandard-input"
+	RejectNonstandardOut   blockchain.RejectCode = "nonstandard-output"
+	RejectTooManyAncestors blockchain.RejectCode = "too-long-mempool-chain-ancestors"
+	RejectTooManyDescends  blockchain.RejectCode = "too-long-mempool-chain-descendants"
+)
+
+// The standard template locks an output to the 20 byte hash of a public
+// key and unlocks it with that key and a signature of two curve numbers.
+const (
+	standardKeyHashSize   = 20
+	standardPublicKeySize = 64
+	standardSignatureSize = 64
+)
+
+// Policy is what the pool takes on top of the consensus rules.
+type Policy struct {
+	// MinRelayFeeRate is the lowest fee per 1000 bytes relayed.
+	MinRelayFeeRate int
+	// DustThreshold is the smallest output value relayed.
+	DustThreshold int
+	// MaxTxSize bounds the serialized size of a transaction.
+	MaxTxSize  int
+	MaxInputs  int
+	MaxOutputs int
+	// AcceptNonstandard lets in inputs and outputs of other shapes than the
+	// standard template.
+	AcceptNonstandard bool
+	// MaxAncestors bounds a transaction and the pool transactions it spends
+	// from, directly or not; MaxDescendants a pool transaction and those
+	// spending from it.
+	MaxAncestors   int
+	MaxDescendants int
+}
+
+// DefaultPolicy relays transactions without fees, as the chain always has.
+func DefaultPolicy() Policy {
+	return Policy{
+		MinRelayFeeRate: 0,
+		DustThreshold:   1,
+		MaxTxSize:       100_000,
+		MaxInputs:       1000,
+		MaxOutputs:      1000,
+		MaxAncestors:    25,
+		MaxDescendants:  25,
+	}
+}
+
+// checkStandard checks what the policy asks of tx alone, size being its
+// serialized size.
+func (p *Policy) checkStandard(tx *blockchain.Transaction, size int) error {
+	if size > p.MaxTxSize {
+		return rejectf(RejectTxSize, "transaction %x is %d bytes, more than %d", tx.ID, size, p.MaxTxSize)
+	}
+	if len(tx.Inputs) > p.MaxInputs {
+		return rejectf(RejectTooManyInputs, "transaction %x has %d inputs, more than %d", tx.ID, len(tx.Inputs), p.MaxInputs)
+	}
+	if len(tx.Outputs) > p.MaxOutputs {
+		return rejectf(RejectTooManyOutputs, "transaction %x has %d outputs, more than %d", tx.ID, len(tx.Outputs), p.MaxOutputs)
+	}
+
+	for i, in := range tx.Inputs {
+		if !p.AcceptNonstandard && (len(in.PublicKey) == 0 || len(in.PublicKey) > standardPublicKeySize ||
+			len(in.Signature) == 0 || len(in.Signature) > standardSignatureSize) {
+			return rejectf(RejectNonstandardIn, "input %d of transaction %x is not a standard key and signature", i, tx.ID)
+		}
+	}
+	for i, out := range tx.Outputs {
+		if !p.AcceptNonstandard && len(out.PublicKeyHash) != standardKeyHashSize {
+			return rejectf(RejectNonstandardOut, "output %d of transaction %x does not lock to a standard key hash", i, tx.ID)
+		}
+		if out.Value < p.DustThreshold {
+			return rejectf(RejectDust, "output %d of transaction %x is worth %d, less than %d", i, tx.ID, out.Value, p.DustThreshold)
+		}
+	}
+
+	return nil
+}
+
+// checkFee checks that entry pays the minimum relay fee for its size.
+func (p *Policy) checkFee(entry *Entry) error {
+	// fee/size < rate/1000 without rounding
+	if entry.Fee*1000 < p.MinRelayFeeRate*entry.Size {
+		return rejectf(RejectMinRelayFee, "transaction %x pays %d for %d bytes, less than %d per 1000 bytes",
+			entry.Tx.ID, entry.Fee, entry.Size, p.MinRelayFeeRate)
+	}
+
+	return nil
+}
+
+// checkChainLimits checks that tx neither has too many ancestors in the
+// pool nor gives one of them too many descendants.
+func (mp *Mempool) checkChainLimits(tx *blockchain.Transaction) error {
+	ancestors := mp.ancestors(tx)
+	if len(ancestors)+1 > mp.policy.MaxAncestors {
+		return rejectf(RejectTooManyAncestors, "transaction %x would have %d ancestors in the pool, more than %d",
+			tx.ID, len(ancestors)+1, mp.policy.MaxAncestors)
+	}
+	for _, ancestor := range ancestors {
+		if descendants := len(mp.Descendants(ancestor)) + 2; descendants > mp.policy.MaxDescendants {
+			return rejectf(RejectTooManyDescends, "transaction %x would give %x %d descendants in the pool, more than %d",
+				tx.ID, ancestor.Tx.ID, descendants, mp.policy.MaxDescendants)
+		}
+	}
+
+	return nil
+}
+
+// ancestors returns the pool transactions tx spends from, directly or
+// through others.
+func (mp *Mempool) ancestors(tx *blockchain.Transaction) []*Entry {
+	var ancestors []*Entry
+	appendParents := func(tx *blockchain.Transaction) {
+		for _, in := range tx.Inputs {
+			parent, ok := mp.txs[hex.EncodeToString(in.ID)]
+			if ok && !slices.Contains(ancestors, parent) {
+				ancestors = append(ancestors, parent)
+			}
+		}
+	}
+
+	appendParents(tx)
+	for i := 0; i < len(ancestors); i++ {
+		appendParents(ancestors[i].Tx)
+	}
+
+	return ancestors
+}
@@ -0,0 +1,132 @@
+package mempool
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/numbermax/blockchain/internal/services/blockchain"
+)
+
+func TestPolicyRejections(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy func(p *Policy)
+		// tx returns the transaction to try, accepting into the pool what
+		// it needs first.
+		tx   func(t *testing.T, tp *testPool) *blockchain.Transaction
+		want blockchain.RejectCode
+	}{
+		{
+			name: "standard",
+			tx: func(t *testing.T, tp *testPool) *blockchain.Transaction {
+				return tp.spend(t, 0, tp.coins[:1], tp.pay(60), tp.pay(40))
+			},
+		},
+		{
+			name: "dust",
+			tx: func(t *testing.T, tp *testPool) *blockchain.Transaction {
+				return tp.spend(t, 0, tp.coins[:1], tp.pay(100), tp.pay(0))
+			},
+			want: RejectDust,
+		},
+		{
+			name:   "tx size",
+			policy: func(p *Policy) { p.MaxTxSize = 100 },
+			tx: func(t *testing.T, tp *testPool) *blockchain.Transaction {
+				return tp.spend(t, 0, tp.coins[:1], tp.pay(100))
+			},
+			want: RejectTxSize,
+		},
+		{
+			name:   "too many inputs",
+			policy: func(p *Policy) { p.MaxInputs = 1 },
+			tx: func(t *testing.T, tp *testPool) *blockchain.Transaction {
+				return tp.spend(t, 0, tp.coins[:2], tp.pay(200))
+			},
+			want: RejectTooManyInputs,
+		},
+		{
+			name:   "too many outputs",
+			policy: func(p *Policy) { p.MaxOutputs = 1 },
+			tx: func(t *testing.T, tp *testPool) *blockchain.Transaction {
+				return tp.spend(t, 0, tp.coins[:1], tp.pay(50), tp.pay(50))
+			},
+			want: RejectTooManyOutputs,
+		},
+		{
+			name: "nonstandard input",
+			tx: func(t *testing.T, tp *testPool) *blockchain.Transaction {
+				tx := tp.spend(t, 0, tp.coins[:1], tp.pay(100))
+				tx.Inputs[0].PublicKey = bytes.Repeat([]byte{1}, standardPublicKeySize+1)
+				tx.ID = tx.ComputeID()
+				return tx
+			},
+			want: RejectNonstandardIn,
+		},
+		{
+			name: "nonstandard output",
+			tx: func(t *testing.T, tp *testPool) *blockchain.Transaction {
+				long := blockchain.TxOutput{Value: 100, PublicKeyHash: append(bytes.Clone(tp.pkh), 0)}
+				return tp.spend(t, 0, tp.coins[:1], long)
+			},
+			want: RejectNonstandardOut,
+		},
+		{
+			name:   "nonstandard accepted",
+			policy: func(p *Policy) { p.AcceptNonstandard = true },
+			tx: func(t *testing.T, tp *testPool) *blockchain.Transaction {
+				long := blockchain.TxOutput{Value: 100, PublicKeyHash: append(bytes.Clone(tp.pkh), 0)}
+				return tp.spend(t, 0, tp.coins[:1], long)
+			},
+		},
+		{
+			name:   "min relay fee",
+			policy: func(p *Policy) { p.MinRelayFeeRate = 1000 },
+			tx: func(t *testing.T, tp *testPool) *blockchain.Transaction {
+				// a fee of 1 for hundreds of bytes
+				return tp.spend(t, 0, tp.coins[:1], tp.pay(99))
+			},
+			want: RejectMinRelayFee,
+		},
+		{
+			name:   "ancestors",
+			policy: func(p *Policy) { p.MaxAncestors = 2 },
+			tx: func(t *testing.T, tp *testPool) *blockchain.Transaction {
+				parent := tp.spend(t, 0, tp.coins[:1], tp.pay(100))
+				tp.accept(t, parent)
+				child := tp.spend(t, 0, []blockchain.UTXO{output(parent, 0)}, tp.pay(100))
+				tp.accept(t, child)
+				return tp.spend(t, 0, []blockchain.UTXO{output(child, 0)}, tp.pay(100))
+			},
+			want: RejectTooManyAncestors,
+		},
+		{
+			name:   "descendants",
+			policy: func(p *Policy) { p.MaxDescendants = 2 },
+			tx: func(t *testing.T, tp *testPool) *blockchain.Transaction {
+				parent := tp.spend(t, 0, tp.coins[:1], tp.pay(50), tp.pay(50))
+				tp.accept(t, parent)
+				tp.accept(t, tp.spend(t, 0, []blockchain.UTXO{output(parent, 0)}, tp.pay(50)))
+				return tp.spend(t, 0, []blockchain.UTXO{output(parent, 1)}, tp.pay(50))
+			},
+			want: RejectTooManyDescends,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := DefaultPolicy()
+			if tt.policy != nil {
+				tt.policy(&policy)
+			}
+			tp := newTestPool(t, policy, 2)
+
+			tx := tt.tx(t, tp)
+			_, err := tp.Accept(tx)
+			assertReject(t, err, tt.want)
+			if held := tp.Get(tx.ID) != nil; held != (tt.want == "") {
+				t.Errorf("pool holds the transaction: %v", held)
+			}
+		})
+	}
+}
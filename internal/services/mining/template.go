@@ -0,0 +1,239 @@
+// Package mining assembles the blocks a miner works on from the mempool.
+package mining
+
+import (
+	"container/heap"
+	"encoding/hex"
+	"slices"
+
+	"github.com/numbermax/blockchain/internal/services/blockchain"
+	"github.com/numbermax/blockchain/internal/services/mempool"
+)
+
+const (
+	// WeightScale is what a byte of a transaction weighs, a byte of its
+	// signatures weighing one.
+	WeightScale = 4
+	// coinbaseReserve is the room kept for the coinbase, which the miner
+	// adds to the template.
+	coinbaseReserve = 1000
+)
+
+// Limits bound the block a template is assembled for.
+type Limits struct {
+	// MaxBlockSize bounds the serialized size of the transactions.
+	MaxBlockSize int
+	// MaxBlockWeight bounds their weight, see Weight.
+	MaxBlockWeight int
+}
+
+func DefaultLimits() Limits {
+	return Limits{
+		MaxBlockSize:   1_000_000,
+		MaxBlockWeight: 4_000_000,
+	}
+}
+
+// TemplateTx is a transaction of a template.
+type TemplateTx struct {
+	Tx     *blockchain.Transaction
+	Fee    int
+	Size   int
+	Weight int
+	// Depends holds the indexes in the template of the transactions this
+	// one spends, which come before it.
+	Depends []int
+}
+
+// BlockTemplate is the block to mine on top of the chain tip, less the
+// coinbase.
+type BlockTemplate struct {
+	PrevHash     []byte
+	Height       int
+	Transactions []*TemplateTx
+	Fees         int
+	Size         int
+	Weight       int
+}
+
+// Weight is WeightScale for every byte of tx but the bytes of its
+// signatures, which weigh one.
+func Weight(tx *blockchain.Transaction) int {
+	stripped := *tx
+	stripped.Inputs = slices.Clone(tx.Inputs)
+	signatures := 0
+	for i := range stripped.Inputs {
+		signatures += len(stripped.Inputs[i].Signature)
+		stripped.Inputs[i].Signature = nil
+	}
+
+	return len(stripped.Serialize())*WeightScale + signatures
+}
+
+// candidate is a pool transaction waiting to be picked, with its package:
+// itself and the ancestors not picked yet.
+type candidate struct {
+	entry  *mempool.Entry
+	weight int
+	order  int
+	// ancestors are the pool transactions it spends, directly or through
+	// others, and parents those it spends directly.
+	ancestors []*candidate
+	parents   []*candidate
+	children  []*candidate
+	// pkgFee, pkgSize and pkgWeight add up the package.
+	pkgFee    int
+	pkgSize   int
+	pkgWeight int
+	picked    bool
+	// heapIndex is where the candidate is in the heap, -1 once it left.
+	heapIndex int
+}
+
+// NewBlockTemplate picks transactions from pool for the block on top of the
+// chain tip. It picks by package fee rate: a transaction is taken with the
+// ancestors it needs, so a child paying a high fee gets its parent paying
+// a low one mined, and packages are taken in order of their fee per byte
+// for as long as they fit limits. The caller holds the chain lock.
+func NewBlockTemplate(chain *blockchain.BlockChain, pool *mempool.Mempool, limits Limits) *BlockTemplate {
+	entries := pool.Entries()
+	byID := make(map[string]*candidate, len(entries))
+	candidates := make(candidateHeap, 0, len(entries))
+	for i, entry := range entries {
+		c := &candidate{entry: entry, weight: Weight(entry.Tx), order: i, heapIndex: i}
+		// entries come after the transactions they spend
+		for _, in := range entry.Tx.Inputs {
+			if parent, ok := byID[hex.EncodeToString(in.ID)]; ok && !slices.Contains(c.parents, parent) {
+				c.parents = append(c.parents, parent)
+				parent.children = append(parent.children, c)
+			}
+		}
+		for _, parent := range c.parents {
+			for _, a := range append([]*candidate{parent}, parent.ancestors...) {
+				if !slices.Contains(c.ancestors, a) {
+					c.ancestors = append(c.ancestors, a)
+				}
+			}
+		}
+		c.pkgFee, c.pkgSize, c.pkgWeight = entry.Fee, entry.Size, c.weight
+		for _, a := range c.ancestors {
+			c.pkgFee += a.entry.Fee
+			c.pkgSize += a.entry.Size
+			c.pkgWeight += a.weight
+		}
+		byID[hex.EncodeToString(entry.Tx.ID)] = c
+		candidates = append(candidates, c)
+	}
+	heap.Init(&candidates)
+
+	template := &BlockTemplate{
+		PrevHash: chain.LastHash,
+		Height:   chain.GetBestHeight() + 1,
+		Size:     coinbaseReserve,
+		Weight:   coinbaseReserve * WeightScale,
+	}
+	index := make(map[*candidate]int)
+	for candidates.Len() > 0 {
+		best := heap.Pop(&candidates).(*candidate)
+		if template.Size+best.pkgSize > limits.MaxBlockSize || template.Weight+best.pkgWeight > limits.MaxBlockWeight {
+			// its descendants need it, so they do not fit either and
+			// are dropped when their turn comes
+			continue
+		}
+
+		template.Fees += best.pkgFee
+		template.Size += best.pkgSize
+		template.Weight += best.pkgWeight
+		for _, p := range best.pkg() {
+			p.picked = true
+			if p.heapIndex >= 0 {
+				heap.Remove(&candidates, p.heapIndex)
+			}
+			tx := &TemplateTx{Tx: p.entry.Tx, Fee: p.entry.Fee, Size: p.entry.Size, Weight: p.weight}
+			for _, parent := range p.parents {
+				tx.Depends = append(tx.Depends, index[parent])
+			}
+			index[p] = len(template.Transactions)
+			template.Transactions = append(template.Transactions, tx)
+
+			// the packages of its descendants no longer hold it
+			for _, d := range p.descendants() {
+				if d.heapIndex < 0 {
+					continue
+				}
+				d.pkgFee -= p.entry.Fee
+				d.pkgSize -= p.entry.Size
+				d.pkgWeight -= p.weight
+				heap.Fix(&candidates, d.heapIndex)
+			}
+		}
+	}
+
+	return template
+}
+
+// pkg returns c and its ancestors not picked yet, parents first.
+func (c *candidate) pkg() []*candidate {
+	pkg := []*candidate{c}
+	for _, a := range c.ancestors {
+		if !a.picked {
+			pkg = append(pkg, a)
+		}
+	}
+	slices.SortFunc(pkg, func(a, b *candidate) int { return a.order - b.order })
+
+	return pkg
+}
+
+// descendants returns the pool transactions spending c, directly or
+// through others.
+func (c *candidate) descendants() []*candidate {
+	descendants := slices.Clone(c.children)
+	for i := 0; i < len(descendants); i++ {
+		for _, child := range descendants[i].children {
+			if !slices.Contains(descendants, child) {
+				descendants = append(descendants, child)
+			}
+		}
+	}
+
+	return descendants
+}
+
+// candidateHeap orders candidates by the fee rate of their packages, the
+// highest first and the earliest of equal rates.
+type candidateHeap []*candidate
+
+func (h candidateHeap) Len() int { return len(h) }
+
+func (h candidateHeap) Less(i, j int) bool {
+	a, b := h[i], h[j]
+	// a.pkgFee/a.pkgSize against b.pkgFee/b.pkgSize without rounding
+	if x, y := a.pkgFee*b.pkgSize, b.pkgFee*a.pkgSize; x != y {
+		return x > y
+	}
+
+	return a.order < b.order
+}
+
+func (h candidateHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIndex = i
+	h[j].heapIndex = j
+}
+
+func (h *candidateHeap) Push(x any) {
+	c := x.(*candidate)
+	c.heapIndex = len(*h)
+	*h = append(*h, c)
+}
+
+func (h *candidateHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	old[len(old)-1] = nil
+	c.heapIndex = -1
+	*h = old[:len(old)-1]
+
+	return c
+}
@@ -0,0 +1,208 @@
+package mining
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/numbermax/blockchain/internal/services/blockchain"
+	"github.com/numbermax/blockchain/internal/services/mempool"
+	"github.com/numbermax/blockchain/internal/services/wallet"
+)
+
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// testPool is an empty pool on a chain of coinbases paying w.
+type testPool struct {
+	*mempool.Mempool
+	chain *blockchain.BlockChain
+	w     *wallet.Wallet
+	pkh   []byte
+	coins []blockchain.UTXO
+}
+
+func newTestPool(t *testing.T, coins int) *testPool {
+	t.Helper()
+
+	w := wallet.MakeWallet()
+	pkh := wallet.PublicKeyHash(w.PublicKey)
+	addr := string(wallet.PublicKeyHashToAddress(pkh))
+
+	chain := blockchain.InitBlockChainWithStore(*discardLogger(), blockchain.NewMemoryStore(), addr)
+	for i := 1; i < coins; i++ {
+		chain.AddBlock([]*blockchain.Transaction{blockchain.CoinbaseTx(addr, fmt.Sprintf("coin %d", i))})
+	}
+	fees, err := mempool.LoadFeeEstimator(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tp := &testPool{
+		Mempool: mempool.New(*discardLogger(), chain, fees, mempool.DefaultPolicy()),
+		chain:   chain,
+		w:       w,
+		pkh:     pkh,
+	}
+	err = chain.Store.ForEachUTXO(func(txID []byte, out int, output blockchain.TxOutput) error {
+		tp.coins = append(tp.coins, blockchain.UTXO{TxID: txID, Out: out, Output: output})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tp
+}
+
+// accept adds to the pool a transaction spending utxos to outputs of the
+// values given.
+func (tp *testPool) accept(t *testing.T, utxos []blockchain.UTXO, values ...int) *blockchain.Transaction {
+	t.Helper()
+
+	tx := &blockchain.Transaction{}
+	var spent []blockchain.TxOutput
+	for _, utxo := range utxos {
+		tx.Inputs = append(tx.Inputs, blockchain.TxInput{ID: utxo.TxID, Out: utxo.Out, PublicKey: tp.w.PublicKey})
+		spent = append(spent, utxo.Output)
+	}
+	for _, value := range values {
+		tx.Outputs = append(tx.Outputs, blockchain.TxOutput{Value: value, PublicKeyHash: tp.pkh})
+	}
+	tx.ID = tx.Hash()
+	if err := blockchain.SignTransaction(tx, tp.w.PrivateKey, spent); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tp.Accept(tx); err != nil {
+		t.Fatalf("transaction %x refused: %v", tx.ID, err)
+	}
+
+	return tx
+}
+
+func output(tx *blockchain.Transaction, out int) []blockchain.UTXO {
+	return []blockchain.UTXO{{TxID: tx.ID, Out: out, Output: tx.Outputs[out]}}
+}
+
+// assertTemplate checks that template holds want in that order, every
+// transaction depending on the template transactions it spends.
+func assertTemplate(t *testing.T, template *BlockTemplate, want ...*blockchain.Transaction) {
+	t.Helper()
+
+	if len(template.Transactions) != len(want) {
+		t.Fatalf("template holds %d transactions, want %d", len(template.Transactions), len(want))
+	}
+	fees := 0
+	for i, tx := range template.Transactions {
+		if !bytes.Equal(tx.Tx.ID, want[i].ID) {
+			t.Errorf("transaction %d is %x, want %x", i, tx.Tx.ID, want[i].ID)
+		}
+		fees += tx.Fee
+
+		var depends []int
+		for _, in := range tx.Tx.Inputs {
+			for j, parent := range template.Transactions[:i] {
+				if bytes.Equal(in.ID, parent.Tx.ID) {
+					depends = append(depends, j)
+				}
+			}
+		}
+		if fmt.Sprint(tx.Depends) != fmt.Sprint(depends) {
+			t.Errorf("transaction %d depends on %v, want %v", i, tx.Depends, depends)
+		}
+	}
+	if template.Fees != fees {
+		t.Errorf("template fees = %d, want %d", template.Fees, fees)
+	}
+}
+
+func TestTemplateChildPaysForParent(t *testing.T) {
+	tp := newTestPool(t, 2)
+	// the parent pays 1, too little to go before the other transaction
+	// alone, its child pays for both
+	parent := tp.accept(t, tp.coins[:1], 49, 50)
+	other := tp.accept(t, tp.coins[1:], 90)
+	child := tp.accept(t, output(parent, 1), 10)
+
+	template := NewBlockTemplate(tp.chain, tp.Mempool, DefaultLimits())
+	assertTemplate(t, template, parent, child, other)
+	if template.Fees != 51 {
+		t.Errorf("template fees = %d, want 51", template.Fees)
+	}
+}
+
+func TestTemplateDependsOnPickedParents(t *testing.T) {
+	tp := newTestPool(t, 2)
+	// the first child takes its parent in, the other transaction pays a
+	// better rate than the second child, which spends both
+	parent := tp.accept(t, tp.coins[:1], 50, 50)
+	first := tp.accept(t, output(parent, 0), 5)
+	other := tp.accept(t, tp.coins[1:], 80)
+	second := tp.accept(t, append(output(parent, 1), output(first, 0)...), 30)
+
+	template := NewBlockTemplate(tp.chain, tp.Mempool, DefaultLimits())
+	assertTemplate(t, template, parent, first, other, second)
+	if got := template.Transactions[3].Depends; len(got) != 2 || got[0] != 0 || got[1] != 1 {
+		t.Errorf("second child depends on %v, want [0 1]", got)
+	}
+}
+
+func TestTemplateRepricesDescendants(t *testing.T) {
+	tp := newTestPool(t, 2)
+	// the parent goes first alone; with it the child would pay a better
+	// rate than the other transaction, without it a worse one
+	parent := tp.accept(t, tp.coins[:1], 60)
+	child := tp.accept(t, output(parent, 0), 59)
+	other := tp.accept(t, tp.coins[1:], 90)
+
+	assertTemplate(t, NewBlockTemplate(tp.chain, tp.Mempool, DefaultLimits()), parent, other, child)
+}
+
+func TestTemplateLimits(t *testing.T) {
+	tp := newTestPool(t, 3)
+	// a package of two at the best rate, then two transactions alone
+	parent := tp.accept(t, tp.coins[:1], 90)
+	child := tp.accept(t, output(parent, 0), 20)
+	high := tp.accept(t, tp.coins[1:2], 70)
+	low := tp.accept(t, tp.coins[2:3], 95)
+
+	full := NewBlockTemplate(tp.chain, tp.Mempool, DefaultLimits())
+	assertTemplate(t, full, parent, child, high, low)
+	size := full.Transactions[0].Size
+	weight := full.Transactions[0].Weight
+
+	tests := []struct {
+		name   string
+		limits Limits
+		want   []*blockchain.Transaction
+	}{
+		{
+			// the package does not fit, what comes after it does
+			name:   "size",
+			limits: Limits{MaxBlockSize: coinbaseReserve + size + size/2, MaxBlockWeight: DefaultLimits().MaxBlockWeight},
+			want:   []*blockchain.Transaction{high},
+		},
+		{
+			name:   "weight",
+			limits: Limits{MaxBlockSize: DefaultLimits().MaxBlockSize, MaxBlockWeight: coinbaseReserve*WeightScale + 3*weight + weight/2},
+			want:   []*blockchain.Transaction{parent, child, high},
+		},
+		{
+			name:   "nothing fits",
+			limits: Limits{MaxBlockSize: coinbaseReserve + size/2, MaxBlockWeight: DefaultLimits().MaxBlockWeight},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			template := NewBlockTemplate(tp.chain, tp.Mempool, tt.limits)
+			assertTemplate(t, template, tt.want...)
+			if template.Size > tt.limits.MaxBlockSize || template.Weight > tt.limits.MaxBlockWeight {
+				t.Errorf("template of %d bytes weighing %d is over the limits %+v", template.Size, template.Weight, tt.limits)
+			}
+		})
+	}
+}
@@ -0,0 +1,367 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	peersFile = "peers.json"
+
+	// maxAddresses bounds the address manager; the least useful entries are
+	// dropped to make room.
+	maxAddresses = 2000
+	// maxPerSource bounds the addresses learnt from one source that are
+	// kept, so a single peer cannot fill the address manager.
+	maxPerSource = 250
+	// maxFailures is how many failed connections in a row make an address
+	// that never worked worth forgetting.
+	maxFailures = 10
+	// retryBase is the wait after a failed connection, doubled with every
+	// further failure up to retryMax.
+	retryBase = 10 * time.Second
+	retryMax  = 30 * time.Minute
+)
+
+// KnownAddr is what the address manager remembers about a peer address.
+type KnownAddr struct {
+	Addr        string    `json:"addr"`
+	Source      string    `json:"source"`
+	AddedAt     time.Time `json:"added_at"`
+	LastSeen    time.Time `json:"last_seen"`
+	LastAttempt time.Time `json:"last_attempt"`
+	LastSuccess time.Time `json:"last_success"`
+	Successes   int       `json:"successes"`
+	// Failures counts failed connections since the last success.
+	Failures int `json:"failures"`
+}
+
+// AddrManInfo summarizes the address manager.
+type AddrManInfo struct {
+	Total int `json:"total"`
+	// Tried addresses had at least one successful connection.
+	Tried  int            `json:"tried"`
+	New    int            `json:"new"`
+	Groups map[string]int `json:"groups"`
+}
+
+// AddrManager keeps the addresses of known peers in the data dir, learns new
+// ones from gossip and picks outbound peers among them.
+type AddrManager struct {
+	path  string
+	mu    sync.Mutex
+	addrs map[string]*KnownAddr
+}
+
+// LoadAddrManager reads the addresses saved in dataDir, starting empty when
+// there are none.
+func LoadAddrManager(dataDir string) (*AddrManager, error) {
+	am := &AddrManager{
+		path:  filepath.Join(dataDir, peersFile),
+		addrs: make(map[string]*KnownAddr),
+	}
+
+	data, err := os.ReadFile(am.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return am, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*KnownAddr
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("%s: %w", am.path, err)
+	}
+	for _, ka := range list {
+		am.addrs[ka.Addr] = ka
+	}
+
+	return am, nil
+}
+
+// Save writes the addresses to the data dir.
+func (am *AddrManager) Save() error {
+	am.mu.Lock()
+	list := make([]*KnownAddr, 0, len(am.addrs))
+	for _, ka := range am.addrs {
+		copied := *ka
+		list = append(list, &copied)
+	}
+	am.mu.Unlock()
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := am.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, am.path)
+}
+
+// Add learns addrs from source and returns how many were new, keeping at
+// most maxPerSource of those source taught. Addresses that are already
+// known only get their last seen time moved forward.
+func (am *AddrManager) Add(addrs []NetAddr, source string) int {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	fromSource := 0
+	for _, ka := range am.addrs {
+		if ka.Source == source {
+			fromSource++
+		}
+	}
+
+	now := time.Now()
+	added := 0
+	for _, na := range addrs {
+		if !validAddr(na.Addr) {
+			continue
+		}
+		seen := na.LastSeen
+		if seen.After(now) {
+			seen = now
+		}
+
+		if ka, ok := am.addrs[na.Addr]; ok {
+			if seen.After(ka.LastSeen) {
+				ka.LastSeen = seen
+			}
+			continue
+		}
+		if fromSource >= maxPerSource {
+			continue
+		}
+
+		if len(am.addrs) >= maxAddresses {
+			am.evict()
+		}
+		am.addrs[na.Addr] = &KnownAddr{
+			Addr:     na.Addr,
+			Source:   source,
+			AddedAt:  now,
+			LastSeen: seen,
+		}
+		fromSource++
+		added++
+	}
+
+	return added
+}
+
+// Attempt records a connection attempt to addr.
+func (am *AddrManager) Attempt(addr string) {
+	am.update(addr, func(ka *KnownAddr) {
+		ka.LastAttempt = time.Now()
+	})
+}
+
+// Good records a successful connection to addr, adding it if unknown.
+func (am *AddrManager) Good(addr string) {
+	am.Add([]NetAddr{{Addr: addr, LastSeen: time.Now()}}, addr)
+	am.update(addr, func(ka *KnownAddr) {
+		ka.LastSuccess = time.Now()
+		ka.LastSeen = ka.LastSuccess
+		ka.Successes++
+		ka.Failures = 0
+	})
+}
+
+// Failed records a failed connection to addr, forgetting it when it never
+// worked and keeps failing.
+func (am *AddrManager) Failed(addr string) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	ka, ok := am.addrs[addr]
+	if !ok {
+		return
+	}
+	ka.Failures++
+	if ka.Successes == 0 && ka.Failures >= maxFailures {
+		delete(am.addrs, addr)
+	}
+}
+
+// Select picks an address to connect out to. Addresses in a group of
+// connected are skipped, so outbound peers spread over networks, as are
+// addresses still waiting out a failure. Addresses that worked before and
+// failed less are more likely to be picked. It returns "" when no address
+// qualifies.
+func (am *AddrManager) Select(connected map[string]bool) string {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	groups := make(map[string]bool)
+	for addr := range connected {
+		groups[addrGroup(addr)] = true
+	}
+
+	now := time.Now()
+	var candidates []*KnownAddr
+	var weights []float64
+	total := 0.0
+	for _, ka := range am.addrs {
+		if connected[ka.Addr] || groups[addrGroup(ka.Addr)] {
+			continue
+		}
+		if ka.Failures > 0 && now.Sub(ka.LastAttempt) < retryDelay(ka.Failures) {
+			continue
+		}
+
+		weight := 1.0 / float64(1+ka.Failures)
+		if ka.Successes > 0 {
+			weight *= 2
+		}
+		candidates = append(candidates, ka)
+		weights = append(weights, weight)
+		total += weight
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+
+	pick := rand.Float64() * total
+	for i, weight := range weights {
+		if pick < weight {
+			return candidates[i].Addr
+		}
+		pick -= weight
+	}
+
+	return candidates[len(candidates)-1].Addr
+}
+
+// Sample returns up to max addresses to gossip, those seen last first.
+func (am *AddrManager) Sample(max int) []NetAddr {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	list := make([]NetAddr, 0, len(am.addrs))
+	for _, ka := range am.addrs {
+		if ka.LastSeen.IsZero() {
+			continue
+		}
+		list = append(list, NetAddr{Addr: ka.Addr, LastSeen: ka.LastSeen})
+	}
+	rand.Shuffle(len(list), func(i, j int) { list[i], list[j] = list[j], list[i] })
+	if len(list) > max {
+		list = list[:max]
+	}
+
+	return list
+}
+
+// Info summarizes the known addresses.
+func (am *AddrManager) Info() *AddrManInfo {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	info := &AddrManInfo{Groups: make(map[string]int)}
+	for _, ka := range am.addrs {
+		info.Total++
+		if ka.Successes > 0 {
+			info.Tried++
+		} else {
+			info.New++
+		}
+		info.Groups[addrGroup(ka.Addr)]++
+	}
+
+	return info
+}
+
+func (am *AddrManager) update(addr string, fn func(ka *KnownAddr)) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	if ka, ok := am.addrs[addr]; ok {
+		fn(ka)
+	}
+}
+
+// evict drops the address least worth keeping: one that never worked while
+// there are any, among those failing ones first, then the one seen longest
+// ago. The caller holds mu.
+func (am *AddrManager) evict() {
+	var worst *KnownAddr
+	for _, ka := range am.addrs {
+		if worst == nil || worse(ka, worst) {
+			worst = ka
+		}
+	}
+	if worst != nil {
+		delete(am.addrs, worst.Addr)
+	}
+}
+
+// worse reports whether a is less worth keeping than b.
+func worse(a, b *KnownAddr) bool {
+	if tried := a.Successes > 0; tried != (b.Successes > 0) {
+		return !tried
+	}
+	if a.Failures != b.Failures {
+		return a.Failures > b.Failures
+	}
+
+	return a.LastSeen.Before(b.LastSeen)
+}
+
+func retryDelay(failures int) time.Duration {
+	delay := retryBase
+	for i := 1; i < failures && delay < retryMax; i++ {
+		delay *= 2
+	}
+
+	return min(delay, retryMax)
+}
+
+// validAddr accepts host:port addresses with a numeric, non zero port.
+func validAddr(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return false
+	}
+	p, err := strconv.Atoi(port)
+
+	return err == nil && p > 0 && p < 1<<16
+}
+
+// addrGroup is the network an address belongs to for outbound diversity:
+// the /16 of an IPv4 address, the /32 of an IPv6 one, the name of a host.
+// Loopback addresses, used when testing on one machine, are each their own
+// group.
+func addrGroup(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		if host == "localhost" {
+			return addr
+		}
+		return host
+	case ip.IsLoopback():
+		return addr
+	case ip.To4() != nil:
+		return ip.Mask(net.CIDRMask(16, 32)).String() + "/16"
+	default:
+		return ip.Mask(net.CIDRMask(32, 128)).String() + "/32"
+	}
+}
@@ -0,0 +1,107 @@
+package network
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newTestAddrMan(t *testing.T) *AddrManager {
+	t.Helper()
+
+	am, err := LoadAddrManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return am
+}
+
+// gossip returns n addresses seen at seen, numbered from first.
+func gossip(first, n int, seen time.Time) []NetAddr {
+	addrs := make([]NetAddr, n)
+	for i := range addrs {
+		addrs[i] = NetAddr{Addr: fmt.Sprintf("10.%d.%d.1:8333", (first+i)/256, (first+i)%256), LastSeen: seen}
+	}
+
+	return addrs
+}
+
+// fill adds untried addresses from many sources until am is full.
+func fill(am *AddrManager, seen time.Time) {
+	for source := 0; am.Info().Total < maxAddresses; source++ {
+		total := am.Info().Total
+		am.Add(gossip(total, min(maxPerSource, maxAddresses-total), seen), fmt.Sprintf("192.0.2.%d:8333", source))
+	}
+}
+
+func TestEvictKeepsTriedAddresses(t *testing.T) {
+	am := newTestAddrMan(t)
+	// a tried address seen long ago and failing since, the worst of all
+	// had it never worked
+	const tried = "198.51.100.1:8333"
+	am.Good(tried)
+	for i := 0; i < maxFailures/2; i++ {
+		am.Failed(tried)
+	}
+	am.update(tried, func(ka *KnownAddr) { ka.LastSeen = time.Now().Add(-24 * time.Hour) })
+
+	fill(am, time.Now())
+	// among the untried, a failing one goes first
+	failing := gossip(7, 1, time.Time{})[0].Addr
+	am.Failed(failing)
+
+	for i := 0; i < 2; i++ {
+		am.Add(gossip(maxAddresses+i, 1, time.Now()), "203.0.113.1:8333")
+		if knownAddr(am, tried) == nil {
+			t.Fatalf("tried address evicted to make room for address %d", i)
+		}
+	}
+	if knownAddr(am, failing) != nil {
+		t.Error("failing untried address kept")
+	}
+	if info := am.Info(); info.Total != maxAddresses || info.Tried != 1 {
+		t.Errorf("address manager holds %d addresses, %d tried, want %d and 1", info.Total, info.Tried, maxAddresses)
+	}
+}
+
+func TestEvictTriedOnceAllAre(t *testing.T) {
+	am := newTestAddrMan(t)
+	fill(am, time.Now())
+	am.mu.Lock()
+	for _, ka := range am.addrs {
+		ka.Successes = 1
+	}
+	am.mu.Unlock()
+	oldest := gossip(3, 1, time.Time{})[0].Addr
+	am.update(oldest, func(ka *KnownAddr) { ka.LastSeen = time.Now().Add(-time.Hour) })
+
+	if added := am.Add(gossip(maxAddresses, 1, time.Now()), "203.0.113.1:8333"); added != 1 {
+		t.Fatalf("added %d addresses, want 1", added)
+	}
+	if knownAddr(am, oldest) != nil {
+		t.Error("the tried address seen longest ago was kept")
+	}
+}
+
+func TestAddCapsAddressesPerSource(t *testing.T) {
+	am := newTestAddrMan(t)
+	const source = "203.0.113.1:8333"
+
+	earlier := time.Now().Add(-time.Hour)
+	if added := am.Add(gossip(0, maxPerSource+10, earlier), source); added != maxPerSource {
+		t.Errorf("added %d addresses from one source, want %d", added, maxPerSource)
+	}
+	if added := am.Add(gossip(maxPerSource+10, 1, time.Now()), source); added != 0 {
+		t.Errorf("added %d more from the same source, want none", added)
+	}
+	if added := am.Add(gossip(maxPerSource+10, 1, time.Now()), "203.0.113.2:8333"); added != 1 {
+		t.Errorf("added %d from another source, want 1", added)
+	}
+
+	// the source still refreshes what it taught before
+	am.Add(gossip(0, 1, time.Now()), source)
+	if ka := knownAddr(am, gossip(0, 1, earlier)[0].Addr); ka == nil || !ka.LastSeen.After(earlier) {
+		t.Errorf("known address not seen again: %+v", ka)
+	}
+}
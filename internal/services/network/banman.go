@@ -0,0 +1,200 @@
+package network
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const banFile = "banlist.json"
+
+// BanEntry is a banned subnet; a single address is a subnet of one.
+type BanEntry struct {
+	Subnet      string    `json:"subnet"`
+	CreatedAt   time.Time `json:"created_at"`
+	BannedUntil time.Time `json:"banned_until"`
+	Reason      string    `json:"reason"`
+}
+
+// BanManager keeps the banned subnets in the data dir. Bans expire on their
+// own.
+type BanManager struct {
+	path   string
+	saveMu sync.Mutex
+	mu     sync.Mutex
+	bans   map[string]*BanEntry
+	nets   map[string]*net.IPNet
+}
+
+// LoadBanManager reads the bans saved in dataDir, dropping expired ones.
+func LoadBanManager(dataDir string) (*BanManager, error) {
+	bm := &BanManager{
+		path: filepath.Join(dataDir, banFile),
+		bans: make(map[string]*BanEntry),
+		nets: make(map[string]*net.IPNet),
+	}
+
+	data, err := os.ReadFile(bm.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return bm, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*BanEntry
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("%s: %w", bm.path, err)
+	}
+	for _, ban := range list {
+		subnet, err := ParseSubnet(ban.Subnet)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", bm.path, err)
+		}
+		bm.bans[subnet.String()] = ban
+		bm.nets[subnet.String()] = subnet
+	}
+	bm.sweep(time.Now())
+
+	return bm, nil
+}
+
+// Ban bans subnet until the given time, replacing an earlier ban of it.
+func (bm *BanManager) Ban(subnet *net.IPNet, until time.Time, reason string) error {
+	bm.mu.Lock()
+	key := subnet.String()
+	bm.bans[key] = &BanEntry{
+		Subnet:      key,
+		CreatedAt:   time.Now(),
+		BannedUntil: until,
+		Reason:      reason,
+	}
+	bm.nets[key] = subnet
+	bm.mu.Unlock()
+
+	return bm.save()
+}
+
+// Unban lifts the ban of subnet.
+func (bm *BanManager) Unban(subnet *net.IPNet) error {
+	bm.mu.Lock()
+	key := subnet.String()
+	if _, ok := bm.bans[key]; !ok {
+		bm.mu.Unlock()
+		return fmt.Errorf("%s is not banned", key)
+	}
+	delete(bm.bans, key)
+	delete(bm.nets, key)
+	bm.mu.Unlock()
+
+	return bm.save()
+}
+
+// Clear lifts every ban.
+func (bm *BanManager) Clear() error {
+	bm.mu.Lock()
+	bm.bans = make(map[string]*BanEntry)
+	bm.nets = make(map[string]*net.IPNet)
+	bm.mu.Unlock()
+
+	return bm.save()
+}
+
+// List returns the bans in force, ordered by subnet.
+func (bm *BanManager) List() []BanEntry {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	bm.sweep(time.Now())
+	list := make([]BanEntry, 0, len(bm.bans))
+	for _, ban := range bm.bans {
+		list = append(list, *ban)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Subnet < list[j].Subnet })
+
+	return list
+}
+
+// IsBanned reports whether the host of addr, which may carry a port, is in
+// a banned subnet. Host names are never banned, only the address a
+// connection to them comes from.
+func (bm *BanManager) IsBanned(addr string) bool {
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	now := time.Now()
+	for key, subnet := range bm.nets {
+		if subnet.Contains(ip) && now.Before(bm.bans[key].BannedUntil) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sweep drops the bans that ran out. The caller holds mu.
+func (bm *BanManager) sweep(now time.Time) {
+	for key, ban := range bm.bans {
+		if !now.Before(ban.BannedUntil) {
+			delete(bm.bans, key)
+			delete(bm.nets, key)
+		}
+	}
+}
+
+func (bm *BanManager) save() error {
+	bm.saveMu.Lock()
+	defer bm.saveMu.Unlock()
+
+	list := bm.List()
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := bm.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, bm.path)
+}
+
+// ParseSubnet reads an address or a CIDR subnet. An address is the subnet
+// holding only itself.
+func ParseSubnet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, subnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet %q", s)
+		}
+		return subnet, nil
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
@@ -0,0 +1,306 @@
+package network
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/numbermax/blockchain/internal/services/blockchain"
+)
+
+const (
+	// shortIDBits is the width of a short transaction ID.
+	shortIDBits = 48
+	// compactTimeout is how long a peer may take to send the transactions
+	// asked for before the full block is fetched instead.
+	compactTimeout = 10 * time.Second
+)
+
+// CompactStats counts how the compact blocks peers sent were turned back
+// into blocks.
+type CompactStats struct {
+	Received int `json:"received"`
+	// Reconstructed blocks were rebuilt from the mempool alone, Requested
+	// ones after asking the peer for the transactions missing.
+	Reconstructed int `json:"reconstructed"`
+	Requested     int `json:"requested"`
+	// Fallbacks are blocks downloaded in full after rebuilding failed.
+	Fallbacks      int `json:"fallbacks"`
+	Pending        int `json:"pending"`
+	TxsPrefilled   int `json:"txs_prefilled"`
+	TxsFromMempool int `json:"txs_from_mempool"`
+	TxsRequested   int `json:"txs_requested"`
+	// SuccessRate is the share of finished compact blocks that did without
+	// the full block.
+	SuccessRate float64 `json:"success_rate"`
+}
+
+// partialBlock is a compact block waiting for the transactions asked of
+// its sender.
+type partialBlock struct {
+	header  *blockchain.BlockHeader
+	txs     []*blockchain.Transaction
+	missing []int
+	from    *Peer
+	sentAt  time.Time
+}
+
+// compactRelay rebuilds the blocks announced as compact blocks.
+type compactRelay struct {
+	node *Node
+
+	mu      sync.Mutex
+	pending map[string]*partialBlock
+	stats   CompactStats
+}
+
+func newCompactRelay(node *Node) *compactRelay {
+	return &compactRelay{
+		node:    node,
+		pending: make(map[string]*partialBlock),
+	}
+}
+
+// shortID names txID within the block hash, salted by nonce.
+func shortID(blockHash []byte, nonce uint64, txID []byte) uint64 {
+	h := sha256.New()
+	h.Write(blockHash)
+	binary.Write(h, binary.BigEndian, nonce)
+	h.Write(txID)
+	sum := h.Sum(nil)
+
+	return binary.BigEndian.Uint64(sum[:8]) >> (64 - shortIDBits)
+}
+
+// newCompactBlock announces block, prefilling its coinbase.
+func newCompactBlock(block *blockchain.Block, nonce uint64) *CmpctBlockMsg {
+	msg := &CmpctBlockMsg{Header: block.Header(), Nonce: nonce}
+	for i, tx := range block.Transactions {
+		if i == 0 {
+			msg.Prefilled = append(msg.Prefilled, PrefilledTx{Index: 0, Tx: tx})
+			continue
+		}
+		msg.ShortIDs = append(msg.ShortIDs, shortID(block.Hash, nonce, tx.ID))
+	}
+
+	return msg
+}
+
+// Stats returns the counts so far.
+func (cr *compactRelay) Stats() *CompactStats {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	stats := cr.stats
+	stats.Pending = len(cr.pending)
+	if done := stats.Reconstructed + stats.Requested + stats.Fallbacks; done > 0 {
+		stats.SuccessRate = float64(stats.Reconstructed+stats.Requested) / float64(done)
+	}
+
+	return &stats
+}
+
+// handleCompactBlock fills in a compact block from the mempool and asks p
+// for the transactions that are not there.
+func (cr *compactRelay) handleCompactBlock(p *Peer, msg *CmpctBlockMsg) error {
+	n := cr.node
+	header := msg.Header
+	total := len(msg.ShortIDs) + len(msg.Prefilled)
+	if total > maxCompactTxs {
+		n.misbehaving(p, penaltyOversized, fmt.Sprintf("compact block of %d transactions", total))
+		return nil
+	}
+	if n.hasBlock(header.Hash) || cr.isPending(header.Hash) {
+		return nil
+	}
+	if err := blockchain.CheckHeader(header); err != nil {
+		n.misbehaving(p, rejectPenalty(err), err.Error())
+		return nil
+	}
+	if !n.hasBlock(header.PrevHash) {
+		// too far ahead to rebuild, the announcement starts a header sync
+		n.sync.handleHeaders(p, []*blockchain.BlockHeader{header})
+		return nil
+	}
+
+	txs := make([]*blockchain.Transaction, total)
+	for _, pre := range msg.Prefilled {
+		if pre.Index < 0 || pre.Index >= total || txs[pre.Index] != nil || pre.Tx == nil {
+			return fmt.Errorf("%w: bad prefilled transaction at %d", errMalformed, pre.Index)
+		}
+		txs[pre.Index] = pre.Tx
+	}
+
+	// short IDs that two mempool transactions share match neither
+	n.chainMu.Lock()
+	entries := n.mempool.Entries()
+	n.chainMu.Unlock()
+	byShortID := make(map[uint64]*blockchain.Transaction, len(entries))
+	for _, entry := range entries {
+		id := shortID(header.Hash, msg.Nonce, entry.Tx.ID)
+		if _, ok := byShortID[id]; ok {
+			byShortID[id] = nil
+			continue
+		}
+		byShortID[id] = entry.Tx
+	}
+
+	cr.mu.Lock()
+	cr.stats.Received++
+	cr.stats.TxsPrefilled += len(msg.Prefilled)
+	cr.mu.Unlock()
+
+	seen := make(map[uint64]bool, len(msg.ShortIDs))
+	var missing []int
+	next := 0
+	for i := range txs {
+		if txs[i] != nil {
+			continue
+		}
+		id := msg.ShortIDs[next]
+		next++
+		if seen[id] {
+			cr.fallback(p, header.Hash, "short IDs collide within the block")
+			return nil
+		}
+		seen[id] = true
+
+		if tx := byShortID[id]; tx != nil {
+			txs[i] = tx
+		} else {
+			missing = append(missing, i)
+		}
+	}
+
+	cr.mu.Lock()
+	cr.stats.TxsFromMempool += len(msg.ShortIDs) - len(missing)
+	if len(missing) > 0 {
+		cr.pending[hex.EncodeToString(header.Hash)] = &partialBlock{
+			header:  header,
+			txs:     txs,
+			missing: missing,
+			from:    p,
+			sentAt:  time.Now(),
+		}
+	}
+	cr.mu.Unlock()
+
+	if len(missing) > 0 {
+		p.logger.Debug("Requesting compact block transactions",
+			slog.String("hash", fmt.Sprintf("%x", header.Hash)),
+			slog.Int("missing", len(missing)))
+		p.Send(cmdGetBlockTxn, &GetBlockTxnMsg{BlockHash: header.Hash, Indexes: missing})
+		return nil
+	}
+	cr.finish(p, header, txs, false)
+
+	return nil
+}
+
+// handleBlockTxn completes the compact block the transactions p sent were
+// asked for.
+func (cr *compactRelay) handleBlockTxn(p *Peer, msg *BlockTxnMsg) {
+	key := hex.EncodeToString(msg.BlockHash)
+
+	cr.mu.Lock()
+	partial, ok := cr.pending[key]
+	if !ok || partial.from != p {
+		cr.mu.Unlock()
+		p.logger.Debug("Ignoring unrequested block transactions", slog.String("hash", key))
+		return
+	}
+	delete(cr.pending, key)
+	cr.mu.Unlock()
+
+	if len(msg.Txs) != len(partial.missing) {
+		cr.fallback(p, msg.BlockHash, fmt.Sprintf("asked for %d transactions, got %d", len(partial.missing), len(msg.Txs)))
+		return
+	}
+	for i, index := range partial.missing {
+		if msg.Txs[i] == nil {
+			cr.fallback(p, msg.BlockHash, "empty transaction")
+			return
+		}
+		partial.txs[index] = msg.Txs[i]
+	}
+
+	cr.mu.Lock()
+	cr.stats.TxsRequested += len(msg.Txs)
+	cr.mu.Unlock()
+
+	cr.finish(p, partial.header, partial.txs, true)
+}
+
+// finish hands the rebuilt block to the chain, unless its transactions are
+// not those the header commits to: a short ID matched the wrong mempool
+// transaction, and the full block is fetched instead.
+func (cr *compactRelay) finish(p *Peer, header *blockchain.BlockHeader, txs []*blockchain.Transaction, requested bool) {
+	block := &blockchain.Block{
+		Hash:         header.Hash,
+		Transactions: txs,
+		PrevHash:     header.PrevHash,
+		Nonce:        header.Nonce,
+		Version:      header.Version,
+	}
+	if !bytes.Equal(block.HashTransactions(), header.TxHash) {
+		cr.fallback(p, header.Hash, "transactions do not match the header")
+		return
+	}
+
+	cr.mu.Lock()
+	if requested {
+		cr.stats.Requested++
+	} else {
+		cr.stats.Reconstructed++
+	}
+	cr.mu.Unlock()
+
+	cr.node.processBlock(p, block)
+}
+
+// fallback gives up on rebuilding the block hash and asks p for all of it.
+func (cr *compactRelay) fallback(p *Peer, hash []byte, reason string) {
+	cr.mu.Lock()
+	delete(cr.pending, hex.EncodeToString(hash))
+	cr.stats.Fallbacks++
+	cr.mu.Unlock()
+
+	p.logger.Info("Fetching full block",
+		slog.String("hash", fmt.Sprintf("%x", hash)),
+		slog.String("reason", reason))
+	p.Send(cmdGetData, &GetDataMsg{Hashes: [][]byte{hash}})
+}
+
+// expire falls back to the full block for compact blocks whose missing
+// transactions did not come in time.
+func (cr *compactRelay) expire() {
+	cr.mu.Lock()
+	var late []*partialBlock
+	for key, partial := range cr.pending {
+		if time.Since(partial.sentAt) > compactTimeout {
+			late = append(late, partial)
+			delete(cr.pending, key)
+		}
+	}
+	cr.mu.Unlock()
+
+	for _, partial := range late {
+		if !cr.node.hasBlock(partial.header.Hash) {
+			cr.fallback(partial.from, partial.header.Hash, "missing transactions timed out")
+		}
+	}
+}
+
+func (cr *compactRelay) isPending(hash []byte) bool {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	_, ok := cr.pending[hex.EncodeToString(hash)]
+
+	return ok
+}
@@ -0,0 +1,156 @@
+package network
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/numbermax/blockchain/internal/services/blockchain"
+)
+
+const testCompactNonce = 7
+
+// sent takes what was queued for p with command, nil if nothing was.
+func sent(p *Peer, command string) any {
+	var payload any
+	for {
+		select {
+		case msg := <-p.send:
+			if msg.command == command {
+				payload = msg.payload
+			}
+		default:
+			return payload
+		}
+	}
+}
+
+// compactBlock returns a block on the tip of n spending a new coin, whose
+// spending transaction n does not know yet.
+func compactBlock(t *testing.T, n *Node) (*blockchain.Block, *blockchain.Transaction) {
+	t.Helper()
+
+	tx := spendable(t, n)
+	block := blockchain.CreateBlock([]*blockchain.Transaction{blockchain.CoinbaseTx(testAddr, "compact"), tx}, n.chain.LastHash)
+
+	return block, tx
+}
+
+func acceptToMempool(t *testing.T, n *Node, tx *blockchain.Transaction) {
+	t.Helper()
+
+	if _, err := n.mempool.Accept(tx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func assertConnected(t *testing.T, n *Node, block *blockchain.Block, connected bool) {
+	t.Helper()
+
+	if got := bytes.Equal(n.chain.LastHash, block.Hash); got != connected {
+		t.Errorf("block %x connected: %v, want %v", block.Hash, got, connected)
+	}
+}
+
+// assertFallback checks that p was asked for the full block.
+func assertFallback(t *testing.T, n *Node, p *Peer, block *blockchain.Block) {
+	t.Helper()
+
+	msg, ok := sent(p, cmdGetData).(*GetDataMsg)
+	if !ok || len(msg.Hashes) != 1 || !bytes.Equal(msg.Hashes[0], block.Hash) {
+		t.Errorf("asked for %+v, want the full block %x", msg, block.Hash)
+	}
+	if stats := n.CompactStats(); stats.Fallbacks != 1 {
+		t.Errorf("%d fallbacks, want 1", stats.Fallbacks)
+	}
+}
+
+func TestCompactBlockFromMempool(t *testing.T) {
+	n := newTestNode(t, t.TempDir(), freeAddr(t))
+	p := tcpPeer(t, n)
+	block, tx := compactBlock(t, n)
+	acceptToMempool(t, n, tx)
+
+	sendMessage(t, n, p, cmdCmpctBlock, newCompactBlock(block, testCompactNonce))
+	assertConnected(t, n, block, true)
+	if sent(p, cmdGetBlockTxn) != nil {
+		t.Error("transactions asked for with all of them in the mempool")
+	}
+	if stats := n.CompactStats(); stats.Reconstructed != 1 || stats.TxsFromMempool != 1 || stats.TxsPrefilled != 1 {
+		t.Errorf("stats = %+v, want one block rebuilt from the mempool", stats)
+	}
+}
+
+func TestCompactBlockRequestsMissing(t *testing.T) {
+	src := newTestNode(t, t.TempDir(), freeAddr(t))
+	n := newTestNode(t, t.TempDir(), freeAddr(t))
+	block, _ := compactBlock(t, src)
+	parent, err := src.chain.GetBlock(src.chain.LastHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := src.chain.ProcessBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.chain.ProcessBlock(parent); err != nil {
+		t.Fatal(err)
+	}
+	toSrc, toN := tcpPeer(t, src), tcpPeer(t, n)
+
+	sendMessage(t, n, toN, cmdCmpctBlock, newCompactBlock(block, testCompactNonce))
+	assertConnected(t, n, block, false)
+	request, ok := sent(toN, cmdGetBlockTxn).(*GetBlockTxnMsg)
+	if !ok || len(request.Indexes) != 1 || request.Indexes[0] != 1 {
+		t.Fatalf("asked for %+v, want transaction 1", request)
+	}
+
+	sendMessage(t, src, toSrc, cmdGetBlockTxn, request)
+	answer, ok := sent(toSrc, cmdBlockTxn).(*BlockTxnMsg)
+	if !ok {
+		t.Fatal("getblocktxn not answered")
+	}
+	sendMessage(t, n, toN, cmdBlockTxn, answer)
+	assertConnected(t, n, block, true)
+	if stats := n.CompactStats(); stats.Requested != 1 || stats.TxsRequested != 1 || stats.Pending != 0 {
+		t.Errorf("stats = %+v, want one block rebuilt with a transaction asked for", stats)
+	}
+
+	// transactions nobody asked for are ignored
+	sendMessage(t, n, toN, cmdBlockTxn, answer)
+	if stats := n.CompactStats(); stats.Requested != 1 {
+		t.Errorf("%d blocks rebuilt, want 1", stats.Requested)
+	}
+}
+
+func TestCompactBlockShortIDCollision(t *testing.T) {
+	n := newTestNode(t, t.TempDir(), freeAddr(t))
+	p := tcpPeer(t, n)
+	tx := spendable(t, n)
+	other := spendable(t, n)
+	acceptToMempool(t, n, tx)
+	acceptToMempool(t, n, other)
+	block := blockchain.CreateBlock([]*blockchain.Transaction{blockchain.CoinbaseTx(testAddr, "compact"), tx, other}, n.chain.LastHash)
+
+	msg := newCompactBlock(block, testCompactNonce)
+	msg.ShortIDs[1] = msg.ShortIDs[0]
+	sendMessage(t, n, p, cmdCmpctBlock, msg)
+	assertConnected(t, n, block, false)
+	assertFallback(t, n, p, block)
+}
+
+// A short ID matching the wrong mempool transaction rebuilds a block the
+// header does not commit to.
+func TestCompactBlockTxHashMismatch(t *testing.T) {
+	n := newTestNode(t, t.TempDir(), freeAddr(t))
+	p := tcpPeer(t, n)
+	tx := spendable(t, n)
+	other := spendable(t, n)
+	block := blockchain.CreateBlock([]*blockchain.Transaction{blockchain.CoinbaseTx(testAddr, "compact"), tx}, n.chain.LastHash)
+	acceptToMempool(t, n, tx)
+	acceptToMempool(t, n, other)
+
+	msg := newCompactBlock(block, testCompactNonce)
+	msg.ShortIDs[0] = shortID(block.Hash, testCompactNonce, other.ID)
+	sendMessage(t, n, p, cmdCmpctBlock, msg)
+	assertConnected(t, n, block, false)
+	assertFallback(t, n, p, block)
+}
@@ -0,0 +1,223 @@
+package network
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/numbermax/blockchain/internal/services/blockchain"
+)
+
+const (
+	// ProtocolVersion is sent in the version message.
+	ProtocolVersion = 1
+
+	commandSize = 12
+	// maxMessageSize bounds a payload so a bad length does not allocate
+	// without limit.
+	maxMessageSize = 32 << 20
+	// maxAddrPerMessage bounds the addresses of one addr message.
+	maxAddrPerMessage = 1000
+	// maxGetData bounds the blocks asked for in one getdata message, which
+	// are all queued for sending at once.
+	maxGetData = 2 * maxBlocksInFlight
+	// maxLocator bounds the hashes of a locator, which grows with the log
+	// of the chain height.
+	maxLocator = 100
+	// maxCompactTxs bounds the transactions of a compact block and of the
+	// requests to fill it in.
+	maxCompactTxs = 1 << 16
+)
+
+const (
+	cmdVersion     = "version"
+	cmdVerack      = "verack"
+	cmdPing        = "ping"
+	cmdPong        = "pong"
+	cmdGetAddr     = "getaddr"
+	cmdAddr        = "addr"
+	cmdGetFilter   = "getcfilter"
+	cmdFilter      = "cfilter"
+	cmdBlock       = "block"
+	cmdGetHeaders  = "getheaders"
+	cmdHeaders     = "headers"
+	cmdGetData     = "getdata"
+	cmdNotFound    = "notfound"
+	cmdTx          = "tx"
+	cmdSendCmpct   = "sendcmpct"
+	cmdCmpctBlock  = "cmpctblock"
+	cmdGetBlockTxn = "getblocktxn"
+	cmdBlockTxn    = "blocktxn"
+)
+
+// messageHeader starts every message on the wire, big-endian, followed by
+// the gob encoded payload.
+type messageHeader struct {
+	Magic    uint32
+	Command  [commandSize]byte
+	Length   uint32
+	Checksum [4]byte
+}
+
+// VersionMsg opens a connection in both directions.
+type VersionMsg struct {
+	Version int
+	Genesis []byte
+	Height  int
+	// ListenAddr is where the sender accepts connections, empty if it
+	// does not.
+	ListenAddr string
+	// Nonce tells a node it connected to itself.
+	Nonce uint64
+}
+
+type PingMsg struct {
+	Nonce uint64
+}
+
+// NetAddr is a peer address as gossiped between nodes.
+type NetAddr struct {
+	Addr     string
+	LastSeen time.Time
+}
+
+type AddrMsg struct {
+	Addrs []NetAddr
+}
+
+type GetFilterMsg struct {
+	BlockHash []byte
+}
+
+// FilterMsg answers getcfilter; Filter is nil when the block or its filter
+// is unknown.
+type FilterMsg struct {
+	BlockHash []byte
+	Filter    *blockchain.BlockFilter
+}
+
+// BlockMsg carries a block.
+type BlockMsg struct {
+	Block *blockchain.Block
+}
+
+// GetHeadersMsg asks for the main chain headers following the first
+// locator hash the peer knows.
+type GetHeadersMsg struct {
+	Locator [][]byte
+}
+
+// HeadersMsg answers getheaders; it also announces new blocks.
+type HeadersMsg struct {
+	Headers []*blockchain.BlockHeader
+}
+
+// GetDataMsg asks for blocks, answered with a block message each and a
+// notfound message for those the peer does not have.
+type GetDataMsg struct {
+	Hashes [][]byte
+}
+
+type NotFoundMsg struct {
+	Hashes [][]byte
+}
+
+// TxMsg relays a transaction the sender accepted to its mempool.
+type TxMsg struct {
+	Tx *blockchain.Transaction
+}
+
+// CmpctBlockMsg announces a block by its header and a short ID for each
+// transaction, which the receiver looks up in its mempool. The transactions
+// it cannot have, the coinbase at least, come along in Prefilled.
+type CmpctBlockMsg struct {
+	Header *blockchain.BlockHeader
+	// Nonce salts the short IDs, so they collide differently per block.
+	Nonce uint64
+	// ShortIDs are in block order, skipping the prefilled positions.
+	ShortIDs  []uint64
+	Prefilled []PrefilledTx
+}
+
+// PrefilledTx is a transaction of a compact block sent in full, Index being
+// its position in the block.
+type PrefilledTx struct {
+	Index int
+	Tx    *blockchain.Transaction
+}
+
+// GetBlockTxnMsg asks for the transactions of a compact block the receiver
+// could not find, by their position in the block.
+type GetBlockTxnMsg struct {
+	BlockHash []byte
+	Indexes   []int
+}
+
+// BlockTxnMsg answers getblocktxn with the transactions in the order asked.
+type BlockTxnMsg struct {
+	BlockHash []byte
+	Txs       []*blockchain.Transaction
+}
+
+// writeMessage frames payload, which may be nil, under command.
+func writeMessage(w io.Writer, command string, payload any) (int, error) {
+	var body bytes.Buffer
+	if payload != nil {
+		if err := gob.NewEncoder(&body).Encode(payload); err != nil {
+			return 0, err
+		}
+	}
+
+	header := messageHeader{
+		Magic:  blockchain.ActiveNetwork().Magic,
+		Length: uint32(body.Len()),
+	}
+	copy(header.Command[:], command)
+	sum := sha256.Sum256(body.Bytes())
+	copy(header.Checksum[:], sum[:4])
+
+	var frame bytes.Buffer
+	if err := binary.Write(&frame, binary.BigEndian, &header); err != nil {
+		return 0, err
+	}
+	frame.Write(body.Bytes())
+
+	return w.Write(frame.Bytes())
+}
+
+// readMessage reads the next message and returns its command and payload.
+func readMessage(r io.Reader) (string, []byte, error) {
+	var header messageHeader
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return "", nil, err
+	}
+	if header.Magic != blockchain.ActiveNetwork().Magic {
+		return "", nil, fmt.Errorf("message for network %08x", header.Magic)
+	}
+	if header.Length > maxMessageSize {
+		return "", nil, fmt.Errorf("%w: %d bytes is too large", errMalformed, header.Length)
+	}
+
+	payload := make([]byte, header.Length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return "", nil, err
+	}
+	sum := sha256.Sum256(payload)
+	if !bytes.Equal(sum[:4], header.Checksum[:]) {
+		return "", nil, fmt.Errorf("%w: checksum mismatch", errMalformed)
+	}
+
+	return string(bytes.TrimRight(header.Command[:], "\x00")), payload, nil
+}
+
+func decodePayload(payload []byte, v any) error {
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(v); err != nil {
+		return fmt.Errorf("%w: %w", errMalformed, err)
+	}
+
+	return nil
+}
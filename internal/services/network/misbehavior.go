@@ -0,0 +1,191 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/numbermax/blockchain/internal/services/blockchain"
+	"github.com/numbermax/blockchain/internal/services/mempool"
+)
+
+const (
+	// banThreshold is the misbehavior score that gets a peer banned.
+	banThreshold = 100
+	// DefaultBanTime is how long a misbehaving peer stays banned.
+	DefaultBanTime = 24 * time.Hour
+
+	// penaltyMalformed is for data that does not decode, which no node
+	// running our code sends.
+	penaltyMalformed = 100
+	// penaltyOversized is for messages over a protocol limit.
+	penaltyOversized = 20
+	// penaltyDuplicateHandshake is for a version or verack after the
+	// handshake.
+	penaltyDuplicateHandshake = 1
+
+	// txRejectAllowance is how many relayed transactions a peer may have
+	// refused in txRejectWindow for reasons that cost no score; every
+	// further one costs penaltyTxRejects.
+	txRejectAllowance = 100
+	txRejectWindow    = time.Minute
+	penaltyTxRejects  = 10
+)
+
+// rejectPenalties is the misbehavior score of sending a block that broke a
+// rule. Every rule has an entry, so a new rule has to name its penalty.
+var rejectPenalties = map[blockchain.RejectCode]int{
+	blockchain.RejectBadHash:         100,
+	blockchain.RejectHighHash:        100,
+	blockchain.RejectNoTransactions:  100,
+	blockchain.RejectBadTxID:         100,
+	blockchain.RejectDuplicateTx:     100,
+	blockchain.RejectCoinbasePos:     100,
+	blockchain.RejectCoinbaseAmount:  100,
+	blockchain.RejectNoInputs:        100,
+	blockchain.RejectNegativeOutput:  100,
+	blockchain.RejectMissingInputs:   100,
+	blockchain.RejectDoubleSpend:     100,
+	blockchain.RejectWrongKey:        100,
+	blockchain.RejectBadSignature:    100,
+	blockchain.RejectValueCreated:    100,
+	blockchain.RejectInvalidPrevious: 100,
+	blockchain.RejectOtherGenesis:    100,
+	blockchain.RejectLooseCoinbase:   100,
+}
+
+// txRejectPenalties override rejectPenalties for relayed transactions. A
+// node running our code can relay a transaction that lost a race: it may be
+// known already, conflict with one we got first, or spend an output a block
+// just confirmed the spending of. Refusals past txRejectAllowance cost a
+// score all the same.
+var txRejectPenalties = map[blockchain.RejectCode]int{
+	blockchain.RejectMissingInputs: 0,
+	mempool.RejectAlreadyKnown:     0,
+	mempool.RejectConflict:         0,
+	mempool.RejectFull:             0,
+	// a replacement that lost to another one pays too little for the pool
+	// it arrives at
+	mempool.RejectReplaceFee:          0,
+	mempool.RejectReplaceFeeRate:      0,
+	mempool.RejectTooManyReplacements: 0,
+	mempool.RejectSpendsConflicting:   0,
+	// peers may run another policy
+	mempool.RejectMinRelayFee:      0,
+	mempool.RejectDust:             0,
+	mempool.RejectTxSize:           0,
+	mempool.RejectTooManyInputs:    0,
+	mempool.RejectTooManyOutputs:   0,
+	mempool.RejectNonstandardIn:    0,
+	mempool.RejectNonstandardOut:   0,
+	mempool.RejectTooManyAncestors: 0,
+	mempool.RejectTooManyDescends:  0,
+}
+
+// errMalformed marks messages that do not decode.
+var errMalformed = errors.New("malformed message")
+
+// rejectPenalty returns the score of a block rejected with err, 0 when err
+// is not a rule failure of the sender.
+func rejectPenalty(err error) int {
+	code := blockchain.RejectCodeOf(err)
+	if code == "" {
+		return 0
+	}
+	if penalty, ok := rejectPenalties[code]; ok {
+		return penalty
+	}
+
+	return banThreshold
+}
+
+// txRejectPenalty returns the score of a relayed transaction the mempool
+// refused with err.
+func txRejectPenalty(err error) int {
+	if penalty, ok := txRejectPenalties[blockchain.RejectCodeOf(err)]; ok {
+		return penalty
+	}
+
+	return rejectPenalty(err)
+}
+
+// overTxRejectAllowance counts a relayed transaction of p that was refused
+// for free and reports whether p has used up its allowance of those.
+func (p *Peer) overTxRejectAllowance(now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if now.Sub(p.txRejectsSince) >= txRejectWindow {
+		p.txRejectsSince = now
+		p.txRejects = 0
+	}
+	p.txRejects++
+
+	return p.txRejects > txRejectAllowance
+}
+
+// misbehaving adds penalty to the score of p and bans its address once the
+// score reaches banThreshold.
+func (n *Node) misbehaving(p *Peer, penalty int, reason string) {
+	if penalty <= 0 {
+		return
+	}
+
+	p.mu.Lock()
+	p.banScore += penalty
+	score := p.banScore
+	p.mu.Unlock()
+
+	p.logger.Warn("Peer misbehaving",
+		slog.Int("penalty", penalty),
+		slog.Int("score", score),
+		slog.String("reason", reason))
+	if score < banThreshold {
+		return
+	}
+
+	subnet, err := ParseSubnet(p.remoteIP())
+	if err != nil {
+		p.Disconnect()
+		return
+	}
+	if err := n.Ban(subnet, DefaultBanTime, reason); err != nil {
+		p.logger.Error("Saving the ban failed", slog.String("error", err.Error()))
+	}
+	p.logger.Warn("Peer banned", slog.String("subnet", subnet.String()))
+}
+
+// Ban bans subnet for duration and drops the peers in it.
+func (n *Node) Ban(subnet *net.IPNet, duration time.Duration, reason string) error {
+	if duration <= 0 {
+		return fmt.Errorf("invalid ban time %s", duration)
+	}
+	err := n.banMan.Ban(subnet, time.Now().Add(duration), reason)
+
+	n.mu.Lock()
+	for _, p := range n.peers {
+		if ip := net.ParseIP(p.remoteIP()); ip != nil && subnet.Contains(ip) {
+			p.Disconnect()
+		}
+	}
+	n.mu.Unlock()
+
+	return err
+}
+
+// Unban lifts the ban of subnet.
+func (n *Node) Unban(subnet *net.IPNet) error {
+	return n.banMan.Unban(subnet)
+}
+
+// ListBanned returns the bans in force.
+func (n *Node) ListBanned() []BanEntry {
+	return n.banMan.List()
+}
+
+// ClearBanned lifts every ban.
+func (n *Node) ClearBanned() error {
+	return n.banMan.Clear()
+}
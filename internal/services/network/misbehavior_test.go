@@ -0,0 +1,184 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/numbermax/blockchain/internal/services/blockchain"
+	"github.com/numbermax/blockchain/internal/services/wallet"
+)
+
+// tcpPeer is a peer past the handshake on a localhost connection, so that
+// it has an address to ban.
+func tcpPeer(t *testing.T, n *Node) *Peer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	remote, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+
+	p := newPeer(n, local, remote.LocalAddr().String(), true, false)
+	p.version = &VersionMsg{}
+	n.mu.Lock()
+	n.nextID++
+	p.id = n.nextID
+	n.peers[p.id] = p
+	n.mu.Unlock()
+
+	return p
+}
+
+func sendMessage(t *testing.T, n *Node, from *Peer, command string, msg any) {
+	t.Helper()
+
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.handleMessage(from, command, payload.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// spendable mines a block on the chain of n paying a new wallet and
+// returns a transaction of that wallet spending it.
+func spendable(t *testing.T, n *Node) *blockchain.Transaction {
+	t.Helper()
+
+	w := wallet.MakeWallet()
+	pkh := wallet.PublicKeyHash(w.PublicKey)
+	coinbase := blockchain.CoinbaseTx(string(wallet.PublicKeyHashToAddress(pkh)), "spendable")
+	n.chain.AddBlock([]*blockchain.Transaction{coinbase})
+
+	tx := &blockchain.Transaction{
+		Inputs:  []blockchain.TxInput{{ID: coinbase.ID, Out: 0, PublicKey: w.PublicKey}},
+		Outputs: []blockchain.TxOutput{{Value: coinbase.Outputs[0].Value, PublicKeyHash: pkh}},
+	}
+	tx.ID = tx.Hash()
+	if err := blockchain.SignTransaction(tx, w.PrivateKey, coinbase.Outputs); err != nil {
+		t.Fatal(err)
+	}
+
+	return tx
+}
+
+// badSignature returns tx with its signature broken.
+func badSignature(tx *blockchain.Transaction) *blockchain.Transaction {
+	bad := *tx
+	bad.Inputs = append([]blockchain.TxInput{}, tx.Inputs...)
+	bad.Inputs[0].Signature = bytes.Clone(tx.Inputs[0].Signature)
+	bad.Inputs[0].Signature[0] ^= 1
+
+	return &bad
+}
+
+func assertBanned(t *testing.T, n *Node, p *Peer, banned bool) {
+	t.Helper()
+
+	if got := n.banMan.IsBanned(p.remoteIP()); got != banned {
+		t.Errorf("peer %s banned: %v, want %v", p.remoteIP(), got, banned)
+	}
+}
+
+func TestBadSignatureTxBansPeer(t *testing.T) {
+	n := newTestNode(t, t.TempDir(), freeAddr(t))
+	p := tcpPeer(t, n)
+
+	sendMessage(t, n, p, cmdTx, &TxMsg{Tx: badSignature(spendable(t, n))})
+	assertBanned(t, n, p, true)
+}
+
+func TestBadSignatureBlockBansPeer(t *testing.T) {
+	n := newTestNode(t, t.TempDir(), freeAddr(t))
+	p := tcpPeer(t, n)
+
+	tx := badSignature(spendable(t, n))
+	block := blockchain.CreateBlock([]*blockchain.Transaction{blockchain.CoinbaseTx(testAddr, "bad"), tx}, n.chain.LastHash)
+	sendMessage(t, n, p, cmdBlock, &BlockMsg{Block: block})
+	assertBanned(t, n, p, true)
+	if bytes.Equal(n.chain.LastHash, block.Hash) {
+		t.Error("block with a bad signature connected")
+	}
+}
+
+func TestRefusedTxAllowance(t *testing.T) {
+	n := newTestNode(t, t.TempDir(), freeAddr(t))
+	p := tcpPeer(t, n)
+	tx := spendable(t, n)
+
+	// the first gets in, the others are known already and free until
+	// the allowance runs out
+	for i := 0; i <= txRejectAllowance; i++ {
+		sendMessage(t, n, p, cmdTx, &TxMsg{Tx: tx})
+	}
+	assertBanned(t, n, p, false)
+	for i := 0; i < banThreshold/penaltyTxRejects; i++ {
+		sendMessage(t, n, p, cmdTx, &TxMsg{Tx: tx})
+	}
+	assertBanned(t, n, p, true)
+
+	// the allowance starts again with every window
+	other := tcpPeer(t, n)
+	other.txRejects, other.txRejectsSince = txRejectAllowance, time.Now().Add(-txRejectWindow)
+	if other.overTxRejectAllowance(time.Now()) {
+		t.Error("allowance of a past window still used up")
+	}
+}
+
+func TestBansPersistAndExpire(t *testing.T) {
+	dir := t.TempDir()
+	bm, err := LoadBanManager(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	long, _ := ParseSubnet("192.0.2.0/24")
+	short, _ := ParseSubnet("198.51.100.7")
+	if err := bm.Ban(long, time.Now().Add(time.Hour), "long"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bm.Ban(short, time.Now().Add(200*time.Millisecond), "short"); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadBanManager(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []string{"192.0.2.9:8333", "198.51.100.7"} {
+		if !loaded.IsBanned(addr) {
+			t.Errorf("%s not banned after loading", addr)
+		}
+	}
+	if loaded.IsBanned("198.51.100.8") {
+		t.Error("address next to a banned one banned")
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if loaded.IsBanned("198.51.100.7") || !loaded.IsBanned("192.0.2.9") {
+		t.Error("bans did not expire in their time")
+	}
+	loaded, err = LoadBanManager(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := loaded.List(); len(list) != 1 || list[0].Subnet != long.String() {
+		t.Errorf("bans after expiry = %v, want only %s", list, long)
+	}
+}
@@ -0,0 +1,1058 @@
+// Package network connects nodes to each other: it finds and remembers
+// peers, keeps outbound connections open and exchanges messages with them.
+package network
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/numbermax/blockchain/internal/services/blockchain"
+	"github.com/numbermax/blockchain/internal/services/mempool"
+	"github.com/numbermax/blockchain/internal/services/mining"
+)
+
+const (
+	// DefaultListenAddr is where a node accepts peers unless told otherwise.
+	DefaultListenAddr = "127.0.0.1:9333"
+	// DefaultDataDir holds the peer addresses next to the chain.
+	DefaultDataDir = "./tmp"
+
+	defaultMaxOutbound = 8
+	defaultMaxInbound  = 117
+
+	dialTimeout      = 5 * time.Second
+	connectInterval  = 2 * time.Second
+	saveInterval     = time.Minute
+	advertiseEvery   = 10 * time.Minute
+	maxRelayAddrs    = 10
+	relayAddrPeers   = 2
+	getAddrResponses = maxAddrPerMessage
+)
+
+// Config sets up a Node.
+type Config struct {
+	// ListenAddr is where peers can connect; it is also advertised to them,
+	// so it should name a reachable host.
+	ListenAddr string
+	// Connect limits outbound connections to these addresses, the address
+	// manager is not used to find others.
+	Connect []string
+	// AddNodes are kept connected on top of the peers the address manager
+	// picks.
+	AddNodes    []string
+	MaxOutbound int
+	MaxInbound  int
+	DataDir     string
+	// Encryption says when connections are encrypted, EncryptionPrefer
+	// when empty.
+	Encryption EncryptionPolicy
+	// AllowedKeys, when set, are the only static keys peers may have;
+	// they need EncryptionRequire.
+	AllowedKeys [][]byte
+	// Policy is what the mempool takes and relays, mempool.DefaultPolicy
+	// when zero.
+	Policy mempool.Policy
+	// BlockLimits bound the block templates, mining.DefaultLimits when
+	// zero.
+	BlockLimits mining.Limits
+}
+
+// Node keeps the connections of this node to its peers.
+type Node struct {
+	logger  slog.Logger
+	cfg     Config
+	chain   *blockchain.BlockChain
+	chainMu sync.Mutex
+	addrMan *AddrManager
+	banMan  *BanManager
+	nodeKey *ecdh.PrivateKey
+	sync    *syncManager
+	orphans *orphanPool
+	mempool *mempool.Mempool
+	fees    *mempool.FeeEstimator
+	compact *compactRelay
+	nonce   uint64
+
+	listener net.Listener
+	quit     chan struct{}
+	wg       sync.WaitGroup
+
+	mu      sync.Mutex
+	peers   map[int]*Peer
+	nextID  int
+	manual  []string
+	dialing map[string]bool
+	// plaintextAddrs are the peers that turned out not to encrypt.
+	plaintextAddrs map[string]bool
+	stopped        bool
+	lastSave       time.Time
+	// newTemplate is closed when the tip or the mempool changes, then
+	// replaced.
+	newTemplate chan struct{}
+}
+
+func NewNode(logger slog.Logger, chain *blockchain.BlockChain, cfg Config) (*Node, error) {
+	if cfg.ListenAddr == "" {
+		cfg.ListenAddr = DefaultListenAddr
+	}
+	if cfg.DataDir == "" {
+		cfg.DataDir = DefaultDataDir
+	}
+	if cfg.MaxOutbound <= 0 {
+		cfg.MaxOutbound = defaultMaxOutbound
+	}
+	if cfg.MaxInbound <= 0 {
+		cfg.MaxInbound = defaultMaxInbound
+	}
+	if cfg.Encryption == "" {
+		cfg.Encryption = EncryptionPrefer
+	}
+	if cfg.Policy == (mempool.Policy{}) {
+		cfg.Policy = mempool.DefaultPolicy()
+	}
+	if cfg.BlockLimits == (mining.Limits{}) {
+		cfg.BlockLimits = mining.DefaultLimits()
+	}
+	if len(cfg.AllowedKeys) > 0 && cfg.Encryption != EncryptionRequire {
+		return nil, errors.New("an allowlist of peer keys needs the require encryption policy")
+	}
+
+	addrMan, err := LoadAddrManager(cfg.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	banMan, err := LoadBanManager(cfg.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	nodeKey, err := LoadNodeKey(cfg.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	fees, err := mempool.LoadFeeEstimator(cfg.DataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	manual := append(append([]string{}, cfg.Connect...), cfg.AddNodes...)
+	for _, addr := range manual {
+		if !validAddr(addr) {
+			return nil, fmt.Errorf("invalid peer address %q", addr)
+		}
+	}
+
+	n := &Node{
+		logger:         logger,
+		cfg:            cfg,
+		chain:          chain,
+		addrMan:        addrMan,
+		banMan:         banMan,
+		nodeKey:        nodeKey,
+		nonce:          rand.Uint64(),
+		quit:           make(chan struct{}),
+		peers:          make(map[int]*Peer),
+		manual:         manual,
+		dialing:        make(map[string]bool),
+		plaintextAddrs: make(map[string]bool),
+		newTemplate:    make(chan struct{}),
+		orphans:        newOrphanPool(),
+		mempool:        mempool.New(logger, chain, fees, cfg.Policy),
+		fees:           fees,
+	}
+	n.sync = newSyncManager(n)
+	n.compact = newCompactRelay(n)
+
+	return n, nil
+}
+
+// ChainLock guards the chain, which the node shares with whatever else
+// serves it, such as the RPC server.
+func (n *Node) ChainLock() sync.Locker {
+	return &n.chainMu
+}
+
+// Mempool returns the transactions the node accepted. It is guarded by the
+// chain lock.
+func (n *Node) Mempool() *mempool.Mempool {
+	return n.mempool
+}
+
+// BlockTemplate picks the mempool transactions for the next block. The
+// caller holds the chain lock.
+func (n *Node) BlockTemplate() *mining.BlockTemplate {
+	return mining.NewBlockTemplate(n.chain, n.mempool, n.cfg.BlockLimits)
+}
+
+// BlockLimits returns the limits block templates are assembled for.
+func (n *Node) BlockLimits() mining.Limits {
+	return n.cfg.BlockLimits
+}
+
+// TemplateID names the block template the chain tip and the mempool give:
+// it changes when either does. The caller holds the chain lock.
+func (n *Node) TemplateID() string {
+	return fmt.Sprintf("%x-%d", n.chain.LastHash, n.mempool.Changes())
+}
+
+// WaitTemplate waits until the block template named id is outdated, for at
+// most timeout. The caller does not hold the chain lock.
+func (n *Node) WaitTemplate(id string, timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		n.chainMu.Lock()
+		current := n.TemplateID()
+		n.mu.Lock()
+		changed := n.newTemplate
+		n.mu.Unlock()
+		n.chainMu.Unlock()
+		if current != id {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return
+		case <-n.quit:
+			return
+		}
+	}
+}
+
+// notifyTemplate wakes those waiting for the block template to change,
+// after the tip or the mempool did.
+func (n *Node) notifyTemplate() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	close(n.newTemplate)
+	n.newTemplate = make(chan struct{})
+}
+
+// Start listens for peers and starts connecting out.
+func (n *Node) Start() error {
+	listener, err := net.Listen("tcp", n.cfg.ListenAddr)
+	if err != nil {
+		return err
+	}
+	n.listener = listener
+	n.logger.Info("Listening for peers",
+		slog.String("addr", n.cfg.ListenAddr),
+		slog.String("encryption", string(n.cfg.Encryption)),
+		slog.String("node_key", hex.EncodeToString(n.NodeKey())))
+
+	n.wg.Add(3)
+	go n.acceptLoop()
+	go n.connectLoop()
+	go n.sync.run()
+
+	return nil
+}
+
+// Stop disconnects every peer and saves the known addresses and the fee
+// estimates.
+func (n *Node) Stop() {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return
+	}
+	n.stopped = true
+	for _, p := range n.peers {
+		p.Disconnect()
+	}
+	n.mu.Unlock()
+
+	close(n.quit)
+	if n.listener != nil {
+		n.listener.Close()
+	}
+	n.wg.Wait()
+
+	n.save()
+}
+
+// save writes what the node learnt to the data dir.
+func (n *Node) save() {
+	if err := n.addrMan.Save(); err != nil {
+		n.logger.Error("Saving peer addresses failed", slog.String("error", err.Error()))
+	}
+	if err := n.fees.Save(); err != nil {
+		n.logger.Error("Saving fee estimates failed", slog.String("error", err.Error()))
+	}
+}
+
+// AddNode keeps addr connected from now on.
+func (n *Node) AddNode(addr string) error {
+	if !validAddr(addr) {
+		return fmt.Errorf("invalid peer address %q", addr)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, known := range n.manual {
+		if known == addr {
+			return fmt.Errorf("%s was already added", addr)
+		}
+	}
+	n.manual = append(n.manual, addr)
+
+	return nil
+}
+
+// PeerInfo describes the connected peers.
+func (n *Node) PeerInfo() []PeerInfo {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	infos := make([]PeerInfo, 0, len(n.peers))
+	for _, p := range n.peers {
+		if p.established() {
+			infos = append(infos, p.Info())
+		}
+	}
+
+	return infos
+}
+
+func (n *Node) AddrManInfo() *AddrManInfo {
+	return n.addrMan.Info()
+}
+
+// SyncInfo reports the progress of the block download.
+func (n *Node) SyncInfo() *SyncInfo {
+	return n.sync.Info()
+}
+
+// CompactStats reports how well compact blocks from peers were rebuilt.
+func (n *Node) CompactStats() *CompactStats {
+	return n.compact.Stats()
+}
+
+// SubmitTransaction adds tx to the mempool and relays it to every peer. The
+// caller holds the chain lock.
+func (n *Node) SubmitTransaction(tx *blockchain.Transaction) (*mempool.Entry, error) {
+	entry, err := n.mempool.Accept(tx)
+	if err != nil {
+		return nil, err
+	}
+	n.relayTx(nil, tx)
+	n.notifyTemplate()
+
+	return entry, nil
+}
+
+// SubmitBlock hands a block mined outside the node to the chain and, once
+// connected, announces it to every peer. The caller does not hold the
+// chain lock.
+func (n *Node) SubmitBlock(block *blockchain.Block) error {
+	n.chainMu.Lock()
+	err := n.chain.ProcessBlock(block)
+	n.chainMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	n.logger.Info("Accepted submitted block", slog.String("hash", fmt.Sprintf("%x", block.Hash)))
+	n.sync.blockConnected(block)
+	n.connectOrphans(block.Hash)
+	n.notifyTemplate()
+	n.announceTip()
+
+	return nil
+}
+
+func (n *Node) acceptLoop() {
+	defer n.wg.Done()
+
+	for {
+		conn, err := n.listener.Accept()
+		if err != nil {
+			select {
+			case <-n.quit:
+				return
+			default:
+			}
+			n.logger.Warn("Accept failed", slog.String("error", err.Error()))
+			time.Sleep(time.Second)
+			continue
+		}
+
+		if n.countPeers(true) >= n.cfg.MaxInbound {
+			conn.Close()
+			continue
+		}
+		n.addPeer(newPeer(n, conn, conn.RemoteAddr().String(), true, false))
+	}
+}
+
+// connectLoop keeps manual peers connected and, unless -connect is used,
+// fills the outbound slots from the address manager.
+func (n *Node) connectLoop() {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(connectInterval)
+	defer ticker.Stop()
+	lastAdvertised := time.Now()
+
+	for {
+		n.connectPeers()
+
+		if self := n.selfAddr(); self != nil && time.Since(lastAdvertised) >= advertiseEvery {
+			n.broadcast(cmdAddr, &AddrMsg{Addrs: self})
+			lastAdvertised = time.Now()
+		}
+
+		n.orphans.expire()
+		n.compact.expire()
+
+		if time.Since(n.lastSave) >= saveInterval {
+			n.save()
+			n.lastSave = time.Now()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-n.quit:
+			return
+		}
+	}
+}
+
+func (n *Node) connectPeers() {
+	n.mu.Lock()
+	connected := n.connectedAddrs()
+	manual := append([]string{}, n.manual...)
+	n.mu.Unlock()
+
+	for _, addr := range manual {
+		if !connected[addr] && !n.banMan.IsBanned(addr) {
+			n.dial(addr, true)
+		}
+	}
+	if len(n.cfg.Connect) > 0 {
+		return
+	}
+
+	for outbound := n.countPeers(false); outbound < n.cfg.MaxOutbound; {
+		addr := n.addrMan.Select(connected)
+		if addr == "" {
+			return
+		}
+		connected[addr] = true
+		if addr == n.cfg.ListenAddr || n.banMan.IsBanned(addr) {
+			continue
+		}
+		n.dial(addr, false)
+		outbound++
+	}
+}
+
+// dial connects out to addr in the background.
+func (n *Node) dial(addr string, manual bool) {
+	n.mu.Lock()
+	if n.dialing[addr] || n.stopped {
+		n.mu.Unlock()
+		return
+	}
+	n.dialing[addr] = true
+	n.mu.Unlock()
+
+	n.addrMan.Attempt(addr)
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		defer func() {
+			n.mu.Lock()
+			delete(n.dialing, addr)
+			n.mu.Unlock()
+		}()
+
+		conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+		if err != nil {
+			n.logger.Debug("Connecting to peer failed",
+				slog.String("addr", addr),
+				slog.String("error", err.Error()))
+			n.addrMan.Failed(addr)
+			return
+		}
+		n.addPeer(newPeer(n, conn, addr, false, manual))
+	}()
+}
+
+func (n *Node) addPeer(p *Peer) {
+	n.mu.Lock()
+	if n.stopped || n.banMan.IsBanned(p.remoteIP()) {
+		n.mu.Unlock()
+		p.conn.Close()
+		return
+	}
+	n.nextID++
+	p.id = n.nextID
+	n.peers[p.id] = p
+	n.mu.Unlock()
+
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+
+		err := p.run()
+
+		n.mu.Lock()
+		delete(n.peers, p.id)
+		n.mu.Unlock()
+		n.sync.removePeer(p)
+
+		if !p.inbound && errors.Is(err, errNoEncryption) && n.cfg.Encryption == EncryptionPrefer {
+			n.noEncryption(p.addr)
+		} else if !p.inbound && !p.established() {
+			n.addrMan.Failed(p.addr)
+		}
+		if err != nil {
+			p.logger.Info("Peer disconnected", slog.String("reason", err.Error()))
+		}
+	}()
+}
+
+// peerReady is called once the handshake with p is done.
+func (n *Node) peerReady(p *Peer) {
+	info := p.Info()
+	p.logger.Info("Peer connected",
+		slog.Int("id", info.ID),
+		slog.Bool("inbound", info.Inbound),
+		slog.Int("height", info.StartHeight))
+
+	// only a connection we made proves the address works
+	if p.inbound {
+		if listen := p.listenAddress(); listen != "" {
+			n.addrMan.Add([]NetAddr{{Addr: listen, LastSeen: time.Now()}}, p.addr)
+		}
+	} else {
+		n.addrMan.Good(p.addr)
+	}
+	if !p.inbound {
+		p.askAddrs()
+	}
+	if self := n.selfAddr(); self != nil {
+		p.Send(cmdAddr, &AddrMsg{Addrs: self})
+	}
+	p.Send(cmdSendCmpct, nil)
+	n.sync.addPeer(p)
+}
+
+func (n *Node) handleMessage(p *Peer, command string, payload []byte) error {
+	switch command {
+	case cmdPing:
+		var msg PingMsg
+		if err := decodePayload(payload, &msg); err != nil {
+			return err
+		}
+		p.Send(cmdPong, &msg)
+
+	case cmdPong:
+		var msg PingMsg
+		if err := decodePayload(payload, &msg); err != nil {
+			return err
+		}
+		p.pong(msg.Nonce)
+
+	case cmdGetAddr:
+		addrs := n.addrMan.Sample(getAddrResponses)
+		if len(addrs) > 0 {
+			p.Send(cmdAddr, &AddrMsg{Addrs: addrs})
+		}
+
+	case cmdAddr:
+		var msg AddrMsg
+		if err := decodePayload(payload, &msg); err != nil {
+			return err
+		}
+		if len(msg.Addrs) > maxAddrPerMessage {
+			n.misbehaving(p, penaltyOversized, fmt.Sprintf("%d addresses in one message", len(msg.Addrs)))
+			return nil
+		}
+		answer := p.answersGetAddr(&msg)
+		added := n.addrMan.Add(n.othersAddrs(msg.Addrs), p.addr)
+		if added > 0 {
+			p.logger.Debug("Learned peer addresses", slog.Int("new", added))
+		}
+		// small messages are fresh announcements worth passing on; the
+		// answer to a getaddr is the peer's address list, however short,
+		// and passing it on would spread it across the network
+		if !answer && len(msg.Addrs) <= maxRelayAddrs && added > 0 {
+			n.relayAddrs(p, &msg)
+		}
+
+	case cmdGetFilter:
+		var msg GetFilterMsg
+		if err := decodePayload(payload, &msg); err != nil {
+			return err
+		}
+		n.chainMu.Lock()
+		filter, err := n.chain.GetBlockFilter(msg.BlockHash)
+		n.chainMu.Unlock()
+		if err != nil {
+			filter = nil
+		}
+		p.Send(cmdFilter, &FilterMsg{BlockHash: msg.BlockHash, Filter: filter})
+
+	case cmdBlock:
+		var msg BlockMsg
+		if err := decodePayload(payload, &msg); err != nil {
+			return err
+		}
+		if msg.Block == nil {
+			return fmt.Errorf("%w: empty block", errMalformed)
+		}
+		if !n.sync.handleBlock(p, msg.Block) {
+			n.processBlock(p, msg.Block)
+		}
+
+	case cmdGetHeaders:
+		var msg GetHeadersMsg
+		if err := decodePayload(payload, &msg); err != nil {
+			return err
+		}
+		if len(msg.Locator) > maxLocator {
+			n.misbehaving(p, penaltyOversized, fmt.Sprintf("locator of %d hashes", len(msg.Locator)))
+			return nil
+		}
+		n.chainMu.Lock()
+		headers, err := n.chain.HeadersAfter(msg.Locator, blockchain.MaxHeadersPerRequest)
+		n.chainMu.Unlock()
+		if err != nil {
+			p.logger.Debug("No headers to send", slog.String("error", err.Error()))
+		}
+		p.Send(cmdHeaders, &HeadersMsg{Headers: headers})
+
+	case cmdHeaders:
+		var msg HeadersMsg
+		if err := decodePayload(payload, &msg); err != nil {
+			return err
+		}
+		for _, header := range msg.Headers {
+			if header == nil {
+				return fmt.Errorf("%w: empty header", errMalformed)
+			}
+		}
+		n.sync.handleHeaders(p, msg.Headers)
+
+	case cmdGetData:
+		var msg GetDataMsg
+		if err := decodePayload(payload, &msg); err != nil {
+			return err
+		}
+		if len(msg.Hashes) > maxGetData {
+			n.misbehaving(p, penaltyOversized, fmt.Sprintf("%d blocks in one getdata", len(msg.Hashes)))
+			return nil
+		}
+		n.sendBlocks(p, msg.Hashes)
+
+	case cmdNotFound:
+		var msg NotFoundMsg
+		if err := decodePayload(payload, &msg); err != nil {
+			return err
+		}
+		n.sync.handleNotFound(p, msg.Hashes)
+
+	case cmdTx:
+		var msg TxMsg
+		if err := decodePayload(payload, &msg); err != nil {
+			return err
+		}
+		if msg.Tx == nil {
+			return fmt.Errorf("%w: empty transaction", errMalformed)
+		}
+		n.acceptTx(p, msg.Tx)
+
+	case cmdSendCmpct:
+		p.mu.Lock()
+		p.compact = true
+		p.mu.Unlock()
+
+	case cmdCmpctBlock:
+		var msg CmpctBlockMsg
+		if err := decodePayload(payload, &msg); err != nil {
+			return err
+		}
+		if msg.Header == nil {
+			return fmt.Errorf("%w: empty header", errMalformed)
+		}
+		return n.compact.handleCompactBlock(p, &msg)
+
+	case cmdGetBlockTxn:
+		var msg GetBlockTxnMsg
+		if err := decodePayload(payload, &msg); err != nil {
+			return err
+		}
+		if len(msg.Indexes) > maxCompactTxs {
+			n.misbehaving(p, penaltyOversized, fmt.Sprintf("%d transactions in one getblocktxn", len(msg.Indexes)))
+			return nil
+		}
+		return n.sendBlockTxn(p, &msg)
+
+	case cmdBlockTxn:
+		var msg BlockTxnMsg
+		if err := decodePayload(payload, &msg); err != nil {
+			return err
+		}
+		n.compact.handleBlockTxn(p, &msg)
+
+	case cmdVersion, cmdVerack:
+		n.misbehaving(p, penaltyDuplicateHandshake, "duplicate "+command)
+
+	default:
+		p.logger.Debug("Ignoring unknown message", slog.String("command", command))
+	}
+
+	return nil
+}
+
+// processBlock hands a block from p to the chain, scoring p for a block
+// that breaks a rule.
+func (n *Node) processBlock(p *Peer, block *blockchain.Block) {
+	n.chainMu.Lock()
+	err := n.chain.ProcessBlock(block)
+	n.chainMu.Unlock()
+
+	switch {
+	case err == nil:
+		p.logger.Info("Accepted block", slog.String("hash", fmt.Sprintf("%x", block.Hash)))
+		n.sync.blockConnected(block)
+		n.connectOrphans(block.Hash)
+		n.notifyTemplate()
+		if !n.sync.Info().Syncing {
+			n.announceTip()
+		}
+	case errors.Is(err, blockchain.ErrBlockKnown):
+		p.logger.Debug("Ignoring block", slog.String("reason", err.Error()))
+	case errors.Is(err, blockchain.ErrOrphanBlock):
+		n.addOrphan(p, block)
+	default:
+		if penalty := rejectPenalty(err); penalty > 0 {
+			n.misbehaving(p, penalty, err.Error())
+			return
+		}
+		p.logger.Error("Processing block failed", slog.String("error", err.Error()))
+	}
+}
+
+// addOrphan holds a block whose parent is unknown and asks p, which sent
+// it, for the block missing below it.
+func (n *Node) addOrphan(p *Peer, block *blockchain.Block) {
+	missing, added := n.orphans.add(block, p)
+	if !added {
+		return
+	}
+
+	p.logger.Info("Holding orphan block",
+		slog.String("hash", fmt.Sprintf("%x", block.Hash)),
+		slog.String("missing", fmt.Sprintf("%x", missing)))
+	p.Send(cmdGetData, &GetDataMsg{Hashes: [][]byte{missing}})
+}
+
+// connectOrphans connects the orphans waiting for the block hash, then
+// those waiting for them, and so on.
+func (n *Node) connectOrphans(hash []byte) {
+	queue := [][]byte{hash}
+	for len(queue) > 0 {
+		parent := queue[0]
+		queue = queue[1:]
+
+		for _, orphan := range n.orphans.takeChildren(parent) {
+			n.chainMu.Lock()
+			err := n.chain.ProcessBlock(orphan.block)
+			n.chainMu.Unlock()
+
+			switch {
+			case err == nil:
+				n.logger.Info("Connected orphan block", slog.String("hash", fmt.Sprintf("%x", orphan.block.Hash)))
+				n.sync.blockConnected(orphan.block)
+				queue = append(queue, orphan.block.Hash)
+			case errors.Is(err, blockchain.ErrBlockKnown):
+				queue = append(queue, orphan.block.Hash)
+			default:
+				if penalty := rejectPenalty(err); penalty > 0 {
+					n.misbehaving(orphan.from, penalty, err.Error())
+					continue
+				}
+				n.logger.Error("Connecting orphan block failed", slog.String("error", err.Error()))
+			}
+		}
+	}
+}
+
+// sendBlocks answers getdata with the blocks this node has and a notfound
+// for the others.
+func (n *Node) sendBlocks(p *Peer, hashes [][]byte) {
+	var missing [][]byte
+	for _, hash := range hashes {
+		n.chainMu.Lock()
+		block, err := n.chain.GetBlock(hash)
+		n.chainMu.Unlock()
+		if err != nil {
+			missing = append(missing, hash)
+			continue
+		}
+		p.Send(cmdBlock, &BlockMsg{Block: block})
+	}
+	if len(missing) > 0 {
+		p.Send(cmdNotFound, &NotFoundMsg{Hashes: missing})
+	}
+}
+
+// sendBlockTxn answers getblocktxn with the transactions of a block asked
+// for by position.
+func (n *Node) sendBlockTxn(p *Peer, msg *GetBlockTxnMsg) error {
+	n.chainMu.Lock()
+	block, err := n.chain.GetBlock(msg.BlockHash)
+	n.chainMu.Unlock()
+	if err != nil {
+		p.logger.Debug("No block transactions to send", slog.String("error", err.Error()))
+		return nil
+	}
+
+	txs := make([]*blockchain.Transaction, 0, len(msg.Indexes))
+	for _, index := range msg.Indexes {
+		if index < 0 || index >= len(block.Transactions) {
+			return fmt.Errorf("%w: block %x has no transaction %d", errMalformed, msg.BlockHash, index)
+		}
+		txs = append(txs, block.Transactions[index])
+	}
+	p.Send(cmdBlockTxn, &BlockTxnMsg{BlockHash: msg.BlockHash, Txs: txs})
+
+	return nil
+}
+
+// acceptTx adds a transaction from p to the mempool and relays it on,
+// scoring p for one that breaks a rule or for refused ones past its
+// allowance.
+func (n *Node) acceptTx(p *Peer, tx *blockchain.Transaction) {
+	n.chainMu.Lock()
+	_, err := n.mempool.Accept(tx)
+	n.chainMu.Unlock()
+
+	if err != nil {
+		if penalty := txRejectPenalty(err); penalty > 0 {
+			n.misbehaving(p, penalty, err.Error())
+			return
+		}
+		if p.overTxRejectAllowance(time.Now()) {
+			n.misbehaving(p, penaltyTxRejects, "too many refused transactions: "+err.Error())
+			return
+		}
+		p.logger.Debug("Ignoring transaction", slog.String("reason", err.Error()))
+		return
+	}
+	p.logger.Debug("Accepted transaction", slog.String("txid", fmt.Sprintf("%x", tx.ID)))
+	n.relayTx(p, tx)
+	n.notifyTemplate()
+}
+
+// relayTx sends a transaction to every peer but source, which may be nil.
+func (n *Node) relayTx(source *Peer, tx *blockchain.Transaction) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, p := range n.peers {
+		if p != source && p.established() {
+			p.Send(cmdTx, &TxMsg{Tx: tx})
+		}
+	}
+}
+
+// announceTip sends the chain tip to every peer, so those behind fetch it:
+// as a compact block to the peers that asked for them, as a header to the
+// others.
+func (n *Node) announceTip() {
+	n.chainMu.Lock()
+	header, err := n.chain.GetBlockHeader(n.chain.LastHash)
+	var block *blockchain.Block
+	if err == nil {
+		// the tip of a chain loaded from a snapshot may have no body
+		block, _ = n.chain.GetBlock(header.Hash)
+	}
+	n.chainMu.Unlock()
+	if err != nil {
+		n.logger.Error("Announcing the tip failed", slog.String("error", err.Error()))
+		return
+	}
+
+	headers := &HeadersMsg{Headers: []*blockchain.BlockHeader{header}}
+	var compact *CmpctBlockMsg
+	if block != nil {
+		compact = newCompactBlock(block, rand.Uint64())
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, p := range n.peers {
+		if !p.established() {
+			continue
+		}
+		if compact != nil && p.wantsCompact() {
+			p.Send(cmdCmpctBlock, compact)
+		} else {
+			p.Send(cmdHeaders, headers)
+		}
+	}
+}
+
+// hasBlock reports whether the block body is stored.
+func (n *Node) hasBlock(hash []byte) bool {
+	n.chainMu.Lock()
+	defer n.chainMu.Unlock()
+
+	ok, err := n.chain.Store.HasBlock(hash)
+
+	return err == nil && ok
+}
+
+func (n *Node) bestHeight() int {
+	n.chainMu.Lock()
+	defer n.chainMu.Unlock()
+
+	return n.chain.GetBestHeight()
+}
+
+// relayAddrs passes an addr announcement from source on to a few other
+// peers.
+func (n *Node) relayAddrs(source *Peer, msg *AddrMsg) {
+	n.mu.Lock()
+	var targets []*Peer
+	for _, p := range n.peers {
+		if p != source && p.established() {
+			targets = append(targets, p)
+		}
+	}
+	n.mu.Unlock()
+
+	rand.Shuffle(len(targets), func(i, j int) { targets[i], targets[j] = targets[j], targets[i] })
+	if len(targets) > relayAddrPeers {
+		targets = targets[:relayAddrPeers]
+	}
+	for _, p := range targets {
+		p.Send(cmdAddr, msg)
+	}
+}
+
+// broadcast sends a message to every established peer.
+func (n *Node) broadcast(command string, payload any) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, p := range n.peers {
+		if p.established() {
+			p.Send(command, payload)
+		}
+	}
+}
+
+func (n *Node) versionMsg() *VersionMsg {
+	n.chainMu.Lock()
+	defer n.chainMu.Unlock()
+
+	genesis, _ := n.genesisHash()
+
+	return &VersionMsg{
+		Version:    ProtocolVersion,
+		Genesis:    genesis,
+		Height:     n.chain.GetBestHeight(),
+		ListenAddr: n.cfg.ListenAddr,
+		Nonce:      n.nonce,
+	}
+}
+
+func (n *Node) checkVersion(p *Peer, msg *VersionMsg) error {
+	if msg.Nonce == n.nonce {
+		return errors.New("connected to self")
+	}
+	if msg.Version < ProtocolVersion {
+		return fmt.Errorf("protocol version %d is too old", msg.Version)
+	}
+
+	n.chainMu.Lock()
+	genesis, err := n.genesisHash()
+	n.chainMu.Unlock()
+	if err == nil && !bytes.Equal(genesis, msg.Genesis) {
+		return fmt.Errorf("peer follows the chain of genesis %x", msg.Genesis)
+	}
+
+	return nil
+}
+
+// genesisHash returns the hash of the first block, which a chain started
+// from a snapshot knows before it has the block. The caller holds chainMu.
+func (n *Node) genesisHash() ([]byte, error) {
+	if state := n.chain.Snapshot(); state != nil {
+		return state.Genesis, nil
+	}
+
+	return n.chain.GetBlockHash(0)
+}
+
+// selfAddr is the announcement of this node's own address, nil when it has
+// none worth announcing.
+func (n *Node) selfAddr() []NetAddr {
+	host, _, err := net.SplitHostPort(n.cfg.ListenAddr)
+	if err != nil || host == "" || net.ParseIP(host).IsUnspecified() {
+		return nil
+	}
+
+	return []NetAddr{{Addr: n.cfg.ListenAddr, LastSeen: time.Now()}}
+}
+
+// othersAddrs drops our own listen address from gossiped addrs.
+func (n *Node) othersAddrs(addrs []NetAddr) []NetAddr {
+	others := make([]NetAddr, 0, len(addrs))
+	for _, na := range addrs {
+		if na.Addr != n.cfg.ListenAddr {
+			others = append(others, na)
+		}
+	}
+
+	return others
+}
+
+// connectedAddrs returns the addresses of all peers, connected or being
+// dialed. The caller holds mu.
+func (n *Node) connectedAddrs() map[string]bool {
+	addrs := make(map[string]bool)
+	for _, p := range n.peers {
+		addrs[p.addr] = true
+		if listen := p.listenAddress(); listen != "" {
+			addrs[listen] = true
+		}
+	}
+	for addr := range n.dialing {
+		addrs[addr] = true
+	}
+
+	return addrs
+}
+
+func (n *Node) countPeers(inbound bool) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	count := 0
+	for _, p := range n.peers {
+		if p.inbound == inbound {
+			count++
+		}
+	}
+
+	return count
+}
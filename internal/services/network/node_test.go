@@ -0,0 +1,276 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/numbermax/blockchain/internal/services/blockchain"
+)
+
+const testAddr = "1EnGBkhk3qkj9u6dyXNrBcBUgd2xnzZGaG"
+
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// freeAddr returns a localhost address nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	return listener.Addr().String()
+}
+
+// newTestNode opens a node on a fresh chain, which every test node shares
+// the genesis of, keeping its files in dataDir.
+func newTestNode(t *testing.T, dataDir, listen string, connect ...string) *Node {
+	t.Helper()
+
+	return newTestNodeWith(t, Config{
+		ListenAddr: listen,
+		Connect:    connect,
+		DataDir:    dataDir,
+	})
+}
+
+// newTestNodeWith opens a node like newTestNode does, configured by cfg.
+func newTestNodeWith(t *testing.T, cfg Config) *Node {
+	t.Helper()
+
+	chain := blockchain.InitBlockChainWithStore(*discardLogger(), blockchain.NewMemoryStore(), testAddr)
+	node, err := NewNode(*discardLogger(), chain, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return node
+}
+
+func startTestNode(t *testing.T, node *Node) {
+	t.Helper()
+
+	if err := node.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(node.Stop)
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// knownAddr returns what am remembers about addr, nil if nothing.
+func knownAddr(am *AddrManager, addr string) *KnownAddr {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	if ka, ok := am.addrs[addr]; ok {
+		copied := *ka
+		return &copied
+	}
+
+	return nil
+}
+
+func TestAddrGossipBetweenLocalNodes(t *testing.T) {
+	addrA, addrB := freeAddr(t), freeAddr(t)
+	dirB := t.TempDir()
+	// an address only A knows, for B to learn by gossip
+	const gossiped = "127.0.0.1:1"
+
+	a := newTestNode(t, t.TempDir(), addrA)
+	a.addrMan.Add([]NetAddr{{Addr: gossiped, LastSeen: time.Now()}}, "test")
+	startTestNode(t, a)
+
+	b := newTestNode(t, dirB, addrB, addrA)
+	startTestNode(t, b)
+
+	waitFor(t, "B to learn the gossiped address", func() bool {
+		return knownAddr(b.addrMan, gossiped) != nil
+	})
+	waitFor(t, "A to learn where B listens", func() bool {
+		return knownAddr(a.addrMan, addrB) != nil
+	})
+	if ka := knownAddr(b.addrMan, addrA); ka == nil || ka.Successes == 0 {
+		t.Errorf("B remembers A as %+v, want a successful connection", ka)
+	}
+	if ka := knownAddr(b.addrMan, addrB); ka != nil {
+		t.Errorf("B learnt its own address from A: %+v", ka)
+	}
+
+	b.Stop()
+
+	saved, err := LoadAddrManager(dirB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []string{addrA, gossiped} {
+		if knownAddr(saved, addr) == nil {
+			t.Errorf("%s was not saved in %s", addr, peersFile)
+		}
+	}
+
+	// without -connect the restarted node finds A in the saved addresses
+	restarted := newTestNode(t, dirB, freeAddr(t))
+	startTestNode(t, restarted)
+	waitFor(t, "the restarted node to connect to A", func() bool {
+		for _, info := range restarted.PeerInfo() {
+			if info.Addr == addrA && !info.Inbound {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// addrPeer is a peer past the handshake whose messages are left queued
+// for the test to read.
+func addrPeer(t *testing.T, n *Node, addr string) *Peer {
+	t.Helper()
+
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+
+	p := newPeer(n, local, addr, false, false)
+	p.version = &VersionMsg{ListenAddr: addr}
+	p.listenAddr = addr
+	n.mu.Lock()
+	n.nextID++
+	p.id = n.nextID
+	n.peers[p.id] = p
+	n.mu.Unlock()
+
+	return p
+}
+
+func sendAddrs(t *testing.T, n *Node, from *Peer, addrs ...string) {
+	t.Helper()
+
+	msg := AddrMsg{}
+	for _, addr := range addrs {
+		msg.Addrs = append(msg.Addrs, NetAddr{Addr: addr, LastSeen: time.Now()})
+	}
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.handleMessage(from, cmdAddr, payload.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// relayed returns the addresses queued for p in addr messages.
+func relayed(p *Peer) []string {
+	var addrs []string
+	for {
+		select {
+		case out := <-p.send:
+			if msg, ok := out.payload.(*AddrMsg); ok && out.command == cmdAddr {
+				for _, na := range msg.Addrs {
+					addrs = append(addrs, na.Addr)
+				}
+			}
+		default:
+			return addrs
+		}
+	}
+}
+
+func TestGetAddrAnswerIsNotRelayed(t *testing.T) {
+	n := newTestNode(t, t.TempDir(), freeAddr(t))
+	source := addrPeer(t, n, "127.0.0.1:2001")
+	other := addrPeer(t, n, "127.0.0.1:2002")
+
+	source.askAddrs()
+	relayed(source)
+
+	// the peer announcing itself is not the answer, and is passed on
+	sendAddrs(t, n, source, source.addr)
+	if got := relayed(other); len(got) != 1 || got[0] != source.addr {
+		t.Errorf("relayed %v, want the announcement of %s", got, source.addr)
+	}
+
+	// a short address list is still the peer's own list
+	sendAddrs(t, n, source, "127.0.0.1:3001", "127.0.0.1:3002")
+	if knownAddr(n.addrMan, "127.0.0.1:3001") == nil {
+		t.Error("the answer to getaddr was not learnt")
+	}
+	if got := relayed(other); len(got) != 0 {
+		t.Errorf("the answer to getaddr was relayed: %v", got)
+	}
+
+	// later announcements are fresh again
+	sendAddrs(t, n, source, "127.0.0.1:3003")
+	if got := relayed(other); len(got) != 1 || got[0] != "127.0.0.1:3003" {
+		t.Errorf("relayed %v, want the announcement of 127.0.0.1:3003", got)
+	}
+}
+
+// mineChain adds the given number of coinbase only blocks to the chain of n.
+func mineChain(t *testing.T, n *Node, blocks int) {
+	t.Helper()
+
+	for i := 0; i < blocks; i++ {
+		n.chain.AddBlock([]*blockchain.Transaction{blockchain.CoinbaseTx(testAddr, fmt.Sprintf("block %d", i))})
+	}
+}
+
+// copyChain connects the blocks of from on to, which shares its genesis.
+func copyChain(t *testing.T, from, to *Node) {
+	t.Helper()
+
+	for height := 1; height <= from.chain.GetBestHeight(); height++ {
+		block, err := from.chain.GetBlockByHeight(height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := to.chain.ProcessBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// A node syncs a chain longer than the download window from two peers.
+func TestSyncFromTwoLocalNodes(t *testing.T) {
+	addrA, addrB := freeAddr(t), freeAddr(t)
+	a := newTestNode(t, t.TempDir(), addrA)
+	mineChain(t, a, 2*blockWindow+20)
+	b := newTestNode(t, t.TempDir(), addrB)
+	copyChain(t, a, b)
+	startTestNode(t, a)
+	startTestNode(t, b)
+
+	c := newTestNode(t, t.TempDir(), freeAddr(t), addrA, addrB)
+	startTestNode(t, c)
+	waitFor(t, "the chain to download", func() bool {
+		return c.SyncInfo().BlockHeight == a.chain.GetBestHeight()
+	})
+	if !bytes.Equal(c.chain.LastHash, a.chain.LastHash) {
+		t.Errorf("synced to tip %x, want %x", c.chain.LastHash, a.chain.LastHash)
+	}
+	if info := c.SyncInfo(); info.Syncing || info.HeaderHeight != info.BlockHeight || len(info.Peers) != 2 {
+		t.Errorf("sync info after the download = %+v", info)
+	}
+}
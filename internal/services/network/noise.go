@@ -0,0 +1,408 @@
+package network
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// The encrypted transport runs the Noise XX handshake, in which both sides
+// prove their static key, with X25519, ChaCha20-Poly1305 and SHA-256:
+//
+//	-> e
+//	<- e, ee, s, es
+//	-> s, se
+//
+// after which every message travels in length prefixed encrypted frames.
+const (
+	noiseProtocol = "Noise_XX_25519_ChaChaPoly_SHA256"
+	noiseKeySize  = 32
+	noiseTagSize  = chacha20poly1305.Overhead
+	// maxFrame bounds the plaintext of one transport frame.
+	maxFrame = 1 << 16
+)
+
+var errDecrypt = errors.New("frame failed to decrypt")
+
+// cipherState encrypts with one key and a counter nonce.
+type cipherState struct {
+	aead  cipher.AEAD
+	nonce uint64
+}
+
+func newCipherState(key []byte) *cipherState {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		panic(err)
+	}
+
+	return &cipherState{aead: aead}
+}
+
+func (cs *cipherState) nextNonce() []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], cs.nonce)
+	cs.nonce++
+
+	return nonce
+}
+
+func (cs *cipherState) seal(dst, ad, plaintext []byte) []byte {
+	return cs.aead.Seal(dst, cs.nextNonce(), plaintext, ad)
+}
+
+func (cs *cipherState) open(dst, ad, ciphertext []byte) ([]byte, error) {
+	plaintext, err := cs.aead.Open(dst, cs.nextNonce(), ciphertext, ad)
+	if err != nil {
+		return nil, errDecrypt
+	}
+
+	return plaintext, nil
+}
+
+// handshakeState is the symmetric and key state of one side of the
+// handshake.
+type handshakeState struct {
+	ck, h     []byte
+	cs        *cipherState
+	s, e      *ecdh.PrivateKey
+	rs, re    *ecdh.PublicKey
+	initiator bool
+}
+
+func newHandshake(static *ecdh.PrivateKey, prologue []byte, initiator bool) *handshakeState {
+	h := []byte(noiseProtocol)
+	hs := &handshakeState{ck: h, h: h, s: static, initiator: initiator}
+	hs.mixHash(prologue)
+
+	return hs
+}
+
+func (hs *handshakeState) mixHash(data []byte) {
+	sum := sha256.New()
+	sum.Write(hs.h)
+	sum.Write(data)
+	hs.h = sum.Sum(nil)
+}
+
+func (hs *handshakeState) mixKey(ikm []byte) {
+	var key []byte
+	hs.ck, key = noiseHKDF(hs.ck, ikm)
+	hs.cs = newCipherState(key)
+}
+
+func (hs *handshakeState) mixDH(priv *ecdh.PrivateKey, pub *ecdh.PublicKey) error {
+	shared, err := priv.ECDH(pub)
+	if err != nil {
+		return err
+	}
+	hs.mixKey(shared)
+
+	return nil
+}
+
+func (hs *handshakeState) encryptAndHash(plaintext []byte) []byte {
+	out := plaintext
+	if hs.cs != nil {
+		out = hs.cs.seal(nil, hs.h, plaintext)
+	}
+	hs.mixHash(out)
+
+	return out
+}
+
+func (hs *handshakeState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	out := ciphertext
+	if hs.cs != nil {
+		var err error
+		if out, err = hs.cs.open(nil, hs.h, ciphertext); err != nil {
+			return nil, err
+		}
+	}
+	hs.mixHash(ciphertext)
+
+	return out, nil
+}
+
+// split returns the ciphers for sending and receiving.
+func (hs *handshakeState) split() (*cipherState, *cipherState) {
+	k1, k2 := noiseHKDF(hs.ck, nil)
+	if hs.initiator {
+		return newCipherState(k1), newCipherState(k2)
+	}
+
+	return newCipherState(k2), newCipherState(k1)
+}
+
+// noiseHKDF derives two keys from the chaining key and ikm.
+func noiseHKDF(ck, ikm []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, ck)
+	mac.Write(ikm)
+	temp := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, temp)
+	mac.Write([]byte{1})
+	out1 := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, temp)
+	mac.Write(out1)
+	mac.Write([]byte{2})
+	out2 := mac.Sum(nil)
+
+	return out1, out2
+}
+
+// writeE generates the ephemeral key and writes its public half.
+func (hs *handshakeState) writeE(buf *bytes.Buffer) error {
+	e, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	hs.e = e
+	buf.Write(e.PublicKey().Bytes())
+	hs.mixHash(e.PublicKey().Bytes())
+
+	return nil
+}
+
+func (hs *handshakeState) readE(msg []byte) ([]byte, error) {
+	if len(msg) < noiseKeySize {
+		return nil, errors.New("handshake message too short")
+	}
+	re, err := ecdh.X25519().NewPublicKey(msg[:noiseKeySize])
+	if err != nil {
+		return nil, err
+	}
+	hs.re = re
+	hs.mixHash(msg[:noiseKeySize])
+
+	return msg[noiseKeySize:], nil
+}
+
+func (hs *handshakeState) writeS(buf *bytes.Buffer) {
+	buf.Write(hs.encryptAndHash(hs.s.PublicKey().Bytes()))
+}
+
+func (hs *handshakeState) readS(msg []byte) ([]byte, error) {
+	size := noiseKeySize + noiseTagSize
+	if len(msg) < size {
+		return nil, errors.New("handshake message too short")
+	}
+	key, err := hs.decryptAndHash(msg[:size])
+	if err != nil {
+		return nil, err
+	}
+	rs, err := ecdh.X25519().NewPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	hs.rs = rs
+
+	return msg[size:], nil
+}
+
+// writePayload ends a handshake message with an empty payload.
+func (hs *handshakeState) writePayload(buf *bytes.Buffer) {
+	buf.Write(hs.encryptAndHash(nil))
+}
+
+func (hs *handshakeState) readPayload(msg []byte) error {
+	if _, err := hs.decryptAndHash(msg); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// noiseInitiate runs the handshake as the side that connected and returns
+// the session and the static key of the peer. Handshake messages are read
+// from r, which buffers conn.
+func noiseInitiate(conn net.Conn, r io.Reader, static *ecdh.PrivateKey, prologue []byte) (*secureConn, []byte, error) {
+	hs := newHandshake(static, prologue, true)
+
+	// -> e
+	var msg bytes.Buffer
+	if err := hs.writeE(&msg); err != nil {
+		return nil, nil, err
+	}
+	hs.writePayload(&msg)
+	if err := writeHandshakeMessage(conn, msg.Bytes()); err != nil {
+		return nil, nil, err
+	}
+
+	// <- e, ee, s, es
+	in, err := readHandshakeMessage(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if in, err = hs.readE(in); err != nil {
+		return nil, nil, err
+	}
+	if err := hs.mixDH(hs.e, hs.re); err != nil {
+		return nil, nil, err
+	}
+	if in, err = hs.readS(in); err != nil {
+		return nil, nil, err
+	}
+	if err := hs.mixDH(hs.e, hs.rs); err != nil {
+		return nil, nil, err
+	}
+	if err := hs.readPayload(in); err != nil {
+		return nil, nil, err
+	}
+
+	// -> s, se
+	msg.Reset()
+	hs.writeS(&msg)
+	if err := hs.mixDH(hs.s, hs.re); err != nil {
+		return nil, nil, err
+	}
+	hs.writePayload(&msg)
+	if err := writeHandshakeMessage(conn, msg.Bytes()); err != nil {
+		return nil, nil, err
+	}
+
+	send, recv := hs.split()
+
+	return &secureConn{Conn: conn, r: r, send: send, recv: recv}, hs.rs.Bytes(), nil
+}
+
+// noiseRespond runs the handshake as the side that was connected to.
+func noiseRespond(conn net.Conn, r io.Reader, static *ecdh.PrivateKey, prologue []byte) (*secureConn, []byte, error) {
+	hs := newHandshake(static, prologue, false)
+
+	// -> e
+	in, err := readHandshakeMessage(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if in, err = hs.readE(in); err != nil {
+		return nil, nil, err
+	}
+	if err := hs.readPayload(in); err != nil {
+		return nil, nil, err
+	}
+
+	// <- e, ee, s, es
+	var msg bytes.Buffer
+	if err := hs.writeE(&msg); err != nil {
+		return nil, nil, err
+	}
+	if err := hs.mixDH(hs.e, hs.re); err != nil {
+		return nil, nil, err
+	}
+	hs.writeS(&msg)
+	if err := hs.mixDH(hs.s, hs.re); err != nil {
+		return nil, nil, err
+	}
+	hs.writePayload(&msg)
+	if err := writeHandshakeMessage(conn, msg.Bytes()); err != nil {
+		return nil, nil, err
+	}
+
+	// -> s, se
+	if in, err = readHandshakeMessage(r); err != nil {
+		return nil, nil, err
+	}
+	if in, err = hs.readS(in); err != nil {
+		return nil, nil, err
+	}
+	if err := hs.mixDH(hs.e, hs.rs); err != nil {
+		return nil, nil, err
+	}
+	if err := hs.readPayload(in); err != nil {
+		return nil, nil, err
+	}
+
+	send, recv := hs.split()
+
+	return &secureConn{Conn: conn, r: r, send: send, recv: recv}, hs.rs.Bytes(), nil
+}
+
+// Handshake messages go with a two byte length.
+func writeHandshakeMessage(w io.Writer, msg []byte) error {
+	frame := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(frame, uint16(len(msg)))
+	_, err := w.Write(append(frame, msg...))
+
+	return err
+}
+
+func readHandshakeMessage(r io.Reader) ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// secureConn is a connection after the handshake. Each frame is a four
+// byte length followed by up to maxFrame bytes encrypted. It takes one
+// reader and one writer at a time.
+type secureConn struct {
+	net.Conn
+	r          io.Reader
+	send, recv *cipherState
+	// buf holds what was decrypted and not read yet.
+	buf []byte
+}
+
+func (c *secureConn) Read(p []byte) (int, error) {
+	if len(c.buf) == 0 {
+		var size [4]byte
+		if _, err := io.ReadFull(c.r, size[:]); err != nil {
+			return 0, err
+		}
+		length := binary.BigEndian.Uint32(size[:])
+		if length > maxFrame+noiseTagSize {
+			return 0, fmt.Errorf("encrypted frame of %d bytes", length)
+		}
+		frame := make([]byte, length)
+		if _, err := io.ReadFull(c.r, frame); err != nil {
+			return 0, err
+		}
+		plaintext, err := c.recv.open(frame[:0], nil, frame)
+		if err != nil {
+			return 0, err
+		}
+		c.buf = plaintext
+	}
+
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+
+	return n, nil
+}
+
+func (c *secureConn) Write(p []byte) (int, error) {
+	var out bytes.Buffer
+	for rest := p; len(rest) > 0; {
+		chunk := rest[:min(len(rest), maxFrame)]
+		rest = rest[len(chunk):]
+
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(chunk)+noiseTagSize))
+		out.Write(size[:])
+		out.Write(c.send.seal(nil, nil, chunk))
+	}
+	if _, err := c.Conn.Write(out.Bytes()); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
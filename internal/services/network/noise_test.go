@@ -0,0 +1,123 @@
+package network
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func newStaticKey(t *testing.T) *ecdh.PrivateKey {
+	t.Helper()
+
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+// noisePair runs the handshake between the two keys over a pipe and returns
+// the session of the initiator and of the responder.
+func noisePair(t *testing.T, initiator, responder *ecdh.PrivateKey) (*secureConn, *secureConn) {
+	t.Helper()
+
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	prologue := []byte("test")
+
+	type result struct {
+		session *secureConn
+		key     []byte
+		err     error
+	}
+	done := make(chan result)
+	go func() {
+		session, key, err := noiseRespond(b, b, responder, prologue)
+		done <- result{session, key, err}
+	}()
+
+	out, outKey, err := noiseInitiate(a, a, initiator, prologue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := <-done
+	if in.err != nil {
+		t.Fatal(in.err)
+	}
+
+	if !bytes.Equal(outKey, responder.PublicKey().Bytes()) {
+		t.Errorf("initiator learnt key %x, want %x", outKey, responder.PublicKey().Bytes())
+	}
+	if !bytes.Equal(in.key, initiator.PublicKey().Bytes()) {
+		t.Errorf("responder learnt key %x, want %x", in.key, initiator.PublicKey().Bytes())
+	}
+
+	return out, in.session
+}
+
+// sendOver writes data to from in the background and reads it back from to.
+func sendOver(t *testing.T, from, to *secureConn, data []byte) []byte {
+	t.Helper()
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := from.Write(data)
+		written <- err
+	}()
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(to, got); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+
+	return got
+}
+
+func TestNoiseHandshake(t *testing.T) {
+	out, in := noisePair(t, newStaticKey(t), newStaticKey(t))
+
+	large := make([]byte, 2*maxFrame+100)
+	rand.Read(large)
+	tests := []struct {
+		name     string
+		from, to *secureConn
+		data     []byte
+	}{
+		{"initiator to responder", out, in, []byte("version")},
+		{"responder to initiator", in, out, []byte("verack")},
+		{"over several frames", out, in, large},
+		{"again after several frames", in, out, []byte("ping")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sendOver(t, tt.from, tt.to, tt.data); !bytes.Equal(got, tt.data) {
+				t.Errorf("read %d bytes differing from the %d written", len(got), len(tt.data))
+			}
+		})
+	}
+}
+
+func TestNoiseTamperedFrame(t *testing.T) {
+	out, in := noisePair(t, newStaticKey(t), newStaticKey(t))
+
+	sealed := out.send.seal(nil, nil, []byte("block"))
+	sealed[len(sealed)/2] ^= 1
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(sealed)))
+	go out.Conn.Write(append(frame, sealed...))
+
+	if _, err := in.Read(make([]byte, 16)); !errors.Is(err, errDecrypt) {
+		t.Errorf("reading a tampered frame: %v, want %v", err, errDecrypt)
+	}
+}
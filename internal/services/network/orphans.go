@@ -0,0 +1,160 @@
+package network
+
+import (
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/numbermax/blockchain/internal/services/blockchain"
+)
+
+const (
+	// maxOrphans and maxOrphanBytes bound the orphan pool; the oldest
+	// orphans go first to make room.
+	maxOrphans     = 100
+	maxOrphanBytes = 16 << 20
+	// orphanExpiry drops an orphan whose parent never showed up.
+	orphanExpiry = 20 * time.Minute
+)
+
+type orphanBlock struct {
+	block   *blockchain.Block
+	from    *Peer
+	size    int
+	addedAt time.Time
+}
+
+// orphanPool holds blocks whose parent is unknown until the parent is
+// connected. Only blocks that passed the checks a block can get without its
+// parent, proof of work among them, get in.
+type orphanPool struct {
+	mu     sync.Mutex
+	blocks map[string]*orphanBlock
+	// byPrev lists the orphans waiting for each parent.
+	byPrev map[string][]string
+	size   int
+}
+
+func newOrphanPool() *orphanPool {
+	return &orphanPool{
+		blocks: make(map[string]*orphanBlock),
+		byPrev: make(map[string][]string),
+	}
+}
+
+// add keeps block, sent by from, and returns the block missing below it:
+// the parent of its oldest ancestor in the pool. It reports false when the
+// block was held already or is not kept: when it is larger than the whole
+// pool may be, or was itself dropped to make room.
+func (op *orphanPool) add(block *blockchain.Block, from *Peer) ([]byte, bool) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	key := hex.EncodeToString(block.Hash)
+	if _, ok := op.blocks[key]; ok {
+		return nil, false
+	}
+
+	orphan := &orphanBlock{
+		block:   block,
+		from:    from,
+		size:    len(block.Serialize()),
+		addedAt: time.Now(),
+	}
+	if orphan.size > maxOrphanBytes {
+		return nil, false
+	}
+	op.blocks[key] = orphan
+	prev := hex.EncodeToString(block.PrevHash)
+	op.byPrev[prev] = append(op.byPrev[prev], key)
+	op.size += orphan.size
+
+	for len(op.blocks) > maxOrphans || op.size > maxOrphanBytes {
+		op.remove(op.oldest())
+	}
+	if _, ok := op.blocks[key]; !ok {
+		return nil, false
+	}
+
+	missing := block.PrevHash
+	for {
+		ancestor, ok := op.blocks[hex.EncodeToString(missing)]
+		if !ok {
+			return missing, true
+		}
+		missing = ancestor.block.PrevHash
+	}
+}
+
+// takeChildren removes and returns the orphans waiting for hash.
+func (op *orphanPool) takeChildren(hash []byte) []*orphanBlock {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	var children []*orphanBlock
+	keys := append([]string{}, op.byPrev[hex.EncodeToString(hash)]...)
+	for _, key := range keys {
+		if orphan, ok := op.blocks[key]; ok {
+			children = append(children, orphan)
+			op.remove(key)
+		}
+	}
+
+	return children
+}
+
+// expire drops the orphans held longer than orphanExpiry.
+func (op *orphanPool) expire() {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	for key, orphan := range op.blocks {
+		if time.Since(orphan.addedAt) > orphanExpiry {
+			op.remove(key)
+		}
+	}
+}
+
+func (op *orphanPool) len() int {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	return len(op.blocks)
+}
+
+// oldest returns the key of the orphan held longest. The caller holds mu.
+func (op *orphanPool) oldest() string {
+	var oldest string
+	var at time.Time
+	for key, orphan := range op.blocks {
+		if oldest == "" || orphan.addedAt.Before(at) {
+			oldest, at = key, orphan.addedAt
+		}
+	}
+
+	return oldest
+}
+
+// remove drops an orphan. The caller holds mu.
+func (op *orphanPool) remove(key string) {
+	orphan, ok := op.blocks[key]
+	if !ok {
+		return
+	}
+	delete(op.blocks, key)
+	op.size -= orphan.size
+
+	prev := hex.EncodeToString(orphan.block.PrevHash)
+	siblings := op.byPrev[prev]
+	for i, sibling := range siblings {
+		if sibling == key {
+			siblings = append(siblings[:i], siblings[i+1:]...)
+			break
+		}
+	}
+	if len(siblings) == 0 {
+		delete(op.byPrev, prev)
+	} else {
+		op.byPrev[prev] = siblings
+	}
+}
@@ -0,0 +1,69 @@
+package network
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/numbermax/blockchain/internal/services/blockchain"
+)
+
+func orphanOf(prev []byte, hash byte) *blockchain.Block {
+	return &blockchain.Block{
+		Hash:     bytes.Repeat([]byte{hash}, 32),
+		PrevHash: prev,
+		Version:  blockchain.BlockVersion,
+	}
+}
+
+func TestOrphanPoolAsksForTheMissingAncestor(t *testing.T) {
+	op := newOrphanPool()
+	missing := bytes.Repeat([]byte{0xff}, 32)
+	first := orphanOf(missing, 1)
+	second := orphanOf(first.Hash, 2)
+
+	if got, added := op.add(second, nil); !added || !bytes.Equal(got, first.Hash) {
+		t.Errorf("add(second) = %x, %v, want %x", got, added, first.Hash)
+	}
+	if got, added := op.add(first, nil); !added || !bytes.Equal(got, missing) {
+		t.Errorf("add(first) = %x, %v, want %x", got, added, missing)
+	}
+	if got, added := op.add(orphanOf(second.Hash, 3), nil); !added || !bytes.Equal(got, missing) {
+		t.Errorf("add on top of two orphans = %x, %v, want %x", got, added, missing)
+	}
+	if _, added := op.add(first, nil); added {
+		t.Error("a held orphan was added again")
+	}
+}
+
+func TestOrphanPoolRefusesOversizedBlocks(t *testing.T) {
+	op := newOrphanPool()
+	op.add(orphanOf(nil, 1), nil)
+
+	block := orphanOf(nil, 2)
+	block.Transactions = []*blockchain.Transaction{{ID: make([]byte, maxOrphanBytes)}}
+	if _, added := op.add(block, nil); added {
+		t.Error("a block larger than the pool was added")
+	}
+	if op.len() != 1 {
+		t.Errorf("pool holds %d orphans, want the one before the oversized block", op.len())
+	}
+}
+
+func TestOrphanPoolReportsEvictedBlock(t *testing.T) {
+	op := newOrphanPool()
+	for i := 0; i < maxOrphans; i++ {
+		op.add(orphanOf(nil, byte(i)), nil)
+	}
+	// the pool is full of orphans younger than the next one
+	for _, orphan := range op.blocks {
+		orphan.addedAt = time.Now().Add(time.Hour)
+	}
+
+	if _, added := op.add(orphanOf(nil, maxOrphans), nil); added {
+		t.Error("add reported a block it dropped right away")
+	}
+	if op.len() != maxOrphans {
+		t.Errorf("pool holds %d orphans, want %d", op.len(), maxOrphans)
+	}
+}
@@ -0,0 +1,375 @@
+package network
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	handshakeTimeout = 10 * time.Second
+	pingInterval     = 2 * time.Minute
+	// idleTimeout drops a peer that sent nothing, not even a pong, for this
+	// long.
+	idleTimeout = 5 * time.Minute
+	sendQueue   = 64
+)
+
+// PeerInfo describes a connected peer for getpeerinfo.
+type PeerInfo struct {
+	ID      int    `json:"id"`
+	Addr    string `json:"addr"`
+	Inbound bool   `json:"inbound"`
+	// Manual is set for peers from -connect, -addnode and addnode.
+	Manual      bool          `json:"manual"`
+	ListenAddr  string        `json:"listen_addr,omitempty"`
+	Version     int           `json:"version"`
+	StartHeight int           `json:"start_height"`
+	ConnectedAt time.Time     `json:"connected_at"`
+	LastSend    time.Time     `json:"last_send"`
+	LastRecv    time.Time     `json:"last_recv"`
+	BytesSent   int           `json:"bytes_sent"`
+	BytesRecv   int           `json:"bytes_recv"`
+	PingTime    time.Duration `json:"ping_time"`
+	BanScore    int           `json:"ban_score"`
+	// Encrypted peers proved the static key PeerKey in the handshake.
+	Encrypted bool   `json:"encrypted"`
+	PeerKey   string `json:"peer_key,omitempty"`
+	// Compact is set for peers that want new blocks as compact blocks.
+	Compact bool `json:"compact"`
+}
+
+type outMessage struct {
+	command string
+	payload any
+}
+
+// Peer is one connection to another node.
+type Peer struct {
+	node *Node
+	id   int
+	conn net.Conn
+	// stream carries the messages, encrypted or over conn itself. It is
+	// set before writeLoop starts.
+	stream  net.Conn
+	addr    string
+	inbound bool
+	manual  bool
+	logger  slog.Logger
+
+	send chan outMessage
+	quit chan struct{}
+	once sync.Once
+
+	mu          sync.Mutex
+	version     *VersionMsg
+	listenAddr  string
+	connectedAt time.Time
+	lastSend    time.Time
+	lastRecv    time.Time
+	bytesSent   int
+	bytesRecv   int
+	pingNonce   uint64
+	pingSent    time.Time
+	pingTime    time.Duration
+	banScore    int
+	compact     bool
+	peerKey     []byte
+	// askedAddrs is set while a getaddr sent to the peer is unanswered.
+	askedAddrs bool
+	// txRejects counts the relayed transactions refused for free since
+	// txRejectsSince.
+	txRejects      int
+	txRejectsSince time.Time
+}
+
+func newPeer(node *Node, conn net.Conn, addr string, inbound, manual bool) *Peer {
+	return &Peer{
+		node:        node,
+		conn:        conn,
+		addr:        addr,
+		inbound:     inbound,
+		manual:      manual,
+		logger:      *node.logger.With(slog.String("peer", addr)),
+		send:        make(chan outMessage, sendQueue),
+		quit:        make(chan struct{}),
+		connectedAt: time.Now(),
+	}
+}
+
+// Send queues a message, dropping the peer when it does not keep up.
+func (p *Peer) Send(command string, payload any) {
+	select {
+	case p.send <- outMessage{command, payload}:
+	case <-p.quit:
+	default:
+		p.logger.Warn("Peer is not reading, disconnecting")
+		p.Disconnect()
+	}
+}
+
+// Disconnect closes the connection; the node forgets the peer once its
+// goroutines are done.
+func (p *Peer) Disconnect() {
+	p.once.Do(func() {
+		close(p.quit)
+		p.conn.Close()
+	})
+}
+
+func (p *Peer) Info() PeerInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	info := PeerInfo{
+		ID:          p.id,
+		Addr:        p.addr,
+		Inbound:     p.inbound,
+		Manual:      p.manual,
+		ListenAddr:  p.listenAddr,
+		ConnectedAt: p.connectedAt,
+		LastSend:    p.lastSend,
+		LastRecv:    p.lastRecv,
+		BytesSent:   p.bytesSent,
+		BytesRecv:   p.bytesRecv,
+		PingTime:    p.pingTime,
+		BanScore:    p.banScore,
+		Compact:     p.compact,
+		Encrypted:   p.peerKey != nil,
+	}
+	if p.peerKey != nil {
+		info.PeerKey = hex.EncodeToString(p.peerKey)
+	}
+	if p.version != nil {
+		info.Version = p.version.Version
+		info.StartHeight = p.version.Height
+	}
+
+	return info
+}
+
+// run does the handshake and then serves the peer until it disconnects.
+func (p *Peer) run() (err error) {
+	defer p.Disconnect()
+	defer func() {
+		if errors.Is(err, errMalformed) {
+			p.node.misbehaving(p, penaltyMalformed, err.Error())
+		}
+	}()
+
+	r, err := p.openTransport()
+	if err != nil {
+		return fmt.Errorf("transport: %w", err)
+	}
+	go p.writeLoop()
+
+	if err := p.handshake(r); err != nil {
+		return fmt.Errorf("handshake: %w", err)
+	}
+	p.node.peerReady(p)
+
+	for {
+		p.conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		command, payload, err := p.read(r)
+		if err != nil {
+			return err
+		}
+		if err := p.node.handleMessage(p, command, payload); err != nil {
+			return fmt.Errorf("%s: %w", command, err)
+		}
+	}
+}
+
+// handshake exchanges version and verack. The side that dialed speaks
+// first.
+func (p *Peer) handshake(r *bufio.Reader) error {
+	p.conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+
+	if !p.inbound {
+		p.Send(cmdVersion, p.node.versionMsg())
+	}
+
+	gotVersion, gotVerack := false, false
+	for !gotVersion || !gotVerack {
+		command, payload, err := p.read(r)
+		if err != nil {
+			return err
+		}
+
+		switch command {
+		case cmdVersion:
+			if gotVersion {
+				return errors.New("duplicate version")
+			}
+			var msg VersionMsg
+			if err := decodePayload(payload, &msg); err != nil {
+				return err
+			}
+			if err := p.node.checkVersion(p, &msg); err != nil {
+				return err
+			}
+			p.mu.Lock()
+			p.version = &msg
+			p.listenAddr = advertisedAddr(p, &msg)
+			p.mu.Unlock()
+			gotVersion = true
+
+			if p.inbound {
+				p.Send(cmdVersion, p.node.versionMsg())
+			}
+			p.Send(cmdVerack, nil)
+		case cmdVerack:
+			if !gotVersion {
+				return errors.New("verack before version")
+			}
+			gotVerack = true
+		default:
+			return fmt.Errorf("%s before the handshake", command)
+		}
+	}
+
+	return nil
+}
+
+func (p *Peer) read(r *bufio.Reader) (string, []byte, error) {
+	command, payload, err := readMessage(r)
+	if err != nil {
+		return "", nil, err
+	}
+
+	p.mu.Lock()
+	p.lastRecv = time.Now()
+	p.bytesRecv += len(payload)
+	p.mu.Unlock()
+
+	return command, payload, nil
+}
+
+func (p *Peer) writeLoop() {
+	ping := time.NewTicker(pingInterval)
+	defer ping.Stop()
+
+	for {
+		var msg outMessage
+		select {
+		case msg = <-p.send:
+		case <-ping.C:
+			nonce := rand.Uint64()
+			p.mu.Lock()
+			p.pingNonce, p.pingSent = nonce, time.Now()
+			p.mu.Unlock()
+			msg = outMessage{cmdPing, &PingMsg{Nonce: nonce}}
+		case <-p.quit:
+			return
+		}
+
+		p.conn.SetWriteDeadline(time.Now().Add(handshakeTimeout))
+		n, err := writeMessage(p.stream, msg.command, msg.payload)
+		if err != nil {
+			p.logger.Debug("Write failed", slog.String("error", err.Error()))
+			p.Disconnect()
+			return
+		}
+
+		p.mu.Lock()
+		p.lastSend = time.Now()
+		p.bytesSent += n
+		p.mu.Unlock()
+	}
+}
+
+// pong records the round trip of the ping nonce answers.
+func (p *Peer) pong(nonce uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if nonce == p.pingNonce && !p.pingSent.IsZero() {
+		p.pingTime = time.Since(p.pingSent)
+		p.pingSent = time.Time{}
+	}
+}
+
+// established reports whether the handshake is done.
+func (p *Peer) established() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.version != nil
+}
+
+// wantsCompact reports whether the peer asked for compact blocks.
+func (p *Peer) wantsCompact() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.compact
+}
+
+// askAddrs sends the peer a getaddr.
+func (p *Peer) askAddrs() {
+	p.mu.Lock()
+	p.askedAddrs = true
+	p.mu.Unlock()
+
+	p.Send(cmdGetAddr, nil)
+}
+
+// answersGetAddr reports whether msg is the answer to our getaddr: the
+// first addr message after it that is not the peer announcing itself.
+func (p *Peer) answersGetAddr(msg *AddrMsg) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.askedAddrs {
+		return false
+	}
+	if len(msg.Addrs) == 1 && msg.Addrs[0].Addr == p.listenAddr {
+		return false
+	}
+	p.askedAddrs = false
+
+	return true
+}
+
+// listenAddress returns where the peer accepts connections, "" if unknown.
+func (p *Peer) listenAddress() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.listenAddr
+}
+
+// remoteIP is the address the connection comes from, without the port.
+func (p *Peer) remoteIP() string {
+	host, _, err := net.SplitHostPort(p.conn.RemoteAddr().String())
+	if err != nil {
+		return ""
+	}
+
+	return host
+}
+
+// advertisedAddr turns the listen address a peer announced into one that
+// reaches it: the port it listens on at the address it connected from.
+func advertisedAddr(p *Peer, msg *VersionMsg) string {
+	if msg.ListenAddr == "" {
+		return ""
+	}
+	if !p.inbound {
+		return p.addr
+	}
+
+	_, port, err := net.SplitHostPort(msg.ListenAddr)
+	host := p.remoteIP()
+	if err != nil || host == "" {
+		return ""
+	}
+
+	return net.JoinHostPort(host, port)
+}
@@ -0,0 +1,531 @@
+package network
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/numbermax/blockchain/internal/services/blockchain"
+)
+
+const (
+	// blockWindow is how far past the first missing block downloads may
+	// run ahead.
+	blockWindow = 256
+	// maxBlocksInFlight bounds the blocks asked of one peer at a time.
+	maxBlocksInFlight = 16
+	// blockStallTimeout is how long the first missing block may be
+	// outstanding before its peer is taken to stall the download.
+	blockStallTimeout = 10 * time.Second
+	// blockTimeout drops a peer that leaves any block request unanswered
+	// this long.
+	blockTimeout   = 30 * time.Second
+	headersTimeout = 30 * time.Second
+	syncInterval   = time.Second
+	progressEvery  = 10 * time.Second
+)
+
+// SyncInfo reports the progress of the block download.
+type SyncInfo struct {
+	// Syncing is set while the header chain is ahead of the blocks.
+	Syncing      bool `json:"syncing"`
+	HeaderHeight int  `json:"header_height"`
+	BlockHeight  int  `json:"block_height"`
+	InFlight     int  `json:"in_flight"`
+	// Downloaded blocks wait for their parents to be connected.
+	Downloaded int `json:"downloaded"`
+	// Orphans are blocks that arrived unasked with an unknown parent.
+	Orphans    int            `json:"orphans"`
+	HeaderPeer string         `json:"header_peer,omitempty"`
+	Peers      []SyncPeerInfo `json:"peers"`
+}
+
+// SyncPeerInfo is the download state of one peer.
+type SyncPeerInfo struct {
+	Addr       string `json:"addr"`
+	BestHeight int    `json:"best_height"`
+	InFlight   int    `json:"in_flight"`
+}
+
+type syncPeer struct {
+	best     int
+	inFlight int
+	// notFound holds the blocks the peer said it does not have.
+	notFound map[string]bool
+}
+
+type blockRequest struct {
+	peer   *Peer
+	height int
+	sentAt time.Time
+}
+
+type downloadedBlock struct {
+	block *blockchain.Block
+	from  *Peer
+}
+
+// syncManager downloads the chain headers first: it follows the best header
+// chain its peers know, then fetches the blocks of that chain from several
+// peers at once within a window past the first missing block, and connects
+// them in order as they arrive.
+type syncManager struct {
+	node   *Node
+	logger slog.Logger
+
+	mu           sync.Mutex
+	headers      *blockchain.HeaderChain
+	peers        map[*Peer]*syncPeer
+	headerPeer   *Peer
+	headerSentAt time.Time
+	// headerTried holds the peers that timed out on a header request.
+	headerTried map[*Peer]bool
+	requests    map[string]*blockRequest
+	downloaded  map[string]*downloadedBlock
+	// cursor is the lowest header chain height whose block is not stored.
+	cursor       int
+	lastProgress time.Time
+
+	wake chan struct{}
+	info atomic.Pointer[SyncInfo]
+}
+
+func newSyncManager(node *Node) *syncManager {
+	s := &syncManager{
+		node:        node,
+		logger:      *node.logger.With(slog.String("component", "sync")),
+		peers:       make(map[*Peer]*syncPeer),
+		headerTried: make(map[*Peer]bool),
+		requests:    make(map[string]*blockRequest),
+		downloaded:  make(map[string]*downloadedBlock),
+		wake:        make(chan struct{}, 1),
+	}
+	s.resetHeaders()
+	s.publish()
+
+	return s
+}
+
+// resetHeaders starts the header chain over, to be downloaded from the
+// genesis again. The caller holds mu or has not shared s yet.
+func (s *syncManager) resetHeaders() {
+	headers, err := blockchain.OpenHeaderChainWithStore(s.logger, blockchain.NewMemoryStore())
+	blockchain.ErrHandle(err)
+
+	s.headers = headers
+	s.headerPeer = nil
+	s.cursor = 0
+}
+
+// Info returns the progress as of the last change.
+func (s *syncManager) Info() *SyncInfo {
+	return s.info.Load()
+}
+
+// run connects downloaded blocks and watches for stalls until the node
+// stops.
+func (s *syncManager) run() {
+	defer s.node.wg.Done()
+
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.wake:
+			s.connectBlocks()
+		case <-ticker.C:
+			s.tick()
+		case <-s.node.quit:
+			return
+		}
+	}
+}
+
+func (s *syncManager) addPeer(p *Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.peers[p] = &syncPeer{
+		best:     p.Info().StartHeight,
+		notFound: make(map[string]bool),
+	}
+	s.startHeaderSync()
+	s.schedule()
+}
+
+// removePeer forgets p; the blocks it was asked for go to other peers.
+func (s *syncManager) removePeer(p *Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.peers[p]; !ok {
+		return
+	}
+	delete(s.peers, p)
+	delete(s.headerTried, p)
+	for key, req := range s.requests {
+		if req.peer == p {
+			delete(s.requests, key)
+		}
+	}
+	if s.headerPeer == p {
+		s.headerPeer = nil
+		s.startHeaderSync()
+	}
+	s.schedule()
+}
+
+// startHeaderSync asks a peer that knows more than the header chain for
+// headers, unless one is asked already. The caller holds mu.
+func (s *syncManager) startHeaderSync() {
+	if s.headerPeer != nil {
+		return
+	}
+
+	best := s.headers.GetBestHeight()
+	var pick *Peer
+	for p, sp := range s.peers {
+		if sp.best > best && !s.headerTried[p] && (pick == nil || sp.best > s.peers[pick].best) {
+			pick = p
+		}
+	}
+	if pick == nil {
+		return
+	}
+
+	s.headerPeer = pick
+	s.requestHeaders(pick)
+}
+
+// requestHeaders asks p for the headers past the header chain tip. The
+// caller holds mu.
+func (s *syncManager) requestHeaders(p *Peer) {
+	s.headerSentAt = time.Now()
+	p.Send(cmdGetHeaders, &GetHeadersMsg{Locator: s.headers.Locator()})
+}
+
+// handleHeaders adds the headers p sent, in answer to getheaders or to
+// announce new blocks.
+func (s *syncManager) handleHeaders(p *Peer, list []*blockchain.BlockHeader) {
+	if len(list) > blockchain.MaxHeadersPerRequest {
+		s.node.misbehaving(p, penaltyOversized, fmt.Sprintf("%d headers in one message", len(list)))
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sp, ok := s.peers[p]
+	if !ok {
+		return
+	}
+
+	before := s.headers.GetBestHeight()
+	_, err := s.headers.AddHeaders(list)
+	switch {
+	case errors.Is(err, blockchain.ErrOrphanBlock):
+		// an announcement past what we know, catch up from the announcer
+		if s.headerPeer == nil {
+			s.headerPeer = p
+			s.requestHeaders(p)
+		}
+		return
+	case err != nil:
+		if penalty := rejectPenalty(err); penalty > 0 {
+			s.node.misbehaving(p, penalty, err.Error())
+			return
+		}
+		s.logger.Error("Adding headers failed", slog.String("error", err.Error()))
+		return
+	}
+
+	if len(list) > 0 {
+		if height, err := s.headers.GetBlockHeight(list[len(list)-1].Hash); err == nil && height > sp.best {
+			sp.best = height
+		}
+	}
+	if best := s.headers.GetBestHeight(); best != before {
+		s.rewindCursor()
+		if p == s.headerPeer {
+			s.logger.Info("Downloaded headers",
+				slog.Int("height", best),
+				slog.String("peer", p.addr))
+		}
+	}
+
+	if p == s.headerPeer {
+		if len(list) == blockchain.MaxHeadersPerRequest {
+			s.requestHeaders(p)
+		} else {
+			// the peer sent all it has, it knows no more than we do now
+			sp.best = min(sp.best, s.headers.GetBestHeight())
+			s.headerPeer = nil
+			s.headerTried = make(map[*Peer]bool)
+			s.startHeaderSync()
+		}
+	}
+	s.schedule()
+}
+
+// handleBlock takes a block p was asked for and reports false for any
+// other block.
+func (s *syncManager) handleBlock(p *Peer, block *blockchain.Block) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := hex.EncodeToString(block.Hash)
+	req, ok := s.requests[key]
+	if !ok || req.peer != p {
+		return false
+	}
+	delete(s.requests, key)
+	if sp, ok := s.peers[p]; ok {
+		sp.inFlight--
+	}
+	s.downloaded[key] = &downloadedBlock{block: block, from: p}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	s.schedule()
+
+	return true
+}
+
+// handleNotFound moves the blocks p does not have to other peers.
+func (s *syncManager) handleNotFound(p *Peer, hashes [][]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sp, ok := s.peers[p]
+	if !ok {
+		return
+	}
+	for _, hash := range hashes {
+		key := hex.EncodeToString(hash)
+		if req, ok := s.requests[key]; ok && req.peer == p {
+			delete(s.requests, key)
+			sp.inFlight--
+		}
+		sp.notFound[key] = true
+	}
+	s.schedule()
+}
+
+// blockConnected keeps the header chain in step with a block that arrived
+// outside the download, such as a relayed new block.
+func (s *syncManager) blockConnected(block *blockchain.Block) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.headers.AddHeaders([]*blockchain.BlockHeader{block.Header()}); err == nil {
+		s.schedule()
+	}
+}
+
+// schedule moves the cursor past stored blocks and asks peers for the
+// missing blocks in the window, each from the least busy peer that has it.
+// The caller holds mu.
+func (s *syncManager) schedule() {
+	defer s.publish()
+
+	best := s.headers.GetBestHeight()
+	for ; s.cursor <= best; s.cursor++ {
+		hash, err := s.headers.GetBlockHash(s.cursor)
+		if err != nil || !s.node.hasBlock(hash) {
+			break
+		}
+	}
+
+	batches := make(map[*Peer][][]byte)
+	for height := s.cursor; height <= best && height < s.cursor+blockWindow; height++ {
+		hash, err := s.headers.GetBlockHash(height)
+		if err != nil {
+			break
+		}
+		key := hex.EncodeToString(hash)
+		if s.requests[key] != nil || s.downloaded[key] != nil {
+			continue
+		}
+		if height > s.cursor && s.node.hasBlock(hash) {
+			continue
+		}
+
+		var pick *Peer
+		for p, sp := range s.peers {
+			if sp.best < height || sp.inFlight >= maxBlocksInFlight || sp.notFound[key] {
+				continue
+			}
+			if pick == nil || sp.inFlight < s.peers[pick].inFlight {
+				pick = p
+			}
+		}
+		if pick == nil {
+			continue
+		}
+
+		s.peers[pick].inFlight++
+		s.requests[key] = &blockRequest{peer: pick, height: height, sentAt: time.Now()}
+		batches[pick] = append(batches[pick], hash)
+	}
+
+	for p, hashes := range batches {
+		p.Send(cmdGetData, &GetDataMsg{Hashes: hashes})
+	}
+}
+
+// rewindCursor moves the cursor back to where a new best header branch
+// leaves the blocks already stored. The caller holds mu.
+func (s *syncManager) rewindCursor() {
+	for ; s.cursor > 0; s.cursor-- {
+		hash, err := s.headers.GetBlockHash(s.cursor - 1)
+		if err == nil && s.node.hasBlock(hash) {
+			return
+		}
+	}
+}
+
+// tick drops peers that stall the download, moves on from a header peer
+// that does not answer and logs the progress.
+func (s *syncManager) tick() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var stalling []*Peer
+	for _, req := range s.requests {
+		age := now.Sub(req.sentAt)
+		if age > blockTimeout || (req.height == s.cursor && age > blockStallTimeout && len(s.peers) > 1) {
+			stalling = append(stalling, req.peer)
+		}
+	}
+	for _, p := range stalling {
+		p.logger.Warn("Peer stalls the block download, disconnecting")
+		p.Disconnect()
+	}
+
+	if s.headerPeer != nil && now.Sub(s.headerSentAt) > headersTimeout {
+		s.headerPeer.logger.Warn("Peer does not answer for headers, trying another")
+		s.headerTried[s.headerPeer] = true
+		s.headerPeer = nil
+	}
+	s.startHeaderSync()
+	s.schedule()
+
+	info := s.info.Load()
+	if info.Syncing && now.Sub(s.lastProgress) >= progressEvery {
+		s.lastProgress = now
+		s.logger.Info("Block download progress",
+			slog.Int("height", info.BlockHeight),
+			slog.Int("header_height", info.HeaderHeight),
+			slog.Int("in_flight", info.InFlight),
+			slog.Int("downloaded", info.Downloaded),
+			slog.Int("peers", len(info.Peers)))
+	}
+}
+
+// connectBlocks hands the downloaded blocks whose parent is stored to the
+// chain, over and over until none is left that can go.
+func (s *syncManager) connectBlocks() {
+	s.mu.Lock()
+	blocks := s.downloaded
+	s.downloaded = make(map[string]*downloadedBlock)
+	wasSyncing := s.info.Load().Syncing
+	s.mu.Unlock()
+
+	type rejection struct {
+		peer *Peer
+		err  error
+	}
+	var rejected []rejection
+	var connected [][]byte
+
+	s.node.chainMu.Lock()
+	for progress := true; progress; {
+		progress = false
+		for key, dl := range blocks {
+			if len(dl.block.PrevHash) > 0 {
+				if ok, err := s.node.chain.Store.HasBlock(dl.block.PrevHash); err != nil || !ok {
+					continue
+				}
+			}
+			delete(blocks, key)
+			progress = true
+
+			err := s.node.chain.ProcessBlock(dl.block)
+			switch {
+			case err == nil:
+				connected = append(connected, dl.block.Hash)
+			case errors.Is(err, blockchain.ErrBlockKnown):
+			case rejectPenalty(err) > 0:
+				rejected = append(rejected, rejection{dl.from, err})
+			default:
+				s.logger.Error("Connecting block failed",
+					slog.String("hash", fmt.Sprintf("%x", dl.block.Hash)),
+					slog.String("error", err.Error()))
+			}
+		}
+	}
+	height := s.node.chain.GetBestHeight()
+	s.node.chainMu.Unlock()
+
+	for _, r := range rejected {
+		s.node.misbehaving(r.peer, rejectPenalty(r.err), r.err.Error())
+	}
+
+	s.mu.Lock()
+	for key, dl := range blocks {
+		s.downloaded[key] = dl
+	}
+	if len(rejected) > 0 {
+		// the best headers lead to an invalid block, find the chain again
+		s.logger.Warn("Best header chain has an invalid block, downloading headers again")
+		s.resetHeaders()
+		s.startHeaderSync()
+	}
+	s.schedule()
+	caughtUp := !s.info.Load().Syncing
+	s.mu.Unlock()
+
+	for _, hash := range connected {
+		s.node.connectOrphans(hash)
+	}
+	if len(connected) > 0 {
+		s.node.notifyTemplate()
+	}
+	if len(connected) > 0 && caughtUp {
+		if wasSyncing {
+			s.logger.Info("Block download finished", slog.Int("height", height))
+		}
+		s.node.announceTip()
+	}
+}
+
+// publish stores the progress for Info. The caller holds mu.
+func (s *syncManager) publish() {
+	info := &SyncInfo{
+		HeaderHeight: s.headers.GetBestHeight(),
+		BlockHeight:  s.node.bestHeight(),
+		InFlight:     len(s.requests),
+		Downloaded:   len(s.downloaded),
+		Orphans:      s.node.orphans.len(),
+		Peers:        make([]SyncPeerInfo, 0, len(s.peers)),
+	}
+	info.Syncing = info.HeaderHeight > info.BlockHeight
+	if s.headerPeer != nil {
+		info.HeaderPeer = s.headerPeer.addr
+	}
+	for p, sp := range s.peers {
+		info.Peers = append(info.Peers, SyncPeerInfo{Addr: p.addr, BestHeight: sp.best, InFlight: sp.inFlight})
+	}
+	sort.Slice(info.Peers, func(i, j int) bool { return info.Peers[i].Addr < info.Peers[j].Addr })
+
+	s.info.Store(info)
+}
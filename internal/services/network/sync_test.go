@@ -0,0 +1,157 @@
+package network
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/numbermax/blockchain/internal/services/blockchain"
+)
+
+// syncingPeer is a peer of n that announced a chain of height blocks.
+func syncingPeer(t *testing.T, n *Node, height int) *Peer {
+	t.Helper()
+
+	p := tcpPeer(t, n)
+	p.version.Height = height
+	n.sync.addPeer(p)
+
+	return p
+}
+
+// requested takes the hashes of the blocks p was asked for since the last
+// call, other messages to p being dropped.
+func requested(p *Peer) [][]byte {
+	var hashes [][]byte
+	for {
+		select {
+		case msg := <-p.send:
+			if getData, ok := msg.payload.(*GetDataMsg); ok {
+				hashes = append(hashes, getData.Hashes...)
+			}
+		default:
+			return hashes
+		}
+	}
+}
+
+// serve answers the block requests of p from src until p is asked for no
+// more, connecting what can be connected after every round, and returns
+// the highest block asked for.
+func serve(t *testing.T, n, src *Node, p *Peer) int {
+	t.Helper()
+
+	highest := 0
+	for hashes := requested(p); len(hashes) > 0; hashes = requested(p) {
+		for _, hash := range hashes {
+			block, err := src.chain.GetBlock(hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if height, _ := src.chain.GetBlockHeight(hash); height > highest {
+				highest = height
+			}
+			if !n.sync.handleBlock(p, block) {
+				t.Fatalf("block %x was not asked of the peer", hash)
+			}
+		}
+		n.sync.connectBlocks()
+	}
+
+	return highest
+}
+
+func isDisconnected(p *Peer) bool {
+	select {
+	case <-p.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// One peer holding back the first missing block keeps the other from
+// running further ahead than the window, until it is dropped for stalling.
+func TestSyncWindowAndStall(t *testing.T) {
+	src := newTestNode(t, t.TempDir(), freeAddr(t))
+	mineChain(t, src, 2*blockWindow+20)
+	best := src.chain.GetBestHeight()
+
+	n := newTestNode(t, t.TempDir(), freeAddr(t))
+	s := n.sync
+	slow, fast := syncingPeer(t, n, best), syncingPeer(t, n, best)
+	headers, err := src.chain.HeadersAfter(s.headers.Locator(), blockchain.MaxHeadersPerRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.handleHeaders(s.headerPeer, headers)
+	if info := s.Info(); !info.Syncing || info.HeaderHeight != best || info.BlockHeight != 0 {
+		t.Fatalf("sync info after the headers = %+v", info)
+	}
+
+	held := requested(slow)
+	if len(held) != maxBlocksInFlight {
+		t.Fatalf("slow peer asked for %d blocks, want %d", len(held), maxBlocksInFlight)
+	}
+	first := best
+	for _, hash := range held {
+		height, _ := src.chain.GetBlockHeight(hash)
+		first = min(first, height)
+	}
+
+	highest := serve(t, n, src, fast)
+	if got := n.chain.GetBestHeight(); got != first-1 {
+		t.Errorf("connected up to %d with block %d held back, want %d", got, first, first-1)
+	}
+	if want := first + blockWindow - 1; highest != want {
+		t.Errorf("fast peer asked for blocks up to %d, want the window to end at %d", highest, want)
+	}
+
+	s.mu.Lock()
+	for _, req := range s.requests {
+		req.sentAt = time.Now().Add(-blockStallTimeout - time.Second)
+	}
+	s.mu.Unlock()
+	s.tick()
+	if !isDisconnected(slow) || isDisconnected(fast) {
+		t.Fatalf("slow peer disconnected: %v, fast peer: %v, want only the slow one", isDisconnected(slow), isDisconnected(fast))
+	}
+
+	// the window moves on with the blocks of the slow peer asked elsewhere
+	s.removePeer(slow)
+	serve(t, n, src, fast)
+	if !bytes.Equal(n.chain.LastHash, src.chain.LastHash) {
+		t.Errorf("synced to %d, want %d", n.chain.GetBestHeight(), best)
+	}
+	if info := s.Info(); info.Syncing || info.InFlight != 0 || info.Downloaded != 0 {
+		t.Errorf("sync info after the download = %+v", info)
+	}
+}
+
+func TestSyncRotatesHeaderPeer(t *testing.T) {
+	n := newTestNode(t, t.TempDir(), freeAddr(t))
+	s := n.sync
+	a, b := syncingPeer(t, n, 10), syncingPeer(t, n, 10)
+
+	first, next := a, b
+	if s.headerPeer == b {
+		first, next = b, a
+	}
+	if sent(first, cmdGetHeaders) == nil {
+		t.Fatal("header peer not asked for headers")
+	}
+
+	s.mu.Lock()
+	s.headerSentAt = time.Now().Add(-headersTimeout - time.Second)
+	s.mu.Unlock()
+	s.tick()
+	if s.headerPeer != next || sent(next, cmdGetHeaders) == nil {
+		t.Fatal("headers not asked of the other peer after a timeout")
+	}
+
+	// the other has none to send, so the first is given another try
+	s.handleHeaders(next, nil)
+	if s.headerPeer != first || sent(first, cmdGetHeaders) == nil {
+		t.Error("headers not asked of the first peer again")
+	}
+}
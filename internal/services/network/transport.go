@@ -0,0 +1,212 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/numbermax/blockchain/internal/services/blockchain"
+)
+
+// nodeKeyFile holds the static key of the node in the data dir.
+const nodeKeyFile = "nodekey"
+
+// secureMagic opens an encrypted connection in place of the network magic
+// that starts every plaintext message, so the side connected to can tell
+// the two apart from the first bytes.
+func secureMagic() uint32 {
+	return ^blockchain.ActiveNetwork().Magic
+}
+
+// EncryptionPolicy says when peer connections are encrypted.
+type EncryptionPolicy string
+
+const (
+	// EncryptionOff speaks plaintext only.
+	EncryptionOff EncryptionPolicy = "off"
+	// EncryptionPrefer encrypts with peers that support it and falls back
+	// to plaintext with the others.
+	EncryptionPrefer EncryptionPolicy = "prefer"
+	// EncryptionRequire drops peers that do not encrypt.
+	EncryptionRequire EncryptionPolicy = "require"
+)
+
+// ParseEncryptionPolicy reads a policy name, "" being the default.
+func ParseEncryptionPolicy(s string) (EncryptionPolicy, error) {
+	switch policy := EncryptionPolicy(s); policy {
+	case "":
+		return EncryptionPrefer, nil
+	case EncryptionOff, EncryptionPrefer, EncryptionRequire:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown encryption policy %q, use off, prefer or require", s)
+	}
+}
+
+// errNoEncryption is a peer that closed the connection on the handshake,
+// as a node that does not know the encrypted transport does.
+var errNoEncryption = errors.New("peer does not support encryption")
+
+// LoadNodeKey reads the static key of the node from dataDir, creating it on
+// first use.
+func LoadNodeKey(dataDir string) (*ecdh.PrivateKey, error) {
+	path := filepath.Join(dataDir, nodeKeyFile)
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(dataDir, 0755); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, []byte(hex.EncodeToString(key.Bytes())+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	key, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return key, nil
+}
+
+// ParsePeerKey reads the hex public key of a peer, as given in an
+// allowlist.
+func ParsePeerKey(s string) ([]byte, error) {
+	raw, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(raw) != noiseKeySize {
+		return nil, fmt.Errorf("invalid peer key %q", s)
+	}
+
+	return raw, nil
+}
+
+// openTransport sets up what the messages of p travel over before the
+// version handshake: the connection itself, or an encrypted session on it.
+// It returns the reader of the messages; p.stream takes their writes.
+func (p *Peer) openTransport() (*bufio.Reader, error) {
+	n := p.node
+	r := bufio.NewReader(p.conn)
+	p.stream = p.conn
+
+	p.conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	p.conn.SetWriteDeadline(time.Now().Add(handshakeTimeout))
+	defer p.conn.SetWriteDeadline(time.Time{})
+
+	var session *secureConn
+	var remoteKey []byte
+	prologue := binary.BigEndian.AppendUint32(nil, blockchain.ActiveNetwork().Magic)
+	if p.inbound {
+		start, err := r.Peek(4)
+		if err != nil {
+			return nil, err
+		}
+		if binary.BigEndian.Uint32(start) != secureMagic() {
+			if n.cfg.Encryption == EncryptionRequire {
+				return nil, errors.New("peer does not encrypt")
+			}
+			return r, nil
+		}
+		if n.cfg.Encryption == EncryptionOff {
+			return nil, errors.New("encryption is off")
+		}
+		r.Discard(4)
+		if session, remoteKey, err = noiseRespond(p.conn, r, n.nodeKey, prologue); err != nil {
+			return nil, err
+		}
+	} else {
+		if !n.encryptTo(p.addr) {
+			return r, nil
+		}
+		if _, err := p.conn.Write(binary.BigEndian.AppendUint32(nil, secureMagic())); err != nil {
+			return nil, err
+		}
+		var err error
+		session, remoteKey, err = noiseInitiate(p.conn, r, n.nodeKey, prologue)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) {
+			return nil, fmt.Errorf("%w: %w", errNoEncryption, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !n.allowedKey(remoteKey) {
+		return nil, fmt.Errorf("peer key %x is not allowed", remoteKey)
+	}
+
+	p.mu.Lock()
+	p.peerKey = remoteKey
+	p.mu.Unlock()
+	p.stream = session
+
+	return bufio.NewReader(session), nil
+}
+
+// encryptTo reports whether to open an encrypted connection to addr.
+func (n *Node) encryptTo(addr string) bool {
+	switch n.cfg.Encryption {
+	case EncryptionRequire:
+		return true
+	case EncryptionPrefer:
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		return !n.plaintextAddrs[addr]
+	default:
+		return false
+	}
+}
+
+// noEncryption remembers that addr speaks plaintext only, so it is dialed
+// without encryption from now on.
+func (n *Node) noEncryption(addr string) {
+	n.mu.Lock()
+	n.plaintextAddrs[addr] = true
+	n.mu.Unlock()
+
+	n.logger.Info("Peer does not support encryption, falling back to plaintext", slog.String("peer", addr))
+}
+
+// allowedKey reports whether a peer with the static key may connect. Every
+// key is allowed without an allowlist.
+func (n *Node) allowedKey(key []byte) bool {
+	if len(n.cfg.AllowedKeys) == 0 {
+		return true
+	}
+	for _, allowed := range n.cfg.AllowedKeys {
+		if bytes.Equal(allowed, key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NodeKey returns the public key peers know this node by.
+func (n *Node) NodeKey() []byte {
+	return n.nodeKey.PublicKey().Bytes()
+}
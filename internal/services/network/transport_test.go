@@ -0,0 +1,196 @@
+package network
+
+import (
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func encryptingNode(t *testing.T, policy EncryptionPolicy, allowed ...[]byte) *Node {
+	t.Helper()
+
+	return newTestNodeWith(t, Config{
+		ListenAddr:  freeAddr(t),
+		DataDir:     t.TempDir(),
+		Encryption:  policy,
+		AllowedKeys: allowed,
+	})
+}
+
+// openTransports connects from to to over localhost and opens the
+// transport on both ends as peers do, dropping an end that fails. It
+// returns both peers and their errors.
+func openTransports(t *testing.T, from, to *Node) (out, in *Peer, outErr, inErr error) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out = newPeer(from, dialed, listener.Addr().String(), false, false)
+	in = newPeer(to, accepted, dialed.LocalAddr().String(), true, false)
+	t.Cleanup(func() {
+		out.Disconnect()
+		in.Disconnect()
+	})
+
+	done := make(chan error)
+	go func() {
+		_, err := in.openTransport()
+		if err != nil {
+			in.Disconnect()
+		}
+		done <- err
+	}()
+	if _, outErr = out.openTransport(); outErr != nil {
+		out.Disconnect()
+	} else {
+		// the version message opens a plaintext connection
+		go out.writeLoop()
+		out.Send(cmdVersion, from.versionMsg())
+	}
+	inErr = <-done
+
+	return out, in, outErr, inErr
+}
+
+func assertEncrypted(t *testing.T, p *Peer, with *Node) {
+	t.Helper()
+
+	if info := p.Info(); !info.Encrypted || info.PeerKey != hex.EncodeToString(with.NodeKey()) {
+		t.Errorf("%s peer encrypted: %v with key %q, want the key %x", direction(p), info.Encrypted, info.PeerKey, with.NodeKey())
+	}
+	if _, ok := p.stream.(*secureConn); !ok {
+		t.Errorf("%s peer writes to %T, want an encrypted session", direction(p), p.stream)
+	}
+}
+
+func assertPlaintext(t *testing.T, p *Peer) {
+	t.Helper()
+
+	if p.Info().Encrypted || p.stream != p.conn {
+		t.Errorf("%s peer encrypted, want plaintext", direction(p))
+	}
+}
+
+func direction(p *Peer) string {
+	if p.inbound {
+		return "inbound"
+	}
+	return "outbound"
+}
+
+func TestTransportEncrypts(t *testing.T) {
+	from, to := encryptingNode(t, EncryptionPrefer), encryptingNode(t, EncryptionRequire)
+
+	out, in, outErr, inErr := openTransports(t, from, to)
+	if outErr != nil || inErr != nil {
+		t.Fatalf("transport failed: %v, %v", outErr, inErr)
+	}
+	assertEncrypted(t, out, to)
+	assertEncrypted(t, in, from)
+}
+
+func TestTransportAllowlist(t *testing.T) {
+	from := encryptingNode(t, EncryptionPrefer)
+
+	tests := []struct {
+		name    string
+		allowed []byte
+		refused bool
+	}{
+		{"allowed", from.NodeKey(), false},
+		{"not allowed", newStaticKey(t).PublicKey().Bytes(), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			to := encryptingNode(t, EncryptionRequire, tt.allowed)
+
+			_, _, _, err := openTransports(t, from, to)
+			if refused := err != nil && strings.Contains(err.Error(), "is not allowed"); refused != tt.refused {
+				t.Errorf("key of the peer refused: %v (%v), want %v", refused, err, tt.refused)
+			}
+		})
+	}
+}
+
+func TestTransportPlaintext(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to EncryptionPolicy
+		// dropped is set when the inbound end drops the connection.
+		dropped bool
+	}{
+		{"prefer accepts plaintext", EncryptionOff, EncryptionPrefer, false},
+		{"require drops plaintext", EncryptionOff, EncryptionRequire, true},
+		{"off refuses encryption", EncryptionPrefer, EncryptionOff, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, in, outErr, inErr := openTransports(t, encryptingNode(t, tt.from), encryptingNode(t, tt.to))
+			if tt.dropped {
+				if inErr == nil {
+					t.Error("inbound peer kept")
+				}
+				return
+			}
+			if outErr != nil || inErr != nil {
+				t.Fatalf("transport failed: %v, %v", outErr, inErr)
+			}
+			assertPlaintext(t, out)
+			assertPlaintext(t, in)
+		})
+	}
+}
+
+// A node that prefers encryption redials a plaintext only peer without it.
+func TestTransportFallsBackToPlaintext(t *testing.T) {
+	to := encryptingNode(t, EncryptionOff)
+	from := encryptingNode(t, EncryptionPrefer)
+
+	_, _, outErr, _ := openTransports(t, from, to)
+	if !errors.Is(outErr, errNoEncryption) {
+		t.Fatalf("encrypting to a plaintext only peer: %v, want %v", outErr, errNoEncryption)
+	}
+
+	startTestNode(t, to)
+	startTestNode(t, from)
+	if err := from.AddNode(to.cfg.ListenAddr); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "a plaintext connection", func() bool {
+		for _, info := range from.PeerInfo() {
+			if info.Addr == to.cfg.ListenAddr && info.Version != 0 && !info.Encrypted {
+				return true
+			}
+		}
+		return false
+	})
+	if from.encryptTo(to.cfg.ListenAddr) {
+		t.Error("peer still dialed with encryption")
+	}
+
+	// a node that requires encryption never falls back
+	required := encryptingNode(t, EncryptionRequire)
+	if _, _, outErr, _ := openTransports(t, required, to); outErr == nil {
+		t.Error("required encryption opened a plaintext connection")
+	}
+	required.noEncryption(to.cfg.ListenAddr)
+	if !required.encryptTo(to.cfg.ListenAddr) {
+		t.Error("required encryption dials without it")
+	}
+}
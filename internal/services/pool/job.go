@@ -0,0 +1,126 @@
+package pool
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+
+	"github.com/numbermax/blockchain/internal/services/blockchain"
+)
+
+// Job is the work a mining.notify hands out: a block template whose
+// coinbase pays Value to Address, its data being CoinbasePrefix followed by
+// the hex of the extranonces. The Merkle root is that of the coinbase ID
+// and Branch.
+type Job struct {
+	ID             string
+	PrevHash       []byte
+	Version        int
+	Bits           int
+	Address        string
+	Value          int
+	CoinbasePrefix string
+	Branch         [][]byte
+	// Clean is set when the job builds on a new tip, so work on earlier
+	// jobs is stale.
+	Clean bool
+}
+
+// Coinbase returns the coinbase of the job for a pair of extranonces.
+func (j *Job) Coinbase(extraNonce1, extraNonce2 []byte) *blockchain.Transaction {
+	data := j.CoinbasePrefix + hex.EncodeToString(extraNonce1) + hex.EncodeToString(extraNonce2)
+
+	return blockchain.NewCoinbaseTx(j.Address, data, j.Value)
+}
+
+// Header returns the header of the job with coinbase and nonce, its hash
+// left out.
+func (j *Job) Header(coinbase *blockchain.Transaction, nonce int) *blockchain.BlockHeader {
+	proof := &blockchain.MerkleProof{TxID: coinbase.ID, Siblings: j.Branch}
+
+	return &blockchain.BlockHeader{
+		PrevHash: j.PrevHash,
+		TxHash:   proof.Root(),
+		Nonce:    nonce,
+		Version:  j.Version,
+	}
+}
+
+// params returns the params of the mining.notify for the job:
+// [job_id, prev_hash, version, bits, address, value, coinbase_prefix,
+// merkle_branch, clean_jobs], hashes in hex.
+func (j *Job) params() []any {
+	branch := make([]string, 0, len(j.Branch))
+	for _, hash := range j.Branch {
+		branch = append(branch, hex.EncodeToString(hash))
+	}
+
+	return []any{j.ID, hex.EncodeToString(j.PrevHash), j.Version, j.Bits,
+		j.Address, j.Value, j.CoinbasePrefix, branch, j.Clean}
+}
+
+// parseJob reads the params of a mining.notify.
+func parseJob(params json.RawMessage) (*Job, error) {
+	var prevHash string
+	var branch []string
+	j := &Job{}
+	fields := []any{&j.ID, &prevHash, &j.Version, &j.Bits, &j.Address, &j.Value, &j.CoinbasePrefix, &branch, &j.Clean}
+	if err := decodeFields(params, fields...); err != nil {
+		return nil, fmt.Errorf("mining.notify: %w", err)
+	}
+
+	var err error
+	if j.PrevHash, err = hex.DecodeString(prevHash); err != nil {
+		return nil, fmt.Errorf("mining.notify: prev hash: %w", err)
+	}
+	for _, h := range branch {
+		hash, err := hex.DecodeString(h)
+		if err != nil {
+			return nil, fmt.Errorf("mining.notify: merkle branch: %w", err)
+		}
+		j.Branch = append(j.Branch, hash)
+	}
+
+	return j, nil
+}
+
+// proofOfWork returns the consensus engine of the network, which pools
+// only work with when it is proof of work.
+func proofOfWork() (*blockchain.ProofOfWork, error) {
+	pow, ok := blockchain.Engine().(*blockchain.ProofOfWork)
+	if !ok {
+		return nil, fmt.Errorf("network %s does not run on proof of work", blockchain.ActiveNetwork().Name)
+	}
+
+	return pow, nil
+}
+
+// target returns the target of a difficulty in leading zero bits, which a
+// hash must be below.
+func target(bits int) *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(256-bits))
+}
+
+// meets reports whether hash is below the target of bits.
+func meets(hash []byte, bits int) bool {
+	return new(big.Int).SetBytes(hash).Cmp(target(bits)) < 0
+}
+
+// decodeFields decodes the JSON array params into fields, in order.
+func decodeFields(params json.RawMessage, fields ...any) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(params, &raw); err != nil {
+		return fmt.Errorf("malformed params: %w", err)
+	}
+	if len(raw) < len(fields) {
+		return fmt.Errorf("%d params, want %d", len(raw), len(fields))
+	}
+	for i, field := range fields {
+		if err := json.Unmarshal(raw[i], field); err != nil {
+			return fmt.Errorf("param %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
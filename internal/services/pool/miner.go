@@ -0,0 +1,271 @@
+package pool
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+
+	"github.com/numbermax/blockchain/internal/services/blockchain"
+)
+
+const (
+	// nonceRange is how many nonces a miner tries for an extranonce2
+	// before moving to the next.
+	nonceRange = 1 << 32
+	// solveBatch is how many nonces a miner tries between looks at the
+	// messages of the pool.
+	solveBatch = 1 << 12
+)
+
+// Miner is a Stratum client solving the jobs of a pool on the CPU, to try
+// a pool out and as a reference for workers.
+type Miner struct {
+	logger slog.Logger
+	conn   net.Conn
+	enc    *json.Encoder
+	pow    *blockchain.ProofOfWork
+	worker string
+
+	messages chan *message
+	// err is why messages was closed.
+	err    error
+	nextID int
+	// pending holds the IDs of the shares submitted and not answered yet.
+	pending map[int]bool
+
+	extraNonce1     []byte
+	extraNonce2Size int
+	shareBits       int
+	job             *Job
+	extraNonce2     uint64
+	nonce           int
+
+	// Accepted and Rejected count the answers to the shares submitted,
+	// Blocks the shares that solved a block.
+	Accepted int
+	Rejected int
+	Blocks   int
+}
+
+// DialMiner connects to the pool at addr, subscribes and authorizes worker.
+func DialMiner(logger slog.Logger, addr, worker string) (*Miner, error) {
+	pow, err := proofOfWork()
+	if err != nil {
+		return nil, err
+	}
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Miner{
+		logger:   logger,
+		conn:     nc,
+		enc:      json.NewEncoder(nc),
+		pow:      pow,
+		worker:   worker,
+		messages: make(chan *message, 16),
+		pending:  make(map[int]bool),
+	}
+	go m.readLoop()
+
+	result, err := m.call("mining.subscribe", []any{})
+	if err == nil {
+		var extraNonce1 string
+		var subscriptions any
+		err = decodeFields(result, &subscriptions, &extraNonce1, &m.extraNonce2Size)
+		if err == nil {
+			m.extraNonce1, err = hex.DecodeString(extraNonce1)
+		}
+	}
+	if err == nil {
+		_, err = m.call("mining.authorize", []any{worker, ""})
+	}
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (m *Miner) Close() error {
+	return m.conn.Close()
+}
+
+// Mine solves jobs until the pool answered shares shares.
+func (m *Miner) Mine(shares int) error {
+	for m.Accepted+m.Rejected < shares {
+		// wait for the pool when there is no work or enough is submitted
+		wait := m.job == nil || m.shareBits == 0 || m.Accepted+m.Rejected+len(m.pending) >= shares
+		msg, err := m.receive(wait)
+		if err != nil {
+			return err
+		}
+		if msg != nil {
+			m.handle(msg)
+			continue
+		}
+
+		if err := m.solve(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// solve tries a batch of nonces on the current job, submitting the shares
+// found.
+func (m *Miner) solve() error {
+	j := m.job
+	extraNonce2 := m.extraNonce2Bytes()
+	coinbase := j.Coinbase(m.extraNonce1, extraNonce2)
+
+	for i := 0; i < solveBatch; i++ {
+		hash := m.pow.Hash(j.Header(coinbase, m.nonce))
+		if meets(hash, m.shareBits) {
+			if meets(hash, j.Bits) {
+				m.Blocks++
+			}
+			id, err := m.send("mining.submit", []any{m.worker, j.ID, hex.EncodeToString(extraNonce2), m.nonce})
+			if err != nil {
+				return err
+			}
+			m.pending[id] = true
+		}
+
+		m.nonce++
+		if m.nonce == nonceRange {
+			m.extraNonce2++
+			m.nonce = 0
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func (m *Miner) extraNonce2Bytes() []byte {
+	extraNonce2 := make([]byte, m.extraNonce2Size)
+	v := m.extraNonce2
+	for i := len(extraNonce2) - 1; i >= 0; i-- {
+		extraNonce2[i] = byte(v)
+		v >>= 8
+	}
+
+	return extraNonce2
+}
+
+// handle acts on a notification or the answer to a share.
+func (m *Miner) handle(msg *message) {
+	switch msg.Method {
+	case "mining.set_difficulty":
+		if err := decodeFields(msg.Params, &m.shareBits); err != nil {
+			m.logger.Warn("Ignoring pool difficulty", slog.String("error", err.Error()))
+		}
+
+	case "mining.notify":
+		j, err := parseJob(msg.Params)
+		if err != nil {
+			m.logger.Warn("Ignoring pool job", slog.String("error", err.Error()))
+			return
+		}
+		m.job = j
+		m.extraNonce2 = 0
+		m.nonce = 0
+
+	case "":
+		id, err := strconv.Atoi(string(msg.ID))
+		if err != nil || !m.pending[id] {
+			return
+		}
+		delete(m.pending, id)
+		if string(msg.Result) == "true" {
+			m.Accepted++
+			return
+		}
+		m.Rejected++
+		m.logger.Debug("Share rejected", slog.String("error", string(msg.Error)))
+	}
+}
+
+// call sends a request and waits for its answer, handling what the pool
+// sends meanwhile.
+func (m *Miner) call(method string, params []any) (json.RawMessage, error) {
+	id, err := m.send(method, params)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		msg, err := m.receive(true)
+		if err != nil {
+			return nil, err
+		}
+		if msg.Method != "" || string(msg.ID) != strconv.Itoa(id) {
+			m.handle(msg)
+			continue
+		}
+		if len(msg.Error) > 0 && string(msg.Error) != "null" {
+			return nil, fmt.Errorf("%s: %s", method, msg.Error)
+		}
+		return msg.Result, nil
+	}
+}
+
+func (m *Miner) send(method string, params []any) (int, error) {
+	m.nextID++
+	if err := m.enc.Encode(&request{ID: m.nextID, Method: method, Params: params}); err != nil {
+		return 0, err
+	}
+
+	return m.nextID, nil
+}
+
+// receive returns the next message of the pool, waiting for one when wait
+// is set and returning nil otherwise.
+func (m *Miner) receive(wait bool) (*message, error) {
+	if !wait {
+		select {
+		case msg, ok := <-m.messages:
+			if !ok {
+				return nil, m.err
+			}
+			return msg, nil
+		default:
+			return nil, nil
+		}
+	}
+
+	msg, ok := <-m.messages
+	if !ok {
+		return nil, m.err
+	}
+
+	return msg, nil
+}
+
+func (m *Miner) readLoop() {
+	defer close(m.messages)
+
+	scanner := bufio.NewScanner(m.conn)
+	scanner.Buffer(make([]byte, 4096), maxLineSize)
+	for scanner.Scan() {
+		var msg message
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			m.err = fmt.Errorf("malformed message from pool: %w", err)
+			return
+		}
+		m.messages <- &msg
+	}
+	m.err = scanner.Err()
+	if m.err == nil {
+		m.err = errors.New("pool closed the connection")
+	}
+}
@@ -0,0 +1,643 @@
+// Package pool runs a mining pool on top of a node. Its Stratum-style
+// server speaks JSON lines over TCP: workers subscribe to get an
+// extranonce1 of their own and the extranonce2 size, which together set
+// the coinbase data and so the range of blocks each works on, authorize
+// under a name starting with the address to pay, and are handed jobs built
+// from the block templates of the node. Shares are taken at a lower
+// difficulty than the chain's and counted per worker, so the reward of the
+// blocks found can be paid out in proportion; those that solve a block go
+// through the normal block acceptance of the node.
+//
+// Difficulties are in leading zero bits of the hash. The server sends
+// mining.set_difficulty [share_bits] and mining.notify with the params of
+// a Job; a worker sends mining.submit [worker, job_id, extranonce2, nonce],
+// extranonce2 in hex.
+package pool
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/numbermax/blockchain/internal/services/blockchain"
+	"github.com/numbermax/blockchain/internal/services/mining"
+	"github.com/numbermax/blockchain/internal/services/network"
+	"github.com/numbermax/blockchain/internal/services/wallet"
+)
+
+const (
+	// DefaultListenAddr is where the pool accepts workers unless told
+	// otherwise.
+	DefaultListenAddr = "127.0.0.1:3333"
+	// shareEasing is how many bits easier than blocks shares are unless
+	// told otherwise, making them a sixteenth of the work.
+	shareEasing = 4
+
+	// ExtraNonce2Size is the size of the extranonce2 workers pick, after
+	// the 4 byte extranonce1 the pool gives them.
+	ExtraNonce2Size = 4
+
+	// maxJobs bounds the jobs on the current tip kept for late shares.
+	maxJobs = 8
+	// jobWait bounds a wait for a new template, so the pool notices it is
+	// stopping.
+	jobWait     = time.Second
+	idleTimeout = 10 * time.Minute
+	maxLineSize = 1 << 16
+)
+
+// Stratum error codes.
+const (
+	errOther         = 20
+	errStaleJob      = 21
+	errDuplicate     = 22
+	errLowDifficulty = 23
+	errUnauthorized  = 24
+	errNotSubscribed = 25
+)
+
+// Config sets up a Server.
+type Config struct {
+	ListenAddr string
+	// Address is paid the coinbase of the blocks the pool finds.
+	Address string
+	// ShareBits is the difficulty of shares, a sixteenth of that of blocks
+	// when zero.
+	ShareBits int
+}
+
+// Round is a block the pool found and the shares that led to it, counted
+// per worker since the block before.
+type Round struct {
+	Hash   []byte         `json:"hash"`
+	Height int            `json:"height"`
+	Reward int            `json:"reward"`
+	Shares map[string]int `json:"shares"`
+	// Payouts share out the reward by payout address in proportion to the
+	// shares, what rounding leaves staying with the pool.
+	Payouts map[string]int `json:"payouts"`
+}
+
+// Info is the result of getpoolinfo.
+type Info struct {
+	Address   string `json:"address"`
+	ShareBits int    `json:"share_bits"`
+	Workers   int    `json:"workers"`
+	// Shares are those of the round in progress, per worker.
+	Shares map[string]int `json:"shares"`
+	Blocks []*Round       `json:"blocks"`
+}
+
+// job is a Job with what the pool needs to build its block.
+type job struct {
+	Job
+	height int
+	txs    []*blockchain.Transaction
+	// submitted holds the shares taken, by extranonces and nonce.
+	submitted map[string]bool
+}
+
+// stratumError is a refused request, sent as [code, message, null].
+type stratumError struct {
+	code int
+	msg  string
+}
+
+func (e *stratumError) Error() string {
+	return e.msg
+}
+
+// message is a line of the protocol: a request or a notification, which
+// have a method, or a response.
+type message struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  json.RawMessage `json:"error,omitempty"`
+}
+
+type response struct {
+	ID     json.RawMessage `json:"id"`
+	Result any             `json:"result"`
+	Error  any             `json:"error"`
+}
+
+type request struct {
+	ID     any    `json:"id"`
+	Method string `json:"method"`
+	Params []any  `json:"params"`
+}
+
+// Server hands out jobs to workers and takes their shares.
+type Server struct {
+	logger   slog.Logger
+	cfg      Config
+	node     *network.Node
+	pow      *blockchain.ProofOfWork
+	listener net.Listener
+	quit     chan struct{}
+	wg       sync.WaitGroup
+	// submitMu hands the node one block at a time.
+	submitMu sync.Mutex
+
+	mu             sync.Mutex
+	conns          map[*conn]bool
+	nextExtraNonce uint32
+	nextJob        int
+	current        *job
+	jobs           map[string]*job
+	jobOrder       []string
+	// shares counts the shares of the round in progress per worker.
+	shares  map[string]int
+	blocks  []*Round
+	stopped bool
+}
+
+// conn is a connected worker.
+type conn struct {
+	server      *Server
+	conn        net.Conn
+	logger      slog.Logger
+	extraNonce1 []byte
+
+	// mu guards writes to conn and what follows.
+	mu         sync.Mutex
+	enc        *json.Encoder
+	subscribed bool
+	workers    map[string]bool
+}
+
+func NewServer(logger slog.Logger, node *network.Node, cfg Config) (*Server, error) {
+	if cfg.ListenAddr == "" {
+		cfg.ListenAddr = DefaultListenAddr
+	}
+	pow, err := proofOfWork()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ShareBits == 0 {
+		cfg.ShareBits = max(pow.Bits-shareEasing, 1)
+	}
+	if !wallet.ValidateAddress(cfg.Address) {
+		return nil, fmt.Errorf("invalid pool address %q", cfg.Address)
+	}
+	if cfg.ShareBits < 1 || cfg.ShareBits > pow.Bits {
+		return nil, fmt.Errorf("share difficulty must be between 1 and %d bits", pow.Bits)
+	}
+
+	return &Server{
+		logger: logger,
+		cfg:    cfg,
+		node:   node,
+		pow:    pow,
+		quit:   make(chan struct{}),
+		conns:  make(map[*conn]bool),
+		jobs:   make(map[string]*job),
+		shares: make(map[string]int),
+	}, nil
+}
+
+// Start listens for workers and starts handing out jobs.
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.cfg.ListenAddr)
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+	s.logger.Info("Listening for pool workers",
+		slog.String("addr", s.cfg.ListenAddr),
+		slog.String("address", s.cfg.Address),
+		slog.Int("share_bits", s.cfg.ShareBits))
+
+	s.wg.Add(2)
+	go s.acceptLoop()
+	go s.jobLoop()
+
+	return nil
+}
+
+// Stop disconnects every worker.
+func (s *Server) Stop() {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return
+	}
+	s.stopped = true
+	for c := range s.conns {
+		c.conn.Close()
+	}
+	s.mu.Unlock()
+
+	close(s.quit)
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.wg.Wait()
+}
+
+// Info reports the shares of the round in progress and the blocks found.
+func (s *Server) Info() *Info {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info := &Info{
+		Address:   s.cfg.Address,
+		ShareBits: s.cfg.ShareBits,
+		Workers:   len(s.conns),
+		Shares:    make(map[string]int, len(s.shares)),
+		Blocks:    append([]*Round{}, s.blocks...),
+	}
+	for worker, shares := range s.shares {
+		info.Shares[worker] = shares
+	}
+
+	return info
+}
+
+func (s *Server) acceptLoop() {
+	defer s.wg.Done()
+
+	for {
+		nc, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-s.quit:
+				return
+			default:
+			}
+			s.logger.Warn("Accept failed", slog.String("error", err.Error()))
+			time.Sleep(time.Second)
+			continue
+		}
+
+		s.mu.Lock()
+		if s.stopped {
+			s.mu.Unlock()
+			nc.Close()
+			return
+		}
+		s.nextExtraNonce++
+		c := &conn{
+			server:      s,
+			conn:        nc,
+			logger:      *s.logger.With(slog.String("worker_addr", nc.RemoteAddr().String())),
+			extraNonce1: binary.BigEndian.AppendUint32(nil, s.nextExtraNonce),
+			enc:         json.NewEncoder(nc),
+			workers:     make(map[string]bool),
+		}
+		s.conns[c] = true
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go c.serve()
+	}
+}
+
+// jobLoop makes a new job whenever the template of the node changes.
+func (s *Server) jobLoop() {
+	defer s.wg.Done()
+
+	id := ""
+	for {
+		select {
+		case <-s.quit:
+			return
+		default:
+		}
+
+		s.node.WaitTemplate(id, jobWait)
+		lock := s.node.ChainLock()
+		lock.Lock()
+		next := s.node.TemplateID()
+		var template *mining.BlockTemplate
+		if next != id {
+			template = s.node.BlockTemplate()
+		}
+		lock.Unlock()
+		if template == nil {
+			continue
+		}
+		id = next
+		s.newJob(template)
+	}
+}
+
+// newJob makes the job of template current and sends it to the workers.
+func (s *Server) newJob(template *mining.BlockTemplate) {
+	s.mu.Lock()
+	s.nextJob++
+	j := &job{
+		Job: Job{
+			ID:             strconv.FormatInt(int64(s.nextJob), 16),
+			PrevHash:       template.PrevHash,
+			Version:        blockchain.BlockVersion,
+			Bits:           s.pow.Bits,
+			Address:        s.cfg.Address,
+			Value:          blockchain.Subsidy + template.Fees,
+			CoinbasePrefix: fmt.Sprintf("Pool height %d ", template.Height),
+		},
+		height:    template.Height,
+		submitted: make(map[string]bool),
+	}
+	// the coinbase goes first, its branch does not depend on it
+	ids := [][]byte{nil}
+	for _, tx := range template.Transactions {
+		j.txs = append(j.txs, tx.Tx)
+		ids = append(ids, tx.Tx.ID)
+	}
+	j.Branch = blockchain.MerkleBranch(ids, 0)
+
+	j.Clean = s.current == nil || !bytes.Equal(s.current.PrevHash, j.PrevHash)
+	if j.Clean {
+		s.jobs = make(map[string]*job)
+		s.jobOrder = nil
+	}
+	s.jobs[j.ID] = j
+	s.jobOrder = append(s.jobOrder, j.ID)
+	if len(s.jobOrder) > maxJobs {
+		delete(s.jobs, s.jobOrder[0])
+		s.jobOrder = s.jobOrder[1:]
+	}
+	s.current = j
+
+	var conns []*conn
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+
+	s.logger.Debug("New pool job",
+		slog.String("job", j.ID),
+		slog.Int("height", j.height),
+		slog.Int("transactions", len(j.txs)))
+	for _, c := range conns {
+		c.notify(&j.Job)
+	}
+}
+
+// submitShare checks a share of c and counts it for worker, handing the
+// block to the node when it solves one.
+func (s *Server) submitShare(c *conn, worker, jobID string, extraNonce2 []byte, nonce int) error {
+	s.mu.Lock()
+	j, ok := s.jobs[jobID]
+	if !ok {
+		s.mu.Unlock()
+		return &stratumError{errStaleJob, "job not found"}
+	}
+	key := hex.EncodeToString(c.extraNonce1) + hex.EncodeToString(extraNonce2) + ":" + strconv.Itoa(nonce)
+	if j.submitted[key] {
+		s.mu.Unlock()
+		return &stratumError{errDuplicate, "duplicate share"}
+	}
+	coinbase := j.Coinbase(c.extraNonce1, extraNonce2)
+	hash := s.pow.Hash(j.Header(coinbase, nonce))
+	if !meets(hash, s.cfg.ShareBits) {
+		s.mu.Unlock()
+		return &stratumError{errLowDifficulty, "low difficulty share"}
+	}
+	j.submitted[key] = true
+	s.shares[worker]++
+	s.mu.Unlock()
+
+	if meets(hash, j.Bits) {
+		block := &blockchain.Block{
+			Hash:         hash,
+			Transactions: append([]*blockchain.Transaction{coinbase}, j.txs...),
+			PrevHash:     j.PrevHash,
+			Nonce:        nonce,
+			Version:      j.Version,
+		}
+		s.submitBlock(block, j, worker)
+	}
+
+	return nil
+}
+
+// submitBlock hands a block worker solved to the node and closes the round
+// once it is accepted. The jobs on its parent are stale from then on, so a
+// later block of theirs is not handed over as well.
+func (s *Server) submitBlock(block *blockchain.Block, j *job, worker string) {
+	s.submitMu.Lock()
+	defer s.submitMu.Unlock()
+
+	s.mu.Lock()
+	_, current := s.jobs[j.ID]
+	s.mu.Unlock()
+	if !current {
+		s.logger.Debug("Pool block is stale",
+			slog.String("hash", fmt.Sprintf("%x", block.Hash)),
+			slog.String("worker", worker))
+		return
+	}
+
+	if err := s.node.SubmitBlock(block); err != nil {
+		s.logger.Error("Pool block rejected",
+			slog.String("hash", fmt.Sprintf("%x", block.Hash)),
+			slog.String("worker", worker),
+			slog.String("error", err.Error()))
+		return
+	}
+
+	s.mu.Lock()
+	s.jobs = make(map[string]*job)
+	s.jobOrder = nil
+	round := &Round{
+		Hash:    block.Hash,
+		Height:  j.height,
+		Reward:  j.Value,
+		Shares:  s.shares,
+		Payouts: payouts(j.Value, s.shares),
+	}
+	s.blocks = append(s.blocks, round)
+	s.shares = make(map[string]int)
+	s.mu.Unlock()
+
+	s.logger.Info("Pool found block",
+		slog.String("hash", fmt.Sprintf("%x", block.Hash)),
+		slog.Int("height", j.height),
+		slog.String("worker", worker),
+		slog.Int("workers", len(round.Shares)))
+}
+
+// payouts shares reward out by the payout addresses of the workers in
+// proportion to their shares.
+func payouts(reward int, shares map[string]int) map[string]int {
+	total := 0
+	for _, n := range shares {
+		total += n
+	}
+
+	payouts := make(map[string]int)
+	for worker, n := range shares {
+		payouts[payoutAddress(worker)] += reward * n / total
+	}
+
+	return payouts
+}
+
+// payoutAddress returns the address a worker is paid to, its name up to
+// the first dot.
+func payoutAddress(worker string) string {
+	address, _, _ := strings.Cut(worker, ".")
+
+	return address
+}
+
+// serve answers the requests of c until it disconnects.
+func (c *conn) serve() {
+	defer c.server.wg.Done()
+	defer func() {
+		c.conn.Close()
+		c.server.mu.Lock()
+		delete(c.server.conns, c)
+		c.server.mu.Unlock()
+	}()
+	c.logger.Debug("Pool worker connected")
+
+	scanner := bufio.NewScanner(c.conn)
+	scanner.Buffer(make([]byte, 4096), maxLineSize)
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		if !scanner.Scan() {
+			break
+		}
+
+		var msg message
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			c.logger.Debug("Dropping pool worker", slog.String("reason", err.Error()))
+			return
+		}
+		result, err := c.handle(&msg)
+		c.reply(msg.ID, result, err)
+		if msg.Method == "mining.subscribe" && err == nil {
+			c.sendWork()
+		}
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, net.ErrClosed) {
+		c.logger.Debug("Pool worker disconnected", slog.String("reason", err.Error()))
+	}
+}
+
+func (c *conn) handle(msg *message) (any, error) {
+	switch msg.Method {
+	case "mining.subscribe":
+		return c.subscribe()
+
+	case "mining.authorize":
+		var worker, password string
+		if err := decodeFields(msg.Params, &worker, &password); err != nil {
+			return nil, &stratumError{errOther, err.Error()}
+		}
+		if !wallet.ValidateAddress(payoutAddress(worker)) {
+			return nil, &stratumError{errUnauthorized, "worker name must start with a payout address"}
+		}
+		c.mu.Lock()
+		c.workers[worker] = true
+		c.mu.Unlock()
+		c.logger.Info("Pool worker authorized", slog.String("worker", worker))
+		return true, nil
+
+	case "mining.submit":
+		var worker, jobID, extraNonce2 string
+		var nonce int
+		if err := decodeFields(msg.Params, &worker, &jobID, &extraNonce2, &nonce); err != nil {
+			return nil, &stratumError{errOther, err.Error()}
+		}
+		c.mu.Lock()
+		subscribed, authorized := c.subscribed, c.workers[worker]
+		c.mu.Unlock()
+		if !subscribed {
+			return nil, &stratumError{errNotSubscribed, "not subscribed"}
+		}
+		if !authorized {
+			return nil, &stratumError{errUnauthorized, "unauthorized worker"}
+		}
+		en2, err := hex.DecodeString(extraNonce2)
+		if err != nil || len(en2) != ExtraNonce2Size {
+			return nil, &stratumError{errOther, fmt.Sprintf("extranonce2 must be %d bytes in hex", ExtraNonce2Size)}
+		}
+		if err := c.server.submitShare(c, worker, jobID, en2, nonce); err != nil {
+			return nil, err
+		}
+		return true, nil
+
+	default:
+		return nil, &stratumError{errOther, fmt.Sprintf("unknown method %q", msg.Method)}
+	}
+}
+
+// subscribe gives c its extranonce1.
+func (c *conn) subscribe() (any, error) {
+	c.mu.Lock()
+	c.subscribed = true
+	c.mu.Unlock()
+
+	subscription := hex.EncodeToString(c.extraNonce1)
+
+	return []any{
+		[][]string{{"mining.set_difficulty", subscription}, {"mining.notify", subscription}},
+		hex.EncodeToString(c.extraNonce1),
+		ExtraNonce2Size,
+	}, nil
+}
+
+// sendWork sends the share difficulty and the current job to c, which
+// just subscribed.
+func (c *conn) sendWork() {
+	c.server.mu.Lock()
+	current := c.server.current
+	c.server.mu.Unlock()
+
+	c.send(&request{Method: "mining.set_difficulty", Params: []any{c.server.cfg.ShareBits}})
+	if current != nil {
+		j := current.Job
+		j.Clean = true
+		c.notify(&j)
+	}
+}
+
+// notify sends j to c once it subscribed.
+func (c *conn) notify(j *Job) {
+	c.mu.Lock()
+	subscribed := c.subscribed
+	c.mu.Unlock()
+	if subscribed {
+		c.send(&request{Method: "mining.notify", Params: j.params()})
+	}
+}
+
+func (c *conn) reply(id json.RawMessage, result any, err error) {
+	resp := &response{ID: id, Result: result}
+	if err != nil {
+		var serr *stratumError
+		if !errors.As(err, &serr) {
+			serr = &stratumError{errOther, err.Error()}
+		}
+		resp.Result = false
+		resp.Error = []any{serr.code, serr.msg, nil}
+	}
+	c.send(resp)
+}
+
+func (c *conn) send(v any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(idleTimeout))
+	if err := c.enc.Encode(v); err != nil {
+		c.logger.Debug("Pool worker write failed", slog.String("error", err.Error()))
+		c.conn.Close()
+	}
+}
@@ -0,0 +1,211 @@
+package pool
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+
+	"github.com/numbermax/blockchain/internal/services/blockchain"
+	"github.com/numbermax/blockchain/internal/services/network"
+)
+
+// The pool runs on regtest, where a hash meets the target of blocks and
+// shares, 1 bit, half of the time.
+func TestMain(m *testing.M) {
+	if err := blockchain.SelectNetwork(blockchain.RegTestParams.Name); err != nil {
+		panic(err)
+	}
+
+	os.Exit(m.Run())
+}
+
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// Addresses the pool and its workers are paid to.
+const (
+	poolAddr    = "1Dd5gotCiPNtwJ58UWVm7ucp1yby27HX4i"
+	workerAddr  = "1CJMHZxGniKqQw43krDJSRoqhxKtp353ZP"
+	workerAddr2 = "1DHVLPwnY8k3G57c2oXZG8mg2tnvPJVw8t"
+)
+
+// newTestServer opens a pool, not started, on a node of a fresh chain
+// held in memory.
+func newTestServer(t *testing.T) (*Server, *blockchain.BlockChain, *network.Node) {
+	t.Helper()
+
+	chain := blockchain.InitBlockChainWithStore(*discardLogger(), blockchain.NewMemoryStore(), poolAddr)
+	node, err := network.NewNode(*discardLogger(), chain, network.Config{
+		ListenAddr: "127.0.0.1:0",
+		DataDir:    t.TempDir(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(*discardLogger(), node, Config{ListenAddr: "127.0.0.1:0", Address: poolAddr})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s, chain, node
+}
+
+// addJob makes the current job of s one whose blocks need bits.
+func addJob(s *Server, node *network.Node, bits int) *job {
+	lock := node.ChainLock()
+	lock.Lock()
+	s.newJob(node.BlockTemplate())
+	lock.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current.Bits = bits
+
+	return s.current
+}
+
+// findNonce returns the first nonce from start whose hash, with the
+// coinbase of extraNonce1 and extraNonce2, meets the share target or
+// does not, as asked.
+func findNonce(s *Server, j *job, extraNonce1, extraNonce2 []byte, start int, share bool) int {
+	coinbase := j.Coinbase(extraNonce1, extraNonce2)
+	for nonce := start; ; nonce++ {
+		if meets(s.pow.Hash(j.Header(coinbase, nonce)), s.cfg.ShareBits) == share {
+			return nonce
+		}
+	}
+}
+
+func assertStratumError(t *testing.T, what string, err error, code int) {
+	t.Helper()
+
+	var serr *stratumError
+	if !errors.As(err, &serr) || serr.code != code {
+		t.Errorf("%s: %v, want stratum error %d", what, err, code)
+	}
+}
+
+func TestSubmitShare(t *testing.T) {
+	s, _, node := newTestServer(t)
+	// blocks this hard are never found, the shares are only counted
+	j := addJob(s, node, 256)
+	c := &conn{extraNonce1: []byte{0, 0, 0, 1}}
+	extraNonce2 := make([]byte, ExtraNonce2Size)
+	worker := workerAddr + ".rig1"
+
+	low := findNonce(s, j, c.extraNonce1, extraNonce2, 0, false)
+	assertStratumError(t, "low difficulty share", s.submitShare(c, worker, j.ID, extraNonce2, low), errLowDifficulty)
+
+	good := findNonce(s, j, c.extraNonce1, extraNonce2, 0, true)
+	if err := s.submitShare(c, worker, j.ID, extraNonce2, good); err != nil {
+		t.Fatalf("share: %v", err)
+	}
+	assertStratumError(t, "duplicate share", s.submitShare(c, worker, j.ID, extraNonce2, good), errDuplicate)
+	assertStratumError(t, "share for an unknown job", s.submitShare(c, worker, "unknown", extraNonce2, good), errStaleJob)
+
+	next := good
+	for i := 0; i < 2; i++ {
+		next = findNonce(s, j, c.extraNonce1, extraNonce2, next+1, true)
+		if err := s.submitShare(c, workerAddr2, j.ID, extraNonce2, next); err != nil {
+			t.Fatalf("share %d of %s: %v", i, workerAddr2, err)
+		}
+	}
+
+	shares := s.Info().Shares
+	if shares[worker] != 1 || shares[workerAddr2] != 2 || len(shares) != 2 {
+		t.Errorf("shares = %v, want 1 for %s and 2 for %s", shares, worker, workerAddr2)
+	}
+	if len(s.Info().Blocks) != 0 {
+		t.Errorf("shares below the block target found %d blocks", len(s.Info().Blocks))
+	}
+}
+
+func TestPayouts(t *testing.T) {
+	tests := []struct {
+		name   string
+		reward int
+		shares map[string]int
+		want   map[string]int
+	}{
+		{
+			name:   "workers of one address",
+			reward: 100,
+			shares: map[string]int{"A.1": 1, "A.2": 3},
+			want:   map[string]int{"A": 100},
+		},
+		{
+			name:   "in proportion",
+			reward: 100,
+			shares: map[string]int{"A.1": 1, "A.2": 1, "B": 2},
+			want:   map[string]int{"A": 50, "B": 50},
+		},
+		{
+			name:   "rounding stays with the pool",
+			reward: 100,
+			shares: map[string]int{"A": 1, "B": 2},
+			want:   map[string]int{"A": 33, "B": 66},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := payouts(tt.reward, tt.shares)
+			if len(got) != len(tt.want) {
+				t.Fatalf("payouts = %v, want %v", got, tt.want)
+			}
+			for address, want := range tt.want {
+				if got[address] != want {
+					t.Errorf("payouts = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestMinerFindsBlock(t *testing.T) {
+	s, chain, node := newTestServer(t)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	worker := workerAddr + ".cpu"
+	m, err := DialMiner(*discardLogger(), s.listener.Addr().String(), worker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	// every share solves a block; those the miner sends on the job of
+	// the first before the next job reaches it are stale
+	if err := m.Mine(4); err != nil {
+		t.Fatal(err)
+	}
+	if m.Accepted == 0 || m.Blocks == 0 {
+		t.Fatalf("miner had %d shares accepted, solved %d blocks", m.Accepted, m.Blocks)
+	}
+
+	info := s.Info()
+	if len(info.Blocks) != 1 {
+		t.Fatalf("pool found %d blocks, want 1", len(info.Blocks))
+	}
+	round := info.Blocks[0]
+	if round.Height != 1 || round.Reward != blockchain.Subsidy {
+		t.Errorf("round at height %d with reward %d, want 1 and %d", round.Height, round.Reward, blockchain.Subsidy)
+	}
+	if round.Shares[worker] != 1 || round.Payouts[workerAddr] != round.Reward {
+		t.Errorf("round shares %v and payouts %v, want the reward for %s", round.Shares, round.Payouts, worker)
+	}
+
+	lock := node.ChainLock()
+	lock.Lock()
+	tip, height := chain.LastHash, chain.GetBestHeight()
+	lock.Unlock()
+	if !bytes.Equal(tip, round.Hash) || height != round.Height {
+		t.Errorf("tip %x at height %d, want the pool block %x", tip, height, round.Hash)
+	}
+}
@@ -0,0 +1,357 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/numbermax/blockchain/internal/services/blockchain"
+	"github.com/numbermax/blockchain/internal/services/mempool"
+	"github.com/numbermax/blockchain/internal/services/network"
+	"github.com/numbermax/blockchain/internal/services/pool"
+)
+
+// Client calls a Server.
+type Client struct {
+	url  string
+	http *http.Client
+}
+
+func NewClient(url string) *Client {
+	return &Client{
+		url:  url,
+		http: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Call invokes method with params and decodes its result into result, which
+// may be nil.
+func (c *Client) Call(method string, params, result any) error {
+	req := Request{Method: method}
+	if params != nil {
+		data, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		req.Params = data
+	}
+
+	body, err := json.Marshal(&req)
+	if err != nil {
+		return err
+	}
+	httpResp, err := c.http.Post(c.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", method, httpResp.Status)
+	}
+
+	var resp Response
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return fmt.Errorf("%s: malformed response: %w", method, err)
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("%s: %s", method, resp.Error)
+	}
+	if result == nil {
+		return nil
+	}
+
+	return json.Unmarshal(resp.Result, result)
+}
+
+func (c *Client) GetBestBlock() (*BestBlock, error) {
+	var best BestBlock
+	err := c.Call("getbestblock", nil, &best)
+
+	return &best, err
+}
+
+func (c *Client) GetHeaders(locator [][]byte, max int) ([]*blockchain.BlockHeader, error) {
+	var headers []*blockchain.BlockHeader
+	err := c.Call("getheaders", &HeadersParams{Locator: locator, Max: max}, &headers)
+
+	return headers, err
+}
+
+func (c *Client) GetMerkleProof(txID []byte) (*blockchain.MerkleProof, error) {
+	var proof blockchain.MerkleProof
+	if err := c.Call("getmerkleproof", &MerkleProofParams{TxID: txID}, &proof); err != nil {
+		return nil, err
+	}
+
+	return &proof, nil
+}
+
+// VerifyMerkleProof asks the server for the confirmations of a proof. A
+// light client should rather check proofs against its own headers.
+func (c *Client) VerifyMerkleProof(proof *blockchain.MerkleProof) (int, error) {
+	var res Confirmations
+	err := c.Call("verifymerkleproof", proof, &res)
+
+	return res.Confirmations, err
+}
+
+// SyncHeaders brings headers up to the chain of the server, checking every
+// header before it is stored. It returns the number of new headers.
+func SyncHeaders(c *Client, headers *blockchain.HeaderChain) (int, error) {
+	synced := 0
+	for {
+		list, err := c.GetHeaders(headers.Locator(), blockchain.MaxHeadersPerRequest)
+		if err != nil {
+			return synced, err
+		}
+		if len(list) == 0 {
+			return synced, nil
+		}
+
+		added, err := headers.AddHeaders(list)
+		synced += added
+		if err != nil {
+			return synced, err
+		}
+		if added == 0 {
+			return synced, errors.New("server sent only headers already known")
+		}
+	}
+}
+
+func (c *Client) GetBlockFilter(hash []byte) (*blockchain.BlockFilter, error) {
+	var filter blockchain.BlockFilter
+	if err := c.Call("getblockfilter", &BlockParams{Hash: hash}, &filter); err != nil {
+		return nil, err
+	}
+
+	return &filter, nil
+}
+
+// GetBlock downloads a block and checks that it is the block with hash.
+func (c *Client) GetBlock(hash []byte) (*blockchain.Block, error) {
+	var raw RawBlock
+	if err := c.Call("getblock", &BlockParams{Hash: hash}, &raw); err != nil {
+		return nil, err
+	}
+
+	block, err := blockchain.DeserializeBlock(raw.Block)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(block.Hash, hash) {
+		return nil, fmt.Errorf("asked for block %x, got %x", hash, block.Hash)
+	}
+	if err := blockchain.CheckProofOfWork(block); err != nil {
+		return nil, err
+	}
+	if err := blockchain.CheckTransactions(block); err != nil {
+		return nil, err
+	}
+
+	return block, nil
+}
+
+// FilterMatch is a block that concerns a watched wallet.
+type FilterMatch struct {
+	Height       int
+	BlockHash    []byte
+	Transactions []*blockchain.Transaction
+}
+
+// ScanFilters walks the main chain of headers from the genesis, checks the
+// filter of every block against the filter header chain and downloads only
+// the blocks whose filter matches watch. Blocks that turn out to be false
+// positives are left out of the result.
+func ScanFilters(c *Client, headers *blockchain.HeaderChain, watch *blockchain.FilterWatch) ([]*FilterMatch, error) {
+	var matches []*FilterMatch
+	for height := 0; height <= headers.GetBestHeight(); height++ {
+		hash, err := headers.GetBlockHash(height)
+		if err != nil {
+			return matches, err
+		}
+
+		filter, err := c.GetBlockFilter(hash)
+		if err != nil {
+			return matches, err
+		}
+		if !bytes.Equal(filter.BlockHash, hash) {
+			return matches, fmt.Errorf("asked for the filter of block %x, got %x", hash, filter.BlockHash)
+		}
+		if err := headers.AddFilter(filter); err != nil {
+			return matches, err
+		}
+
+		match, err := watch.Match(filter)
+		if err != nil {
+			return matches, fmt.Errorf("filter of block %x: %w", hash, err)
+		}
+		if !match {
+			continue
+		}
+
+		block, err := c.GetBlock(hash)
+		if err != nil {
+			return matches, err
+		}
+		if txs := watch.AddBlock(block); len(txs) > 0 {
+			matches = append(matches, &FilterMatch{Height: height, BlockHash: hash, Transactions: txs})
+		}
+	}
+
+	return matches, nil
+}
+
+func (c *Client) AddNode(addr string) error {
+	return c.Call("addnode", &AddNodeParams{Addr: addr}, nil)
+}
+
+func (c *Client) GetPeerInfo() ([]network.PeerInfo, error) {
+	var peers []network.PeerInfo
+	err := c.Call("getpeerinfo", nil, &peers)
+
+	return peers, err
+}
+
+func (c *Client) GetAddrManInfo() (*network.AddrManInfo, error) {
+	var info network.AddrManInfo
+	if err := c.Call("getaddrmaninfo", nil, &info); err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+func (c *Client) SetBan(subnet string, remove bool, banTime int64) error {
+	return c.Call("setban", &SetBanParams{Subnet: subnet, Remove: remove, BanTime: banTime}, nil)
+}
+
+func (c *Client) ListBanned() ([]network.BanEntry, error) {
+	var bans []network.BanEntry
+	err := c.Call("listbanned", nil, &bans)
+
+	return bans, err
+}
+
+func (c *Client) ClearBanned() error {
+	return c.Call("clearbanned", nil, nil)
+}
+
+func (c *Client) GetSyncInfo() (*network.SyncInfo, error) {
+	var info network.SyncInfo
+	if err := c.Call("getsyncinfo", nil, &info); err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+// SendRawTransaction submits tx to the mempool of the node, which relays it.
+func (c *Client) SendRawTransaction(tx *blockchain.Transaction) ([]byte, error) {
+	var res TxID
+	err := c.Call("sendrawtransaction", &RawTransaction{Tx: tx.Serialize()}, &res)
+
+	return res.TxID, err
+}
+
+// ListUnspent returns the outputs locked to address that neither the chain
+// nor the mempool of the node spends.
+func (c *Client) ListUnspent(address string) ([]blockchain.UTXO, error) {
+	var utxos []blockchain.UTXO
+	err := c.Call("listunspent", &ListUnspentParams{Address: address}, &utxos)
+
+	return utxos, err
+}
+
+func (c *Client) GetMempoolInfo() (*mempool.Info, error) {
+	var info mempool.Info
+	if err := c.Call("getmempoolinfo", nil, &info); err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+// GetMempoolEntry returns the transaction txID in the mempool of the node.
+func (c *Client) GetMempoolEntry(txID []byte) (*MempoolEntry, error) {
+	var entry MempoolEntry
+	if err := c.Call("getmempoolentry", &TxID{TxID: txID}, &entry); err != nil {
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+// EstimateFee returns the fee rate, per 1000 bytes, that the node expects
+// to confirm a transaction within blocks blocks.
+func (c *Client) EstimateFee(blocks int) (*mempool.FeeEstimate, error) {
+	var estimate mempool.FeeEstimate
+	if err := c.Call("estimatefee", &EstimateFeeParams{Blocks: blocks}, &estimate); err != nil {
+		return nil, err
+	}
+
+	return &estimate, nil
+}
+
+// TestMempoolAccept reports whether the mempool of the node would take tx,
+// without adding it.
+func (c *Client) TestMempoolAccept(tx *blockchain.Transaction) (*MempoolAcceptResult, error) {
+	var res MempoolAcceptResult
+	if err := c.Call("testmempoolaccept", &RawTransaction{Tx: tx.Serialize()}, &res); err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+// GetBlockTemplate returns the block the node would mine next. With a
+// longPollID, the call waits until the template it names is outdated or a
+// while has passed.
+func (c *Client) GetBlockTemplate(longPollID string) (*BlockTemplate, error) {
+	var params any
+	if longPollID != "" {
+		params = &BlockTemplateParams{LongPollID: longPollID}
+	}
+
+	var template BlockTemplate
+	if err := c.Call("getblocktemplate", params, &template); err != nil {
+		return nil, err
+	}
+
+	return &template, nil
+}
+
+// SubmitBlock hands a solved block to the node, which reports whether it
+// took it.
+func (c *Client) SubmitBlock(block *blockchain.Block) (*SubmitBlockResult, error) {
+	var res SubmitBlockResult
+	if err := c.Call("submitblock", &RawBlock{Block: block.Serialize()}, &res); err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+func (c *Client) GetCompactStats() (*network.CompactStats, error) {
+	var stats network.CompactStats
+	if err := c.Call("getcompactstats", nil, &stats); err != nil {
+		return nil, err
+	}
+
+	return &stats, nil
+}
+
+// GetPoolInfo returns the shares of the mining pool of the node and the
+// blocks it found.
+func (c *Client) GetPoolInfo() (*pool.Info, error) {
+	var info pool.Info
+	if err := c.Call("getpoolinfo", nil, &info); err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
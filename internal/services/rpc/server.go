@@ -0,0 +1,699 @@
+// Package rpc serves a full node's chain to light clients as JSON over HTTP.
+// Every call is a POST of a Request to the server root answered by a
+// Response.
+package rpc
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/numbermax/blockchain/internal/services/blockchain"
+	"github.com/numbermax/blockchain/internal/services/network"
+	"github.com/numbermax/blockchain/internal/services/pool"
+	"github.com/numbermax/blockchain/internal/services/wallet"
+)
+
+// DefaultAddr is where the server listens unless told otherwise.
+const DefaultAddr = "localhost:9332"
+
+// maxRequestSize bounds a request body, the largest being a header locator.
+const maxRequestSize = 1 << 20
+
+// longPollTimeout bounds how long getblocktemplate waits for the template
+// to change, within the timeout of a Client.
+const longPollTimeout = 20 * time.Second
+
+type Request struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+type Response struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// BestBlock is the result of getbestblock.
+type BestBlock struct {
+	Hash   []byte `json:"hash"`
+	Height int    `json:"height"`
+}
+
+// HeadersParams are the params of getheaders.
+type HeadersParams struct {
+	Locator [][]byte `json:"locator"`
+	Max     int      `json:"max"`
+}
+
+// MerkleProofParams are the params of getmerkleproof.
+type MerkleProofParams struct {
+	TxID []byte `json:"txid"`
+}
+
+// BlockParams are the params of getblockfilter and getblock.
+type BlockParams struct {
+	Hash []byte `json:"hash"`
+}
+
+// RawBlock is the result of getblock and the params of submitblock, the
+// block as it is stored.
+type RawBlock struct {
+	Block []byte `json:"block"`
+}
+
+// AddNodeParams are the params of addnode.
+type AddNodeParams struct {
+	Addr string `json:"addr"`
+}
+
+// SetBanParams are the params of setban. BanTime is in seconds, the default
+// ban time when zero.
+type SetBanParams struct {
+	Subnet  string `json:"subnet"`
+	Remove  bool   `json:"remove,omitempty"`
+	BanTime int64  `json:"bantime,omitempty"`
+}
+
+// RawTransaction is the params of sendrawtransaction and
+// testmempoolaccept, a transaction as it is serialized.
+type RawTransaction struct {
+	Tx []byte `json:"tx"`
+}
+
+// TxID is the result of sendrawtransaction and the params of
+// getmempoolentry.
+type TxID struct {
+	TxID []byte `json:"txid"`
+}
+
+// ListUnspentParams are the params of listunspent.
+type ListUnspentParams struct {
+	Address string `json:"address"`
+}
+
+// MempoolEntry is the result of getmempoolentry.
+type MempoolEntry struct {
+	Tx          []byte    `json:"tx"`
+	Fee         int       `json:"fee"`
+	Size        int       `json:"size"`
+	Time        time.Time `json:"time"`
+	Replaceable bool      `json:"replaceable"`
+	// DescendantCount and DescendantFees count the transaction and those
+	// spending it, all of which a replacement evicts.
+	DescendantCount int `json:"descendant_count"`
+	DescendantFees  int `json:"descendant_fees"`
+	// Spent holds the outputs the inputs spend, in their order.
+	Spent []blockchain.TxOutput `json:"spent"`
+}
+
+// MempoolAcceptResult is the result of testmempoolaccept. A transaction
+// that is not allowed has the reject code and the error refusing it.
+type MempoolAcceptResult struct {
+	TxID         string                `json:"txid"`
+	Allowed      bool                  `json:"allowed"`
+	RejectReason blockchain.RejectCode `json:"reject_reason,omitempty"`
+	Error        string                `json:"error,omitempty"`
+	Fee          int                   `json:"fee,omitempty"`
+	Size         int                   `json:"size,omitempty"`
+}
+
+// BlockTemplateParams are the optional params of getblocktemplate. With a
+// LongPollID the call waits until the template it names is outdated, by a
+// new tip or a change to the mempool, or a while has passed.
+type BlockTemplateParams struct {
+	LongPollID string `json:"longpollid,omitempty"`
+}
+
+// BlockTemplate is the result of getblocktemplate: the transactions of the
+// next block on top of PrevHash, whose coinbase may claim CoinbaseValue.
+// The block has Version and holds a coinbase followed by Transactions; its
+// hash is that of the header data, the version, PrevHash, the Merkle root
+// of the transaction IDs, the nonce and Bits, which must be below Target.
+// Bits is left out on networks that do not run on proof of work. Size and
+// Weight count the room kept for the coinbase.
+type BlockTemplate struct {
+	Version       int          `json:"version"`
+	PrevHash      []byte       `json:"prev_hash"`
+	Height        int          `json:"height"`
+	Bits          int          `json:"bits,omitempty"`
+	Target        string       `json:"target"`
+	Transactions  []TemplateTx `json:"transactions"`
+	CoinbaseValue int          `json:"coinbase_value"`
+	Size          int          `json:"size"`
+	Weight        int          `json:"weight"`
+	SizeLimit     int          `json:"size_limit"`
+	WeightLimit   int          `json:"weight_limit"`
+	LongPollID    string       `json:"longpollid"`
+}
+
+// Block returns the block of the template with coinbase, left to be solved.
+func (t *BlockTemplate) Block(coinbase *blockchain.Transaction) (*blockchain.Block, error) {
+	txs := []*blockchain.Transaction{coinbase}
+	for _, tx := range t.Transactions {
+		decoded, err := blockchain.DeserializeTransaction(tx.Data)
+		if err != nil {
+			return nil, err
+		}
+		txs = append(txs, decoded)
+	}
+
+	return &blockchain.Block{Transactions: txs, PrevHash: t.PrevHash, Version: t.Version}, nil
+}
+
+// TemplateTx is a transaction of a BlockTemplate, as it is serialized.
+// Depends holds the indexes of the transactions it spends, which come
+// before it.
+type TemplateTx struct {
+	Data    []byte `json:"data"`
+	TxID    []byte `json:"txid"`
+	Fee     int    `json:"fee"`
+	Size    int    `json:"size"`
+	Weight  int    `json:"weight"`
+	Depends []int  `json:"depends,omitempty"`
+}
+
+// SubmitBlockResult is the result of submitblock. A block that is not
+// accepted has the reject code and the error refusing it.
+type SubmitBlockResult struct {
+	Hash         []byte                `json:"hash"`
+	Accepted     bool                  `json:"accepted"`
+	RejectReason blockchain.RejectCode `json:"reject_reason,omitempty"`
+	Error        string                `json:"error,omitempty"`
+}
+
+// Reasons submitblock gives for blocks the chain takes no decision on.
+const (
+	RejectDuplicate blockchain.RejectCode = "duplicate"
+	RejectOrphan    blockchain.RejectCode = "prev-blk-not-found"
+)
+
+// EstimateFeeParams are the params of estimatefee.
+type EstimateFeeParams struct {
+	Blocks int `json:"blocks"`
+}
+
+// Confirmations is the result of verifymerkleproof.
+type Confirmations struct {
+	Confirmations int `json:"confirmations"`
+}
+
+var (
+	errNoNode = errors.New("no peer-to-peer node is running")
+	errNoPool = errors.New("no mining pool is running")
+)
+
+type handler func(params json.RawMessage) (any, error)
+
+// Server answers calls against a chain. Calls are served one at a time, the
+// chain is not safe for concurrent use, but for those that wait, which take
+// the lock themselves.
+type Server struct {
+	logger   slog.Logger
+	chain    *blockchain.BlockChain
+	mu       sync.Locker
+	node     *network.Node
+	pool     *pool.Server
+	methods  map[string]handler
+	unlocked map[string]handler
+}
+
+func NewServer(logger slog.Logger, chain *blockchain.BlockChain) *Server {
+	s := &Server{
+		logger: logger,
+		chain:  chain,
+		mu:     &sync.Mutex{},
+	}
+	s.methods = map[string]handler{
+		"getbestblock":       s.getBestBlock,
+		"getheaders":         s.getHeaders,
+		"getmerkleproof":     s.getMerkleProof,
+		"verifymerkleproof":  s.verifyMerkleProof,
+		"getblockfilter":     s.getBlockFilter,
+		"getblock":           s.getBlock,
+		"addnode":            s.addNode,
+		"getpeerinfo":        s.getPeerInfo,
+		"getaddrmaninfo":     s.getAddrManInfo,
+		"setban":             s.setBan,
+		"listbanned":         s.listBanned,
+		"clearbanned":        s.clearBanned,
+		"getsyncinfo":        s.getSyncInfo,
+		"sendrawtransaction": s.sendRawTransaction,
+		"listunspent":        s.listUnspent,
+		"getmempoolinfo":     s.getMempoolInfo,
+		"getmempoolentry":    s.getMempoolEntry,
+		"estimatefee":        s.estimateFee,
+		"testmempoolaccept":  s.testMempoolAccept,
+		"getcompactstats":    s.getCompactStats,
+		"getpoolinfo":        s.getPoolInfo,
+	}
+	s.unlocked = map[string]handler{
+		"getblocktemplate": s.getBlockTemplate,
+		"submitblock":      s.submitBlock,
+	}
+
+	return s
+}
+
+// AttachNode serves the peer-to-peer methods of node, sharing its lock on
+// the chain. It must be called before the server starts.
+func (s *Server) AttachNode(node *network.Node) {
+	s.node = node
+	s.mu = node.ChainLock()
+}
+
+// AttachPool serves the pool methods of p. It must be called before the
+// server starts.
+func (s *Server) AttachPool(p *pool.Server) {
+	s.pool = p
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req Request
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(&req); err != nil {
+		s.reply(w, nil, fmt.Errorf("malformed request: %w", err))
+		return
+	}
+
+	var result any
+	var err error
+	if method, ok := s.methods[req.Method]; ok {
+		s.mu.Lock()
+		result, err = method(req.Params)
+		s.mu.Unlock()
+	} else if method, ok := s.unlocked[req.Method]; ok {
+		result, err = method(req.Params)
+	} else {
+		s.reply(w, nil, fmt.Errorf("unknown method %q", req.Method))
+		return
+	}
+
+	if err != nil {
+		s.logger.Warn("RPC call failed",
+			slog.String("method", req.Method),
+			slog.String("error", err.Error()))
+	}
+	s.reply(w, result, err)
+}
+
+func (s *Server) reply(w http.ResponseWriter, result any, err error) {
+	var resp Response
+	if err != nil {
+		resp.Error = err.Error()
+	} else {
+		data, err := json.Marshal(result)
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		resp.Result = data
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&resp)
+}
+
+func (s *Server) getBestBlock(json.RawMessage) (any, error) {
+	return &BestBlock{Hash: s.chain.LastHash, Height: s.chain.GetBestHeight()}, nil
+}
+
+func (s *Server) getHeaders(params json.RawMessage) (any, error) {
+	var p HeadersParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Max <= 0 || p.Max > blockchain.MaxHeadersPerRequest {
+		p.Max = blockchain.MaxHeadersPerRequest
+	}
+
+	return s.chain.HeadersAfter(p.Locator, p.Max)
+}
+
+func (s *Server) getMerkleProof(params json.RawMessage) (any, error) {
+	var p MerkleProofParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	_, block, _, err := s.chain.GetTransaction(p.TxID)
+	if err != nil {
+		return nil, err
+	}
+
+	return blockchain.NewMerkleProof(block, p.TxID)
+}
+
+func (s *Server) verifyMerkleProof(params json.RawMessage) (any, error) {
+	var proof blockchain.MerkleProof
+	if err := decodeParams(params, &proof); err != nil {
+		return nil, err
+	}
+
+	confirmations, err := blockchain.CheckMerkleProof(s.chain, &proof)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Confirmations{Confirmations: confirmations}, nil
+}
+
+func (s *Server) getBlockFilter(params json.RawMessage) (any, error) {
+	var p BlockParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	return s.chain.GetBlockFilter(p.Hash)
+}
+
+func (s *Server) getBlock(params json.RawMessage) (any, error) {
+	var p BlockParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+
+	block, err := s.chain.GetBlock(p.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RawBlock{Block: block.Serialize()}, nil
+}
+
+func (s *Server) addNode(params json.RawMessage) (any, error) {
+	var p AddNodeParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if s.node == nil {
+		return nil, errNoNode
+	}
+
+	return nil, s.node.AddNode(p.Addr)
+}
+
+func (s *Server) getPeerInfo(json.RawMessage) (any, error) {
+	if s.node == nil {
+		return nil, errNoNode
+	}
+
+	return s.node.PeerInfo(), nil
+}
+
+func (s *Server) getAddrManInfo(json.RawMessage) (any, error) {
+	if s.node == nil {
+		return nil, errNoNode
+	}
+
+	return s.node.AddrManInfo(), nil
+}
+
+func (s *Server) setBan(params json.RawMessage) (any, error) {
+	var p SetBanParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if s.node == nil {
+		return nil, errNoNode
+	}
+	subnet, err := network.ParseSubnet(p.Subnet)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.Remove {
+		return nil, s.node.Unban(subnet)
+	}
+	banTime := network.DefaultBanTime
+	if p.BanTime != 0 {
+		banTime = time.Duration(p.BanTime) * time.Second
+	}
+
+	return nil, s.node.Ban(subnet, banTime, "manually banned")
+}
+
+func (s *Server) listBanned(json.RawMessage) (any, error) {
+	if s.node == nil {
+		return nil, errNoNode
+	}
+
+	return s.node.ListBanned(), nil
+}
+
+func (s *Server) clearBanned(json.RawMessage) (any, error) {
+	if s.node == nil {
+		return nil, errNoNode
+	}
+
+	return nil, s.node.ClearBanned()
+}
+
+func (s *Server) getSyncInfo(json.RawMessage) (any, error) {
+	if s.node == nil {
+		return nil, errNoNode
+	}
+
+	return s.node.SyncInfo(), nil
+}
+
+func (s *Server) sendRawTransaction(params json.RawMessage) (any, error) {
+	var p RawTransaction
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if s.node == nil {
+		return nil, errNoNode
+	}
+	tx, err := blockchain.DeserializeTransaction(p.Tx)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := s.node.SubmitTransaction(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TxID{TxID: entry.Tx.ID}, nil
+}
+
+func (s *Server) listUnspent(params json.RawMessage) (any, error) {
+	var p ListUnspentParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if s.node == nil {
+		return nil, errNoNode
+	}
+	if !wallet.ValidateAddress(p.Address) {
+		return nil, fmt.Errorf("invalid address %q", p.Address)
+	}
+	pubKeyHash := wallet.Base58Decode([]byte(p.Address))
+
+	return s.node.Mempool().Unspent(pubKeyHash[1 : len(pubKeyHash)-4])
+}
+
+func (s *Server) getMempoolInfo(json.RawMessage) (any, error) {
+	if s.node == nil {
+		return nil, errNoNode
+	}
+
+	return s.node.Mempool().Info(), nil
+}
+
+func (s *Server) getMempoolEntry(params json.RawMessage) (any, error) {
+	var p TxID
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if s.node == nil {
+		return nil, errNoNode
+	}
+
+	pool := s.node.Mempool()
+	entry := pool.Get(p.TxID)
+	if entry == nil {
+		return nil, fmt.Errorf("transaction %x is not in the mempool", p.TxID)
+	}
+	spent, err := pool.SpentOutputs(entry.Tx)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &MempoolEntry{
+		Tx:              entry.Tx.Serialize(),
+		Fee:             entry.Fee,
+		Size:            entry.Size,
+		Time:            entry.Time,
+		Replaceable:     entry.Tx.Replaceable(),
+		DescendantCount: 1,
+		DescendantFees:  entry.Fee,
+		Spent:           spent,
+	}
+	for _, d := range pool.Descendants(entry) {
+		res.DescendantCount++
+		res.DescendantFees += d.Fee
+	}
+
+	return res, nil
+}
+
+func (s *Server) estimateFee(params json.RawMessage) (any, error) {
+	var p EstimateFeeParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if s.node == nil {
+		return nil, errNoNode
+	}
+
+	return s.node.Mempool().EstimateFee(p.Blocks)
+}
+
+func (s *Server) testMempoolAccept(params json.RawMessage) (any, error) {
+	var p RawTransaction
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if s.node == nil {
+		return nil, errNoNode
+	}
+	tx, err := blockchain.DeserializeTransaction(p.Tx)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &MempoolAcceptResult{TxID: hex.EncodeToString(tx.ID)}
+	entry, err := s.node.Mempool().Test(tx)
+	if err != nil {
+		res.RejectReason = blockchain.RejectCodeOf(err)
+		res.Error = err.Error()
+		return res, nil
+	}
+	res.Allowed = true
+	res.Fee = entry.Fee
+	res.Size = entry.Size
+
+	return res, nil
+}
+
+func (s *Server) getBlockTemplate(params json.RawMessage) (any, error) {
+	var p BlockTemplateParams
+	if len(params) > 0 {
+		if err := decodeParams(params, &p); err != nil {
+			return nil, err
+		}
+	}
+	if s.node == nil {
+		return nil, errNoNode
+	}
+	if p.LongPollID != "" {
+		s.node.WaitTemplate(p.LongPollID, longPollTimeout)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	template := s.node.BlockTemplate()
+	limits := s.node.BlockLimits()
+	parent, err := s.chain.GetBlockHeader(template.PrevHash)
+	if err != nil {
+		return nil, err
+	}
+	engine := blockchain.Engine()
+	res := &BlockTemplate{
+		Version:       blockchain.BlockVersion,
+		PrevHash:      template.PrevHash,
+		Height:        template.Height,
+		Target:        fmt.Sprintf("%064x", engine.CalcNextTarget(parent)),
+		Transactions:  []TemplateTx{},
+		CoinbaseValue: blockchain.Subsidy + template.Fees,
+		Size:          template.Size,
+		Weight:        template.Weight,
+		SizeLimit:     limits.MaxBlockSize,
+		WeightLimit:   limits.MaxBlockWeight,
+		LongPollID:    s.node.TemplateID(),
+	}
+	if pow, ok := engine.(*blockchain.ProofOfWork); ok {
+		res.Bits = pow.Bits
+	}
+	for _, tx := range template.Transactions {
+		res.Transactions = append(res.Transactions, TemplateTx{
+			Data:    tx.Tx.Serialize(),
+			TxID:    tx.Tx.ID,
+			Fee:     tx.Fee,
+			Size:    tx.Size,
+			Weight:  tx.Weight,
+			Depends: tx.Depends,
+		})
+	}
+
+	return res, nil
+}
+
+func (s *Server) submitBlock(params json.RawMessage) (any, error) {
+	var p RawBlock
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if s.node == nil {
+		return nil, errNoNode
+	}
+	block, err := blockchain.DeserializeBlock(p.Block)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &SubmitBlockResult{Hash: block.Hash}
+	err = s.node.SubmitBlock(block)
+	switch {
+	case err == nil:
+		res.Accepted = true
+		return res, nil
+	case errors.Is(err, blockchain.ErrBlockKnown):
+		res.RejectReason = RejectDuplicate
+	case errors.Is(err, blockchain.ErrOrphanBlock):
+		res.RejectReason = RejectOrphan
+	default:
+		res.RejectReason = blockchain.RejectCodeOf(err)
+	}
+	res.Error = err.Error()
+
+	return res, nil
+}
+
+func (s *Server) getCompactStats(json.RawMessage) (any, error) {
+	if s.node == nil {
+		return nil, errNoNode
+	}
+
+	return s.node.CompactStats(), nil
+}
+
+func (s *Server) getPoolInfo(json.RawMessage) (any, error) {
+	if s.pool == nil {
+		return nil, errNoPool
+	}
+
+	return s.pool.Info(), nil
+}
+
+func decodeParams(params json.RawMessage, v any) error {
+	if len(params) == 0 {
+		return errors.New("missing params")
+	}
+	if err := json.Unmarshal(params, v); err != nil {
+		return fmt.Errorf("malformed params: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,196 @@
+package rpc
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/numbermax/blockchain/internal/services/blockchain"
+	"github.com/numbermax/blockchain/internal/services/network"
+	"github.com/numbermax/blockchain/internal/services/wallet"
+)
+
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// testServer is a server attached to a node, whose genesis pays w.
+type testServer struct {
+	*Client
+	chain *blockchain.BlockChain
+	node  *network.Node
+	w     *wallet.Wallet
+	addr  string
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+
+	w := wallet.MakeWallet()
+	addr := string(wallet.PublicKeyHashToAddress(wallet.PublicKeyHash(w.PublicKey)))
+	chain := blockchain.InitBlockChainWithStore(*discardLogger(), blockchain.NewMemoryStore(), addr)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen := listener.Addr().String()
+	listener.Close()
+	node, err := network.NewNode(*discardLogger(), chain, network.Config{ListenAddr: listen, DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(*discardLogger(), chain)
+	s.AttachNode(node)
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+
+	return &testServer{Client: NewClient(ts.URL), chain: chain, node: node, w: w, addr: addr}
+}
+
+// nextBlock returns a block on the tip holding only coinbase.
+func (ts *testServer) nextBlock(coinbase *blockchain.Transaction) *blockchain.Block {
+	return blockchain.CreateBlock([]*blockchain.Transaction{coinbase}, ts.chain.LastHash)
+}
+
+// spendGenesis returns a transaction of the test wallet spending the
+// genesis coinbase with a fee.
+func (ts *testServer) spendGenesis(t *testing.T) *blockchain.Transaction {
+	t.Helper()
+
+	genesis, err := ts.chain.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinbase := genesis.Transactions[0]
+	spent := coinbase.Outputs[0]
+	tx := &blockchain.Transaction{
+		Inputs:  []blockchain.TxInput{{ID: coinbase.ID, Out: 0, PublicKey: ts.w.PublicKey}},
+		Outputs: []blockchain.TxOutput{{Value: spent.Value * 9 / 10, PublicKeyHash: spent.PublicKeyHash}},
+	}
+	tx.ID = tx.Hash()
+	if err := blockchain.SignTransaction(tx, ts.w.PrivateKey, []blockchain.TxOutput{spent}); err != nil {
+		t.Fatal(err)
+	}
+
+	return tx
+}
+
+func TestSubmitBlock(t *testing.T) {
+	ts := newTestServer(t)
+
+	accepted := ts.nextBlock(blockchain.CoinbaseTx(ts.addr, "accepted"))
+	greedy := blockchain.CoinbaseTx(ts.addr, "greedy")
+	greedy.Outputs[0].Value++
+	greedy.ID = greedy.Hash()
+	badHash := ts.nextBlock(blockchain.CoinbaseTx(ts.addr, "bad hash"))
+	badHash.Nonce++
+
+	tests := []struct {
+		name   string
+		block  *blockchain.Block
+		reason blockchain.RejectCode
+	}{
+		{"accepted", accepted, ""},
+		{"duplicate", accepted, RejectDuplicate},
+		{"orphan", blockchain.CreateBlock([]*blockchain.Transaction{blockchain.CoinbaseTx(ts.addr, "orphan")}, make([]byte, 32)), RejectOrphan},
+		{"coinbase amount", blockchain.CreateBlock([]*blockchain.Transaction{greedy}, accepted.Hash), blockchain.RejectCoinbaseAmount},
+		{"bad hash", badHash, blockchain.RejectBadHash},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := ts.SubmitBlock(tt.block)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Accepted != (tt.reason == "") || res.RejectReason != tt.reason {
+				t.Errorf("submitblock = %+v, want reject reason %q", res, tt.reason)
+			}
+			if res.Accepted == (res.Error != "") {
+				t.Errorf("accepted %v with error %q", res.Accepted, res.Error)
+			}
+		})
+	}
+}
+
+func TestGetBlockTemplateLongPoll(t *testing.T) {
+	ts := newTestServer(t)
+
+	tests := []struct {
+		name   string
+		change func(t *testing.T)
+		check  func(t *testing.T, template *BlockTemplate)
+	}{
+		{
+			name: "new tip",
+			change: func(t *testing.T) {
+				res, err := ts.SubmitBlock(ts.nextBlock(blockchain.CoinbaseTx(ts.addr, "tip")))
+				if err != nil || !res.Accepted {
+					t.Fatalf("submitblock = %+v, %v", res, err)
+				}
+			},
+			check: func(t *testing.T, template *BlockTemplate) {
+				if !bytes.Equal(template.PrevHash, ts.chain.LastHash) || template.Height != 2 {
+					t.Errorf("template on %x at %d, want on the new tip %x", template.PrevHash, template.Height, ts.chain.LastHash)
+				}
+			},
+		},
+		{
+			name: "mempool change",
+			change: func(t *testing.T) {
+				if _, err := ts.SendRawTransaction(ts.spendGenesis(t)); err != nil {
+					t.Fatal(err)
+				}
+			},
+			check: func(t *testing.T, template *BlockTemplate) {
+				if len(template.Transactions) != 1 {
+					t.Errorf("template holds %d transactions, want the new one", len(template.Transactions))
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			template, err := ts.GetBlockTemplate("")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			type result struct {
+				template *BlockTemplate
+				err      error
+			}
+			done := make(chan result, 1)
+			go func() {
+				next, err := ts.GetBlockTemplate(template.LongPollID)
+				done <- result{next, err}
+			}()
+			select {
+			case <-done:
+				t.Fatal("long poll returned before the template changed")
+			case <-time.After(200 * time.Millisecond):
+			}
+
+			tt.change(t)
+			select {
+			case r := <-done:
+				if r.err != nil {
+					t.Fatal(r.err)
+				}
+				if r.template.LongPollID == template.LongPollID {
+					t.Error("long poll returned the same template")
+				}
+				tt.check(t, r.template)
+			case <-time.After(5 * time.Second):
+				t.Fatal("long poll did not return after the template changed")
+			}
+		})
+	}
+}
@@ -9,6 +9,8 @@ import (
 	"fmt"
 	"log"
 	"math/big"
+
+	"github.com/mr-tron/base58"
 )
 
 const (
@@ -23,12 +25,7 @@ type Wallet struct {
 
 func (w *Wallet) Address() []byte {
 	pubHash := PublicKeyHash(w.PublicKey)
-
-	versionedHash := append([]byte{version}, pubHash...)
-	checksum := Checksum(versionedHash)
-
-	fullHash := append(versionedHash, checksum...)
-	address := Base58Encode(fullHash)
+	address := PublicKeyHashToAddress(pubHash)
 
 	fmt.Printf("pub key: %x\n", w.PublicKey)
 	fmt.Printf("pub hash: %x\n", pubHash)
@@ -37,8 +34,23 @@ func (w *Wallet) Address() []byte {
 	return address
 }
 
+// PublicKeyHashToAddress encodes a public key hash as a Base58Check address.
+func PublicKeyHashToAddress(pubHash []byte) []byte {
+	versionedHash := append([]byte{version}, pubHash...)
+	checksum := Checksum(versionedHash)
+
+	fullHash := append(versionedHash, checksum...)
+
+	return Base58Encode(fullHash)
+}
+
+// ValidateAddress reports whether address is well formed, which it may not
+// be when it comes from a peer or a pool worker.
 func ValidateAddress(address string) bool {
-	publicKeyHash := Base58Decode([]byte(address))
+	publicKeyHash, err := base58.Decode(address)
+	if err != nil || len(publicKeyHash) < 1+checksumLength {
+		return false
+	}
 	actualChecksum := publicKeyHash[len(publicKeyHash)-checksumLength:]
 	version := publicKeyHash[0]
 	publicKeyHash = publicKeyHash[1 : len(publicKeyHash)-checksumLength]
@@ -55,7 +67,12 @@ func NewKeyPair() (ecdsa.PrivateKey, []byte) {
 		log.Panic()
 	}
 
-	pub := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
+	// verifiers split the key in halves, so X and Y take the same number
+	// of bytes whatever their leading zeros
+	size := (curve.Params().BitSize + 7) / 8
+	pub := make([]byte, 2*size)
+	private.PublicKey.X.FillBytes(pub[:size])
+	private.PublicKey.Y.FillBytes(pub[size:])
 
 	return *private, pub
 }
@@ -97,11 +114,8 @@ func bytesToPrivateKey(privateKeyBytes []byte) *ecdsa.PrivateKey {
 		D: new(big.Int).SetBytes(privateKeyBytes),
 	}
 
-	// not need to regenerate, public key is saved to file
-	// if privateKey.PublicKey.X == nil || privateKey.PublicKey.Y == nil {
-	// 	fmt.Println("Public key is nil, regenerating...")
-	// 	privateKey.PublicKey.X, privateKey.PublicKey.Y = curve.ScalarBaseMult(privateKeyBytes)
-	// }
+	// crypto/ecdsa refuses to sign with a key whose public point is unset
+	privateKey.PublicKey.X, privateKey.PublicKey.Y = curve.ScalarBaseMult(privateKeyBytes)
 
 	return privateKey
 }